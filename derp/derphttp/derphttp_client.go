@@ -37,6 +37,22 @@ import (
 // Send/Recv will completely re-establish the connection (unless Close
 // has been called).
 type Client struct {
+	// TLSConfig optionally specifies the TLS configuration to use
+	// for https servers, such as to trust other root CAs. Its
+	// ServerName is set to the server's hostname if empty.
+	TLSConfig *tls.Config
+
+	// DialContext optionally specifies the dial function for
+	// creating the TCP connection to the server or proxy.
+	// If nil, a net.Dialer is used.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Proxy optionally returns the HTTP proxy to tunnel the
+	// connection through with CONNECT, as does http.Transport's
+	// field of the same name. A nil URL or nil Proxy means to
+	// connect directly.
+	Proxy func(*http.Request) (*url.URL, error)
+
 	privateKey key.Private
 	logf       logger.Logf
 	url        *url.URL
@@ -91,6 +107,58 @@ func urlPort(u *url.URL) string {
 	return ""
 }
 
+// tlsConfig returns the TLS configuration for connecting to c.url.
+func (c *Client) tlsConfig() *tls.Config {
+	if c.TLSConfig == nil {
+		return &tls.Config{ServerName: c.url.Hostname()}
+	}
+	conf := c.TLSConfig.Clone()
+	if conf.ServerName == "" {
+		conf.ServerName = c.url.Hostname()
+	}
+	return conf
+}
+
+// proxyConnect asks the HTTP proxy at proxyURL, which conn is
+// connected to, to tunnel conn to addr.
+func proxyConnect(conn net.Conn, proxyURL *url.URL, addr string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		req.SetBasicAuth(u.Username(), pass)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		delete(req.Header, "Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// Read the response unbuffered, so no bytes of what the server
+	// sends through the tunnel are consumed here.
+	resp, err := http.ReadResponse(bufio.NewReaderSize(oneByteReader{conn}, 16), req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy CONNECT to %s: %v", addr, resp.Status)
+	}
+	return nil
+}
+
+// oneByteReader reads at most a byte at a time from r.
+type oneByteReader struct{ r io.Reader }
+
+func (o oneByteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return o.r.Read(p)
+}
+
 func (c *Client) connect(ctx context.Context, caller string) (client *derp.Client, err error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -135,9 +203,34 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		}
 	}()
 
-	var d net.Dialer
-	log.Printf("Dialing: %q", net.JoinHostPort(c.url.Hostname(), urlPort(c.url)))
-	tcpConn, err = d.DialContext(ctx, "tcp", net.JoinHostPort(c.url.Hostname(), urlPort(c.url)))
+	req, err := http.NewRequest("GET", c.url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "DERP")
+	req.Header.Set("Connection", "Upgrade")
+
+	var proxyURL *url.URL
+	if c.Proxy != nil {
+		proxyURL, err = c.Proxy(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dialAddr := net.JoinHostPort(c.url.Hostname(), urlPort(c.url))
+	if proxyURL != nil {
+		if proxyURL.Scheme != "http" {
+			return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+		}
+		dialAddr = net.JoinHostPort(proxyURL.Hostname(), urlPort(proxyURL))
+	}
+	dial := c.DialContext
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	log.Printf("Dialing: %q", dialAddr)
+	tcpConn, err = dial(ctx, "tcp", dialAddr)
 	if err != nil {
 		return nil, err
 	}
@@ -165,22 +258,21 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		}
 	}()
 
+	if proxyURL != nil {
+		if err := proxyConnect(tcpConn, proxyURL, net.JoinHostPort(c.url.Hostname(), urlPort(c.url))); err != nil {
+			return nil, err
+		}
+	}
+
 	var httpConn net.Conn // a TCP conn or a TLS conn; what we speak HTTP to
 	if c.url.Scheme == "https" {
-		httpConn = tls.Client(tcpConn, &tls.Config{ServerName: c.url.Host})
+		httpConn = tls.Client(tcpConn, c.tlsConfig())
 	} else {
 		httpConn = tcpConn
 	}
 
 	brw := bufio.NewReadWriter(bufio.NewReader(httpConn), bufio.NewWriter(httpConn))
 
-	req, err := http.NewRequest("GET", c.url.String(), nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Upgrade", "DERP")
-	req.Header.Set("Connection", "Upgrade")
-
 	if err := req.Write(brw); err != nil {
 		return nil, err
 	}
@@ -248,6 +340,13 @@ func (c *Client) Close() error {
 	return nil
 }
 
+// Reset closes the connection to the server, if any, as when it
+// seems to be dead. Unlike after Close, the next Send or Recv
+// reconnects. A Recv in progress fails.
+func (c *Client) Reset() {
+	c.closeForReconnect()
+}
+
 // closeForReconnect closes the underlying network connection and
 // zeros out the client field so future calls to Connect will
 // reconnect.
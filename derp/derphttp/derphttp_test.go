@@ -8,8 +8,11 @@ import (
 	"context"
 	crand "crypto/rand"
 	"crypto/tls"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"sync"
 	"testing"
 	"time"
@@ -147,3 +150,66 @@ func TestSendRecv(t *testing.T) {
 	recvNothing(1)
 
 }
+
+func TestConnectViaProxy(t *testing.T) {
+	var serverPrivateKey, clientPrivateKey key.Private
+	if _, err := crand.Read(serverPrivateKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crand.Read(clientPrivateKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	s := derp.NewServer(serverPrivateKey, t.Logf)
+	defer s.Close()
+	derpSrv := httptest.NewServer(Handler(s))
+	defer derpSrv.Close()
+
+	connects := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		connects <- r.Host
+		backConn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			backConn.Close()
+			return
+		}
+		go func() {
+			io.Copy(backConn, brw)
+			backConn.Close()
+		}()
+		io.Copy(conn, backConn)
+		conn.Close()
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewClient(clientPrivateKey, derpSrv.URL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Proxy = http.ProxyURL(proxyURL)
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-connects:
+		if want := derpSrv.Listener.Addr().String(); got != want {
+			t.Errorf("proxy CONNECT to %q; want %q", got, want)
+		}
+	default:
+		t.Error("connected without using the proxy")
+	}
+}
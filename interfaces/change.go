@@ -0,0 +1,173 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Network changes are noticed by events from the OS where possible:
+// a netlink socket on Linux and a route socket on Darwin (see
+// change_linux.go and change_darwin.go). Elsewhere, or if the OS
+// source can't be opened or fails, the network state is polled.
+// Either way, a change is only reported once the state, as
+// summarized by networkState, differs.
+
+var (
+	// changePollInterval is how often the network state is polled
+	// while any change callbacks are registered, when there's no OS
+	// source of change events.
+	changePollInterval = 5 * time.Second
+
+	// changeSettleTime is how long the network state must stay the
+	// same after a change before callbacks are called, so a burst of
+	// changes (such as during DHCP churn) results in one call.
+	changeSettleTime = 1 * time.Second
+
+	// networkState returns a summary of the machine's network state
+	// that differs whenever a change callback should be called.
+	networkState = currentNetworkState
+
+	// newChangeSource opens the OS's source of network change
+	// events. Each receive from events means the network may have
+	// changed; events is closed if the source fails. stop closes it.
+	newChangeSource = osChangeSource
+)
+
+var (
+	changeMu        sync.Mutex
+	changeCallbacks = map[int]func(){} // registration ID -> callback
+	changeNextID    int
+	changeStop      chan struct{} // non-nil while the poller is running
+)
+
+// RegisterChangeCallback arranges for f to be called, in its own
+// goroutine, whenever the machine's interface addresses or default
+// route change. f is called about changeSettleTime after a change
+// where the OS reports changes, or up to several seconds later where
+// they're polled for.
+//
+// The returned func unregisters f.
+func RegisterChangeCallback(f func()) (unregister func()) {
+	changeMu.Lock()
+	defer changeMu.Unlock()
+	id := changeNextID
+	changeNextID++
+	changeCallbacks[id] = f
+	if changeStop == nil {
+		changeStop = make(chan struct{})
+		go pollChanges(changeStop)
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			changeMu.Lock()
+			defer changeMu.Unlock()
+			delete(changeCallbacks, id)
+			if len(changeCallbacks) == 0 && changeStop != nil {
+				close(changeStop)
+				changeStop = nil
+			}
+		})
+	}
+}
+
+// pollChanges runs in its own goroutine until stop is closed,
+// calling the registered change callbacks whenever the network
+// state changes and then settles. It checks the state on each event
+// from the OS change source, or, without one, every
+// changePollInterval.
+func pollChanges(stop <-chan struct{}) {
+	var tick <-chan time.Time
+	pollEvery := func() {
+		ticker := time.NewTicker(changePollInterval)
+		tick = ticker.C
+		go func() {
+			<-stop
+			ticker.Stop()
+		}()
+	}
+	events, stopEvents, err := newChangeSource()
+	if err != nil {
+		pollEvery()
+	} else {
+		defer stopEvents()
+	}
+
+	last := networkState()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick:
+		case _, ok := <-events:
+			if !ok {
+				events = nil
+				pollEvery()
+				continue
+			}
+		}
+		cur := networkState()
+		if cur == last {
+			continue
+		}
+		// Wait for things to settle down.
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(changeSettleTime):
+			}
+			next := networkState()
+			if next == cur {
+				break
+			}
+			cur = next
+		}
+		if cur == last {
+			continue
+		}
+		last = cur
+
+		changeMu.Lock()
+		for _, f := range changeCallbacks {
+			go f()
+		}
+		changeMu.Unlock()
+	}
+}
+
+// currentNetworkState returns the machine's global unicast
+// addresses and default route as a string. As in
+// CandidateLocalEndpoints, interfaces that look like Tailscale or
+// other WireGuard tunnels are left out, so configuring the tunnel
+// isn't a change.
+func currentNetworkState() string {
+	ifs, err := upInterfaces()
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	var addrs []string
+	for _, nif := range ifs {
+		if maybeTailscaleInterfaceName(strings.ToLower(nif.name)) {
+			continue
+		}
+		for _, a := range nif.addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			addrs = append(addrs, ipnet.IP.String())
+		}
+	}
+	sort.Strings(addrs)
+	iface, gw, _ := DefaultRoute()
+	return fmt.Sprintf("addrs=%s route=%s/%v", strings.Join(addrs, ","), iface, gw)
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import "golang.org/x/sys/unix"
+
+// osChangeSource reports changes to interfaces, addresses and routes
+// from a route socket.
+func osChangeSource() (events <-chan struct{}, stop func(), err error) {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, nil, err
+	}
+	unix.CloseOnExec(fd)
+	return socketChangeSource(fd, "route", isRouteChange)
+}
+
+// isRouteChange reports whether msg, a route socket message, is about
+// a change to an interface, address or route, rather than, say, a
+// failed route lookup.
+func isRouteChange(msg []byte) bool {
+	// The type is the fourth byte of the header, after the
+	// message's length and version.
+	if len(msg) < 4 {
+		return false
+	}
+	switch msg[3] {
+	case unix.RTM_NEWADDR, unix.RTM_DELADDR, unix.RTM_IFINFO,
+		unix.RTM_ADD, unix.RTM_DELETE, unix.RTM_CHANGE:
+		return true
+	}
+	return false
+}
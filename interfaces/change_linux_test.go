@@ -0,0 +1,30 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOSChangeSource(t *testing.T) {
+	events, stop, err := osChangeSource()
+	if err != nil {
+		t.Fatalf("opening netlink socket: %v", err)
+	}
+	stop()
+	// Stopping closes the socket, ending the reader.
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("events not closed after stop")
+		}
+	}
+}
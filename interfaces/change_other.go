@@ -0,0 +1,18 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!darwin
+
+package interfaces
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// osChangeSource fails, as there's no OS source of network change
+// events on this platform yet, so changes are polled for.
+func osChangeSource() (events <-chan struct{}, stop func(), err error) {
+	return nil, nil, fmt.Errorf("interfaces: no network change events on %s", runtime.GOOS)
+}
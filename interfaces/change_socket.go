@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin
+
+package interfaces
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketChangeSource is a newChangeSource reading messages from the
+// socket fd, named name, which it takes ownership of. Each message
+// isChange accepts is an event.
+func socketChangeSource(fd int, name string, isChange func(msg []byte) bool) (events <-chan struct{}, stop func(), err error) {
+	// In non-blocking mode, the socket is read via the runtime's
+	// poller, so closing it unblocks the read.
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, nil, err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	ch := make(chan struct{}, 1)
+	send := func() {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// An event is already pending.
+		}
+	}
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := f.Read(buf)
+			if errors.Is(err, unix.ENOBUFS) {
+				send() // messages were lost, so assume a change
+				continue
+			}
+			if err != nil {
+				return
+			}
+			if isChange(buf[:n]) {
+				send()
+			}
+		}
+	}()
+	return ch, func() { f.Close() }, nil
+}
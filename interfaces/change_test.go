@@ -0,0 +1,154 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNetworkState substitutes a network state that tests set with
+// the returned func, until restore is called.
+func fakeNetworkState() (set func(string), restore func()) {
+	old := networkState
+	var mu sync.Mutex
+	state := "a"
+	networkState = func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return state
+	}
+	set = func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		state = s
+	}
+	return set, func() { networkState = old }
+}
+
+func TestRegisterChangeCallback(t *testing.T) {
+	defer func(poll, settle time.Duration, source func() (<-chan struct{}, func(), error)) {
+		changePollInterval, changeSettleTime, newChangeSource = poll, settle, source
+	}(changePollInterval, changeSettleTime, newChangeSource)
+	setState, restore := fakeNetworkState()
+	defer restore()
+	changePollInterval = 10 * time.Millisecond
+	changeSettleTime = 10 * time.Millisecond
+	// No OS events, so changes are polled for.
+	newChangeSource = func() (<-chan struct{}, func(), error) {
+		return nil, nil, errors.New("no events")
+	}
+
+	called := make(chan bool, 10)
+	unregister := RegisterChangeCallback(func() { called <- true })
+	defer unregister()
+
+	select {
+	case <-called:
+		t.Fatal("callback called without a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Rapid changes are coalesced into one call.
+	setState("b")
+	setState("c")
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not called after change")
+	}
+	select {
+	case <-called:
+		t.Fatal("callback called twice for one change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unregister()
+	setState("d")
+	select {
+	case <-called:
+		t.Fatal("callback called after unregister")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestChangeSourceEvents(t *testing.T) {
+	defer func(poll, settle time.Duration, source func() (<-chan struct{}, func(), error)) {
+		changePollInterval, changeSettleTime, newChangeSource = poll, settle, source
+	}(changePollInterval, changeSettleTime, newChangeSource)
+	setState, restore := fakeNetworkState()
+	defer restore()
+	changePollInterval = time.Hour // never polled
+	changeSettleTime = 10 * time.Millisecond
+	events := make(chan struct{})
+	stopped := make(chan bool, 1)
+	newChangeSource = func() (<-chan struct{}, func(), error) {
+		return events, func() { stopped <- true }, nil
+	}
+
+	called := make(chan bool, 10)
+	unregister := RegisterChangeCallback(func() { called <- true })
+
+	// An event without a change in state calls nothing.
+	events <- struct{}{}
+	select {
+	case <-called:
+		t.Fatal("callback called without a change")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A change is noticed on the next event, without polling.
+	setState("b")
+	select {
+	case <-called:
+		t.Fatal("callback called before an event")
+	case <-time.After(50 * time.Millisecond):
+	}
+	events <- struct{}{}
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not called after event")
+	}
+
+	unregister()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("change source not stopped after unregister")
+	}
+}
+
+func TestNetworkStateIgnoresTunnels(t *testing.T) {
+	defer func(f func() ([]namedAddrs, error)) { upInterfaces = f }(upInterfaces)
+	ipNet := func(s string) net.Addr {
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.IP = ip
+		return n
+	}
+	eth := namedAddrs{"eth0", []net.Addr{ipNet("192.168.1.2/24")}}
+	upInterfaces = func() ([]namedAddrs, error) { return []namedAddrs{eth}, nil }
+	before := currentNetworkState()
+
+	upInterfaces = func() ([]namedAddrs, error) {
+		return []namedAddrs{eth, {"tailscale0", []net.Addr{ipNet("100.101.102.103/32")}}}, nil
+	}
+	if got := currentNetworkState(); got != before {
+		t.Errorf("tunnel address changed network state from %q to %q", before, got)
+	}
+
+	upInterfaces = func() ([]namedAddrs, error) {
+		return []namedAddrs{{"eth0", []net.Addr{ipNet("192.168.1.3/24")}}}, nil
+	}
+	if got := currentNetworkState(); got == before {
+		t.Errorf("new address didn't change network state %q", got)
+	}
+}
@@ -7,6 +7,7 @@ package interfaces
 
 import (
 	"net"
+	"strconv"
 	"strings"
 )
 
@@ -41,10 +42,50 @@ func Tailscale() (net.IP, *net.Interface, error) {
 // It only returns an error if there's a problem querying the system
 // interfaces.
 func HaveIPv6GlobalAddress() (bool, error) {
-	ifs, err := net.Interfaces()
+	addrs, err := upInterfaceAddrs()
 	if err != nil {
 		return false, err
 	}
+	return anyGlobalIPv6(addrs), nil
+}
+
+// HaveIPv6 reports whether the machine has a global scope unicast
+// IPv6 address, and so might reach the internet over IPv6. Hosts with
+// only link-local (fe80::/10) or loopback IPv6 addresses can't.
+// Tailscale's own addresses don't count either.
+//
+// It returns false if the system interfaces can't be queried.
+func HaveIPv6() bool {
+	ok, _ := HaveIPv6GlobalAddress()
+	return ok
+}
+
+// anyGlobalIPv6 reports whether addrs contains a global unicast IPv6
+// address other than a Tailscale one.
+func anyGlobalIPv6(addrs []net.Addr) bool {
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipnet.IP
+		if ip.To4() != nil || !ip.IsGlobalUnicast() || IsTailscaleIP(ip) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// upInterfaceAddrs returns the addresses of the machine's up,
+// non-loopback interfaces. Interfaces whose addresses can't be read
+// are skipped. It's a variable so tests can substitute addresses.
+var upInterfaceAddrs = func() ([]net.Addr, error) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ret []net.Addr
 	for i := range ifs {
 		iface := &ifs[i]
 		if !isUp(iface) || isLoopback(iface) {
@@ -54,18 +95,75 @@ func HaveIPv6GlobalAddress() (bool, error) {
 		if err != nil {
 			continue
 		}
-		for _, a := range addrs {
+		ret = append(ret, addrs...)
+	}
+	return ret, nil
+}
+
+// namedAddrs are the addresses of a named interface.
+type namedAddrs struct {
+	name  string
+	addrs []net.Addr
+}
+
+// upInterfaces returns the names and addresses of the machine's up,
+// non-loopback interfaces. Interfaces whose addresses can't be read
+// are skipped. It's a variable so tests can substitute interfaces.
+var upInterfaces = func() ([]namedAddrs, error) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ret []namedAddrs
+	for i := range ifs {
+		iface := &ifs[i]
+		if !isUp(iface) || isLoopback(iface) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		ret = append(ret, namedAddrs{iface.Name, addrs})
+	}
+	return ret, nil
+}
+
+// CandidateLocalEndpoints returns "ip:port" endpoints at port for each
+// of the machine's global unicast addresses, IPv4 and IPv6, on up
+// interfaces, for peers on the same LAN to try. Loopback and
+// link-local addresses are excluded, as are addresses of interfaces
+// whose names suggest they're a Tailscale or other WireGuard tunnel,
+// as packets to those would go through the tunnel itself.
+//
+// It returns nil if the system interfaces can't be queried.
+func CandidateLocalEndpoints(port uint16) []string {
+	ifs, err := upInterfaces()
+	if err != nil {
+		return nil
+	}
+	portStr := strconv.Itoa(int(port))
+	var eps []string
+	for _, nif := range ifs {
+		if maybeTailscaleInterfaceName(strings.ToLower(nif.name)) {
+			continue
+		}
+		for _, a := range nif.addrs {
 			ipnet, ok := a.(*net.IPNet)
 			if !ok {
 				continue
 			}
-			if ipnet.IP.To4() != nil || !ipnet.IP.IsGlobalUnicast() {
-				continue
+			ip := ipnet.IP
+			if !ip.IsGlobalUnicast() {
+				continue // loopback, link-local, multicast, etc.
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
 			}
-			return true, nil
+			eps = append(eps, net.JoinHostPort(ip.String(), portStr))
 		}
 	}
-	return false, nil
+	return eps
 }
 
 // maybeTailscaleInterfaceName reports whether s is an interface
@@ -78,9 +176,36 @@ func maybeTailscaleInterfaceName(s string) bool {
 }
 
 // IsTailscaleIP reports whether ip is an IP in a range used by
-// Tailscale virtual network interfaces.
+// Tailscale virtual network interfaces: the IPv4 CGNAT range or
+// Tailscale's IPv6 ULA range.
 func IsTailscaleIP(ip net.IP) bool {
-	return cgNAT.Contains(ip)
+	return cgNAT.Contains(ip) || tsULA.Contains(ip)
+}
+
+// AddressInPrefix returns the first address of an up interface
+// that's contained in prefix, or nil if there isn't one.
+// A non-nil error is only returned on a problem listing the system interfaces.
+func AddressInPrefix(prefix *net.IPNet) (net.IP, error) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifs {
+		iface := &ifs[i]
+		if !isUp(iface) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && prefix.Contains(ipnet.IP) {
+				return ipnet.IP, nil
+			}
+		}
+	}
+	return nil, nil
 }
 
 func isUp(nif *net.Interface) bool       { return nif.Flags&net.FlagUp != 0 }
@@ -137,6 +262,42 @@ func LocalAddresses() (regular, loopback []string, err error) {
 	return regular, loopback, nil
 }
 
+// UnicastAddresses returns the machine's IPv4 and IPv6 unicast
+// addresses on up interfaces, excluding loopback and link-local
+// addresses, which aren't usable as endpoints for other machines.
+func UnicastAddresses() (v4, v6 []net.IP, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range ifaces {
+		iface := &ifaces[i]
+		if !isUp(iface) || isLoopback(iface) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip := ipnet.IP
+			if !ip.IsGlobalUnicast() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				v4 = append(v4, ip4)
+			} else {
+				v6 = append(v6, ip)
+			}
+		}
+	}
+	return v4, v6, nil
+}
+
 var cgNAT = func() *net.IPNet {
 	_, ipNet, err := net.ParseCIDR("100.64.0.0/10")
 	if err != nil {
@@ -145,6 +306,14 @@ var cgNAT = func() *net.IPNet {
 	return ipNet
 }()
 
+var tsULA = func() *net.IPNet {
+	_, ipNet, err := net.ParseCIDR("fd7a:115c:a1e0::/48")
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}()
+
 var linkLocalIPv4 = func() *net.IPNet {
 	_, ipNet, err := net.ParseCIDR("169.254.0.0/16")
 	if err != nil {
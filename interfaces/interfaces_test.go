@@ -5,6 +5,7 @@
 package interfaces
 
 import (
+	"errors"
 	"net"
 	"testing"
 )
@@ -16,6 +17,11 @@ func TestIsTailscaleIP(t *testing.T) {
 	}{
 		{"100.81.251.94", true},
 		{"8.8.8.8", false},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"fd7a:115c:a1e0:ab12:4843:cd96:6251:fb5e", true},
+		{"fd7a:115c:a1e1::1", false},
+		{"2001:4860:4860::8888", false},
 	}
 	for _, tt := range tests {
 		ip := net.ParseIP(tt.ip)
@@ -29,3 +35,103 @@ func TestIsTailscaleIP(t *testing.T) {
 	}
 
 }
+
+func TestHaveIPv6(t *testing.T) {
+	tests := []struct {
+		name  string
+		addrs []string // CIDRs
+		want  bool
+	}{
+		{"none", nil, false},
+		{"v4_only", []string{"192.168.1.2/24", "10.0.0.1/8"}, false},
+		{"link_local_only", []string{"192.168.1.2/24", "fe80::1234/64"}, false},
+		{"loopback", []string{"::1/128"}, false},
+		{"tailscale_only", []string{"100.101.102.103/32", "fd7a:115c:a1e0:ab12:4843:cd96:6251:fb5e/128"}, false},
+		{"global", []string{"fe80::1234/64", "2001:db8::1/64"}, true},
+	}
+	defer func(old func() ([]net.Addr, error)) { upInterfaceAddrs = old }(upInterfaceAddrs)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addrs []net.Addr
+			for _, s := range tt.addrs {
+				ip, ipNet, err := net.ParseCIDR(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				ipNet.IP = ip
+				addrs = append(addrs, ipNet)
+			}
+			upInterfaceAddrs = func() ([]net.Addr, error) { return addrs, nil }
+			if got := HaveIPv6(); got != tt.want {
+				t.Errorf("HaveIPv6() = %v; want %v", got, tt.want)
+			}
+		})
+	}
+
+	upInterfaceAddrs = func() ([]net.Addr, error) { return nil, errors.New("boom") }
+	if HaveIPv6() {
+		t.Error("HaveIPv6() = true when interfaces can't be read")
+	}
+}
+
+func TestCandidateLocalEndpoints(t *testing.T) {
+	iface := func(name string, cidrs ...string) namedAddrs {
+		na := namedAddrs{name: name}
+		for _, s := range cidrs {
+			ip, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ipNet.IP = ip
+			na.addrs = append(na.addrs, ipNet)
+		}
+		return na
+	}
+	tests := []struct {
+		name string
+		ifs  []namedAddrs
+		want []string
+	}{
+		{"none", nil, nil},
+		{
+			"multi_homed",
+			[]namedAddrs{
+				iface("eth0", "192.168.1.2/24", "fe80::1234/64", "2001:db8::2/64"),
+				iface("wlan0", "10.0.0.5/8", "169.254.3.4/16"),
+				iface("tailscale0", "100.101.102.103/32", "fd7a:115c:a1e0:ab12:4843:cd96:6251:fb5e/128"),
+			},
+			[]string{"192.168.1.2:41641", "[2001:db8::2]:41641", "10.0.0.5:41641"},
+		},
+		{
+			"tunnel_only",
+			[]namedAddrs{
+				iface("utun3", "100.101.102.103/32"),
+				iface("wg0", "10.9.0.1/24"),
+				iface("Tailscale", "100.101.102.104/32"),
+			},
+			nil,
+		},
+		{"loopback_addr", []namedAddrs{iface("eth0", "127.0.0.2/8", "::1/128")}, nil},
+	}
+	defer func(old func() ([]namedAddrs, error)) { upInterfaces = old }(upInterfaces)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upInterfaces = func() ([]namedAddrs, error) { return tt.ifs, nil }
+			got := CandidateLocalEndpoints(41641)
+			if len(got) != len(tt.want) {
+				t.Fatalf("CandidateLocalEndpoints = %q; want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("CandidateLocalEndpoints = %q; want %q", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+
+	upInterfaces = func() ([]namedAddrs, error) { return nil, errors.New("boom") }
+	if got := CandidateLocalEndpoints(41641); got != nil {
+		t.Errorf("CandidateLocalEndpoints = %q when interfaces can't be read; want nil", got)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// DefaultRoute returns the name of the interface carrying the
+// machine's IPv4 default route, and the route's gateway.
+func DefaultRoute() (ifaceName string, gatewayIP net.IP, err error) {
+	out, err := exec.Command("/sbin/route", "-n", "get", "default").Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("interfaces: route get default: %v", err)
+	}
+	return parseRouteGet(out)
+}
+
+// parseRouteGet returns the default route from out, the output of
+// "route -n get default".
+func parseRouteGet(out []byte) (ifaceName string, gatewayIP net.IP, err error) {
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		k, v, ok := cutField(s.Text())
+		if !ok {
+			continue
+		}
+		switch k {
+		case "gateway":
+			gatewayIP = net.ParseIP(v)
+		case "interface":
+			ifaceName = v
+		}
+	}
+	if ifaceName == "" {
+		return "", nil, errors.New("interfaces: no default route")
+	}
+	return ifaceName, gatewayIP, nil
+}
+
+// cutField splits a "key: value" line of route(8) output.
+func cutField(line string) (k, v string, ok bool) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]), true
+}
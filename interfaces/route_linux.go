@@ -0,0 +1,67 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// DefaultRoute returns the name of the interface carrying the
+// machine's IPv4 default route, and the route's gateway.
+func DefaultRoute() (ifaceName string, gatewayIP net.IP, err error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	return parseProcNetRoute(f)
+}
+
+// parseProcNetRoute returns the default route from r, which has the
+// format of Linux's /proc/net/route.
+func parseProcNetRoute(r io.Reader) (ifaceName string, gatewayIP net.IP, err error) {
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+	// eth0  00000000    0102A8C0 0003  0      0   100    00000000 ...
+	const (
+		fieldIface = 0
+		fieldDest  = 1
+		fieldGW    = 2
+		fieldMask  = 7
+	)
+	s := bufio.NewScanner(r)
+	s.Scan() // skip header
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) <= fieldMask {
+			continue
+		}
+		if f[fieldDest] != "00000000" || f[fieldMask] != "00000000" {
+			continue
+		}
+		gw, err := hex.DecodeString(f[fieldGW])
+		if err != nil || len(gw) != 4 {
+			return "", nil, fmt.Errorf("bad gateway %q in /proc/net/route", f[fieldGW])
+		}
+		// The kernel writes the address as a host-endian
+		// (in practice, little-endian) uint32.
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(gw))
+		return f[fieldIface], ip, nil
+	}
+	if err := s.Err(); err != nil {
+		return "", nil, err
+	}
+	return "", nil, errNoDefaultRoute
+}
+
+var errNoDefaultRoute = errors.New("interfaces: no default route")
@@ -0,0 +1,30 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package interfaces
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseProcNetRoute(t *testing.T) {
+	const routes = `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+wlp2s0	0000A8C0	00000000	0001	0	0	600	00FFFFFF	0	0	0
+wlp2s0	00000000	0100A8C0	0003	0	0	600	00000000	0	0	0
+`
+	iface, gw, err := parseProcNetRoute(strings.NewReader(routes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iface != "wlp2s0" || !gw.Equal(net.IPv4(192, 168, 0, 1)) {
+		t.Errorf("got %q, %v; want wlp2s0, 192.168.0.1", iface, gw)
+	}
+
+	_, _, err = parseProcNetRoute(strings.NewReader(strings.Split(routes, "\n")[0] + "\n"))
+	if err != errNoDefaultRoute {
+		t.Errorf("no routes: err = %v; want %v", err, errNoDefaultRoute)
+	}
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!darwin
+
+package interfaces
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// DefaultRoute returns the name of the interface carrying the
+// machine's IPv4 default route, and the route's gateway.
+//
+// It's not yet supported on this platform and always returns an error.
+func DefaultRoute() (ifaceName string, gatewayIP net.IP, err error) {
+	return "", nil, fmt.Errorf("interfaces: DefaultRoute not supported on %s", runtime.GOOS)
+}
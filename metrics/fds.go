@@ -0,0 +1,42 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"expvar"
+	"os"
+)
+
+// OpenFDs is an expvar.Func reporting CurrentFDs, for publishing as a
+// gauge, such as under the name "gauge_process_open_fds".
+var OpenFDs = expvar.Func(func() interface{} { return CurrentFDs() })
+
+// CurrentFDs returns the number of file descriptors the process has
+// open, or 0 if it can't tell.
+//
+// It lists /proc/self/fd (Linux) or /dev/fd (macOS and the BSDs),
+// which is cheap enough to do on every metrics scrape.
+func CurrentFDs() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if n, ok := countDir(dir); ok {
+			return n
+		}
+	}
+	return 0
+}
+
+func countDir(dir string) (n int, ok bool) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0, false
+	}
+	// Don't count the descriptor used to read the directory.
+	return len(names) - 1, true
+}
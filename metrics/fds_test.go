@@ -0,0 +1,29 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestCurrentFDs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("CurrentFDs unsupported on Windows")
+	}
+	before := CurrentFDs()
+	if before <= 0 {
+		t.Fatalf("CurrentFDs = %d; want > 0", before)
+	}
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got := CurrentFDs(); got != before+1 {
+		t.Errorf("after open, CurrentFDs = %d; want %d", got, before+1)
+	}
+}
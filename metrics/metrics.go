@@ -6,7 +6,18 @@
 // Tailscale for monitoring.
 package metrics
 
-import "expvar"
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // Map is a string-to-Var map variable that satisfies the expvar.Var
 // interface.
@@ -21,3 +32,432 @@ import "expvar"
 type Set struct {
 	expvar.Map
 }
+
+// Remove removes the variable key from s, such as when the thing it
+// describes goes away. It's safe to call concurrently with Do, but
+// not from within Do's callback.
+func (s *Set) Remove(key string) {
+	s.Map.Delete(key)
+}
+
+// AsMap returns a snapshot of the values of s's integer members,
+// its *expvar.Int, *Counter, *Gauge and *RateCounter variables,
+// keyed by name.
+// Other members are omitted.
+func (s *Set) AsMap() map[string]int64 {
+	m := make(map[string]int64)
+	s.Do(func(kv expvar.KeyValue) {
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			m[kv.Key] = v.Value()
+		case *Counter:
+			m[kv.Key] = v.Value()
+		case *Gauge:
+			m[kv.Key] = v.Value()
+		case *RateCounter:
+			m[kv.Key] = v.Value()
+		}
+	})
+	return m
+}
+
+// LabelMap is a string-to-Var map variable that satisfies the
+// expvar.Var interface.
+//
+// Semantically, this is mapped by tsweb's Prometheus exporter as a
+// collection of variables with the same name, with a varying label
+// value. Use this to export things that are intuitively breakdowns
+// into different buckets, such as requests by status code.
+type LabelMap struct {
+	Label string // Prometheus label name for the map's keys
+	expvar.Map
+}
+
+// Get returns a direct pointer to the expvar.Int for key, creating
+// it if necessary.
+func (m *LabelMap) Get(key string) *expvar.Int {
+	m.Map.Add(key, 0)
+	return m.Map.Get(key).(*expvar.Int)
+}
+
+// Gauge is an int64 value that can go up and down, such as a number
+// of active connections. It satisfies the expvar.Var interface and
+// is safe for concurrent use.
+//
+// It's exported by tsweb's Prometheus exporter as a gauge.
+type Gauge struct {
+	v int64 // atomic
+}
+
+// Set sets g's value to v.
+func (g *Gauge) Set(v int64) { atomic.StoreInt64(&g.v, v) }
+
+// Add adds delta, which may be negative, to g's value.
+func (g *Gauge) Add(delta int64) { atomic.AddInt64(&g.v, delta) }
+
+// Value returns g's value.
+func (g *Gauge) Value() int64 { return atomic.LoadInt64(&g.v) }
+
+// String returns g's value as JSON, for expvar.
+func (g *Gauge) String() string { return strconv.FormatInt(g.Value(), 10) }
+
+// Counter is an int64 value that only goes up, such as a number of
+// packets sent. It's an *expvar.Int with an Inc method, and like
+// one, satisfies the expvar.Var interface and is safe for concurrent
+// use.
+//
+// It's exported by tsweb's Prometheus exporter as a counter.
+type Counter struct {
+	expvar.Int
+}
+
+// Inc adds 1 to c's value.
+func (c *Counter) Inc() { c.Add(1) }
+
+// NewCounterIn returns a new Counter, published in set as name.
+//
+// Prometheus metric names can't contain dots, dashes or spaces, so
+// name should be made of lowercase letters, digits and underscores,
+// like "packets_sent". NewCounterIn panics if it's not, or if set
+// already has a variable named name.
+func NewCounterIn(set *Set, name string) *Counter {
+	if !validMetricName(name) {
+		panic(fmt.Sprintf("metrics: invalid counter name %q; use lowercase letters, digits and underscores", name))
+	}
+	if set.Get(name) != nil {
+		panic(fmt.Sprintf("metrics: %q already in set", name))
+	}
+	c := new(Counter)
+	set.Set(name, c)
+	return c
+}
+
+// validMetricName reports whether name is non-empty, made of
+// lowercase letters, digits and underscores, and doesn't start with
+// a digit.
+func validMetricName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Info is a gauge that's always 1, with labels that carry facts
+// such as a binary's version, as in Prometheus "info" metrics like
+// build_info{version="1.0"} 1. It satisfies the expvar.Var interface.
+type Info struct {
+	Labels []Label // in export order
+}
+
+// A Label is a Prometheus label name and value.
+type Label struct {
+	Name, Value string
+}
+
+// String returns i's labels as a JSON object, for expvar.
+func (i *Info) String() string {
+	m := make(map[string]string, len(i.Labels))
+	for _, l := range i.Labels {
+		m[l.Name] = l.Value
+	}
+	j, _ := json.Marshal(m)
+	return string(j)
+}
+
+// Histogram is a distribution of durations, such as request
+// latencies, counted in buckets. It satisfies the expvar.Var
+// interface.
+//
+// It's exported by tsweb's Prometheus exporter as a histogram with
+// durations in seconds.
+type Histogram struct {
+	bounds []time.Duration // bucket upper bounds, ascending
+
+	mu     sync.Mutex
+	counts []uint64 // observations per bucket; the extra last one is +Inf
+	sum    time.Duration
+}
+
+// DefaultLatencyBuckets are bucket upper bounds suitable for web
+// request latencies.
+var DefaultLatencyBuckets = []time.Duration{
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// NewHistogram returns a new Histogram with buckets having the given
+// upper bounds, which must be in ascending order. An additional
+// bucket with no upper bound holds larger observations.
+// If bounds is empty, DefaultLatencyBuckets is used.
+func NewHistogram(bounds []time.Duration) *Histogram {
+	if len(bounds) == 0 {
+		bounds = DefaultLatencyBuckets
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			panic("metrics: histogram bounds not in ascending order")
+		}
+	}
+	return &Histogram{
+		bounds: append([]time.Duration(nil), bounds...),
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// Observe adds d to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += d
+}
+
+// Buckets returns the histogram's bucket upper bounds and, for each,
+// the cumulative number of observations less than or equal to it.
+// It also returns the sum and total count of all observations.
+func (h *Histogram) Buckets() (bounds []time.Duration, cumCounts []uint64, sum time.Duration, count uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cumCounts = make([]uint64, len(h.bounds))
+	for i := range h.bounds {
+		count += h.counts[i]
+		cumCounts[i] = count
+	}
+	count += h.counts[len(h.bounds)]
+	return h.bounds, cumCounts, h.sum, count
+}
+
+// String returns the histogram as JSON, for expvar.
+func (h *Histogram) String() string {
+	bounds, cumCounts, sum, count := h.Buckets()
+	var sb strings.Builder
+	sb.WriteString(`{"buckets": {`)
+	for i, b := range bounds {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "%q: %d", strconv.FormatFloat(b.Seconds(), 'g', -1, 64), cumCounts[i])
+	}
+	fmt.Fprintf(&sb, `}, "sum": %s, "count": %d}`, strconv.FormatFloat(sum.Seconds(), 'g', -1, 64), count)
+	return sb.String()
+}
+
+// SummaryQuantiles are the quantiles a Summary reports.
+var SummaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+// DefaultSummaryWindow is the number of recent observations a
+// Summary computes quantiles over, if NewSummary is given zero.
+const DefaultSummaryWindow = 1024
+
+// Summary is a distribution of durations, such as request latencies,
+// summarized by the quantiles in SummaryQuantiles of its most recent
+// observations. Unlike a Histogram, it needs no predefined buckets,
+// so it's suited to tracking tail latency. It satisfies the
+// expvar.Var interface.
+//
+// Its memory use is fixed by its window size, however many
+// observations are made. The sum and count of observations cover
+// all of them, not just the window.
+//
+// It's exported by tsweb's Prometheus exporter as a summary with
+// durations in seconds.
+type Summary struct {
+	mu     sync.Mutex
+	window []time.Duration // ring buffer of recent observations
+	next   int             // index in window of the next observation
+	full   bool            // whether window has wrapped around
+	sum    time.Duration
+	count  uint64
+}
+
+// NewSummary returns a new Summary that computes quantiles over its
+// window most recent observations. If window is zero,
+// DefaultSummaryWindow is used.
+func NewSummary(window int) *Summary {
+	if window <= 0 {
+		window = DefaultSummaryWindow
+	}
+	return &Summary{window: make([]time.Duration, window)}
+}
+
+// Observe adds d to the summary.
+func (s *Summary) Observe(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.window[s.next] = d
+	s.next++
+	if s.next == len(s.window) {
+		s.next = 0
+		s.full = true
+	}
+	s.sum += d
+	s.count++
+}
+
+// Quantiles returns, for each of SummaryQuantiles, the observation
+// at that quantile of the current window. ok is false if there have
+// been no observations. It also returns the sum and total count of
+// all observations.
+func (s *Summary) Quantiles() (vals []time.Duration, ok bool, sum time.Duration, count uint64) {
+	s.mu.Lock()
+	n := s.next
+	if s.full {
+		n = len(s.window)
+	}
+	recent := append([]time.Duration(nil), s.window[:n]...)
+	sum, count = s.sum, s.count
+	s.mu.Unlock()
+
+	if len(recent) == 0 {
+		return nil, false, sum, count
+	}
+	sort.Slice(recent, func(i, j int) bool { return recent[i] < recent[j] })
+	vals = make([]time.Duration, len(SummaryQuantiles))
+	for i, q := range SummaryQuantiles {
+		// Nearest rank.
+		rank := int(math.Ceil(q * float64(len(recent))))
+		if rank < 1 {
+			rank = 1
+		}
+		vals[i] = recent[rank-1]
+	}
+	return vals, true, sum, count
+}
+
+// String returns the summary as JSON, for expvar.
+func (s *Summary) String() string {
+	vals, ok, sum, count := s.Quantiles()
+	var sb strings.Builder
+	sb.WriteString(`{"quantiles": {`)
+	if ok {
+		for i, q := range SummaryQuantiles {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			fmt.Fprintf(&sb, "%q: %s", strconv.FormatFloat(q, 'g', -1, 64), strconv.FormatFloat(vals[i].Seconds(), 'g', -1, 64))
+		}
+	}
+	fmt.Fprintf(&sb, `}, "sum": %s, "count": %d}`, strconv.FormatFloat(sum.Seconds(), 'g', -1, 64), count)
+	return sb.String()
+}
+
+// DefaultRateWindow is the window a RateCounter computes its rate
+// over, if it's not given one.
+const DefaultRateWindow = 10 * time.Second
+
+// RateCounter is a counter, like an *expvar.Int, that also reports
+// its recent rate of increase for human-readable debug pages. It
+// satisfies the expvar.Var interface and is safe for concurrent use.
+// Its zero value is a counter with a window of DefaultRateWindow.
+//
+// The rate is estimated from two buckets, the counts in the current
+// and the previous window, so it's cheap to maintain but only
+// approximate.
+//
+// It's exported by tsweb's Prometheus exporter as a counter of its
+// cumulative value; Prometheus computes its own rates.
+type RateCounter struct {
+	window time.Duration
+	now    func() time.Time // if nil, time.Now
+
+	mu      sync.Mutex
+	total   int64
+	started time.Time // when the counter was first used
+	start   time.Time // start of the current window
+	cur     int64     // count in the current window
+	prev    int64     // count in the previous window
+}
+
+// NewRateCounter returns a new RateCounter that computes its rate
+// over window. If window is zero, DefaultRateWindow is used.
+func NewRateCounter(window time.Duration) *RateCounter {
+	return &RateCounter{window: window}
+}
+
+// advanceLocked moves c's windows forward to now.
+// c.mu must be held.
+func (c *RateCounter) advanceLocked(now time.Time) {
+	if c.window <= 0 {
+		c.window = DefaultRateWindow
+	}
+	if c.started.IsZero() {
+		c.started, c.start = now, now
+		return
+	}
+	n := now.Sub(c.start) / c.window
+	if n <= 0 {
+		return
+	}
+	if n == 1 {
+		c.prev = c.cur
+	} else {
+		c.prev = 0
+	}
+	c.cur = 0
+	c.start = c.start.Add(n * c.window)
+}
+
+func (c *RateCounter) timeNow() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// Add adds delta to c's value.
+func (c *RateCounter) Add(delta int64) {
+	now := c.timeNow()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advanceLocked(now)
+	c.total += delta
+	c.cur += delta
+}
+
+// Value returns c's cumulative value.
+func (c *RateCounter) Value() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
+
+// Rate returns c's recent rate of increase, in events per second.
+// It's averaged over the current window so far and the previous
+// one, or over c's lifetime if that's shorter.
+func (c *RateCounter) Rate() float64 {
+	now := c.timeNow()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advanceLocked(now)
+	span := c.window + now.Sub(c.start)
+	if life := now.Sub(c.started); life < span {
+		span = life
+	}
+	if span <= 0 {
+		return 0
+	}
+	return float64(c.prev+c.cur) / span.Seconds()
+}
+
+// String returns c's cumulative value as JSON, for expvar.
+func (c *RateCounter) String() string { return strconv.FormatInt(c.Value(), 10) }
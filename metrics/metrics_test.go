@@ -0,0 +1,153 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"expvar"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSummaryWindow(t *testing.T) {
+	s := NewSummary(10)
+	for i := 1; i <= 1000; i++ {
+		s.Observe(time.Duration(i) * time.Millisecond)
+	}
+	vals, ok, sum, count := s.Quantiles()
+	if !ok {
+		t.Fatal("no quantiles")
+	}
+	// Only the last 10 observations, 991ms to 1000ms, are in the window.
+	want := []time.Duration{995 * time.Millisecond, 999 * time.Millisecond, 1000 * time.Millisecond}
+	for i, q := range SummaryQuantiles {
+		if vals[i] != want[i] {
+			t.Errorf("quantile %v = %v; want %v", q, vals[i], want[i])
+		}
+	}
+	if count != 1000 {
+		t.Errorf("count = %d; want 1000", count)
+	}
+	if want := 500500 * time.Millisecond; sum != want {
+		t.Errorf("sum = %v; want %v", sum, want)
+	}
+	if got, want := len(s.window), 10; got != want {
+		t.Errorf("window size = %d; want %d", got, want)
+	}
+}
+
+func TestSetRemove(t *testing.T) {
+	s := new(Set)
+	for i, k := range []string{"a", "b", "c"} {
+		v := new(expvar.Int)
+		v.Set(int64(i + 1))
+		s.Set(k, v)
+	}
+	g := new(Gauge)
+	g.Set(-4)
+	s.Set("d", g)
+	s.Set("f", new(expvar.Float))
+
+	// Remove concurrently with iteration, as varz scrapes would.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.Do(func(expvar.KeyValue) {})
+			s.AsMap()
+		}
+	}()
+	s.Remove("b")
+	s.Remove("nonexistent")
+	wg.Wait()
+
+	var keys []string
+	s.Do(func(kv expvar.KeyValue) { keys = append(keys, kv.Key) })
+	if got, want := strings.Join(keys, ","), "a,c,d,f"; got != want {
+		t.Errorf("Do keys = %s; want %s", got, want)
+	}
+	want := map[string]int64{"a": 1, "c": 3, "d": -4}
+	if got := s.AsMap(); !reflect.DeepEqual(got, want) {
+		t.Errorf("AsMap = %v; want %v", got, want)
+	}
+}
+
+func TestNewCounterIn(t *testing.T) {
+	s := new(Set)
+	c := NewCounterIn(s, "packets_sent")
+	c.Inc()
+	c.Add(4)
+	if got := c.Value(); got != 5 {
+		t.Errorf("Value = %d; want 5", got)
+	}
+
+	var got []string
+	s.Do(func(kv expvar.KeyValue) { got = append(got, kv.Key+"="+kv.Value.String()) })
+	if want := []string{"packets_sent=5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Do = %q; want %q", got, want)
+	}
+	if got, want := s.AsMap(), map[string]int64{"packets_sent": 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AsMap = %v; want %v", got, want)
+	}
+
+	for _, name := range []string{"packets_sent", "", "packets.sent", "packets-sent", "Packets", "2xx"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewCounterIn(%q) didn't panic", name)
+				}
+			}()
+			NewCounterIn(s, name)
+		}()
+	}
+}
+
+func TestRateCounter(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := NewRateCounter(10 * time.Second)
+	c.now = func() time.Time { return now }
+
+	approx := func(got, want float64) bool {
+		return got > want*0.9 && got < want*1.1
+	}
+
+	// 20 events per second, one every 50ms, for 35 seconds.
+	for i := 0; i < 700; i++ {
+		c.Add(1)
+		now = now.Add(50 * time.Millisecond)
+		if i >= 20 {
+			if got := c.Rate(); !approx(got, 20) {
+				t.Fatalf("after %d events, Rate = %v; want ~20", i+1, got)
+			}
+		}
+	}
+	if got, want := c.Value(), int64(700); got != want {
+		t.Errorf("Value = %d; want %d", got, want)
+	}
+	if got, want := c.String(), "700"; got != want {
+		t.Errorf("String = %q; want %q", got, want)
+	}
+
+	// Slow to 2 events per second.
+	for i := 0; i < 40; i++ {
+		c.Add(1)
+		now = now.Add(500 * time.Millisecond)
+	}
+	if got := c.Rate(); !approx(got, 2) {
+		t.Errorf("after slowing, Rate = %v; want ~2", got)
+	}
+
+	// After two idle windows, the rate is zero but the value stays.
+	now = now.Add(20 * time.Second)
+	if got := c.Rate(); got != 0 {
+		t.Errorf("when idle, Rate = %v; want 0", got)
+	}
+	if got, want := c.Value(), int64(740); got != want {
+		t.Errorf("Value = %d; want %d", got, want)
+	}
+}
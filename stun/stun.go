@@ -6,9 +6,13 @@
 package stun
 
 import (
+	"crypto/hmac"
+	"crypto/md5"
 	crand "crypto/rand"
+	"crypto/sha1"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"net"
 )
@@ -16,7 +20,14 @@ import (
 const (
 	attrNumSoftware      = 0x8022
 	attrNumFingerprint   = 0x8028
+	attrUsername         = 0x0006
+	attrMessageIntegrity = 0x0008
 	attrMappedAddress    = 0x0001
+	attrChangedAddress   = 0x0005 // RFC 3489; superseded by OTHER-ADDRESS
+	attrChangeRequest    = 0x0003 // RFC 5780
+	attrErrorCode        = 0x0009
+	attrOtherAddress     = 0x802c // RFC 5780
+	attrResponseOrigin   = 0x802b // RFC 5780
 	attrXorMappedAddress = 0x0020
 	// This alternative attribute type is not
 	// mentioned in the RFC, but the shift into
@@ -28,7 +39,9 @@ const (
 	software       = "tailnode" // notably: 8 bytes long, so no padding
 	bindingRequest = "\x00\x01"
 	magicCookie    = "\x21\x12\xa4\x42"
-	lenFingerprint = 8 // 2+byte header + 2-byte length + 4-byte crc32
+	lenChangeReq   = 8  // 2-byte type + 2-byte length + 4-byte flags
+	lenFingerprint = 8  // 2+byte header + 2-byte length + 4-byte crc32
+	lenIntegrity   = 24 // 2-byte type + 2-byte length + 20-byte HMAC-SHA1
 	ipv4Len        = 4
 	ipv6Len        = 16
 	headerLen      = 20
@@ -37,7 +50,11 @@ const (
 // TxID is a transaction ID.
 type TxID [12]byte
 
-// NewTxID returns a new random TxID.
+// NewTxID returns a new random TxID, read from crypto/rand.
+//
+// Callers should always use NewTxID for the requests they send.
+// Responses are matched to requests by transaction ID, so a
+// predictable one lets an off-path attacker forge responses.
 func NewTxID() TxID {
 	var tx TxID
 	if _, err := crand.Read(tx[:]); err != nil {
@@ -47,27 +64,206 @@ func NewTxID() TxID {
 }
 
 // Request generates a binding request STUN packet.
-// The transaction ID, tID, should be a random sequence of bytes.
+// The transaction ID, tID, should come from NewTxID.
 func Request(tID TxID) []byte {
+	return RequestWithSoftware(tID, software)
+}
+
+// RequestWithSoftware is like Request, but identifies the sending
+// software as sw in the request's SOFTWARE attribute.
+//
+// Only requests from Request are accepted by ParseBindingRequest.
+func RequestWithSoftware(tID TxID, sw string) []byte {
 	// STUN header, RFC5389 Section 6.
-	const lenAttrSoftware = 4 + len(software)
+	lenAttrSoftware := 4 + paddedLen(len(sw))
 	b := make([]byte, 0, headerLen+lenAttrSoftware+lenFingerprint)
 	b = append(b, bindingRequest...)
 	b = appendU16(b, uint16(lenAttrSoftware+lenFingerprint)) // number of bytes following header
 	b = append(b, magicCookie...)
 	b = append(b, tID[:]...)
 
-	// Attribute SOFTWARE, RFC5389 Section 15.5.
-	b = appendU16(b, attrNumSoftware)
-	b = appendU16(b, uint16(len(software)))
-	b = append(b, software...)
+	// Attribute SOFTWARE, RFC5389 Section 15.10.
+	b = appendAttr(b, attrNumSoftware, []byte(sw))
+
+	return AppendFingerprint(b)
+}
+
+// CHANGE-REQUEST flag bits, RFC 5780 Section 7.2.
+const (
+	changeIPFlag   = 0x4
+	changePortFlag = 0x2
+)
 
+// RequestChange is like Request, but its RFC 5780 CHANGE-REQUEST
+// attribute asks the server to send its response from its alternate
+// IP address if changeIP is set, and from its alternate port if
+// changePort is set. Whether a response to such a request arrives
+// tells a client whether its NAT filters inbound packets by address
+// or by port.
+//
+// Servers that don't support CHANGE-REQUEST, including those using
+// ParseBindingRequestSoftware, reject the request.
+func RequestChange(tID TxID, changeIP, changePort bool) []byte {
+	lenAttrSoftware := 4 + len(software)
+	b := make([]byte, 0, headerLen+lenAttrSoftware+lenChangeReq+lenFingerprint)
+	b = append(b, bindingRequest...)
+	b = appendU16(b, 0) // set by AppendFingerprint
+	b = append(b, magicCookie...)
+	b = append(b, tID[:]...)
+	b = appendAttr(b, attrNumSoftware, []byte(software))
+
+	var flags uint32
+	if changeIP {
+		flags |= changeIPFlag
+	}
+	if changePort {
+		flags |= changePortFlag
+	}
+	b = appendU16(b, attrChangeRequest)
+	b = appendU16(b, 4)
+	b = appendU32(b, flags)
+
+	return AppendFingerprint(b)
+}
+
+// AppendFingerprint appends a FINGERPRINT attribute to the STUN
+// message b, such as one returned by Response, and updates the
+// message length in b's header to include it.
+//
+// No attributes may be added to b afterwards.
+func AppendFingerprint(b []byte) []byte {
 	// Attribute FINGERPRINT, RFC5389 Section 15.5.
+	// The CRC covers the header with its length already
+	// including the fingerprint attribute.
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLen+lenFingerprint))
 	fp := fingerPrint(b)
 	b = appendU16(b, attrNumFingerprint)
 	b = appendU16(b, 4)
 	b = appendU32(b, fp)
+	return b
+}
 
+// ShortTermKey returns the key for MESSAGE-INTEGRITY with short-term
+// credentials (RFC 5389 section 15.4): the password itself. The
+// password isn't processed with SASLprep, so callers with non-ASCII
+// passwords must do that themselves.
+func ShortTermKey(password string) []byte {
+	return []byte(password)
+}
+
+// LongTermKey returns the key for MESSAGE-INTEGRITY with long-term
+// credentials (RFC 5389 section 15.4): the MD5 hash of
+// username:realm:password. As with ShortTermKey, SASLprep is left
+// to the caller.
+func LongTermKey(username, realm, password string) []byte {
+	h := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return h[:]
+}
+
+// RequestWithCredentials is like Request, but authenticates the
+// request to servers that require credentials with USERNAME and
+// MESSAGE-INTEGRITY attributes, using key from ShortTermKey or
+// LongTermKey.
+func RequestWithCredentials(tID TxID, username string, key []byte) []byte {
+	b := make([]byte, 0, headerLen+4+len(software)+4+paddedLen(len(username))+lenIntegrity+lenFingerprint)
+	b = append(b, bindingRequest...)
+	b = appendU16(b, 0) // set by AppendMessageIntegrity and AppendFingerprint
+	b = append(b, magicCookie...)
+	b = append(b, tID[:]...)
+	b = appendAttr(b, attrNumSoftware, []byte(software))
+	b = appendAttr(b, attrUsername, []byte(username))
+	b = AppendMessageIntegrity(b, key)
+	return AppendFingerprint(b)
+}
+
+// AppendMessageIntegrity appends a MESSAGE-INTEGRITY attribute to
+// the STUN message b, an HMAC-SHA1 of b keyed with key (see
+// ShortTermKey and LongTermKey), and updates the message length in
+// b's header to include it.
+//
+// Only a FINGERPRINT attribute may be added to b afterwards.
+func AppendMessageIntegrity(b []byte, key []byte) []byte {
+	// Attribute MESSAGE-INTEGRITY, RFC 5389 section 15.4.
+	// The HMAC covers the header with its length already
+	// including this attribute, but not any FINGERPRINT
+	// that follows.
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerLen+lenIntegrity))
+	b = appendU16(b, attrMessageIntegrity)
+	b = appendU16(b, sha1.Size)
+	return append(b, messageIntegrity(b[:len(b)-4], key)...)
+}
+
+// messageIntegrity returns the HMAC-SHA1 of b, a STUN message up to
+// its MESSAGE-INTEGRITY attribute, as if the message ended after
+// that attribute.
+func messageIntegrity(b []byte, key []byte) []byte {
+	var hdr [headerLen]byte
+	copy(hdr[:], b)
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(b)-headerLen+lenIntegrity))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(hdr[:])
+	mac.Write(b[headerLen:])
+	return mac.Sum(nil)
+}
+
+// VerifyMessageIntegrity checks that the STUN message b, such as a
+// binding response, has a MESSAGE-INTEGRITY attribute that's valid
+// for key, followed by nothing but an optional FINGERPRINT. It
+// returns ErrNoMessageIntegrity if b has no such attribute and
+// ErrWrongMessageIntegrity if it doesn't match. The comparison is
+// constant-time.
+func VerifyMessageIntegrity(b []byte, key []byte) error {
+	if !Is(b) {
+		return ErrNotSTUN
+	}
+	attrsLen := int(beu16(b[2:4]))
+	if attrsLen%4 != 0 || attrsLen > len(b)-headerLen {
+		return ErrMalformedAttrs
+	}
+	b = b[:headerLen+attrsLen] // trim trailing packet bytes
+	var got []byte
+	var end int // offset in b of the end of MESSAGE-INTEGRITY
+	off := headerLen
+	if err := foreachAttr(b[headerLen:], func(attrType uint16, a []byte) error {
+		attrOff := off
+		off += 4 + paddedLen(len(a))
+		switch {
+		case got == nil && attrType == attrMessageIntegrity:
+			if len(a) != sha1.Size {
+				return ErrMalformedAttrs
+			}
+			got, end = a, off
+		case got != nil && attrType != attrNumFingerprint:
+			return ErrMalformedAttrs // only FINGERPRINT may follow
+		case got != nil && attrOff != end:
+			return ErrMalformedAttrs // and only one attribute
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if got == nil {
+		return ErrNoMessageIntegrity
+	}
+	if !hmac.Equal(got, messageIntegrity(b[:end-lenIntegrity], key)) {
+		return ErrWrongMessageIntegrity
+	}
+	return nil
+}
+
+// paddedLen returns n rounded up to a multiple of 4, the length an
+// attribute value of length n occupies on the wire.
+func paddedLen(n int) int { return (n + 3) &^ 3 }
+
+// appendAttr appends an attribute of type attrType with value v to
+// b, zero-padding it to a 4 byte boundary.
+func appendAttr(b []byte, attrType uint16, v []byte) []byte {
+	b = appendU16(b, attrType)
+	b = appendU16(b, uint16(len(v)))
+	b = append(b, v...)
+	for i := len(v); i < paddedLen(len(v)); i++ {
+		b = append(b, 0)
+	}
 	return b
 }
 
@@ -83,8 +279,10 @@ func appendU32(b []byte, v uint32) []byte {
 
 // ParseBindingRequest parses a STUN binding request.
 //
-// It returns an error unless it advertises that it came from
-// Tailscale.
+// It returns ErrNotSTUN if b lacks the STUN magic cookie, and
+// ErrNotBindingRequest for any other STUN message, such as a binding
+// response. It also returns an error unless the request advertises
+// that it came from Tailscale.
 func ParseBindingRequest(b []byte) (TxID, error) {
 	if !Is(b) {
 		return TxID{}, ErrNotSTUN
@@ -92,6 +290,11 @@ func ParseBindingRequest(b []byte) (TxID, error) {
 	if string(b[:len(bindingRequest)]) != bindingRequest {
 		return TxID{}, ErrNotBindingRequest
 	}
+	attrsLen := int(beu16(b[2:4]))
+	if attrsLen%4 != 0 || attrsLen > len(b)-headerLen {
+		return TxID{}, ErrMalformedAttrs
+	}
+	b = b[:headerLen+attrsLen] // trim trailing packet bytes
 	var txID TxID
 	copy(txID[:], b[8:8+len(txID)])
 	var softwareOK bool
@@ -122,40 +325,145 @@ func ParseBindingRequest(b []byte) (TxID, error) {
 	return txID, nil
 }
 
+// ParseBindingRequestSoftware parses a STUN binding request from any
+// client, returning its transaction ID and the value of its SOFTWARE
+// attribute, or the empty string if it has none. It's meant for
+// servers that want to log what software their clients run.
+//
+// Unlike ParseBindingRequest, it doesn't require the request to come
+// from Tailscale, or to have a FINGERPRINT, though one that's present
+// must be the last attribute and must be correct. Per RFC 5389
+// section 7.3.1, unknown comprehension-optional attributes are
+// skipped, while unknown comprehension-required ones make it return
+// ErrUnknownAttr.
+func ParseBindingRequestSoftware(b []byte) (txID TxID, sw string, err error) {
+	if !Is(b) {
+		return TxID{}, "", ErrNotSTUN
+	}
+	if string(b[:len(bindingRequest)]) != bindingRequest {
+		return TxID{}, "", ErrNotBindingRequest
+	}
+	attrsLen := int(beu16(b[2:4]))
+	if attrsLen%4 != 0 || attrsLen > len(b)-headerLen {
+		return TxID{}, "", ErrMalformedAttrs
+	}
+	b = b[:headerLen+attrsLen] // trim trailing packet bytes
+	copy(txID[:], b[8:8+len(txID)])
+	var gotFP bool
+	if err := foreachAttr(b[headerLen:], func(attrType uint16, a []byte) error {
+		if gotFP {
+			return ErrMalformedAttrs // nothing may follow FINGERPRINT
+		}
+		switch {
+		case attrType == attrNumSoftware:
+			sw = string(a)
+		case attrType == attrNumFingerprint:
+			if len(a) != 4 {
+				return ErrMalformedAttrs
+			}
+			gotFP = true
+		case attrType < 0x8000 && !knownAttr(attrType):
+			return ErrUnknownAttr
+		}
+		return nil
+	}); err != nil {
+		return TxID{}, "", err
+	}
+	if gotFP {
+		fp := binary.BigEndian.Uint32(b[len(b)-4:])
+		if fp != fingerPrint(b[:len(b)-lenFingerprint]) {
+			return TxID{}, "", ErrWrongFingerprint
+		}
+	}
+	return txID, sw, nil
+}
+
+// knownAttr reports whether attrType is a comprehension-required
+// attribute this package understands. None of them affect a binding
+// request, but clients may send them anyway.
+func knownAttr(attrType uint16) bool {
+	switch attrType {
+	case attrMappedAddress, attrChangedAddress, attrErrorCode, attrXorMappedAddress,
+		attrUsername, attrMessageIntegrity:
+		return true
+	}
+	return false
+}
+
 var (
 	ErrNotSTUN            = errors.New("response is not a STUN packet")
 	ErrNotSuccessResponse = errors.New("STUN response error")
 	ErrMalformedAttrs     = errors.New("STUN response has malformed attributes")
+	ErrNoMappedAddress    = errors.New("STUN response has no MAPPED-ADDRESS or XOR-MAPPED-ADDRESS attribute")
+	ErrNotErrorResponse   = errors.New("STUN response is not an error response")
+	ErrNoErrorCode        = errors.New("STUN error response has no ERROR-CODE attribute")
+	ErrNoOtherAddress     = errors.New("STUN response has no OTHER-ADDRESS or CHANGED-ADDRESS attribute")
 	ErrNotBindingRequest  = errors.New("STUN request not a binding request")
 	ErrWrongSoftware      = errors.New("STUN request came from non-Tailscale software")
 	ErrNoFingerprint      = errors.New("STUN request didn't end in fingerprint")
 	ErrWrongFingerprint   = errors.New("STUN request had bogus fingerprint")
+	ErrUnknownAttr        = errors.New("STUN request has unknown comprehension-required attribute")
+
+	ErrNoMessageIntegrity    = errors.New("STUN message has no MESSAGE-INTEGRITY attribute")
+	ErrWrongMessageIntegrity = errors.New("STUN message has wrong MESSAGE-INTEGRITY")
 )
 
+// ErrMalformedAttribute is the error returned when an attribute of a
+// STUN message doesn't fit in it: its header is truncated, or its
+// declared length, rounded up to the 4 byte boundary attributes are
+// padded to, runs past the end of the message.
+//
+// errors.Is reports it to be ErrMalformedAttrs.
+type ErrMalformedAttribute struct {
+	Type   uint16 // attribute type, or 0 if its header is truncated
+	Offset int    // of the attribute's header, after the STUN header
+	Reason string
+}
+
+func (e *ErrMalformedAttribute) Error() string {
+	return fmt.Sprintf("STUN message has malformed attribute 0x%04x at offset %d: %s", e.Type, e.Offset, e.Reason)
+}
+
+// Is reports whether target is ErrMalformedAttrs.
+func (e *ErrMalformedAttribute) Is(target error) bool { return target == ErrMalformedAttrs }
+
+// foreachAttr calls fn with the type and value of each attribute in
+// b, the attributes of a STUN message, stopping at the first error.
 func foreachAttr(b []byte, fn func(attrType uint16, a []byte) error) error {
-	for len(b) > 0 {
-		if len(b) < 4 {
-			return errors.New("effed-f1")
-			return ErrMalformedAttrs
+	off := 0
+	for off < len(b) {
+		rest := b[off:]
+		if len(rest) < 4 {
+			return &ErrMalformedAttribute{Offset: off, Reason: fmt.Sprintf("truncated header of %d bytes", len(rest))}
 		}
-		attrType := binary.BigEndian.Uint16(b[:2])
-		attrLen := int(binary.BigEndian.Uint16(b[2:4]))
-		attrLenPad := attrLen % 4
-		b = b[4:]
-		if attrLen+attrLenPad > len(b) {
-			return errors.New("effed-f2")
-			return ErrMalformedAttrs
+		attrType := binary.BigEndian.Uint16(rest[:2])
+		attrLen := int(binary.BigEndian.Uint16(rest[2:4]))
+		attrLenWithPad := paddedLen(attrLen)
+		rest = rest[4:]
+		if attrLenWithPad > len(rest) {
+			return &ErrMalformedAttribute{
+				Type:   attrType,
+				Offset: off,
+				Reason: fmt.Sprintf("length %d (%d padded) exceeds the %d bytes remaining", attrLen, attrLenWithPad, len(rest)),
+			}
 		}
-		if err := fn(attrType, b[:attrLen]); err != nil {
+		if err := fn(attrType, rest[:attrLen]); err != nil {
 			return err
 		}
-		b = b[attrLen+attrLenPad:]
+		off += 4 + attrLenWithPad
 	}
 	return nil
 }
 
 // Response generates a binding response.
 func Response(txID TxID, ip net.IP, port uint16) []byte {
+	return ResponseWithSoftware(txID, ip, port, "")
+}
+
+// ResponseWithSoftware is like Response, but if sw is non-empty the
+// response also identifies the responding software as sw in a
+// SOFTWARE attribute.
+func ResponseWithSoftware(txID TxID, ip net.IP, port uint16, sw string) []byte {
 	if ip4 := ip.To4(); ip4 != nil {
 		ip = ip4
 	}
@@ -169,6 +477,9 @@ func Response(txID TxID, ip net.IP, port uint16) []byte {
 		return nil
 	}
 	attrsLen := 8 + len(ip)
+	if sw != "" {
+		attrsLen += 4 + paddedLen(len(sw))
+	}
 	b := make([]byte, 0, headerLen+attrsLen)
 
 	// Header
@@ -177,7 +488,10 @@ func Response(txID TxID, ip net.IP, port uint16) []byte {
 	b = append(b, magicCookie...)
 	b = append(b, txID[:]...)
 
-	// Attributes (well, one)
+	// Attributes
+	if sw != "" {
+		b = appendAttr(b, attrNumSoftware, []byte(sw))
+	}
 	b = appendU16(b, attrXorMappedAddress)
 	b = appendU16(b, uint16(4+len(ip)))
 	b = append(b,
@@ -194,10 +508,36 @@ func Response(txID TxID, ip net.IP, port uint16) []byte {
 	return b
 }
 
+// Software returns the value of STUN message b's SOFTWARE
+// attribute, or the empty string if it has none.
+func Software(b []byte) (string, error) {
+	if !Is(b) {
+		return "", ErrNotSTUN
+	}
+	attrsLen := int(beu16(b[2:4]))
+	b = b[headerLen:] // remove STUN header
+	if attrsLen%4 != 0 || attrsLen > len(b) {
+		return "", ErrMalformedAttrs
+	}
+	var sw string
+	if err := foreachAttr(b[:attrsLen], func(attrType uint16, a []byte) error {
+		if attrType == attrNumSoftware {
+			sw = string(a)
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return sw, nil
+}
+
 func beu16(b []byte) uint16 { return binary.BigEndian.Uint16(b) }
 
 // ParseResponse parses a successful binding response STUN packet.
-// The IP address is extracted from the XOR-MAPPED-ADDRESS attribute.
+// The IP address is extracted from the XOR-MAPPED-ADDRESS attribute,
+// falling back to the legacy MAPPED-ADDRESS attribute if the former
+// is absent. Both IPv4 (4 byte) and IPv6 (16 byte) addresses are
+// supported; an IPv4 address is preferred if both are present.
 // The returned addr slice is owned by the caller and does not alias b.
 func ParseResponse(b []byte) (tID TxID, addr []byte, port uint16, err error) {
 	if !Is(b) {
@@ -209,7 +549,7 @@ func ParseResponse(b []byte) (tID TxID, addr []byte, port uint16, err error) {
 	}
 	attrsLen := int(beu16(b[2:4]))
 	b = b[headerLen:] // remove STUN header
-	if attrsLen > len(b) {
+	if attrsLen%4 != 0 || attrsLen > len(b) {
 		return tID, nil, 0, ErrMalformedAttrs
 	} else if len(b) > attrsLen {
 		b = b[:attrsLen] // trim trailing packet bytes
@@ -264,11 +604,168 @@ func ParseResponse(b []byte) (tID TxID, addr []byte, port uint16, err error) {
 	if fallbackAddr6 != nil {
 		return tID, append([]byte{}, fallbackAddr6...), fallbackPort6, nil
 	}
-	return tID, nil, 0, ErrMalformedAttrs
+	return tID, nil, 0, ErrNoMappedAddress
+}
+
+// ParseError parses a binding error response STUN packet, returning
+// the status code (such as 401 or 420) and reason phrase from its
+// ERROR-CODE attribute.
+//
+// If b is a successful binding response, ErrNotErrorResponse is returned.
+func ParseError(b []byte) (code int, reason string, err error) {
+	if !Is(b) {
+		return 0, "", ErrNotSTUN
+	}
+	if b[0] != 0x01 || b[1] != 0x11 {
+		return 0, "", ErrNotErrorResponse
+	}
+	attrsLen := int(beu16(b[2:4]))
+	b = b[headerLen:] // remove STUN header
+	if attrsLen%4 != 0 || attrsLen > len(b) {
+		return 0, "", ErrMalformedAttrs
+	}
+	b = b[:attrsLen]
+
+	found := false
+	if err := foreachAttr(b, func(attrType uint16, attr []byte) error {
+		if attrType != attrErrorCode || found {
+			return nil
+		}
+		// ERROR-CODE attribute, RFC5389 Section 15.6.
+		if len(attr) < 4 {
+			return ErrMalformedAttrs
+		}
+		class, number := int(attr[2]&0x07), int(attr[3])
+		if class < 3 || class > 6 || number > 99 {
+			return ErrMalformedAttrs
+		}
+		code = class*100 + number
+		reason = string(attr[4:])
+		found = true
+		return nil
+	}); err != nil {
+		return 0, "", err
+	}
+	if !found {
+		return 0, "", ErrNoErrorCode
+	}
+	return code, reason, nil
+}
+
+// ParseOtherAddress parses a successful binding response STUN packet
+// and returns the server's alternate address from its OTHER-ADDRESS
+// attribute, falling back to the legacy CHANGED-ADDRESS attribute.
+// Servers that support NAT behavior discovery (RFC 5780) answer
+// binding requests sent to this address from a different IP and port.
+//
+// If the response has neither attribute, ErrNoOtherAddress is returned.
+func ParseOtherAddress(b []byte) (addr []byte, port uint16, err error) {
+	if !Is(b) {
+		return nil, 0, ErrNotSTUN
+	}
+	if b[0] != 0x01 || b[1] != 0x01 {
+		return nil, 0, ErrNotSuccessResponse
+	}
+	attrsLen := int(beu16(b[2:4]))
+	b = b[headerLen:] // remove STUN header
+	if attrsLen%4 != 0 || attrsLen > len(b) {
+		return nil, 0, ErrMalformedAttrs
+	}
+	b = b[:attrsLen]
+
+	var fallbackAddr []byte
+	var fallbackPort uint16
+	if err := foreachAttr(b, func(attrType uint16, attr []byte) error {
+		switch attrType {
+		case attrOtherAddress:
+			if addr != nil {
+				return nil
+			}
+			a, p, err := mappedAddress(attr)
+			if err != nil {
+				return ErrMalformedAttrs
+			}
+			addr, port = a, p
+		case attrChangedAddress:
+			if fallbackAddr != nil {
+				return nil
+			}
+			a, p, err := mappedAddress(attr)
+			if err != nil {
+				return ErrMalformedAttrs
+			}
+			fallbackAddr, fallbackPort = a, p
+		}
+		return nil
+	}); err != nil {
+		return nil, 0, err
+	}
+	if addr != nil {
+		return addr, port, nil
+	}
+	if fallbackAddr != nil {
+		return fallbackAddr, fallbackPort, nil
+	}
+	return nil, 0, ErrNoOtherAddress
+}
+
+// ResponseAddrs are the addresses in a successful binding response.
+type ResponseAddrs struct {
+	TxID TxID
+
+	// Mapped is the client's address as the server saw it, as
+	// returned by ParseResponse.
+	Mapped *net.UDPAddr
+
+	// Origin is the address the server sent the response from,
+	// from its RESPONSE-ORIGIN attribute, or nil if it had none.
+	Origin *net.UDPAddr
+
+	// Other is the server's alternate address, as returned by
+	// ParseOtherAddress, or nil if it had none.
+	Other *net.UDPAddr
+}
+
+// ParseResponseAddrs is like ParseResponse, but also returns the
+// addresses that servers supporting NAT behavior discovery (RFC 5780)
+// include in responses. Comparing mappings seen through the server's
+// Other address tells how the client's NAT behaves.
+func ParseResponseAddrs(b []byte) (ResponseAddrs, error) {
+	tID, addr, port, err := ParseResponse(b)
+	if err != nil {
+		return ResponseAddrs{}, err
+	}
+	ra := ResponseAddrs{
+		TxID:   tID,
+		Mapped: &net.UDPAddr{IP: net.IP(addr), Port: int(port)},
+	}
+	if addr, port, err := ParseOtherAddress(b); err == nil {
+		ra.Other = &net.UDPAddr{IP: net.IP(addr), Port: int(port)}
+	} else if err != ErrNoOtherAddress {
+		return ResponseAddrs{}, err
+	}
+
+	attrsLen := int(beu16(b[2:4]))
+	if err := foreachAttr(b[headerLen:headerLen+attrsLen], func(attrType uint16, attr []byte) error {
+		if attrType != attrResponseOrigin || ra.Origin != nil {
+			return nil
+		}
+		a, p, err := mappedAddress(attr)
+		if err != nil {
+			return ErrMalformedAttrs
+		}
+		ra.Origin = &net.UDPAddr{IP: net.IP(a), Port: int(p)}
+		return nil
+	}); err != nil {
+		return ResponseAddrs{}, err
+	}
+	return ra, nil
 }
 
 func xorMappedAddress(tID TxID, b []byte) (addr []byte, port uint16, err error) {
-	// XOR-MAPPED-ADDRESS attribute, RFC5389 Section 15.2
+	// XOR-MAPPED-ADDRESS attribute, RFC5389 Section 15.2.
+	// IPv4 addresses are XORed with the magic cookie; IPv6
+	// addresses with the magic cookie followed by the txid.
 	if len(b) < 4 {
 		return nil, 0, ErrMalformedAttrs
 	}
@@ -322,6 +819,27 @@ func mappedAddress(b []byte) (addr []byte, port uint16, err error) {
 	return append([]byte(nil), addrField[:addrLen]...), port, nil
 }
 
+// IsWithFingerprint reports whether b is a STUN message ending in a
+// valid FINGERPRINT attribute.
+//
+// It's a stricter version of Is, for telling STUN packets apart
+// from other traffic on the same socket.
+func IsWithFingerprint(b []byte) bool {
+	if !Is(b) {
+		return false
+	}
+	msgLen := headerLen + int(beu16(b[2:4]))
+	if msgLen > len(b) || msgLen < headerLen+lenFingerprint {
+		return false
+	}
+	b = b[:msgLen]
+	fpAttr := b[len(b)-lenFingerprint:]
+	if beu16(fpAttr[0:2]) != attrNumFingerprint || beu16(fpAttr[2:4]) != 4 {
+		return false
+	}
+	return binary.BigEndian.Uint32(fpAttr[4:]) == fingerPrint(b[:len(b)-lenFingerprint])
+}
+
 // Is reports whether b is a STUN message.
 func Is(b []byte) bool {
 	return len(b) >= headerLen &&
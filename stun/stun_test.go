@@ -6,15 +6,16 @@ package stun_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"testing"
 
 	"tailscale.com/stun"
 )
 
-// TODO(bradfitz): fuzz this.
-
 func ExampleRequest() {
 	txID := stun.NewTxID()
 	req := stun.Request(txID)
@@ -193,6 +194,19 @@ func TestIs(t *testing.T) {
 	}
 }
 
+func TestNewTxID(t *testing.T) {
+	a, b := stun.NewTxID(), stun.NewTxID()
+	if a == b {
+		t.Errorf("consecutive TxIDs are both %x", a)
+	}
+	if a == (stun.TxID{}) {
+		t.Error("TxID is all zeros")
+	}
+	if req := stun.Request(a); !stun.Is(req) {
+		t.Errorf("Request(%x) = %x; not STUN", a, req)
+	}
+}
+
 func TestParseBindingRequest(t *testing.T) {
 	tx := stun.NewTxID()
 	req := stun.Request(tx)
@@ -203,6 +217,39 @@ func TestParseBindingRequest(t *testing.T) {
 	if gotTx != tx {
 		t.Errorf("original txID %q != got txID %q", tx, gotTx)
 	}
+
+	// Trailing bytes beyond the message length are ignored.
+	if _, err := stun.ParseBindingRequest(append(append([]byte{}, req...), 0, 0, 0, 0)); err != nil {
+		t.Errorf("with trailing bytes: %v", err)
+	}
+}
+
+func TestParseBindingRequestErrors(t *testing.T) {
+	tx := stun.NewTxID()
+	random := make([]byte, 20)
+	for i := range random {
+		random[i] = byte(i*37 + 11)
+	}
+	truncated := stun.Request(tx)
+	truncated = truncated[:len(truncated)-4]
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"response", stun.Response(tx, net.ParseIP("1.2.3.4"), 1234), stun.ErrNotBindingRequest},
+		{"random", random, stun.ErrNotSTUN},
+		{"short", []byte{0x00, 0x01, 0x00}, stun.ErrNotSTUN},
+		{"truncated", truncated, stun.ErrMalformedAttrs},
+		{"no-software", append([]byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}, tx[:]...), stun.ErrWrongSoftware},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := stun.ParseBindingRequest(tt.data); err != tt.wantErr {
+				t.Errorf("err = %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
 }
 
 func TestResponse(t *testing.T) {
@@ -240,3 +287,682 @@ func TestResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestParseResponseErrors(t *testing.T) {
+	tx := stun.NewTxID()
+	header := func(attrsLen int) []byte {
+		b := []byte{0x01, 0x01, byte(attrsLen >> 8), byte(attrsLen), 0x21, 0x12, 0xa4, 0x42}
+		return append(b, tx[:]...)
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{
+			name:    "no-address",
+			data:    append(header(8), 0x80, 0x22, 0x00, 0x04, 't', 'e', 's', 't'),
+			wantErr: stun.ErrNoMappedAddress,
+		},
+		{
+			name:    "truncated-attr-header",
+			data:    append(header(2), 0x00, 0x20),
+			wantErr: stun.ErrMalformedAttrs,
+		},
+		{
+			name:    "truncated-xor-addr",
+			data:    append(header(8), 0x00, 0x20, 0x00, 0x04, 0x00, 0x01, 0xc7, 0x86),
+			wantErr: stun.ErrMalformedAttrs,
+		},
+		{
+			name:    "truncated-ipv6-xor-addr",
+			data:    append(header(12), 0x00, 0x20, 0x00, 0x08, 0x00, 0x02, 0xc7, 0x86, 1, 2, 3, 4),
+			wantErr: stun.ErrMalformedAttrs,
+		},
+		{
+			name:    "attrs-len-too-long",
+			data:    header(8),
+			wantErr: stun.ErrMalformedAttrs,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := stun.ParseResponse(tt.data)
+			if err != tt.wantErr {
+				t.Errorf("err = %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseOtherAddress(t *testing.T) {
+	tx := stun.NewTxID()
+	msg := func(attrs ...byte) []byte {
+		b := []byte{0x01, 0x01, 0, byte(len(attrs)), 0x21, 0x12, 0xa4, 0x42}
+		b = append(b, tx[:]...)
+		return append(b, attrs...)
+	}
+	other := []byte{0x80, 0x2c, 0x00, 0x08, 0x00, 0x01, 0x0d, 0x97, 192, 0, 2, 1}   // 192.0.2.1:3479
+	changed := []byte{0x00, 0x05, 0x00, 0x08, 0x00, 0x01, 0x0d, 0x98, 192, 0, 2, 2} // 192.0.2.2:3480
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantAddr []byte
+		wantPort uint16
+		wantErr  error
+	}{
+		{
+			name:     "other-address",
+			data:     msg(other...),
+			wantAddr: []byte{192, 0, 2, 1},
+			wantPort: 3479,
+		},
+		{
+			name:     "changed-address",
+			data:     msg(changed...),
+			wantAddr: []byte{192, 0, 2, 2},
+			wantPort: 3480,
+		},
+		{
+			name:     "prefer-other-address",
+			data:     msg(append(append([]byte{}, changed...), other...)...),
+			wantAddr: []byte{192, 0, 2, 1},
+			wantPort: 3479,
+		},
+		{
+			name:    "missing",
+			data:    msg(0x80, 0x22, 0x00, 0x04, 't', 'e', 's', 't'),
+			wantErr: stun.ErrNoOtherAddress,
+		},
+		{
+			name:    "truncated",
+			data:    msg(0x80, 0x2c, 0x00, 0x04, 0x00, 0x01, 0x0d, 0x97),
+			wantErr: stun.ErrMalformedAttrs,
+		},
+		{
+			name:    "not-success",
+			data:    stun.Request(tx),
+			wantErr: stun.ErrNotSuccessResponse,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, port, err := stun.ParseOtherAddress(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v; want %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(addr, tt.wantAddr) || port != tt.wantPort {
+				t.Errorf("got %v:%d; want %v:%d", addr, port, tt.wantAddr, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestParseResponseAddrs(t *testing.T) {
+	tx := stun.NewTxID()
+	// withAttrs returns response b with attrs appended.
+	withAttrs := func(b []byte, attrs ...[]byte) []byte {
+		b = append([]byte(nil), b...)
+		for _, a := range attrs {
+			b = append(b, a...)
+		}
+		binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-20))
+		return b
+	}
+	// addrAttr returns a MAPPED-ADDRESS-style attribute of type typ.
+	addrAttr := func(typ uint16, ip string, port uint16) []byte {
+		a := []byte{byte(typ >> 8), byte(typ), 0, 0, 0, 0, byte(port >> 8), byte(port)}
+		if ip4 := net.ParseIP(ip).To4(); ip4 != nil {
+			a[5] = 1
+			a = append(a, ip4...)
+		} else {
+			a[5] = 2
+			a = append(a, net.ParseIP(ip)...)
+		}
+		binary.BigEndian.PutUint16(a[2:4], uint16(len(a)-4))
+		return a
+	}
+	const origin, other = 0x802b, 0x802c
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantMapped string
+		wantOrigin string // or empty for nil
+		wantOther  string // or empty for nil
+		wantErr    error
+	}{
+		{
+			name: "ipv4",
+			data: withAttrs(stun.Response(tx, net.ParseIP("1.2.3.4"), 5678),
+				addrAttr(origin, "192.0.2.1", 3478),
+				addrAttr(other, "192.0.2.2", 3479)),
+			wantMapped: "1.2.3.4:5678",
+			wantOrigin: "192.0.2.1:3478",
+			wantOther:  "192.0.2.2:3479",
+		},
+		{
+			name: "ipv6",
+			data: withAttrs(stun.Response(tx, net.ParseIP("2001:db8::1"), 5678),
+				addrAttr(origin, "2001:db8::2", 3478),
+				addrAttr(other, "2001:db8::3", 3479)),
+			wantMapped: "[2001:db8::1]:5678",
+			wantOrigin: "[2001:db8::2]:3478",
+			wantOther:  "[2001:db8::3]:3479",
+		},
+		{
+			name:       "origin-only",
+			data:       withAttrs(stun.Response(tx, net.ParseIP("1.2.3.4"), 5678), addrAttr(origin, "192.0.2.1", 3478)),
+			wantMapped: "1.2.3.4:5678",
+			wantOrigin: "192.0.2.1:3478",
+		},
+		{
+			name:       "plain",
+			data:       stun.Response(tx, net.ParseIP("1.2.3.4"), 5678),
+			wantMapped: "1.2.3.4:5678",
+		},
+		{
+			name:    "truncated-origin",
+			data:    withAttrs(stun.Response(tx, net.ParseIP("1.2.3.4"), 5678), []byte{0x80, 0x2b, 0x00, 0x04, 0x00, 0x01, 0x0d, 0x96}),
+			wantErr: stun.ErrMalformedAttrs,
+		},
+		{
+			name:    "not-success",
+			data:    stun.Request(tx),
+			wantErr: stun.ErrNotSuccessResponse,
+		},
+	}
+	str := func(a *net.UDPAddr) string {
+		if a == nil {
+			return ""
+		}
+		return a.String()
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ra, err := stun.ParseResponseAddrs(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if ra.TxID != tx {
+				t.Errorf("TxID = %x; want %x", ra.TxID, tx)
+			}
+			if got := str(ra.Mapped); got != tt.wantMapped {
+				t.Errorf("Mapped = %q; want %q", got, tt.wantMapped)
+			}
+			if got := str(ra.Origin); got != tt.wantOrigin {
+				t.Errorf("Origin = %q; want %q", got, tt.wantOrigin)
+			}
+			if got := str(ra.Other); got != tt.wantOther {
+				t.Errorf("Other = %q; want %q", got, tt.wantOther)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	tx := stun.NewTxID()
+	msg := func(typ0, typ1 byte, attrs ...byte) []byte {
+		b := []byte{typ0, typ1, 0, byte(len(attrs)), 0x21, 0x12, 0xa4, 0x42}
+		b = append(b, tx[:]...)
+		return append(b, attrs...)
+	}
+	unauthorized := append([]byte{0x00, 0x09, 0x00, 0x10, 0x00, 0x00, 0x04, 0x01}, "Unauthorized"...)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantCode   int
+		wantReason string
+		wantErr    error
+	}{
+		{
+			name:       "401",
+			data:       msg(0x01, 0x11, unauthorized...),
+			wantCode:   401,
+			wantReason: "Unauthorized",
+		},
+		{
+			name:    "success-response",
+			data:    stun.Response(tx, net.ParseIP("1.2.3.4"), 1234),
+			wantErr: stun.ErrNotErrorResponse,
+		},
+		{
+			name:    "no-error-code",
+			data:    msg(0x01, 0x11, 0x80, 0x22, 0x00, 0x04, 't', 'e', 's', 't'),
+			wantErr: stun.ErrNoErrorCode,
+		},
+		{
+			name:    "truncated-error-code",
+			data:    msg(0x01, 0x11, 0x00, 0x09, 0x00, 0x00),
+			wantErr: stun.ErrMalformedAttrs,
+		},
+		{
+			name:    "not-stun",
+			data:    []byte("hello"),
+			wantErr: stun.ErrNotSTUN,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, reason, err := stun.ParseError(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v; want %v", err, tt.wantErr)
+			}
+			if code != tt.wantCode || reason != tt.wantReason {
+				t.Errorf("got %d %q; want %d %q", code, reason, tt.wantCode, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestSoftware(t *testing.T) {
+	tx := stun.NewTxID()
+	for _, sw := range []string{"", "a", "ts", "abcd", "tailscale 0.97-0"} {
+		res := stun.ResponseWithSoftware(tx, net.ParseIP("1.2.3.4"), 1234, sw)
+		got, err := stun.Software(res)
+		if err != nil {
+			t.Errorf("response %q: %v", sw, err)
+		} else if got != sw {
+			t.Errorf("response software = %q; want %q", got, sw)
+		}
+		_, ip, port, err := stun.ParseResponse(res)
+		if err != nil || !net.IP(ip).Equal(net.ParseIP("1.2.3.4")) || port != 1234 {
+			t.Errorf("response %q: ParseResponse = %v, %v, %v", sw, ip, port, err)
+		}
+
+		req := stun.RequestWithSoftware(tx, sw)
+		got, err = stun.Software(req)
+		if err != nil {
+			t.Errorf("request %q: %v", sw, err)
+		} else if got != sw {
+			t.Errorf("request software = %q; want %q", got, sw)
+		}
+		if len(req)%4 != 0 {
+			t.Errorf("request %q: length %d not 4 byte aligned", sw, len(req))
+		}
+	}
+
+	if _, err := stun.ParseBindingRequest(stun.RequestWithSoftware(tx, "other")); err != stun.ErrWrongSoftware {
+		t.Errorf("ParseBindingRequest of non-Tailscale request: err = %v; want %v", err, stun.ErrWrongSoftware)
+	}
+}
+
+func TestParseBindingRequestSoftware(t *testing.T) {
+	tx := stun.NewTxID()
+	// request builds a binding request with the given attributes,
+	// each a type and value, and then a fingerprint.
+	request := func(attrs ...interface{}) []byte {
+		b := append([]byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}, tx[:]...)
+		for i := 0; i < len(attrs); i += 2 {
+			v := attrs[i+1].(string)
+			b = append(b, 0, 0, 0, 0)
+			binary.BigEndian.PutUint16(b[len(b)-4:], uint16(attrs[i].(int)))
+			binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(v)))
+			b = append(b, v...)
+			for len(b)%4 != 0 {
+				b = append(b, 0)
+			}
+		}
+		return stun.AppendFingerprint(b)
+	}
+	badFP := request(0x8022, "pion")
+	badFP[len(badFP)-1]++
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{"tailscale", stun.Request(tx), "tailnode", nil},
+		{"other-software", stun.RequestWithSoftware(tx, "pion/stun v0.3"), "pion/stun v0.3", nil},
+		{"unknown-optional", request(0x8022, "pion/stun v0.3", 0x8055, "xyz"), "pion/stun v0.3", nil},
+		{"unknown-optional-first", request(0x80aa, "", 0x8022, "abc"), "abc", nil},
+		{"no-software", request(), "", nil},
+		{"no-fingerprint", append([]byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}, tx[:]...), "", nil},
+		{"unknown-required", request(0x8022, "pion", 0x0099, "x"), "", stun.ErrUnknownAttr},
+		{"bad-fingerprint", badFP, "", stun.ErrWrongFingerprint},
+		{"response", stun.Response(tx, net.ParseIP("1.2.3.4"), 1234), "", stun.ErrNotBindingRequest},
+		{"short", []byte{0x00, 0x01, 0x00}, "", stun.ErrNotSTUN},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotTx, got, err := stun.ParseBindingRequestSoftware(tt.data)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v; want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if gotTx != tx {
+				t.Errorf("txID = %x; want %x", gotTx, tx)
+			}
+			if got != tt.want {
+				t.Errorf("software = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestChange(t *testing.T) {
+	tx := stun.NewTxID()
+	tests := []struct {
+		changeIP, changePort bool
+		flags                byte
+	}{
+		{false, false, 0x00},
+		{false, true, 0x02},
+		{true, false, 0x04},
+		{true, true, 0x06},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("ip=%v,port=%v", tt.changeIP, tt.changePort), func(t *testing.T) {
+			req := stun.RequestChange(tx, tt.changeIP, tt.changePort)
+			// Header, SOFTWARE "tailnode", then CHANGE-REQUEST.
+			const off = 20 + 4 + 8
+			want := []byte{0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x00, tt.flags}
+			if got := req[off : off+8]; !bytes.Equal(got, want) {
+				t.Errorf("CHANGE-REQUEST = % x; want % x", got, want)
+			}
+			gotTx, err := stun.ParseBindingRequest(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotTx != tx {
+				t.Errorf("txID = %x; want %x", gotTx, tx)
+			}
+			if _, _, err := stun.ParseBindingRequestSoftware(req); err != stun.ErrUnknownAttr {
+				t.Errorf("ParseBindingRequestSoftware err = %v; want ErrUnknownAttr", err)
+			}
+		})
+	}
+}
+
+func TestIsWithFingerprint(t *testing.T) {
+	tx := stun.NewTxID()
+	var pion []byte
+	for _, tt := range responseTests {
+		if tt.name == "in-process pion server" {
+			pion = tt.data
+		}
+	}
+	res := stun.Response(tx, net.ParseIP("1.2.3.4"), 1234)
+	withFP := stun.AppendFingerprint(stun.Response(tx, net.ParseIP("1.2.3.4"), 1234))
+	corrupt := append([]byte(nil), withFP...)
+	corrupt[len(corrupt)-1] ^= 1
+
+	tests := []struct {
+		name string
+		in   []byte
+		want bool
+	}{
+		{"pion-vector", pion, true},
+		{"request", stun.Request(tx), true},
+		{"response-without-fingerprint", res, false},
+		{"response-with-fingerprint", withFP, true},
+		{"corrupt-fingerprint", corrupt, false},
+		{"not-stun", []byte("hello, world"), false},
+	}
+	for _, tt := range tests {
+		if got := stun.IsWithFingerprint(tt.in); got != tt.want {
+			t.Errorf("%s: IsWithFingerprint = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, addr, port, err := stun.ParseResponse(withFP); err != nil || !net.IP(addr).Equal(net.ParseIP("1.2.3.4")) || port != 1234 {
+		t.Errorf("ParseResponse with fingerprint = %v, %v, %v", addr, port, err)
+	}
+}
+
+func TestMalformedAttribute(t *testing.T) {
+	tx := stun.NewTxID()
+	msg := func(attrs ...byte) []byte {
+		b := []byte{0x01, 0x01, byte(len(attrs) >> 8), byte(len(attrs)), 0x21, 0x12, 0xa4, 0x42}
+		b = append(b, tx[:]...)
+		return append(b, attrs...)
+	}
+	tests := []struct {
+		name       string
+		data       []byte
+		wantType   uint16
+		wantOffset int
+	}{
+		{
+			name:       "length-past-end",
+			data:       msg(0x00, 0x20, 0x01, 0x00, 0x00, 0x01, 0xc7, 0x86),
+			wantType:   0x0020,
+			wantOffset: 0,
+		},
+		{
+			name: "missing-padding",
+			data: msg(
+				0x80, 0x22, 0x00, 0x04, 't', 'e', 's', 't',
+				0x80, 0x22, 0x00, 0x05, 't', 'e', 's', 't'),
+			wantType:   0x8022,
+			wantOffset: 8,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := stun.ParseResponse(tt.data)
+			var ma *stun.ErrMalformedAttribute
+			if !errors.As(err, &ma) {
+				t.Fatalf("err = %v; want ErrMalformedAttribute", err)
+			}
+			if ma.Type != tt.wantType || ma.Offset != tt.wantOffset {
+				t.Errorf("attribute 0x%04x at offset %d; want 0x%04x at %d", ma.Type, ma.Offset, tt.wantType, tt.wantOffset)
+			}
+			if !errors.Is(err, stun.ErrMalformedAttrs) {
+				t.Errorf("errors.Is(%v, ErrMalformedAttrs) = false", err)
+			}
+		})
+	}
+}
+
+// TestParseMalformed feeds the parsers random, truncated and
+// corrupted messages, which must produce errors rather than panics.
+func TestParseMalformed(t *testing.T) {
+	tx := stun.NewTxID()
+	valid := [][]byte{
+		stun.Request(tx),
+		stun.Response(tx, net.ParseIP("1.2.3.4"), 1234),
+		stun.ResponseWithSoftware(tx, net.ParseIP("1::4"), 1234, "odd-length"),
+		stun.AppendFingerprint(stun.Response(tx, net.ParseIP("1.2.3.4"), 1234)),
+	}
+	for _, tt := range responseTests {
+		valid = append(valid, tt.data)
+	}
+
+	var inputs [][]byte
+	for _, b := range valid {
+		// Every truncation.
+		for n := 0; n < len(b); n++ {
+			inputs = append(inputs, b[:n])
+		}
+		// Every message and attribute length, set to a few bogus
+		// values, and every byte flipped.
+		for i := 2; i+1 < len(b); i += 2 {
+			for _, v := range []uint16{0, 1, 3, 5, 0x7fff, 0xffff} {
+				c := append([]byte(nil), b...)
+				binary.BigEndian.PutUint16(c[i:], v)
+				inputs = append(inputs, c)
+			}
+		}
+		for i := range b {
+			c := append([]byte(nil), b...)
+			c[i] ^= 0xff
+			inputs = append(inputs, c)
+		}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		b := make([]byte, 20+rnd.Intn(64))
+		rnd.Read(b)
+		// Mostly look like STUN, to get past the header checks.
+		if i%8 != 0 {
+			b[0] &= 0x01
+			copy(b[4:8], "\x21\x12\xa4\x42")
+			binary.BigEndian.PutUint16(b[2:4], uint16(rnd.Intn(len(b)-20+8))&^3)
+		}
+		inputs = append(inputs, b)
+	}
+
+	known := []error{
+		stun.ErrNotSTUN,
+		stun.ErrNotSuccessResponse,
+		stun.ErrMalformedAttrs,
+		stun.ErrNoMappedAddress,
+		stun.ErrNotErrorResponse,
+		stun.ErrNoErrorCode,
+		stun.ErrNoOtherAddress,
+		stun.ErrNotBindingRequest,
+		stun.ErrWrongSoftware,
+		stun.ErrNoFingerprint,
+		stun.ErrWrongFingerprint,
+		stun.ErrUnknownAttr,
+	}
+	check := func(fn string, b []byte, err error) {
+		t.Helper()
+		if err == nil {
+			return
+		}
+		for _, k := range known {
+			if errors.Is(err, k) {
+				return
+			}
+		}
+		t.Errorf("%s(%x): unexpected error %v", fn, b, err)
+	}
+	for _, b := range inputs {
+		stun.Is(b)
+		stun.IsWithFingerprint(b)
+		_, _, _, err := stun.ParseResponse(b)
+		check("ParseResponse", b, err)
+		_, err = stun.ParseResponseAddrs(b)
+		check("ParseResponseAddrs", b, err)
+		_, _, err = stun.ParseOtherAddress(b)
+		check("ParseOtherAddress", b, err)
+		_, _, err = stun.ParseError(b)
+		check("ParseError", b, err)
+		_, err = stun.ParseBindingRequest(b)
+		check("ParseBindingRequest", b, err)
+		_, _, err = stun.ParseBindingRequestSoftware(b)
+		check("ParseBindingRequestSoftware", b, err)
+		_, err = stun.Software(b)
+		check("Software", b, err)
+	}
+}
+
+// rfc5769Password is the short-term password of the RFC 5769 test
+// vectors below.
+const rfc5769Password = "VOkJxbRl1RmTxUk/WvJxBt"
+
+// rfc5769Request is the sample request of RFC 5769 section 2.1.
+var rfc5769Request = []byte{
+	0x00, 0x01, 0x00, 0x58, // request type and message length
+	0x21, 0x12, 0xa4, 0x42, // magic cookie
+	0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae, // transaction ID
+	0x80, 0x22, 0x00, 0x10, // SOFTWARE
+	0x53, 0x54, 0x55, 0x4e, 0x20, 0x74, 0x65, 0x73, 0x74, 0x20, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74,
+	0x00, 0x24, 0x00, 0x04, // PRIORITY
+	0x6e, 0x00, 0x01, 0xff,
+	0x80, 0x29, 0x00, 0x08, // ICE-CONTROLLED
+	0x93, 0x2f, 0xf9, 0xb1, 0x51, 0x26, 0x3b, 0x36,
+	0x00, 0x06, 0x00, 0x09, // USERNAME, padded with spaces
+	0x65, 0x76, 0x74, 0x6a, 0x3a, 0x68, 0x36, 0x76, 0x59, 0x20, 0x20, 0x20,
+	0x00, 0x08, 0x00, 0x14, // MESSAGE-INTEGRITY
+	0x9a, 0xea, 0xa7, 0x0c, 0xbf, 0xd8, 0xcb, 0x56, 0x78, 0x1e,
+	0xf2, 0xb5, 0xb2, 0xd3, 0xf2, 0x49, 0xc1, 0xb5, 0x71, 0xa2,
+	0x80, 0x28, 0x00, 0x04, // FINGERPRINT
+	0xe5, 0x7a, 0x3b, 0xcf,
+}
+
+// rfc5769Response is the sample IPv4 response of RFC 5769 section
+// 2.2, mapping 192.0.2.1:32853.
+var rfc5769Response = []byte{
+	0x01, 0x01, 0x00, 0x3c, // response type and message length
+	0x21, 0x12, 0xa4, 0x42, // magic cookie
+	0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae, // transaction ID
+	0x80, 0x22, 0x00, 0x0b, // SOFTWARE
+	0x74, 0x65, 0x73, 0x74, 0x20, 0x76, 0x65, 0x63, 0x74, 0x6f, 0x72, 0x20,
+	0x00, 0x20, 0x00, 0x08, // XOR-MAPPED-ADDRESS
+	0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43,
+	0x00, 0x08, 0x00, 0x14, // MESSAGE-INTEGRITY
+	0x2b, 0x91, 0xf5, 0x99, 0xfd, 0x9e, 0x90, 0xc3, 0x8c, 0x74,
+	0x89, 0xf9, 0x2a, 0xf9, 0xba, 0x53, 0xf0, 0x6b, 0xe7, 0xd7,
+	0x80, 0x28, 0x00, 0x04, // FINGERPRINT
+	0xc0, 0x7d, 0x4c, 0x96,
+}
+
+func TestMessageIntegrityRFC5769(t *testing.T) {
+	key := stun.ShortTermKey(rfc5769Password)
+	for _, tt := range []struct {
+		name string
+		msg  []byte
+	}{
+		{"request", rfc5769Request},
+		{"response", rfc5769Response},
+	} {
+		if !stun.IsWithFingerprint(tt.msg) {
+			t.Fatalf("%s: bad test vector fingerprint", tt.name)
+		}
+		if err := stun.VerifyMessageIntegrity(tt.msg, key); err != nil {
+			t.Errorf("%s: VerifyMessageIntegrity = %v", tt.name, err)
+		}
+		if err := stun.VerifyMessageIntegrity(tt.msg, stun.ShortTermKey("wrong")); err != stun.ErrWrongMessageIntegrity {
+			t.Errorf("%s: with wrong key, err = %v; want %v", tt.name, err, stun.ErrWrongMessageIntegrity)
+		}
+
+		// Rebuild the message from the attributes before
+		// MESSAGE-INTEGRITY, with a wrong length in the header.
+		const lenIntegrityAndFP = 24 + 8
+		b := append([]byte(nil), tt.msg[:len(tt.msg)-lenIntegrityAndFP]...)
+		binary.BigEndian.PutUint16(b[2:4], 0)
+		b = stun.AppendFingerprint(stun.AppendMessageIntegrity(b, key))
+		if !bytes.Equal(b, tt.msg) {
+			t.Errorf("%s: rebuilt message\n%x\nwant\n%x", tt.name, b, tt.msg)
+		}
+	}
+
+	if _, addr, port, err := stun.ParseResponse(rfc5769Response); err != nil || !net.IP(addr).Equal(net.ParseIP("192.0.2.1")) || port != 32853 {
+		t.Errorf("ParseResponse = %v, %d, %v; want 192.0.2.1, 32853", net.IP(addr), port, err)
+	}
+}
+
+func TestMessageIntegrityErrors(t *testing.T) {
+	key := stun.LongTermKey("user", "realm", "pass")
+	req := stun.RequestWithCredentials(stun.NewTxID(), "user", key)
+	if err := stun.VerifyMessageIntegrity(req, key); err != nil {
+		t.Fatalf("RequestWithCredentials: %v", err)
+	}
+	if !stun.IsWithFingerprint(req) {
+		t.Error("RequestWithCredentials has bad fingerprint")
+	}
+	if _, sw, err := stun.ParseBindingRequestSoftware(req); err != nil || sw != "tailnode" {
+		t.Errorf("ParseBindingRequestSoftware = %q, %v", sw, err)
+	}
+
+	tampered := append([]byte(nil), req...)
+	tampered[20+4] ^= 1 // in the SOFTWARE value, after the header
+	if err := stun.VerifyMessageIntegrity(tampered, key); err != stun.ErrWrongMessageIntegrity {
+		t.Errorf("tampered: err = %v; want %v", err, stun.ErrWrongMessageIntegrity)
+	}
+
+	if err := stun.VerifyMessageIntegrity(stun.Request(stun.NewTxID()), key); err != stun.ErrNoMessageIntegrity {
+		t.Errorf("no MESSAGE-INTEGRITY: err = %v; want %v", err, stun.ErrNoMessageIntegrity)
+	}
+
+	// Only FINGERPRINT may follow MESSAGE-INTEGRITY.
+	b := stun.Request(stun.NewTxID())
+	b = b[:len(b)-8] // drop FINGERPRINT
+	b = stun.AppendMessageIntegrity(b, key)
+	b = append(b, 0x80, 0x22, 0x00, 0x04, 'a', 'b', 'c', 'd') // another SOFTWARE
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-20))
+	if err := stun.VerifyMessageIntegrity(b, key); !errors.Is(err, stun.ErrMalformedAttrs) {
+		t.Errorf("attribute after MESSAGE-INTEGRITY: err = %v; want %v", err, stun.ErrMalformedAttrs)
+	}
+}
@@ -49,6 +49,54 @@ type Stunner struct {
 	// If false, only IPv4 is used. There is currently no mixed mode.
 	OnlyIPv6 bool
 
+	// MaxTries optionally specifies how many binding requests are
+	// sent to each server before giving up on it.
+	// If zero, a default schedule of retries is used.
+	MaxTries int
+
+	// RetryInterval optionally specifies how long to wait for a
+	// response to the first binding request sent to a server.
+	// Each subsequent retry waits twice as long as the previous
+	// one, up to maxRetryInterval.
+	// If zero, a default schedule of retries is used.
+	RetryInterval time.Duration
+
+	// Timeout optionally bounds how long to wait for a server to
+	// respond, across all retries. When it expires, the server is
+	// treated as having failed, even if retries remain.
+	// If zero, only the retry schedule limits the wait.
+	Timeout time.Duration
+
+	// MaxConcurrency optionally limits how many servers are queried
+	// at once. Servers beyond the limit wait for an earlier query to
+	// finish. If zero or negative, all servers are queried at once.
+	MaxConcurrency int
+
+	// Failure optionally specifies a func to be called when a
+	// server has not responded after all retries.
+	Failure func(server string)
+
+	// Rejected optionally specifies a func to be called when a STUN
+	// response is discarded because it doesn't answer an outstanding
+	// request to the address it came from, as with a spoofed, stale
+	// or duplicate response.
+	Rejected func(fromAddr *net.UDPAddr)
+
+	// MaxInFlight optionally limits how many outstanding requests'
+	// transaction IDs are remembered, so a flood of requests can't
+	// grow memory use without bound. When the limit is reached, the
+	// oldest request is forgotten to make room, and a response to
+	// it is then rejected. If zero or negative, DefaultMaxInFlight
+	// is used.
+	MaxInFlight int
+
+	// Dropped optionally specifies a func to be called when an
+	// outstanding request to server is forgotten because
+	// MaxInFlight was reached.
+	Dropped func(server string)
+
+	now func() time.Time // if nil, time.Now; for tests
+
 	// sessions tracks the state of each server.
 	// It's keyed by the STUN server (from the Servers field).
 	sessions map[string]*session
@@ -57,26 +105,94 @@ type Stunner struct {
 	inFlight map[stun.TxID]request
 }
 
-func (s *Stunner) addTX(tx stun.TxID, server string) {
+// DefaultMaxInFlight is the default Stunner.MaxInFlight. It's far
+// more than the requests outstanding to a handful of servers, even
+// with retries.
+const DefaultMaxInFlight = 256
+
+func (s *Stunner) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// addTX records an outstanding request with transaction ID tx to
+// server at addr. Requests that have expired are forgotten, as is
+// the oldest one if there are still MaxInFlight outstanding.
+func (s *Stunner) addTX(tx stun.TxID, server string, addr *net.UDPAddr) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	now := s.timeNow()
 	if s.inFlight == nil {
 		s.inFlight = make(map[stun.TxID]request)
 	}
-	s.inFlight[tx] = request{sent: time.Now(), server: server}
+	expiry := s.txExpiry()
+	var oldest stun.TxID
+	var oldestSent time.Time
+	for tx, r := range s.inFlight {
+		if now.Sub(r.sent) > expiry {
+			delete(s.inFlight, tx)
+			continue
+		}
+		if oldestSent.IsZero() || r.sent.Before(oldestSent) {
+			oldest, oldestSent = tx, r.sent
+		}
+	}
+	max := s.MaxInFlight
+	if max <= 0 {
+		max = DefaultMaxInFlight
+	}
+	var dropped string // server of the forgotten request, if any
+	if len(s.inFlight) >= max {
+		dropped = s.inFlight[oldest].server
+		delete(s.inFlight, oldest)
+	}
+	s.inFlight[tx] = request{sent: now, server: server, addr: addr}
+	s.mu.Unlock()
+
+	if dropped != "" {
+		s.logf("stunner: too many outstanding requests; forgot one to %s", dropped)
+		if s.Dropped != nil {
+			s.Dropped(dropped)
+		}
+	}
 }
 
-func (s *Stunner) removeTX(tx stun.TxID) (request, bool) {
+// removeTX removes and returns the outstanding request with
+// transaction ID tx, if it was sent to addr.
+func (s *Stunner) removeTX(tx stun.TxID, addr *net.UDPAddr) (request, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	r, ok := s.inFlight[tx]
+	if !ok || s.timeNow().Sub(r.sent) > s.txExpiry() {
+		return request{}, false
+	}
+	if !r.addr.IP.Equal(addr.IP) || r.addr.Port != addr.Port {
+		// Possibly spoofed. Leave the request outstanding for
+		// the real server's response.
+		return request{}, false
+	}
 	delete(s.inFlight, tx)
-	return r, ok
+	return r, true
+}
+
+// txExpiry returns how long a request's transaction ID is accepted
+// in a response.
+func (s *Stunner) txExpiry() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	var d time.Duration
+	for _, rd := range s.retryDurations() {
+		d += rd
+	}
+	return d
 }
 
 type request struct {
 	sent   time.Time
 	server string
+	addr   *net.UDPAddr // where the request was sent
 }
 
 type session struct {
@@ -96,15 +212,18 @@ func (s *Stunner) Receive(p []byte, fromAddr *net.UDPAddr) {
 		s.logf("stunner: received non-STUN packet")
 		return
 	}
-	now := time.Now()
+	now := s.timeNow()
 	tx, addr, port, err := stun.ParseResponse(p)
 	if err != nil {
 		s.logf("stunner: received bad STUN response: %v", err)
 		return
 	}
-	r, ok := s.removeTX(tx)
+	r, ok := s.removeTX(tx, fromAddr)
 	if !ok {
-		s.logf("stunner: got STUN packet for unknown TxID %x", tx)
+		s.logf("stunner: rejected unsolicited STUN response from %v, TxID %x", fromAddr, tx)
+		if s.Rejected != nil {
+			s.Rejected(fromAddr)
+		}
 		return
 	}
 	d := now.Sub(r.sent)
@@ -127,6 +246,10 @@ func (s *Stunner) resolver() *net.Resolver {
 // Run starts a Stunner and blocks until all servers either respond
 // or are tried multiple times and timeout.
 //
+// Servers are queried concurrently, and Endpoint is called for each
+// response as it arrives, so a slow server doesn't delay results
+// from faster ones. Canceling ctx abandons all outstanding queries.
+//
 // TODO: this always returns success now. It should return errors
 // if certain servers are unavailable probably. Or if all are.
 // Or some configured threshold are.
@@ -141,11 +264,23 @@ func (s *Stunner) Run(ctx context.Context) error {
 	}
 	// after this point, the s.sessions map is read-only
 
+	var sem chan struct{} // limits concurrent queries, if non-nil
+	if s.MaxConcurrency > 0 {
+		sem = make(chan struct{}, s.MaxConcurrency)
+	}
 	var wg sync.WaitGroup
 	for _, server := range s.Servers {
 		wg.Add(1)
 		go func(server string) {
 			defer wg.Done()
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					return
+				}
+			}
 			s.runServer(ctx, server)
 		}(server)
 	}
@@ -157,7 +292,16 @@ func (s *Stunner) Run(ctx context.Context) error {
 func (s *Stunner) runServer(ctx context.Context, server string) {
 	session := s.sessions[server]
 
-	for i, d := range retryDurations {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	for i, d := range s.retryDurations() {
+		if ctx.Err() != nil {
+			break
+		}
 		ctx, cancel := context.WithTimeout(ctx, d)
 		err := s.sendSTUN(ctx, server)
 		if err != nil {
@@ -176,6 +320,9 @@ func (s *Stunner) runServer(ctx context.Context, server string) {
 		}
 	}
 	s.logf("stunner: no STUN response from %s", server)
+	if s.Failure != nil {
+		s.Failure(server)
+	}
 }
 
 func (s *Stunner) sendSTUN(ctx context.Context, server string) error {
@@ -218,7 +365,7 @@ func (s *Stunner) sendSTUN(ctx context.Context, server string) error {
 
 	txID := stun.NewTxID()
 	req := stun.Request(txID)
-	s.addTX(txID, server)
+	s.addTX(txID, server, addr)
 	_, err = s.Send(req, addr)
 	if err != nil {
 		return fmt.Errorf("send: %v", err)
@@ -226,6 +373,35 @@ func (s *Stunner) sendSTUN(ctx context.Context, server string) error {
 	return nil
 }
 
+// retryDurations returns how long to wait for a response to each
+// binding request sent to a server.
+func (s *Stunner) retryDurations() []time.Duration {
+	if s.MaxTries == 0 && s.RetryInterval == 0 {
+		return retryDurations
+	}
+	n := s.MaxTries
+	if n <= 0 {
+		n = len(retryDurations)
+	}
+	d := s.RetryInterval
+	if d <= 0 {
+		d = retryDurations[0]
+	}
+	ret := make([]time.Duration, n)
+	for i := range ret {
+		ret[i] = d
+		d *= 2
+		if d > maxRetryInterval {
+			d = maxRetryInterval
+		}
+	}
+	return ret
+}
+
+// maxRetryInterval is the longest a Stunner waits for a response to
+// a single binding request.
+const maxRetryInterval = 3200 * time.Millisecond
+
 var retryDurations = []time.Duration{
 	100 * time.Millisecond,
 	100 * time.Millisecond,
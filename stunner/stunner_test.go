@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"gortc.io/stun"
+	tsstun "tailscale.com/stun"
 )
 
 func TestStun(t *testing.T) {
@@ -92,7 +93,7 @@ func startSTUNDrop1(conn net.PacketConn, writeTo func([]byte, *net.UDPAddr)) err
 	res := new(stun.Message)
 
 	p := make([]byte, 1024)
-	n, addr, err := conn.ReadFrom(p)
+	n, _, err := conn.ReadFrom(p)
 	if err != nil {
 		return err
 	}
@@ -112,7 +113,9 @@ func startSTUNDrop1(conn net.PacketConn, writeTo func([]byte, *net.UDPAddr)) err
 	if err != nil {
 		return err
 	}
-	writeTo(res.Raw, addr.(*net.UDPAddr))
+	// Deliver the response as if it were read from our socket,
+	// having come from the server.
+	writeTo(res.Raw, conn.LocalAddr().(*net.UDPAddr))
 	return nil
 }
 
@@ -121,7 +124,7 @@ func startSTUN(conn net.PacketConn, writeTo func([]byte, *net.UDPAddr)) error {
 	res := new(stun.Message)
 
 	p := make([]byte, 1024)
-	n, addr, err := conn.ReadFrom(p)
+	n, _, err := conn.ReadFrom(p)
 	if err != nil {
 		return err
 	}
@@ -141,10 +144,106 @@ func startSTUN(conn net.PacketConn, writeTo func([]byte, *net.UDPAddr)) error {
 	if err != nil {
 		return err
 	}
-	writeTo(res.Raw, addr.(*net.UDPAddr))
+	// Deliver the response as if it were read from our socket,
+	// having come from the server.
+	writeTo(res.Raw, conn.LocalAddr().(*net.UDPAddr))
 	return nil
 }
 
+func TestReceiveRejectsUnsolicited(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var eps []string
+	var rejected int
+	s := &Stunner{
+		Endpoint: func(server, ep string, d time.Duration) { eps = append(eps, ep) },
+		Rejected: func(*net.UDPAddr) { rejected++ },
+		sessions: map[string]*session{"server": {ctx: ctx, cancel: cancel}},
+	}
+	server := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3478}
+	spoofer := &net.UDPAddr{IP: net.ParseIP("192.0.2.66"), Port: 3478}
+	tx := tsstun.NewTxID()
+	s.addTX(tx, "server", server)
+	res := tsstun.Response(tx, net.ParseIP("1.2.3.4"), 1234)
+
+	unknown := tsstun.Response(tsstun.NewTxID(), net.ParseIP("6.6.6.6"), 666)
+
+	s.Receive(res, spoofer)    // right TxID, wrong source
+	s.Receive(unknown, server) // unknown TxID
+	s.Receive(res, server)     // the real response
+	s.Receive(res, server)     // a replay
+
+	if want := []string{"1.2.3.4:1234"}; fmt.Sprint(eps) != fmt.Sprint(want) {
+		t.Errorf("endpoints = %q; want %q", eps, want)
+	}
+	if rejected != 3 {
+		t.Errorf("rejected = %d; want 3", rejected)
+	}
+}
+
+func TestInFlightBounded(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	var dropped int
+	s := &Stunner{
+		MaxInFlight: 10,
+		Timeout:     5 * time.Second,
+		Dropped:     func(string) { dropped++ },
+		now:         func() time.Time { return now },
+	}
+	server := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 3478}
+
+	var txs []tsstun.TxID
+	for i := 0; i < 100; i++ {
+		tx := tsstun.NewTxID()
+		txs = append(txs, tx)
+		s.addTX(tx, "server", server)
+		now = now.Add(time.Millisecond)
+		if n := len(s.inFlight); n > s.MaxInFlight {
+			t.Fatalf("after %d requests, %d in flight; want at most %d", i+1, n, s.MaxInFlight)
+		}
+	}
+	if dropped != 90 {
+		t.Errorf("dropped = %d; want 90", dropped)
+	}
+	// The newest are kept and the oldest forgotten.
+	if _, ok := s.inFlight[txs[99]]; !ok {
+		t.Error("newest request forgotten")
+	}
+	if _, ok := s.inFlight[txs[0]]; ok {
+		t.Error("oldest request kept")
+	}
+
+	// Once they expire, they're reaped on the next request.
+	now = now.Add(s.Timeout + time.Second)
+	s.addTX(tsstun.NewTxID(), "server", server)
+	if n := len(s.inFlight); n != 1 {
+		t.Errorf("after expiry, %d in flight; want 1", n)
+	}
+	if dropped != 90 {
+		t.Errorf("expired requests counted as dropped: dropped = %d; want 90", dropped)
+	}
+}
+
 // TODO: test retry timeout (overwrite the retryDurations)
 // TODO: test canceling context passed to Run
 // TODO: test sending bad packets
+
+func TestRetryDurations(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		s    *Stunner
+		want []time.Duration
+	}{
+		{"default", &Stunner{}, retryDurations},
+		{"tries", &Stunner{MaxTries: 3}, []time.Duration{100 * ms, 200 * ms, 400 * ms}},
+		{"interval", &Stunner{MaxTries: 2, RetryInterval: 50 * ms}, []time.Duration{50 * ms, 100 * ms}},
+		{"capped", &Stunner{MaxTries: 4, RetryInterval: 2 * time.Second}, []time.Duration{2 * time.Second, maxRetryInterval, maxRetryInterval, maxRetryInterval}},
+	}
+	for _, tt := range tests {
+		got := tt.s.retryDurations()
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// AccessLogRecord is a record of one HTTP request served by a
+// handler wrapped with AccessLogHandler.
+type AccessLogRecord struct {
+	When       time.Time     `json:"when"`
+	Method     string        `json:"method"`
+	RequestURI string        `json:"request_uri"`
+	RemoteIP   string        `json:"remote_ip"`
+	Code       int           `json:"code"`  // HTTP status code; 0 if the connection was hijacked
+	Bytes      int64         `json:"bytes"` // response body bytes written
+	Duration   time.Duration `json:"duration_ns"`
+	RequestID  string        `json:"request_id,omitempty"` // from RequestIDHandler, if used
+}
+
+// String returns r formatted as a single access log line.
+func (r AccessLogRecord) String() string {
+	if r.RequestID != "" {
+		return fmt.Sprintf("http: [%s] %s %s %s %d %dB %v", r.RequestID, r.RemoteIP, r.Method, r.RequestURI, r.Code, r.Bytes, r.Duration.Round(time.Microsecond))
+	}
+	return fmt.Sprintf("http: %s %s %s %d %dB %v", r.RemoteIP, r.Method, r.RequestURI, r.Code, r.Bytes, r.Duration.Round(time.Microsecond))
+}
+
+// LogHandler returns an http.Handler that serves requests with h and
+// logs each one to logf as formatted by AccessLogRecord.String.
+func LogHandler(h http.Handler, logf logger.Logf) http.Handler {
+	return AccessLogHandler(h, func(r AccessLogRecord) { logf("%s", r) })
+}
+
+// AccessLogHandler returns an http.Handler that serves requests with
+// h and then calls log with a record of each one. It lets callers
+// choose their own log format, such as JSON.
+func AccessLogHandler(h http.Handler, log func(AccessLogRecord)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := AccessLogRecord{
+			When:       time.Now(),
+			Method:     r.Method,
+			RequestURI: r.RequestURI,
+			RemoteIP:   remoteIP(r),
+		}
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+		if lw.code == 0 && !lw.hijacked {
+			// The handler wrote nothing, so net/http sends a 200.
+			lw.code = http.StatusOK
+		}
+		rec.Code = lw.code
+		rec.Bytes = lw.bytes
+		rec.Duration = time.Since(rec.When)
+		rec.RequestID = RequestID(r.Context())
+		if rec.RequestID == "" {
+			// RequestIDHandler, if any, is inside h.
+			rec.RequestID = lw.Header().Get(RequestIDHeader)
+		}
+		log(rec)
+	})
+}
+
+// remoteIP returns the IP address of r's client, without the port.
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// loggingResponseWriter wraps an http.ResponseWriter to record the
+// status code and number of bytes written. It passes through
+// http.Flusher and http.Hijacker so streaming and WebSocket-style
+// handlers keep working.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	code     int
+	bytes    int64
+	hijacked bool
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.code == 0 {
+			w.code = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("tsweb: ResponseWriter does not implement http.Hijacker")
+	}
+	c, rw, err := hj.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return c, rw, err
+}
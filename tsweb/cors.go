@@ -0,0 +1,43 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import "net/http"
+
+// AllowCORS wraps h to permit cross-origin requests from browser
+// pages on allowedOrigins, such as "https://dash.example.com".
+// Requests with any other Origin get no CORS headers, so browsers
+// keep enforcing the same-origin policy for them.
+//
+// AllowCORS answers CORS preflight requests itself. It doesn't
+// grant access to anything on its own: to expose a debug handler,
+// wrap the Protected handler, as in AllowCORS(Protected(h), origins),
+// so AllowDebugAccess still applies to the actual requests.
+func AllowCORS(h http.Handler, allowedOrigins []string) http.Handler {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, o := range allowedOrigins {
+		allowed[o] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		ok := origin != "" && allowed[origin]
+		w.Header().Add("Vary", "Origin")
+		if ok {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if ok {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+				if hdrs := r.Header.Get("Access-Control-Request-Headers"); hdrs != "" {
+					w.Header().Set("Access-Control-Allow-Headers", hdrs)
+				}
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
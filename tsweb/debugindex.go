@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"sync"
+)
+
+type browserLink struct {
+	title, url string
+}
+
+var (
+	browserLinksMu sync.Mutex
+	browserLinks   []browserLink
+
+	registeredVersionMu sync.Mutex
+	registeredVersion   string // as passed to RegisterVersion, after defaults
+	registeredCommit    string
+)
+
+// AddBrowserLink adds a link to url, shown as title, to the debug
+// index page served by NewMux when it's given no debug handler.
+func AddBrowserLink(title, url string) {
+	browserLinksMu.Lock()
+	defer browserLinksMu.Unlock()
+	browserLinks = append(browserLinks, browserLink{title, url})
+}
+
+// debugIndexLinks are the links on every debug index page, to the
+// handlers registered by NewMux and RegisterHealthHandler.
+var debugIndexLinks = []browserLink{
+	{"/debug/pprof/", "/debug/pprof/"},
+	{"/debug/vars", "/debug/vars"},
+	{"/debug/vars.json", "/debug/vars.json"},
+	{"/debug/varz", "/debug/varz"},
+	{"/healthz", "/healthz"},
+}
+
+// debugIndex serves an HTML page at /debug/ linking to the debug
+// handlers and any added with AddBrowserLink. Other paths under
+// /debug/ get a 404.
+func debugIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/debug/" {
+		http.NotFound(w, r)
+		return
+	}
+	browserLinksMu.Lock()
+	links := append(append([]browserLink(nil), debugIndexLinks...), browserLinks...)
+	browserLinksMu.Unlock()
+	registeredVersionMu.Lock()
+	version, commit := registeredVersion, registeredCommit
+	registeredVersionMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	f := func(format string, args ...interface{}) { fmt.Fprintf(w, format, args...) }
+	f("<html><body>\n<h1>Debug</h1>\n<ul>\n")
+	f("<li><b>Uptime:</b> %v</li>\n", Uptime())
+	if version != "" {
+		f("<li><b>Version:</b> %s", html.EscapeString(version))
+		if commit != "" {
+			f(" (%s)", html.EscapeString(commit))
+		}
+		f("</li>\n")
+	}
+	f("</ul>\n<ul>\n")
+	for _, l := range links {
+		f("<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(l.url), html.EscapeString(l.title))
+	}
+	f("</ul>\n</body></html>\n")
+}
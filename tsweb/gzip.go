@@ -0,0 +1,135 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipMinSize is the smallest response body Gzip compresses.
+// Anything shorter fits in a packet or two anyway, and gzip's
+// framing overhead would eat most of the savings.
+const gzipMinSize = 1024
+
+// Gzip wraps h to gzip its responses for clients that send
+// "Accept-Encoding: gzip". Responses smaller than a kilobyte, and
+// responses h has already encoded itself, are sent as is.
+//
+// Flushing the response, as streaming handlers do, flushes the
+// compressed data written so far through to the client.
+func Gzip(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.finish()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether r's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		f := strings.Split(enc, ";")
+		if strings.TrimSpace(f[0]) != "gzip" {
+			continue
+		}
+		if len(f) > 1 && strings.ReplaceAll(f[1], " ", "") == "q=0" {
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the start of a response until it knows
+// whether the response is big enough to compress.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	code  int          // status passed to WriteHeader, or 0
+	buf   []byte       // body buffered while undecided
+	gz    *gzip.Writer // non-nil once compressing
+	plain bool         // decided not to compress
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	switch {
+	case w.gz != nil:
+		return w.gz.Write(p)
+	case w.plain:
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < gzipMinSize {
+		return len(p), nil
+	}
+	if err := w.start(true); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// start sends the response header and any buffered body, compressed
+// if compress is true and h didn't set its own Content-Encoding.
+func (w *gzipResponseWriter) start(compress bool) error {
+	hdr := w.Header()
+	if hdr.Get("Content-Encoding") != "" {
+		compress = false
+	}
+	if compress {
+		if hdr.Get("Content-Type") == "" {
+			// Sniff from the uncompressed bytes, as net/http would.
+			hdr.Set("Content-Type", http.DetectContentType(w.buf))
+		}
+		hdr.Set("Content-Encoding", "gzip")
+		hdr.Del("Content-Length")
+	}
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+	buf := w.buf
+	w.buf = nil
+	if !compress {
+		w.plain = true
+		_, err := w.ResponseWriter.Write(buf)
+		return err
+	}
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	_, err := w.gz.Write(buf)
+	return err
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz == nil && !w.plain {
+		w.start(true)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish completes the response once the wrapped handler returns.
+func (w *gzipResponseWriter) finish() {
+	switch {
+	case w.gz != nil:
+		w.gz.Close()
+	case !w.plain:
+		w.start(false)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A HealthCheck is a named check of some part of a server.
+// Check returns nil if that part is healthy.
+type HealthCheck struct {
+	Name  string
+	Check func() error
+}
+
+// RegisterHealthHandler registers a handler at /healthz on mux that
+// runs checks on each request, for use as a liveness or readiness
+// probe.
+//
+// If all checks pass, it replies 200 with "ok". Otherwise it replies
+// 503 with "unhealthy", followed by the names and errors of the
+// failing checks if the request passes AllowDebugAccess.
+func RegisterHealthHandler(mux *http.ServeMux, checks ...HealthCheck) {
+	mux.Handle("/healthz", healthHandler(checks))
+}
+
+func healthHandler(checks []HealthCheck) http.Handler {
+	checks = append([]HealthCheck(nil), checks...)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var failed []string
+		for _, c := range checks {
+			if err := c.Check(); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", c.Name, err))
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if len(failed) == 0 {
+			io.WriteString(w, "ok\n")
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "unhealthy\n")
+		if AllowDebugAccess(r) {
+			io.WriteString(w, strings.Join(failed, "\n")+"\n")
+		}
+	})
+}
+
+// StalenessCheck returns a HealthCheck that fails if the time
+// reported by last, such as when some state was last refreshed, is
+// zero or more than maxAge ago.
+func StalenessCheck(name string, last func() time.Time, maxAge time.Duration) HealthCheck {
+	return HealthCheck{
+		Name: name,
+		Check: func() error {
+			t := last()
+			if t.IsZero() {
+				return errors.New("never updated")
+			}
+			if age := time.Since(t); age > maxAge {
+				return fmt.Errorf("last updated %v ago, want within %v", age.Round(time.Second), maxAge)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxDebugBodyBytes is the largest request body the debug
+// handlers registered by NewMux may read, unless changed with
+// MaxDebugBodyBytes.
+const DefaultMaxDebugBodyBytes = 1 << 20
+
+var errBodyTooLarge = errors.New("http: request body too large")
+
+// MaxBytesHandler wraps h to limit the request bodies it reads to n
+// bytes, using http.MaxBytesReader. If h reads past the limit, the
+// client gets a 413 Request Entity Too Large reply instead of
+// whatever h responds with, unless h had already started its
+// response. A body whose Content-Length is over the limit fails on
+// its first read. Handlers that don't read the body are unaffected.
+//
+// The innermost MaxBytesHandler's limit applies, so a route that
+// needs to accept larger bodies than the rest of a mux can be
+// wrapped in its own MaxBytesHandler.
+func MaxBytesHandler(h http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		orig := r.Body
+		if mb, ok := orig.(*maxBytesBody); ok {
+			orig = mb.orig // replace the outer limit
+		}
+		body := &maxBytesBody{
+			orig:    orig,
+			rc:      http.MaxBytesReader(w, orig, n),
+			limit:   n,
+			overLen: r.ContentLength > n,
+		}
+		mw := &maxBytesResponseWriter{ResponseWriter: w, r: r, body: body}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Body = body
+		h.ServeHTTP(mw, r2)
+		mw.start()
+	})
+}
+
+// MaxDebugBodyBytes makes the debug handlers read request bodies of
+// at most n bytes instead of DefaultMaxDebugBodyBytes. Zero or
+// negative means no limit. See MaxBytesHandler.
+func MaxDebugBodyBytes(n int64) DebugOption {
+	return func(o *debugOptions) { o.maxBodyBytes = n }
+}
+
+// maxBytesBody is a request body limited by MaxBytesHandler.
+type maxBytesBody struct {
+	orig  io.ReadCloser // the body before limiting
+	rc    io.ReadCloser // orig, through http.MaxBytesReader
+	limit int64
+	read  int64 // bytes read so far
+
+	overLen  bool // the request's Content-Length is over the limit
+	tooLarge bool // the handler tried to read past the limit
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	if b.overLen {
+		b.tooLarge = true
+	}
+	if b.tooLarge {
+		return 0, errBodyTooLarge
+	}
+	n, err := b.rc.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF && b.read >= b.limit {
+		b.tooLarge = true
+	}
+	return n, err
+}
+
+func (b *maxBytesBody) Close() error { return b.rc.Close() }
+
+// maxBytesResponseWriter replaces the response with a 413 error if
+// the request body was too large when the handler starts responding.
+type maxBytesResponseWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	body     *maxBytesBody
+	started  bool // the response has started
+	replaced bool // the response is a 413; the handler's is discarded
+}
+
+// start starts the response, as the handler's unless the body was
+// too large.
+func (w *maxBytesResponseWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	if !w.body.tooLarge {
+		return
+	}
+	w.replaced = true
+	hdr := w.ResponseWriter.Header()
+	hdr.Del("Content-Length")
+	hdr.Del("Content-Encoding")
+	httpError(w.ResponseWriter, w.r, "request body too large", http.StatusRequestEntityTooLarge)
+}
+
+func (w *maxBytesResponseWriter) WriteHeader(code int) {
+	w.start()
+	if !w.replaced {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *maxBytesResponseWriter) Write(p []byte) (int, error) {
+	w.start()
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *maxBytesResponseWriter) Flush() {
+	w.start()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && !w.replaced {
+		f.Flush()
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	promContentType        = "text/plain; version=0.0.4"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// wantOpenMetrics reports whether r asks for the OpenMetrics
+// exposition format rather than Prometheus's text format, either
+// with the query parameter "format=openmetrics" or by accepting
+// application/openmetrics-text.
+func wantOpenMetrics(r *http.Request) bool {
+	if r.FormValue("format") == "openmetrics" {
+		return true
+	}
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt := strings.TrimSpace(strings.Split(a, ";")[0])
+		if mt == "application/openmetrics-text" {
+			return true
+		}
+	}
+	return false
+}
+
+// openMetricsWriter converts the Prometheus text format written to
+// it into OpenMetrics 1.0.0, so the same code decides how expvars
+// are exported in both. Call finish when done to write the
+// terminating "# EOF".
+//
+// The differences are in framing: counter samples get a "_total"
+// suffix, metrics in seconds get a UNIT line, and comments other
+// than metadata, which OpenMetrics doesn't allow, are dropped.
+type openMetricsWriter struct {
+	w   io.Writer
+	buf []byte // partial line written so far
+	err error  // first error writing to w
+
+	family string // current metric family, from its TYPE line
+	typ    string // current metric family's type
+}
+
+func (ow *openMetricsWriter) Write(p []byte) (int, error) {
+	ow.buf = append(ow.buf, p...)
+	for {
+		i := bytes.IndexByte(ow.buf, '\n')
+		if i < 0 {
+			break
+		}
+		ow.writeLine(string(ow.buf[:i]))
+		ow.buf = ow.buf[i+1:]
+	}
+	if ow.err != nil {
+		return 0, ow.err
+	}
+	return len(p), nil
+}
+
+// writeLine converts one Prometheus line, without its newline.
+func (ow *openMetricsWriter) writeLine(line string) {
+	if ow.err != nil {
+		return
+	}
+	if strings.HasPrefix(line, "#") {
+		f := strings.Fields(line)
+		if len(f) != 4 || f[1] != "TYPE" {
+			return // a comment
+		}
+		ow.family, ow.typ = f[2], f[3]
+		if ow.typ == "counter" {
+			ow.family = strings.TrimSuffix(ow.family, "_total")
+		}
+		_, ow.err = fmt.Fprintf(ow.w, "# TYPE %s %s\n", ow.family, ow.typ)
+		if ow.err == nil && strings.HasSuffix(ow.family, "_seconds") {
+			_, ow.err = fmt.Fprintf(ow.w, "# UNIT %s seconds\n", ow.family)
+		}
+		return
+	}
+	if ow.typ == "counter" {
+		name := line
+		if i := strings.IndexAny(line, "{ "); i >= 0 {
+			name = line[:i]
+		}
+		if name == ow.family {
+			line = name + "_total" + line[len(name):]
+		}
+	}
+	_, ow.err = fmt.Fprintf(ow.w, "%s\n", line)
+}
+
+// finish writes any incomplete last line and the terminating EOF.
+func (ow *openMetricsWriter) finish() error {
+	if len(ow.buf) > 0 {
+		ow.writeLine(string(ow.buf))
+		ow.buf = nil
+	}
+	if ow.err != nil {
+		return ow.err
+	}
+	_, ow.err = io.WriteString(ow.w, "# EOF\n")
+	return ow.err
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"container/list"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimitClients is how many client addresses a RateLimiter
+// tracks if MaxClients is zero.
+const DefaultRateLimitClients = 1024
+
+// RateLimiter limits the rate of requests from each client IP
+// address, using a token bucket per address. Clients over the limit
+// get a 429 Too Many Requests reply with a Retry-After header.
+//
+// The client address is determined as by AllowDebugAccess, so
+// requests through a proxy registered with SetTrustedProxies are
+// limited by their original client.
+//
+// Only the MaxClients most recently seen addresses are tracked, so
+// spoofed source addresses can't make it use unbounded memory. An
+// evicted address starts again with a full bucket.
+type RateLimiter struct {
+	Rate  float64 // requests per second allowed per client; zero or negative means no limit
+	Burst int     // requests a client may make at once; at least 1
+
+	// ExemptLoopback specifies whether requests from loopback
+	// addresses skip the limit.
+	ExemptLoopback bool
+
+	// MaxClients is how many client addresses to track.
+	// If zero, DefaultRateLimitClients is used.
+	MaxClients int
+
+	mu   sync.Mutex
+	lru  *list.List               // of *clientBucket, most recently used first
+	byIP map[string]*list.Element // client address -> its element in lru
+}
+
+type clientBucket struct {
+	ip     string
+	tokens float64
+	last   time.Time // when tokens was last updated
+}
+
+// Wrap returns a handler that serves requests with h, as long as
+// their client is within the rate limit.
+func (l *RateLimiter) Wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, ipStr, ok := requestIP(r)
+		if !ok {
+			// Key on the host alone, so each new connection from
+			// the same address doesn't get a fresh bucket.
+			ipStr = remoteIP(r)
+		}
+		if l.ExemptLoopback && ip != nil && ip.IsLoopback() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if wait := l.take(ipStr, time.Now()); wait > 0 {
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			httpError(w, r, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// take takes a token from ip's bucket at time now. It returns zero
+// if there was one, or else how long until there will be.
+func (l *RateLimiter) take(ip string, now time.Time) time.Duration {
+	if l.Rate <= 0 {
+		return 0
+	}
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucketLocked(ip, now, burst)
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// bucketLocked returns ip's bucket, marking it most recently used,
+// and creating it full if it's not tracked.
+func (l *RateLimiter) bucketLocked(ip string, now time.Time, burst float64) *clientBucket {
+	if l.lru == nil {
+		l.lru = list.New()
+		l.byIP = make(map[string]*list.Element)
+	}
+	if e, ok := l.byIP[ip]; ok {
+		l.lru.MoveToFront(e)
+		return e.Value.(*clientBucket)
+	}
+	max := l.MaxClients
+	if max <= 0 {
+		max = DefaultRateLimitClients
+	}
+	for l.lru.Len() >= max {
+		oldest := l.lru.Back()
+		delete(l.byIP, oldest.Value.(*clientBucket).ip)
+		l.lru.Remove(oldest)
+	}
+	b := &clientBucket{ip: ip, tokens: burst, last: now}
+	l.byIP[ip] = l.lru.PushFront(b)
+	return b
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"runtime/debug"
+)
+
+// httpPanics counts panics recovered by RecoverHandler.
+var httpPanics = new(expvar.Int)
+
+func init() {
+	expvar.Publish("counter_panics_total", httpPanics)
+}
+
+// RecoverHandler wraps h to recover from its panics. A panic is
+// logged with its stack trace, counted in the "counter_panics_total"
+// expvar, and, if h hadn't yet started its response, answered with
+// a 500 Internal Server Error.
+//
+// To have the 500 recorded in the access log, wrap RecoverHandler
+// in AccessLogHandler rather than the other way around.
+//
+// Panics with http.ErrAbortHandler, which net/http uses to abort a
+// response silently, aren't recovered.
+func RecoverHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			httpPanics.Add(1)
+			logf := RequestLogf(r.Context(), log.Printf)
+			logf("tsweb: %s %s: panic: %v\n%s", r.Method, r.RequestURI, p, debug.Stack())
+			if lw.code == 0 && !lw.hijacked {
+				httpError(lw, r, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(lw, r)
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"tailscale.com/types/logger"
+)
+
+// RequestIDHeader is the header carrying a request's ID, for tracing
+// it across services.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen is the longest incoming request ID accepted.
+const maxRequestIDLen = 128
+
+type requestIDKey struct{}
+
+// RequestIDHandler wraps h to give each request an ID: the one in its
+// X-Request-ID header, or a new random one if it has none or one
+// that's too long or has unusual characters, which might be
+// mangling logs. The ID is echoed in the response's X-Request-ID
+// header and stored in the request's context, for RequestID.
+//
+// Access log records from AccessLogHandler include the ID, whether
+// it wraps RequestIDHandler or is wrapped by it. So do StdHandler's
+// log lines, and those logged with the Logf from RequestLogf.
+func RequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID returns the ID of the request with context ctx, as
+// assigned by RequestIDHandler, or the empty string if it has none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestLogf returns logf with each line prefixed by the ID of the
+// request with context ctx, if it has one.
+func RequestLogf(ctx context.Context, logf logger.Logf) logger.Logf {
+	id := RequestID(ctx)
+	if id == "" {
+		return logf
+	}
+	return logger.WithPrefix(logf, "["+id+"] ")
+}
+
+// newRequestID returns a new random request ID.
+func newRequestID() string {
+	var b [12]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID reports whether id is acceptable as an incoming
+// request ID: non-empty, not too long, and of characters that are
+// safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':', c == '/', c == '+', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
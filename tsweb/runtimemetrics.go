@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"expvar"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// memStatsMaxAge is how long runtime.MemStats are reused for, since
+// reading them briefly stops the world.
+const memStatsMaxAge = time.Second
+
+// memStatsCache caches the result of a MemStats read.
+type memStatsCache struct {
+	read func(*runtime.MemStats) // runtime.ReadMemStats, except in tests
+
+	mu sync.Mutex
+	at time.Time // when ms was read; zero if never
+	ms runtime.MemStats
+}
+
+// get returns the MemStats, reading them if the last read was more
+// than memStatsMaxAge before now.
+func (c *memStatsCache) get(now time.Time) *runtime.MemStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.at.IsZero() || now.Sub(c.at) > memStatsMaxAge {
+		c.read(&c.ms)
+		c.at = now
+	}
+	ms := c.ms
+	return &ms
+}
+
+var (
+	runtimeMetricsOnce sync.Once
+	memStats           = &memStatsCache{read: runtime.ReadMemStats}
+)
+
+// RegisterRuntimeMetrics publishes expvars of the Go runtime's
+// state, such as the number of goroutines, heap size and garbage
+// collections, named so that /debug/varz exports them as Prometheus
+// gauges and counters. The memory statistics are read at most once
+// a second, however often they're scraped.
+//
+// It's safe to call more than once.
+func RegisterRuntimeMetrics() {
+	runtimeMetricsOnce.Do(func() {
+		expvar.Publish("gauge_goroutines", expvar.Func(func() interface{} { return int64(runtime.NumGoroutine()) }))
+		memStat := func(name string, f func(*runtime.MemStats) uint64) {
+			expvar.Publish(name, expvar.Func(func() interface{} {
+				return int64(f(memStats.get(time.Now())))
+			}))
+		}
+		memStat("gauge_heap_alloc_bytes", func(ms *runtime.MemStats) uint64 { return ms.HeapAlloc })
+		memStat("gauge_heap_inuse_bytes", func(ms *runtime.MemStats) uint64 { return ms.HeapInuse })
+		memStat("gauge_heap_objects", func(ms *runtime.MemStats) uint64 { return ms.HeapObjects })
+		memStat("gauge_stack_inuse_bytes", func(ms *runtime.MemStats) uint64 { return ms.StackInuse })
+		memStat("gauge_sys_bytes", func(ms *runtime.MemStats) uint64 { return ms.Sys })
+		memStat("gauge_next_gc_bytes", func(ms *runtime.MemStats) uint64 { return ms.NextGC })
+		memStat("counter_alloc_bytes_total", func(ms *runtime.MemStats) uint64 { return ms.TotalAlloc })
+		memStat("counter_mallocs_total", func(ms *runtime.MemStats) uint64 { return ms.Mallocs })
+		memStat("counter_frees_total", func(ms *runtime.MemStats) uint64 { return ms.Frees })
+		memStat("counter_gc_total", func(ms *runtime.MemStats) uint64 { return uint64(ms.NumGC) })
+		memStat("counter_gc_pause_ns_total", func(ms *runtime.MemStats) uint64 { return ms.PauseTotalNs })
+	})
+}
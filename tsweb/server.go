@@ -0,0 +1,127 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// DefaultGracePeriod is the default value of Server.GracePeriod.
+const DefaultGracePeriod = 5 * time.Second
+
+// Server wraps an http.Server to shut it down without dropping
+// requests. Its Shutdown first fails its ReadinessCheck, so load
+// balancers stop sending it new requests, then waits GracePeriod
+// before shutting down the http.Server, which lets in-flight
+// requests finish.
+//
+// For ReadinessCheck to take effect, register it with
+// RegisterHealthHandler.
+type Server struct {
+	HTTP *http.Server
+
+	// GracePeriod is how long Shutdown fails the readiness check
+	// before shutting down HTTP. Zero means DefaultGracePeriod.
+	// Negative means not to wait.
+	GracePeriod time.Duration
+
+	// Logf optionally provides a log function to use.
+	// If nil, log.Printf is used.
+	Logf logger.Logf
+
+	wrapOnce sync.Once
+	draining int32 // atomic; non-zero once Shutdown is called
+	inFlight int64 // atomic; requests being served
+}
+
+// ReadinessCheck returns a HealthCheck that fails once Shutdown has
+// been called.
+func (s *Server) ReadinessCheck() HealthCheck {
+	return HealthCheck{
+		Name: "readiness",
+		Check: func() error {
+			if atomic.LoadInt32(&s.draining) != 0 {
+				return errors.New("draining for shutdown")
+			}
+			return nil
+		},
+	}
+}
+
+// ListenAndServe is like http.Server.ListenAndServe.
+func (s *Server) ListenAndServe() error {
+	s.wrapHandler()
+	return s.HTTP.ListenAndServe()
+}
+
+// ListenAndServeTLS is like http.Server.ListenAndServeTLS.
+func (s *Server) ListenAndServeTLS(certFile, keyFile string) error {
+	s.wrapHandler()
+	return s.HTTP.ListenAndServeTLS(certFile, keyFile)
+}
+
+// Serve is like http.Server.Serve.
+func (s *Server) Serve(ln net.Listener) error {
+	s.wrapHandler()
+	return s.HTTP.Serve(ln)
+}
+
+// wrapHandler makes s.HTTP's handler count in-flight requests.
+func (s *Server) wrapHandler() {
+	s.wrapOnce.Do(func() {
+		h := s.HTTP.Handler
+		if h == nil {
+			h = http.DefaultServeMux
+		}
+		s.HTTP.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&s.inFlight, 1)
+			defer atomic.AddInt64(&s.inFlight, -1)
+			h.ServeHTTP(w, r)
+		})
+	})
+}
+
+// Shutdown fails s's readiness check, waits for the grace period or
+// for ctx to be done, then gracefully shuts down the http.Server as
+// with http.Server.Shutdown, waiting for in-flight requests until
+// ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	logf := s.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	atomic.StoreInt32(&s.draining, 1)
+
+	grace := s.GracePeriod
+	if grace == 0 {
+		grace = DefaultGracePeriod
+	}
+	if grace > 0 {
+		logf("tsweb: draining for %v before shutdown", grace)
+		t := time.NewTimer(grace)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+
+	n := atomic.LoadInt64(&s.inFlight)
+	logf("tsweb: shutting down; waiting for %d in-flight requests", n)
+	err := s.HTTP.Shutdown(ctx)
+	if err != nil {
+		logf("tsweb: shutdown: %v", err)
+	}
+	return err
+}
@@ -6,37 +6,132 @@
 package tsweb
 
 import (
+	"bufio"
+	"encoding/json"
 	"expvar"
 	_ "expvar"
 	"fmt"
+	"io"
+	"math"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"tailscale.com/interfaces"
 	"tailscale.com/metrics"
+	"tailscale.com/types/logger"
+	tsversion "tailscale.com/version"
 )
 
 // DevMode controls whether extra output in shown, for when the binary is being run in dev mode.
 var DevMode bool
 
+// JSONErrors controls whether error responses from tsweb's handlers
+// to clients that accept application/json are JSON, as
+// {"error":{"code":403,"message":"..."}}, rather than plain text.
+var JSONErrors bool
+
 // NewMux returns a new ServeMux with debugHandler registered (and protected) at /debug/.
-func NewMux(debugHandler http.Handler) *http.ServeMux {
+// If debugHandler is nil, /debug/ serves an index page linking to
+// the debug handlers, and to any added with AddBrowserLink.
+func NewMux(debugHandler http.Handler, opts ...DebugOption) *http.ServeMux {
+	return NewMuxWithAccess(debugHandler, AllowDebugAccess, opts...)
+}
+
+// NewMuxWithAccess is like NewMux, but the debug handlers are
+// protected by allow instead of AllowDebugAccess.
+func NewMuxWithAccess(debugHandler http.Handler, allow func(*http.Request) bool, opts ...DebugOption) *http.ServeMux {
+	o := newDebugOptions(opts)
 	mux := http.NewServeMux()
-	RegisterCommonDebug(mux)
-	mux.Handle("/debug/", Protected(debugHandler))
+	registerCommonDebug(mux, allow, o)
+	if debugHandler == nil {
+		debugHandler = http.HandlerFunc(debugIndex)
+	}
+	mux.Handle("/debug/", ProtectedWithAccess(o.limit(debugHandler), allow))
 	return mux
 }
 
-func RegisterCommonDebug(mux *http.ServeMux) {
-	expvar.Publish("counter_uptime_sec", expvar.Func(func() interface{} { return int64(Uptime().Seconds()) }))
-	mux.Handle("/debug/pprof/", Protected(http.DefaultServeMux)) // to net/http/pprof
-	mux.Handle("/debug/vars", Protected(http.DefaultServeMux))   // to expvar
-	mux.Handle("/debug/varz", Protected(http.HandlerFunc(varzHandler)))
+// A DebugOption changes how the common debug handlers are registered.
+type DebugOption func(*debugOptions)
+
+type debugOptions struct {
+	gzipVarz     bool
+	rateLimit    *RateLimiter             // or nil for no limit
+	maxBodyBytes int64                    // or zero or negative for no limit
+	pprofAllow   func(*http.Request) bool // or nil for no extra check
+}
+
+func newDebugOptions(opts []DebugOption) *debugOptions {
+	o := &debugOptions{maxBodyBytes: DefaultMaxDebugBodyBytes}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// limit returns h wrapped in the rate limiter and request body size
+// limit, if any, and in RecoverHandler, so a panicking debug handler
+// only fails its own request.
+func (o *debugOptions) limit(h http.Handler) http.Handler {
+	h = RecoverHandler(h)
+	if o.maxBodyBytes > 0 {
+		h = MaxBytesHandler(h, o.maxBodyBytes)
+	}
+	if o.rateLimit == nil {
+		return h
+	}
+	return o.rateLimit.Wrap(h)
+}
+
+// GzipVarz makes /debug/varz gzip its responses for clients that
+// accept it. See Gzip.
+func GzipVarz() DebugOption {
+	return func(o *debugOptions) { o.gzipVarz = true }
+}
+
+// RateLimitDebug makes the debug handlers share l to limit how often
+// each permitted client may call them. By default they're unlimited.
+func RateLimitDebug(l *RateLimiter) DebugOption {
+	return func(o *debugOptions) { o.rateLimit = l }
+}
+
+// PprofAccess makes /debug/pprof/ also require allow to permit a
+// request, on top of the check all the debug handlers share, so that
+// profiles, which can pause the process, can be restricted to fewer
+// clients than /debug/vars and /debug/varz.
+func PprofAccess(allow func(*http.Request) bool) DebugOption {
+	return func(o *debugOptions) { o.pprofAllow = allow }
+}
+
+func RegisterCommonDebug(mux *http.ServeMux, opts ...DebugOption) {
+	registerCommonDebug(mux, AllowDebugAccess, newDebugOptions(opts))
+}
+
+var commonDebugVarsOnce sync.Once
+
+func registerCommonDebug(mux *http.ServeMux, allow func(*http.Request) bool, o *debugOptions) {
+	var varz http.Handler = http.HandlerFunc(varzHandler)
+	if o.gzipVarz {
+		varz = Gzip(varz)
+	}
+	commonDebugVarsOnce.Do(func() {
+		expvar.Publish("counter_uptime_sec", expvar.Func(func() interface{} { return int64(Uptime().Seconds()) }))
+		expvar.Publish("gauge_process_open_fds", metrics.OpenFDs)
+	})
+	pprofAllow := allow
+	if o.pprofAllow != nil {
+		pprofAllow = func(r *http.Request) bool { return allow(r) && o.pprofAllow(r) }
+	}
+	mux.Handle("/debug/pprof/", ProtectedWithAccess(o.limit(http.DefaultServeMux), pprofAllow)) // to net/http/pprof
+	mux.Handle("/debug/vars", ProtectedWithAccess(o.limit(http.DefaultServeMux), allow))        // to expvar
+	mux.Handle("/debug/varz", ProtectedWithAccess(o.limit(varz), allow))
+	mux.Handle("/debug/vars.json", ProtectedWithAccess(o.limit(http.HandlerFunc(varsJSONHandler)), allow))
 }
 
 func DefaultCertDir(leafDir string) string {
@@ -53,33 +148,200 @@ func IsProd443(addr string) bool {
 	return port == "443" || port == "https"
 }
 
+var (
+	trustedProxiesMu sync.Mutex
+	trustedProxies   []*net.IPNet
+)
+
+// SetTrustedProxies sets the networks of the reverse proxies (such as
+// load balancers) that AllowDebugAccess trusts to report a request's
+// client IP in the X-Forwarded-For header.
+//
+// Only list proxies that overwrite or append to X-Forwarded-For
+// themselves: a client can put anything in the header, so trusting a
+// proxy that passes it through unmodified lets any client spoof its
+// address and get debug access.
+func SetTrustedProxies(nets []*net.IPNet) {
+	trustedProxiesMu.Lock()
+	defer trustedProxiesMu.Unlock()
+	trustedProxies = append([]*net.IPNet(nil), nets...)
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	trustedProxiesMu.Lock()
+	defer trustedProxiesMu.Unlock()
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	debugIdentityMu sync.Mutex
+	debugIdentity   func(net.IP) (allowed bool, who string)
+)
+
+// SetDebugIdentityResolver sets a func that AllowDebugAccess consults
+// to decide whether a client may access debug endpoints, based on
+// who the client is rather than just its IP, such as by asking the
+// local tailscaled which Tailscale node and user has that address.
+// who describes the client for the "access denied" message shown in
+// DevMode, and may be empty if it's unknown.
+//
+// With a resolver set, clients with Tailscale IPs are no longer
+// allowed unless it allows them; loopback clients and ALLOW_DEBUG_IP
+// still are. A nil f restores the default IP-based checks.
+func SetDebugIdentityResolver(f func(ip net.IP) (allowed bool, who string)) {
+	debugIdentityMu.Lock()
+	defer debugIdentityMu.Unlock()
+	debugIdentity = f
+}
+
+func getDebugIdentity() func(net.IP) (bool, string) {
+	debugIdentityMu.Lock()
+	defer debugIdentityMu.Unlock()
+	return debugIdentity
+}
+
 // AllowDebugAccess reports whether r should be permitted to access
 // various debug endpoints.
+//
+// Requests with an X-Forwarded-For header are denied unless they
+// come directly from a proxy registered with SetTrustedProxies, in
+// which case the checks apply to the header's rightmost address, the
+// one added by the trusted proxy.
+//
+// Loopback clients, IPv4 or IPv6, are always allowed, as is the
+// client whose address is in the ALLOW_DEBUG_IP environment
+// variable. That may be in any form net.ParseIP accepts, optionally
+// in brackets and, for IPv6, with a zone, such as "fe80::1%eth0",
+// which then must match the client's.
+//
+// See SetDebugIdentityResolver to check who the client is, instead
+// of allowing any client with a Tailscale IP.
 func AllowDebugAccess(r *http.Request) bool {
-	if r.Header.Get("X-Forwarded-For") != "" {
-		// TODO if/when needed. For now, conservative:
+	ip, ipStr, ok := requestIP(r)
+	if !ok {
+		return false
+	}
+	if ip.IsLoopback() || isAllowDebugIP(ipStr) {
+		return true
+	}
+	if resolve := getDebugIdentity(); resolve != nil {
+		allowed, _ := resolve(ip)
+		return allowed
+	}
+	return interfaces.IsTailscaleIP(ip)
+}
+
+// requestIdentity returns who the resolver set with
+// SetDebugIdentityResolver says r's client is, if anyone.
+func requestIdentity(r *http.Request) string {
+	resolve := getDebugIdentity()
+	if resolve == nil {
+		return ""
+	}
+	ip, _, ok := requestIP(r)
+	if !ok || ip == nil {
+		return ""
+	}
+	_, who := resolve(ip)
+	return who
+}
+
+// isAllowDebugIP reports whether ipStr, a client address from
+// requestIP, is the one in the ALLOW_DEBUG_IP environment variable.
+func isAllowDebugIP(ipStr string) bool {
+	env := os.Getenv("ALLOW_DEBUG_IP")
+	if env == "" {
+		return false
+	}
+	if ipStr == env {
+		return true
+	}
+	want, wantZone := parseIP(env)
+	got, gotZone := parseIP(ipStr)
+	if want == nil || got == nil || !want.Equal(got) {
 		return false
 	}
+	return wantZone == "" || wantZone == gotZone
+}
+
+// parseIP parses s, an IP address that may be in brackets and, if
+// IPv6, have a zone, such as "[fe80::1%eth0]". It returns a nil ip
+// if s isn't valid.
+func parseIP(s string) (ip net.IP, zone string) {
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	if i := strings.LastIndexByte(s, '%'); i >= 0 {
+		s, zone = s[:i], s[i+1:]
+		if zone == "" {
+			return nil, ""
+		}
+	}
+	ip = net.ParseIP(s)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil, ""
+	}
+	return ip, zone
+}
+
+// requestIP returns the address of r's client: the host of its
+// RemoteAddr or, if r came from a trusted proxy, the rightmost
+// X-Forwarded-For address. ip is nil if ipStr doesn't parse; it
+// doesn't include the zone of a scoped IPv6 address, while ipStr
+// does. It reports false if r's RemoteAddr is malformed, or if it
+// has an X-Forwarded-For header that can't be trusted.
+func requestIP(r *http.Request) (ip net.IP, ipStr string, ok bool) {
 	ipStr, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return false
+		return nil, "", false
 	}
-	ip := net.ParseIP(ipStr)
-	return interfaces.IsTailscaleIP(ip) || ip.IsLoopback() || ipStr == os.Getenv("ALLOW_DEBUG_IP")
+	ip, _ = parseIP(ipStr)
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		if ip == nil || !isTrustedProxy(ip) {
+			return nil, "", false
+		}
+		// Only the last hop was added by our trusted proxy; any
+		// earlier ones came from the client and can't be trusted.
+		xffs := r.Header["X-Forwarded-For"]
+		hops := strings.Split(xffs[len(xffs)-1], ",")
+		ipStr = strings.TrimSpace(hops[len(hops)-1])
+		if host, _, err := net.SplitHostPort(ipStr); err == nil {
+			ipStr = host // some proxies include the client's port
+		}
+		ip, _ = parseIP(ipStr)
+		if ip == nil {
+			return nil, "", false
+		}
+	}
+	return ip, ipStr, true
 }
 
 // Protected wraps a provided debug handler, h, returning a Handler
 // that enforces AllowDebugAccess and returns forbiden replies for
 // unauthorized requests.
 func Protected(h http.Handler) http.Handler {
+	return ProtectedWithAccess(h, AllowDebugAccess)
+}
+
+// ProtectedWithAccess is like Protected, but permits the requests
+// for which allow returns true instead of using AllowDebugAccess.
+func ProtectedWithAccess(h http.Handler, allow func(*http.Request) bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !AllowDebugAccess(r) {
+		if !allow(r) {
 			msg := "debug access denied"
 			if DevMode {
+				if who := requestIdentity(r); who != "" {
+					msg += " for " + who
+				}
 				ipStr, _, _ := net.SplitHostPort(r.RemoteAddr)
 				msg += fmt.Sprintf("; to permit access, set ALLOW_DEBUG_IP=%v", ipStr)
 			}
-			http.Error(w, msg, http.StatusForbidden)
+			httpError(w, r, msg, http.StatusForbidden)
 			return
 		}
 		h.ServeHTTP(w, r)
@@ -93,7 +355,17 @@ func Uptime() time.Duration { return time.Since(timeStart).Round(time.Second) }
 // Port80Handler is the handler to be given to
 // autocert.Manager.HTTPHandler.  The inner handler is the mux
 // returned by NewMux containing registered /debug handlers.
-type Port80Handler struct{ Main http.Handler }
+type Port80Handler struct {
+	Main http.Handler
+
+	// HTTPSPort is the port that HTTPS is served on, which
+	// requests are redirected to. Zero means 443.
+	HTTPSPort int
+
+	// HSTS optionally specifies a Strict-Transport-Security header
+	// value, such as "max-age=31536000", to send with redirects.
+	HSTS string
+}
 
 func (h Port80Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	path := r.RequestURI
@@ -109,16 +381,29 @@ func (h Port80Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Redirect authorized user to the debug handler.
 		path = "/debug/"
 	}
-	target := "https://" + stripPort(r.Host) + path
+	if h.HSTS != "" {
+		w.Header().Set("Strict-Transport-Security", h.HSTS)
+	}
+	target := "https://" + h.httpsHost(r.Host) + path
 	http.Redirect(w, r, target, http.StatusFound)
 }
 
-func stripPort(hostport string) string {
+// httpsHost returns hostport with its port, if any, replaced by h's
+// HTTPS port.
+func (h Port80Handler) httpsHost(hostport string) string {
+	port := h.HTTPSPort
+	if port == 0 {
+		port = 443
+	}
 	host, _, err := net.SplitHostPort(hostport)
 	if err != nil {
-		return hostport
+		// No port, so the client used the default for the scheme.
+		if port == 443 {
+			return hostport
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
 	}
-	return net.JoinHostPort(host, "443")
+	return net.JoinHostPort(host, strconv.Itoa(port))
 }
 
 // varzHandler is an HTTP handler to write expvar values into the
@@ -128,56 +413,504 @@ func stripPort(hostport string) string {
 //
 // It makes the following assumptions:
 //
-//   * *expvar.Int are counters.
+//   * *expvar.Int and *tailscale/metrics.Counter are counters.
+//   * *expvar.Float are gauges, unless named with a "counter_" prefix.
+//   * *tailscale/metrics.Gauge are gauges.
+//   * *tailscale/metrics.RateCounter are counters of their
+//     cumulative value.
 //   * a *tailscale/metrics.Set is descended into, joining keys with
 //     underscores. So use underscores as your metric names.
+//   * a *tailscale/metrics.Histogram is a histogram, in seconds.
+//   * a *tailscale/metrics.Info is a gauge of 1 with its labels.
+//   * a *tailscale/metrics.Summary is a summary, in seconds.
 //   * an expvar named starting with "gauge_" or "counter_" is of that
 //     Prometheus type, and has that prefix stripped.
+//   * a *expvar.Map with such a prefix is exported as one metric with
+//     a label named "label" whose values are the map's keys. Map
+//     values must be *expvar.Int or *expvar.Float.
+//   * a *tailscale/metrics.LabelMap is like a *expvar.Map, but is a
+//     counter unless prefixed with "gauge_", and uses its Label field
+//     as the label name.
 //   * anything else is untyped and thus not exported.
-//   * expvar.Func can return an int or int64 (for now) and anything else
-//     is not exported.
+//   * expvar.Func can return an int, int64 or float64 (for now) and
+//     anything else is not exported.
+//
+// A "?prefix=" query parameter limits the export to metrics whose
+// exported names, after the above, start with its value, such as
+// "?prefix=magicsock_" for one Set. Without it, all are exported.
+//
+// Clients asking for OpenMetrics, with "?format=openmetrics" or an
+// Accept header, get the same metrics in the OpenMetrics 1.0.0
+// format instead (see openMetricsWriter).
+//
+// The output is buffered and flushed to the client every
+// varzFlushEvery metrics, so scrapers of very large exports start
+// getting data promptly. If the client goes away, the export stops
+// early.
+//
+// Each scrape records when it finished and how long it took in the
+// gauges varz_last_scrape_unixtime and varz_scrape_duration_ms,
+// which the next scrape exports.
 //
 // This will evolve over time, or perhaps be replaced.
 func varzHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	start := varzScrapes.now()
+	writeVarz(w, r, expvar.Do)
+	varzScrapes.record(start)
+}
 
-	var dump func(prefix string, kv expvar.KeyValue)
-	dump = func(prefix string, kv expvar.KeyValue) {
-		name := prefix + kv.Key
-		var typ string
-		switch v := kv.Value.(type) {
-		case *expvar.Int:
-			// Fast path for common value type.
-			fmt.Fprintf(w, "# TYPE %s counter\n%s %v\n", name, name, v.Value())
+const (
+	varzBufferSize = 32 << 10 // bytes of varz output buffered before writing
+	varzFlushEvery = 1000     // metrics between flushes to the client
+)
+
+// writeVarz is varzHandler for the variables listed by do, such as
+// expvar.Do.
+func writeVarz(w http.ResponseWriter, r *http.Request, do func(func(expvar.KeyValue))) {
+	openMetrics := wantOpenMetrics(r)
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", promContentType)
+	}
+	bw := bufio.NewWriterSize(w, varzBufferSize)
+	flush := func() {
+		if bw.Flush() != nil {
 			return
-		case *metrics.Set:
-			v.Do(func(kv expvar.KeyValue) {
-				dump(name+"_", kv)
-			})
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	defer flush()
+	var out io.Writer = bw
+	if openMetrics {
+		ow := &openMetricsWriter{w: bw}
+		defer ow.finish() // before the final flush
+		out = ow
+	}
+
+	namePrefix := r.FormValue("prefix")
+	n := 0
+	done := r.Context().Done()
+	do(func(kv expvar.KeyValue) {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		writePromExpVarFunc(out, "", namePrefix, kv, func() {
+			n++
+			if n%varzFlushEvery == 0 {
+				flush()
+			}
+		})
+	})
+}
+
+// walkExpVar calls f for kv and then, if kv is a *metrics.Set, for
+// each of its members in turn, recursively. path is the keys of the
+// Sets enclosing kv, outermost first; f must not retain it. Every
+// exporter descends into Sets this way, so they agree on what's in
+// them.
+func walkExpVar(path []string, kv expvar.KeyValue, f func(path []string, kv expvar.KeyValue)) {
+	f(path, kv)
+	if s, ok := kv.Value.(*metrics.Set); ok {
+		path = append(path, kv.Key)
+		s.Do(func(kv expvar.KeyValue) {
+			walkExpVar(path, kv, f)
+		})
+	}
+}
+
+// writePromExpVar writes kv to w in the Prometheus text format,
+// prefixing its name with prefix. See varzHandler for the rules
+// of how expvar types are mapped to Prometheus types.
+func writePromExpVar(w io.Writer, prefix string, kv expvar.KeyValue) {
+	writePromExpVarFunc(w, prefix, "", kv, func() {})
+}
+
+// writePromExpVarFunc is like writePromExpVar, but writes only the
+// metrics whose exported names start with namePrefix, and calls
+// wrote after writing each.
+func writePromExpVarFunc(w io.Writer, prefix, namePrefix string, kv expvar.KeyValue, wrote func()) {
+	walkExpVar(nil, kv, func(path []string, kv expvar.KeyValue) {
+		if _, ok := kv.Value.(*metrics.Set); ok {
+			return // its members are written instead
+		}
+		p := prefix
+		for _, k := range path {
+			p += k + "_"
+		}
+		if !strings.HasPrefix(promVarName(p, kv), namePrefix) {
 			return
 		}
-		if strings.HasPrefix(kv.Key, "gauge_") {
+		writePromVar(w, p, kv)
+		wrote()
+	})
+}
+
+// promVarName returns the name writePromVar exports kv as, with
+// prefix: its key, less any "gauge_" or "counter_" type prefix for
+// the types that take one.
+func promVarName(prefix string, kv expvar.KeyValue) string {
+	switch kv.Value.(type) {
+	case *expvar.Int, *metrics.Counter, *metrics.Histogram, *metrics.Info, *metrics.Summary:
+		return prefix + kv.Key
+	}
+	if strings.HasPrefix(kv.Key, "gauge_") {
+		return prefix + strings.TrimPrefix(kv.Key, "gauge_")
+	}
+	return prefix + strings.TrimPrefix(kv.Key, "counter_")
+}
+
+// writePromVar is writePromExpVar for a kv that isn't a
+// *metrics.Set.
+func writePromVar(w io.Writer, prefix string, kv expvar.KeyValue) {
+	name := promVarName(prefix, kv)
+	var typ string
+	switch v := kv.Value.(type) {
+	case *expvar.Int:
+		// Fast path for common value type.
+		fmt.Fprintf(w, "# TYPE %s counter\n%s %v\n", name, name, v.Value())
+		return
+	case *metrics.Counter:
+		fmt.Fprintf(w, "# TYPE %s counter\n%s %v\n", name, name, v.Value())
+		return
+	case *metrics.Histogram:
+		writePromHistogram(w, name, v)
+		return
+	case *metrics.Info:
+		writePromInfo(w, name, v)
+		return
+	case *metrics.Summary:
+		writePromSummary(w, name, v)
+		return
+	}
+	if strings.HasPrefix(kv.Key, "gauge_") {
+		typ = "gauge"
+	} else if strings.HasPrefix(kv.Key, "counter_") {
+		typ = "counter"
+	}
+	switch v := kv.Value.(type) {
+	case *metrics.Gauge:
+		if typ == "" {
 			typ = "gauge"
-			name = prefix + strings.TrimPrefix(kv.Key, "gauge_")
-		} else if strings.HasPrefix(kv.Key, "counter_") {
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, v.Value())
+		return
+	case *metrics.RateCounter:
+		if typ == "" {
 			typ = "counter"
-			name = prefix + strings.TrimPrefix(kv.Key, "counter_")
-		}
-		if fn, ok := kv.Value.(expvar.Func); ok {
-			val := fn()
-			switch val.(type) {
-			case int64, int:
-				if typ != "" {
-					fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, val)
-					return
-				}
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, v.Value())
+		return
+	case *metrics.LabelMap:
+		if typ == "" {
+			typ = "counter"
+		}
+		label := v.Label
+		if label == "" {
+			label = defaultMapLabel
+		}
+		writePromMap(w, name, typ, label, &v.Map)
+		return
+	case *expvar.Map:
+		if typ == "" {
+			fmt.Fprintf(w, "# skipping expvar.Map %q with undeclared Prometheus type\n", name)
+			return
+		}
+		writePromMap(w, name, typ, defaultMapLabel, v)
+		return
+	case *expvar.Float:
+		if typ == "" {
+			typ = "gauge"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n%s %s\n", name, typ, name, formatFloat(v.Value()))
+		return
+	case expvar.Func:
+		val := v()
+		switch val := val.(type) {
+		case int64, int:
+			if typ != "" {
+				fmt.Fprintf(w, "# TYPE %s %s\n%s %v\n", name, typ, name, val)
+				return
 			}
-			fmt.Fprintf(w, "# skipping expvar func %q returning unknown type %T\n", name, val)
+		case float64:
+			if typ != "" {
+				fmt.Fprintf(w, "# TYPE %s %s\n%s %s\n", name, typ, name, formatFloat(val))
+				return
+			}
+		}
+		fmt.Fprintf(w, "# skipping expvar func %q returning unknown type %T\n", name, val)
+		return
+	}
+	fmt.Fprintf(w, "# skipping func %q returning unknown type %T\n", name, kv.Value)
+}
+
+// writePromHistogram writes h to w as the Prometheus histogram name,
+// in seconds.
+func writePromHistogram(w io.Writer, name string, h *metrics.Histogram) {
+	bounds, cumCounts, sum, count := h.Buckets()
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, b := range bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b.Seconds()), cumCounts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(sum.Seconds()))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+// writePromSummary writes s to w as the Prometheus summary name, in
+// seconds. Its quantiles are NaN if s has no observations.
+func writePromSummary(w io.Writer, name string, s *metrics.Summary) {
+	vals, ok, sum, count := s.Quantiles()
+	fmt.Fprintf(w, "# TYPE %s summary\n", name)
+	for i, q := range metrics.SummaryQuantiles {
+		v := math.NaN()
+		if ok {
+			v = vals[i].Seconds()
+		}
+		fmt.Fprintf(w, "%s{quantile=\"%s\"} %s\n", name, formatFloat(q), formatFloat(v))
+	}
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(sum.Seconds()))
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+// writePromInfo writes i to w as the Prometheus gauge name, with
+// value 1 and i's labels.
+func writePromInfo(w io.Writer, name string, i *metrics.Info) {
+	fmt.Fprintf(w, "# TYPE %s gauge\n%s{", name, name)
+	for j, l := range i.Labels {
+		if j > 0 {
+			io.WriteString(w, ",")
+		}
+		fmt.Fprintf(w, "%s=\"%s\"", l.Name, escapeLabelValue(l.Value))
+	}
+	io.WriteString(w, "} 1\n")
+}
+
+// defaultMapLabel is the Prometheus label name used for the keys of
+// an exported *expvar.Map.
+const defaultMapLabel = "label"
+
+// writePromMap writes m to w as the Prometheus metric name of type
+// typ, with each of m's keys as the value of the label named label.
+func writePromMap(w io.Writer, name, typ, label string, m *expvar.Map) {
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+	m.Do(func(kv expvar.KeyValue) {
+		var val string
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			val = strconv.FormatInt(v.Value(), 10)
+		case *expvar.Float:
+			val = formatFloat(v.Value())
+		default:
+			fmt.Fprintf(w, "# skipping %q map key %q with unknown value type %T\n", name, kv.Key, kv.Value)
 			return
 		}
-		fmt.Fprintf(w, "# skipping func %q returning unknown type %T\n", name, kv.Value)
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", name, label, escapeLabelValue(kv.Key), val)
+	})
+}
+
+// labelValueEscaper escapes Prometheus label values.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string { return labelValueEscaper.Replace(v) }
+
+// formatFloat formats f for Prometheus, using the fewest digits
+// that represent it exactly.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ReturnHandler is like http.Handler, but returns an error.
+// A nil error means the handler has written its response.
+type ReturnHandler func(http.ResponseWriter, *http.Request) error
+
+// HTTPError is an error with an HTTP status code, to be returned by
+// a ReturnHandler. Msg is shown to the client, while Err, if non-nil,
+// is only logged.
+type HTTPError struct {
+	Code int    // HTTP status code to send
+	Msg  string // user-visible message
+	Err  error  // optional internal error to log
+}
+
+// Error returns an HTTPError with the given code, message and
+// internal error.
+func Error(code int, msg string, err error) HTTPError {
+	return HTTPError{Code: code, Msg: msg, Err: err}
+}
+
+func (e HTTPError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("httperror{%d, %q}", e.Code, e.Msg)
 	}
-	expvar.Do(func(kv expvar.KeyValue) {
-		dump("", kv)
+	return fmt.Sprintf("httperror{%d, %q, %v}", e.Code, e.Msg, e.Err)
+}
+
+func (e HTTPError) Unwrap() error { return e.Err }
+
+// httpError replies to r with the error message msg and HTTP status
+// code, like http.Error, but in JSON if JSONErrors is set and the
+// client accepts it.
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if !JSONErrors || !acceptsJSON(r) {
+		http.Error(w, msg, code)
+		return
+	}
+	var body struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body.Error.Code = code
+	body.Error.Message = msg
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// acceptsJSON reports whether r's Accept header allows
+// application/json.
+func acceptsJSON(r *http.Request) bool {
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		f := strings.Split(a, ";")
+		if strings.TrimSpace(f[0]) != "application/json" {
+			continue
+		}
+		return len(f) < 2 || strings.ReplaceAll(f[1], " ", "") != "q=0"
+	}
+	return false
+}
+
+var (
+	// httpStatusCount counts responses served by StdHandler by status code.
+	httpStatusCount = &metrics.LabelMap{Label: "code"}
+
+	// httpLatency is the distribution of StdHandler response times.
+	httpLatency = metrics.NewHistogram(metrics.DefaultLatencyBuckets)
+
+	// httpRequests counts requests served by Instrument handlers.
+	httpRequests = new(expvar.Int)
+
+	// httpRequestsByClass counts responses served by Instrument
+	// handlers by status class, such as "2xx".
+	httpRequestsByClass = &metrics.LabelMap{Label: "class"}
+)
+
+func init() {
+	expvar.Publish("counter_http_status", httpStatusCount)
+	expvar.Publish("http_request_duration_seconds", httpLatency)
+	expvar.Publish("counter_http_requests", httpRequests)
+	expvar.Publish("counter_http_requests_by_class", httpRequestsByClass)
+}
+
+// Instrument wraps h, typically a ServeMux, to count the requests
+// it serves, in total and by response status class. The counts are
+// exported by the /debug/varz handler.
+func Instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(lw, r)
+		httpRequests.Add(1)
+		if lw.hijacked {
+			return // no status to count
+		}
+		code := lw.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		httpRequestsByClass.Get(statusClass(code)).Add(1)
+	})
+}
+
+// statusClass returns the class of HTTP status code, such as "4xx".
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "other"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// Version and Commit are the defaults for RegisterVersion. They're
+// meant to be set when linking, as with
+//
+//   go build -ldflags "-X tailscale.com/tsweb.Commit=$(git rev-parse HEAD)"
+//
+// If Version isn't set, version.LONG is used.
+var Version, Commit string
+
+// RegisterVersion publishes the expvar "build_info", which the
+// /debug/varz handler exports as the Prometheus gauge
+// build_info{version="...",commit="..."} 1. Empty arguments default
+// to the Version and Commit variables. The version is also shown on
+// the debug index page.
+//
+// It must be called at most once per process.
+func RegisterVersion(version, commit string) {
+	expvar.Publish("build_info", setVersion(version, commit))
+}
+
+// setVersion records version and commit, after defaults, for the
+// debug index page and returns the build_info metric for them.
+func setVersion(version, commit string) *metrics.Info {
+	if version == "" {
+		version = Version
+	}
+	if version == "" {
+		version = tsversion.LONG
+	}
+	if commit == "" {
+		commit = Commit
+	}
+	registeredVersionMu.Lock()
+	registeredVersion, registeredCommit = version, commit
+	registeredVersionMu.Unlock()
+	return &metrics.Info{Labels: []metrics.Label{
+		{Name: "version", Value: version},
+		{Name: "commit", Value: commit},
+	}}
+}
+
+// StdHandler converts a ReturnHandler into an http.Handler.
+//
+// If h returns an HTTPError, its code and message are sent to the
+// client. Any other error is sent as a generic 500 Internal Server
+// Error. Either way, the internal error is logged to logf, prefixed
+// by the request's ID if RequestIDHandler gave it one. The status
+// code of each response is counted in the "counter_http_status" expvar,
+// and its latency in the "http_request_duration_seconds" histogram.
+func StdHandler(h ReturnHandler, logf logger.Logf) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		defer func() { httpLatency.Observe(time.Since(start)) }()
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		logf := RequestLogf(r.Context(), logf)
+		err := h(lw, r)
+		if err != nil {
+			var code int
+			var msg string
+			if he, ok := err.(HTTPError); ok {
+				code, msg = he.Code, he.Msg
+			} else {
+				code, msg = http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError)
+			}
+			logf("tsweb: %s %s: %v", r.Method, r.RequestURI, err)
+			if lw.code != 0 || lw.hijacked {
+				logf("tsweb: %s %s: handler returned error after writing response", r.Method, r.RequestURI)
+			} else {
+				httpError(lw, r, msg, code)
+			}
+		}
+		if lw.code == 0 && !lw.hijacked {
+			lw.code = http.StatusOK
+		}
+		if !lw.hijacked {
+			httpStatusCount.Get(strconv.Itoa(lw.code)).Add(1)
+		}
 	})
 }
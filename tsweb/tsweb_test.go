@@ -0,0 +1,1632 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"tailscale.com/interfaces"
+	"tailscale.com/metrics"
+)
+
+func TestVarzHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		k    string // key name
+		v    expvar.Var
+		want string
+	}{
+		{
+			"int",
+			"foo",
+			new(expvar.Int),
+			"# TYPE foo counter\nfoo 0\n",
+		},
+		{
+			"float",
+			"load_avg",
+			func() *expvar.Float { f := new(expvar.Float); f.Set(0.1); return f }(),
+			"# TYPE load_avg gauge\nload_avg 0.1\n",
+		},
+		{
+			"counter_float",
+			"counter_seconds",
+			func() *expvar.Float { f := new(expvar.Float); f.Set(1e21); return f }(),
+			"# TYPE seconds counter\nseconds 1e+21\n",
+		},
+		{
+			"func_float64",
+			"gauge_ratio",
+			expvar.Func(func() interface{} { return 0.25 }),
+			"# TYPE ratio gauge\nratio 0.25\n",
+		},
+		{
+			"func_untyped",
+			"ratio",
+			expvar.Func(func() interface{} { return 0.25 }),
+			"# skipping expvar func \"ratio\" returning unknown type float64\n",
+		},
+		{
+			"func_int",
+			"gauge_x",
+			expvar.Func(func() interface{} { return 3 }),
+			"# TYPE x gauge\nx 3\n",
+		},
+		{
+			"metrics_set",
+			"s",
+			func() *metrics.Set {
+				s := new(metrics.Set)
+				s.Set("foo", new(expvar.Int))
+				return s
+			}(),
+			"# TYPE s_foo counter\ns_foo 0\n",
+		},
+		{
+			"gauge",
+			"gauge_active_conns",
+			func() *metrics.Gauge {
+				g := new(metrics.Gauge)
+				g.Set(5)
+				g.Add(-7)
+				return g
+			}(),
+			"# TYPE active_conns gauge\nactive_conns -2\n",
+		},
+		{
+			"rate_counter",
+			"packets",
+			func() *metrics.RateCounter {
+				c := new(metrics.RateCounter)
+				c.Add(4)
+				c.Add(3)
+				return c
+			}(),
+			"# TYPE packets counter\npackets 7\n",
+		},
+		{
+			"counter_in_set",
+			"magicsock",
+			func() *metrics.Set {
+				s := new(metrics.Set)
+				metrics.NewCounterIn(s, "packets_sent").Inc()
+				return s
+			}(),
+			"# TYPE magicsock_packets_sent counter\nmagicsock_packets_sent 1\n",
+		},
+		{
+			"gauge_in_set",
+			"derp",
+			func() *metrics.Set {
+				g := new(metrics.Gauge)
+				g.Add(3)
+				s := new(metrics.Set)
+				s.Set("gauge_active_conns", g)
+				return s
+			}(),
+			"# TYPE derp_active_conns gauge\nderp_active_conns 3\n",
+		},
+		{
+			"histogram",
+			"latency",
+			func() *metrics.Histogram {
+				h := metrics.NewHistogram([]time.Duration{time.Millisecond, time.Second})
+				h.Observe(time.Millisecond)
+				h.Observe(500 * time.Millisecond)
+				h.Observe(2 * time.Second)
+				return h
+			}(),
+			"# TYPE latency histogram\n" +
+				"latency_bucket{le=\"0.001\"} 1\n" +
+				"latency_bucket{le=\"1\"} 2\n" +
+				"latency_bucket{le=\"+Inf\"} 3\n" +
+				"latency_sum 2.501\n" +
+				"latency_count 3\n",
+		},
+		{
+			"label_map",
+			"counter_requests",
+			func() *metrics.LabelMap {
+				m := &metrics.LabelMap{Label: "code"}
+				m.Get("200").Add(3)
+				m.Add("404", 1)
+				return m
+			}(),
+			"# TYPE requests counter\n" +
+				"requests{code=\"200\"} 3\n" +
+				"requests{code=\"404\"} 1\n",
+		},
+		{
+			"label_map_gauge",
+			"gauge_conns",
+			func() *metrics.LabelMap {
+				m := &metrics.LabelMap{Label: "region"}
+				m.Get("lax").Add(2)
+				return m
+			}(),
+			"# TYPE conns gauge\nconns{region=\"lax\"} 2\n",
+		},
+		{
+			"map_untyped",
+			"m",
+			new(expvar.Map),
+			"# skipping expvar.Map \"m\" with undeclared Prometheus type\n",
+		},
+		{
+			"map_gauge",
+			"gauge_derp_bytes",
+			func() *expvar.Map {
+				m := new(expvar.Map)
+				m.Add("lax", 1)
+				m.Add("nyc", 2)
+				m.AddFloat(`a"b\c`, 0.5)
+				m.Set("bad", expvar.Func(func() interface{} { return 1 }))
+				return m
+			}(),
+			"# TYPE derp_bytes gauge\n" +
+				`derp_bytes{label="a\"b\\c"} 0.5` + "\n" +
+				"# skipping \"derp_bytes\" map key \"bad\" with unknown value type expvar.Func\n" +
+				"derp_bytes{label=\"lax\"} 1\n" +
+				"derp_bytes{label=\"nyc\"} 2\n",
+		},
+		{
+			"summary",
+			"latency",
+			func() *metrics.Summary {
+				s := metrics.NewSummary(0)
+				for i := 1; i <= 100; i++ {
+					s.Observe(time.Duration(i) * time.Millisecond)
+				}
+				return s
+			}(),
+			"# TYPE latency summary\n" +
+				"latency{quantile=\"0.5\"} 0.05\n" +
+				"latency{quantile=\"0.9\"} 0.09\n" +
+				"latency{quantile=\"0.99\"} 0.099\n" +
+				"latency_sum 5.05\n" +
+				"latency_count 100\n",
+		},
+		{
+			"summary_empty",
+			"latency",
+			metrics.NewSummary(0),
+			"# TYPE latency summary\n" +
+				"latency{quantile=\"0.5\"} NaN\n" +
+				"latency{quantile=\"0.9\"} NaN\n" +
+				"latency{quantile=\"0.99\"} NaN\n" +
+				"latency_sum 0\n" +
+				"latency_count 0\n",
+		},
+		{
+			"info",
+			"build_info",
+			&metrics.Info{Labels: []metrics.Label{
+				{Name: "version", Value: "1.2.3"},
+				{Name: "commit", Value: `a"b`},
+			}},
+			"# TYPE build_info gauge\n" +
+				`build_info{version="1.2.3",commit="a\"b"} 1` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sb strings.Builder
+			writePromExpVar(&sb, "", expvar.KeyValue{Key: tt.k, Value: tt.v})
+			if got := sb.String(); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVarzOpenMetrics(t *testing.T) {
+	set := new(metrics.Set)
+	reqs := new(expvar.Int)
+	reqs.Add(7)
+	set.Set("requests_total", reqs)
+	codes := &metrics.LabelMap{Label: "code"}
+	codes.Add("200", 3)
+	set.Set("counter_responses", codes)
+	load := new(expvar.Float)
+	load.Set(0.5)
+	set.Set("load", load)
+	set.Set("ratio", expvar.Func(func() interface{} { return 0.25 }))
+	rtt := metrics.NewSummary(0)
+	rtt.Observe(time.Second)
+	set.Set("rtt_seconds", rtt)
+	kv := expvar.KeyValue{Key: "app", Value: set}
+
+	const wantProm = "# TYPE app_responses counter\n" +
+		"app_responses{code=\"200\"} 3\n" +
+		"# TYPE app_load gauge\n" +
+		"app_load 0.5\n" +
+		"# skipping expvar func \"app_ratio\" returning unknown type float64\n" +
+		"# TYPE app_requests_total counter\n" +
+		"app_requests_total 7\n" +
+		"# TYPE app_rtt_seconds summary\n" +
+		"app_rtt_seconds{quantile=\"0.5\"} 1\n" +
+		"app_rtt_seconds{quantile=\"0.9\"} 1\n" +
+		"app_rtt_seconds{quantile=\"0.99\"} 1\n" +
+		"app_rtt_seconds_sum 1\n" +
+		"app_rtt_seconds_count 1\n"
+	const wantOpenMetrics = "# TYPE app_responses counter\n" +
+		"app_responses_total{code=\"200\"} 3\n" +
+		"# TYPE app_load gauge\n" +
+		"app_load 0.5\n" +
+		"# TYPE app_requests counter\n" +
+		"app_requests_total 7\n" +
+		"# TYPE app_rtt_seconds summary\n" +
+		"# UNIT app_rtt_seconds seconds\n" +
+		"app_rtt_seconds{quantile=\"0.5\"} 1\n" +
+		"app_rtt_seconds{quantile=\"0.9\"} 1\n" +
+		"app_rtt_seconds{quantile=\"0.99\"} 1\n" +
+		"app_rtt_seconds_sum 1\n" +
+		"app_rtt_seconds_count 1\n" +
+		"# EOF\n"
+
+	var prom strings.Builder
+	writePromExpVar(&prom, "", kv)
+	if got := prom.String(); got != wantProm {
+		t.Errorf("Prometheus format:\n got %q\nwant %q", got, wantProm)
+	}
+	var om strings.Builder
+	ow := &openMetricsWriter{w: &om}
+	writePromExpVar(ow, "", kv)
+	if err := ow.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if got := om.String(); got != wantOpenMetrics {
+		t.Errorf("OpenMetrics format:\n got %q\nwant %q", got, wantOpenMetrics)
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		accept string
+		wantCT string
+	}{
+		{"default", "/debug/varz", "", promContentType},
+		{"accept_text", "/debug/varz", "text/plain", promContentType},
+		{"query", "/debug/varz?format=openmetrics", "", openMetricsContentType},
+		{"accept", "/debug/varz", "application/openmetrics-text; version=1.0.0,text/plain;q=0.5", openMetricsContentType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			varzHandler(rec, req)
+			if got := rec.Header().Get("Content-Type"); got != tt.wantCT {
+				t.Errorf("Content-Type = %q; want %q", got, tt.wantCT)
+			}
+			hasEOF := strings.HasSuffix(rec.Body.String(), "\n# EOF\n")
+			if want := tt.wantCT == openMetricsContentType; hasEOF != want {
+				t.Errorf("ends with # EOF = %v; want %v", hasEOF, want)
+			}
+		})
+	}
+}
+
+// bigSetVars returns a do func, like expvar.Do, listing one Set of n
+// counters.
+func bigSetVars(n int) func(func(expvar.KeyValue)) {
+	s := new(metrics.Set)
+	for i := 0; i < n; i++ {
+		v := new(expvar.Int)
+		v.Set(int64(i))
+		s.Set(fmt.Sprintf("peer_%05d", i), v)
+	}
+	return func(f func(expvar.KeyValue)) { f(expvar.KeyValue{Key: "big", Value: s}) }
+}
+
+// countingResponseWriter is an http.ResponseWriter that discards what's
+// written to it, counting Write and Flush calls.
+type countingResponseWriter struct {
+	hdr             http.Header
+	bytes           int
+	writes, flushes int
+}
+
+func (w *countingResponseWriter) Header() http.Header {
+	if w.hdr == nil {
+		w.hdr = make(http.Header)
+	}
+	return w.hdr
+}
+func (w *countingResponseWriter) WriteHeader(int) {}
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	w.writes++
+	w.bytes += len(p)
+	return len(p), nil
+}
+func (w *countingResponseWriter) Flush() { w.flushes++ }
+
+func TestVarzFlushes(t *testing.T) {
+	do := bigSetVars(2*varzFlushEvery + 10)
+	w := new(countingResponseWriter)
+	writeVarz(w, httptest.NewRequest("GET", "/debug/varz", nil), do)
+	// Every varzFlushEvery metrics, and at the end.
+	if w.flushes != 3 {
+		t.Errorf("flushes = %d; want 3", w.flushes)
+	}
+	var sb strings.Builder
+	do(func(kv expvar.KeyValue) { writePromExpVar(&sb, "", kv) })
+	if w.bytes != sb.Len() {
+		t.Errorf("wrote %d bytes; want %d", w.bytes, sb.Len())
+	}
+	if w.writes >= 2*varzFlushEvery {
+		t.Errorf("%d writes; want far fewer than one per metric", w.writes)
+	}
+
+	// A client that's gone gets nothing more.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = new(countingResponseWriter)
+	writeVarz(w, httptest.NewRequest("GET", "/debug/varz", nil).WithContext(ctx), do)
+	if w.bytes != 0 {
+		t.Errorf("after disconnect, wrote %d bytes; want 0", w.bytes)
+	}
+}
+
+func TestVarzPrefix(t *testing.T) {
+	intVar := func(n int64) *expvar.Int {
+		v := new(expvar.Int)
+		v.Set(n)
+		return v
+	}
+	fooSet := new(metrics.Set)
+	fooSet.Set("gauge_depth", new(metrics.Gauge))
+	bazSet := new(metrics.Set)
+	bazSet.Set("foo_nested", intVar(3))
+	vars := []expvar.KeyValue{
+		{Key: "foo_requests", Value: intVar(1)},
+		{Key: "gauge_foo_temp", Value: new(metrics.Gauge)},
+		{Key: "counter_foo_hits", Value: new(expvar.Float)},
+		{Key: "gauge_foo_int", Value: intVar(2)}, // an *expvar.Int keeps its "gauge_"
+		{Key: "bar_requests", Value: intVar(4)},
+		{Key: "gauge_bar_temp", Value: new(metrics.Gauge)},
+		{Key: "foo", Value: fooSet},
+		{Key: "baz", Value: bazSet},
+	}
+	do := func(f func(expvar.KeyValue)) {
+		for _, kv := range vars {
+			f(kv)
+		}
+	}
+	names := func(query string) string {
+		rec := httptest.NewRecorder()
+		writeVarz(rec, httptest.NewRequest("GET", "/debug/varz"+query, nil), do)
+		var got []string
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if f := strings.Fields(line); len(f) == 4 && f[1] == "TYPE" {
+				got = append(got, f[2])
+			}
+		}
+		return strings.Join(got, " ")
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"?prefix=foo_", "foo_requests foo_temp foo_hits foo_depth"},
+		{"?prefix=gauge_", "gauge_foo_int"},
+		{"?prefix=baz_", "baz_foo_nested"},
+		{"?prefix=nope_", ""},
+		{"", "foo_requests foo_temp foo_hits gauge_foo_int bar_requests bar_temp foo_depth baz_foo_nested"},
+		{"?prefix=", "foo_requests foo_temp foo_hits gauge_foo_int bar_requests bar_temp foo_depth baz_foo_nested"},
+	}
+	for _, tt := range tests {
+		if got := names(tt.query); got != tt.want {
+			t.Errorf("varz%s exported %q; want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkVarzLargeSet(b *testing.B) {
+	do := bigSetVars(10000)
+	req := httptest.NewRequest("GET", "/debug/varz", nil)
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		var w *countingResponseWriter
+		for i := 0; i < b.N; i++ {
+			w = new(countingResponseWriter)
+			writeVarz(w, req, do)
+		}
+		b.ReportMetric(float64(w.writes), "writes/op")
+	})
+	b.Run("unbuffered", func(b *testing.B) {
+		b.ReportAllocs()
+		var w *countingResponseWriter
+		for i := 0; i < b.N; i++ {
+			w = new(countingResponseWriter)
+			do(func(kv expvar.KeyValue) { writePromExpVar(w, "", kv) })
+		}
+		b.ReportMetric(float64(w.writes), "writes/op")
+	})
+}
+
+func TestVarzScrapeStats(t *testing.T) {
+	defer func(now func() time.Time) { varzScrapes.now = now }(varzScrapes.now)
+	clock := time.Unix(1600000000, 0)
+	varzScrapes.now = func() time.Time {
+		clock = clock.Add(1500 * time.Millisecond)
+		return clock
+	}
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		varzHandler(rec, httptest.NewRequest("GET", "/debug/varz", nil))
+		return rec.Body.String()
+	}
+	scrape()
+	first := varzScrapes.lastUnix()
+	if want := clock.Unix(); first != want {
+		t.Errorf("after first scrape, last scrape time = %d; want %d", first, want)
+	}
+	if got := varzScrapes.durationMillis(); got != 1500 {
+		t.Errorf("scrape duration = %dms; want 1500ms", got)
+	}
+
+	// The second scrape reports the first.
+	out := scrape()
+	for _, want := range []string{
+		fmt.Sprintf("varz_last_scrape_unixtime %d\n", first),
+		"varz_scrape_duration_ms 1500\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("second scrape's output lacks %q", want)
+		}
+	}
+	if got := varzScrapes.lastUnix(); got <= first {
+		t.Errorf("after second scrape, last scrape time = %d; want after %d", got, first)
+	}
+}
+
+func TestVarsJSON(t *testing.T) {
+	inner := new(metrics.Set)
+	g := new(metrics.Gauge)
+	g.Set(3)
+	inner.Set("gauge_active", g)
+	f := new(expvar.Float)
+	f.Set(1.5)
+	inner.Set("ratio", f)
+	outer := new(metrics.Set)
+	n := new(expvar.Int)
+	n.Set(7)
+	outer.Set("count", n)
+	outer.Set("inner", inner)
+	outer.Set("empty", new(metrics.Set))
+	vars := []expvar.KeyValue{
+		{Key: "derp", Value: outer},
+		{Key: "name", Value: expvar.Func(func() interface{} { return "x" })},
+	}
+	do := func(f func(expvar.KeyValue)) {
+		for _, kv := range vars {
+			f(kv)
+		}
+	}
+
+	j, err := json.MarshalIndent(expVarTree(do), "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got interface{}
+	if err := json.Unmarshal(j, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"derp": map[string]interface{}{
+			"count": 7.0,
+			"empty": map[string]interface{}{},
+			"inner": map[string]interface{}{
+				"gauge_active": 3.0,
+				"ratio":        1.5,
+			},
+		},
+		"name": "x",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s; want %v", j, want)
+	}
+	if !strings.Contains(string(j), "\n    \"inner\": {\n      \"gauge_active\": 3,") {
+		t.Errorf("not indented:\n%s", j)
+	}
+
+	// The same Set's members, as varz sees them.
+	var sb strings.Builder
+	writePromExpVar(&sb, "", vars[0])
+	if want := "# TYPE derp_count counter\nderp_count 7\n" +
+		"# TYPE derp_inner_active gauge\nderp_inner_active 3\n" +
+		"# TYPE derp_inner_ratio gauge\nderp_inner_ratio 1.5\n"; sb.String() != want {
+		t.Errorf("varz = %q; want %q", sb.String(), want)
+	}
+}
+
+func TestVarsJSONHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	varsJSONHandler(rec, httptest.NewRequest("GET", "/debug/vars.json", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d; want 200", rec.Code)
+	}
+	if ct, want := rec.Header().Get("Content-Type"), "application/json; charset=utf-8"; ct != want {
+		t.Errorf("Content-Type = %q; want %q", ct, want)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	if _, ok := m["memstats"].(map[string]interface{}); !ok {
+		t.Errorf("memstats missing from %s", rec.Body.Bytes())
+	}
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	RegisterRuntimeMetrics()
+	RegisterRuntimeMetrics() // no duplicate Publish panic
+
+	rec := httptest.NewRecorder()
+	varzHandler(rec, httptest.NewRequest("GET", "/debug/varz", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE goroutines gauge\n",
+		"# TYPE heap_alloc_bytes gauge\n",
+		"# TYPE gc_total counter\n",
+		"# TYPE alloc_bytes_total counter\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("varz output lacks %q", want)
+		}
+	}
+
+	reads := 0
+	c := &memStatsCache{read: func(ms *runtime.MemStats) { reads++; ms.NumGC = uint32(reads) }}
+	t0 := time.Unix(1000, 0)
+	c.get(t0)
+	if got := c.get(t0.Add(memStatsMaxAge / 2)).NumGC; got != 1 || reads != 1 {
+		t.Errorf("within max age: NumGC = %d after %d reads; want cached 1", got, reads)
+	}
+	if got := c.get(t0.Add(2 * memStatsMaxAge)).NumGC; got != 2 {
+		t.Errorf("after max age: NumGC = %d; want 2", got)
+	}
+}
+
+func TestAccessLogHandler(t *testing.T) {
+	var got AccessLogRecord
+	h := AccessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short and stout")
+		w.(http.Flusher).Flush()
+	}), func(r AccessLogRecord) { got = r })
+
+	req := httptest.NewRequest("GET", "/foo?bar=1", nil)
+	req.RemoteAddr = "100.101.102.103:1234"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.Method != "GET" || got.RequestURI != "/foo?bar=1" || got.RemoteIP != "100.101.102.103" {
+		t.Errorf("request fields = %q %q %q", got.Method, got.RequestURI, got.RemoteIP)
+	}
+	if got.Code != http.StatusTeapot {
+		t.Errorf("Code = %d; want %d", got.Code, http.StatusTeapot)
+	}
+	if got.Bytes != int64(len("short and stout")) {
+		t.Errorf("Bytes = %d; want %d", got.Bytes, len("short and stout"))
+	}
+}
+
+func TestRecoverHandler(t *testing.T) {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		name     string
+		h        http.HandlerFunc
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "panic",
+			h:        func(w http.ResponseWriter, r *http.Request) { panic("boom") },
+			wantCode: http.StatusInternalServerError,
+			wantBody: "Internal Server Error\n",
+		},
+		{
+			name: "panic-after-write",
+			h: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+				io.WriteString(w, "partial")
+				panic("boom")
+			},
+			wantCode: http.StatusAccepted,
+			wantBody: "partial",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logBuf.Reset()
+			var got AccessLogRecord
+			h := AccessLogHandler(RecoverHandler(tt.h), func(r AccessLogRecord) { got = r })
+			before := httpPanics.Value()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/panic", nil))
+
+			if rec.Code != tt.wantCode || rec.Body.String() != tt.wantBody {
+				t.Errorf("response = %d %q; want %d %q", rec.Code, rec.Body.String(), tt.wantCode, tt.wantBody)
+			}
+			if got.Code != tt.wantCode {
+				t.Errorf("access log Code = %d; want %d", got.Code, tt.wantCode)
+			}
+			if n := httpPanics.Value() - before; n != 1 {
+				t.Errorf("panics counted = %d; want 1", n)
+			}
+			if l := logBuf.String(); !strings.Contains(l, "GET /panic: panic: boom") || !strings.Contains(l, "goroutine ") {
+				t.Errorf("log lacks panic and stack trace:\n%s", l)
+			}
+		})
+	}
+}
+
+func TestAccessLogHandlerHijack(t *testing.T) {
+	var got AccessLogRecord
+	done := make(chan bool, 1)
+	h := AccessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\n\r\n")
+		c.Close()
+	}), func(r AccessLogRecord) { got = r; done <- true })
+
+	s := httptest.NewServer(h)
+	defer s.Close()
+	res, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	<-done
+	if got.Code != 0 {
+		t.Errorf("Code = %d; want 0 for hijacked connection", got.Code)
+	}
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	long := strings.Repeat("a", maxRequestIDLen+1)
+	tests := []struct {
+		name     string
+		incoming string
+		wantSame bool // whether incoming is kept, else a new ID
+	}{
+		{"none", "", false},
+		{"kept", "abc-123_x.y", true},
+		{"too-long", long, false},
+		{"log-injection", "abc\n[fake] log line", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var inHandler, logged string
+			var logs []string
+			logf := func(format string, args ...interface{}) { logs = append(logs, fmt.Sprintf(format, args...)) }
+			h := AccessLogHandler(RequestIDHandler(StdHandler(func(w http.ResponseWriter, r *http.Request) error {
+				inHandler = RequestID(r.Context())
+				return errors.New("oops")
+			}, logf)), func(r AccessLogRecord) { logged = r.RequestID })
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.incoming != "" {
+				req.Header.Set(RequestIDHeader, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(RequestIDHeader)
+			if tt.wantSame && id != tt.incoming {
+				t.Errorf("response ID = %q; want %q", id, tt.incoming)
+			}
+			if !tt.wantSame && (len(id) != 24 || id == tt.incoming) {
+				t.Errorf("response ID = %q; want a new one", id)
+			}
+			if inHandler != id || logged != id {
+				t.Errorf("ID in handler = %q, in access log = %q; want %q", inHandler, logged, id)
+			}
+			if len(logs) == 0 || !strings.HasPrefix(logs[0], "["+id+"] ") {
+				t.Errorf("StdHandler logs = %q; want prefix [%s]", logs, id)
+			}
+		})
+	}
+
+	// IDs are distinct, and AccessLogHandler also finds them when
+	// wrapped by RequestIDHandler.
+	var ids []string
+	h := RequestIDHandler(AccessLogHandler(http.NotFoundHandler(), func(r AccessLogRecord) { ids = append(ids, r.RequestID) }))
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if len(ids) != 2 || ids[0] == "" || ids[0] == ids[1] {
+		t.Errorf("logged IDs = %q; want two distinct", ids)
+	}
+}
+
+func TestStdHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		h        ReturnHandler
+		wantCode int
+		wantBody string
+		wantLogs int
+	}{
+		{
+			name: "ok",
+			h: func(w http.ResponseWriter, r *http.Request) error {
+				io.WriteString(w, "hi")
+				return nil
+			},
+			wantCode: 200,
+			wantBody: "hi",
+		},
+		{
+			name: "http_error",
+			h: func(w http.ResponseWriter, r *http.Request) error {
+				return Error(http.StatusNotFound, "no such thing", errors.New("internal detail"))
+			},
+			wantCode: 404,
+			wantBody: "no such thing\n",
+			wantLogs: 1,
+		},
+		{
+			name: "plain_error",
+			h: func(w http.ResponseWriter, r *http.Request) error {
+				return errors.New("internal detail")
+			},
+			wantCode: 500,
+			wantBody: "Internal Server Error\n",
+			wantLogs: 1,
+		},
+		{
+			name: "error_after_write",
+			h: func(w http.ResponseWriter, r *http.Request) error {
+				w.WriteHeader(http.StatusAccepted)
+				return errors.New("oops")
+			},
+			wantCode: 202,
+			wantLogs: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs []string
+			logf := func(format string, args ...interface{}) {
+				logs = append(logs, fmt.Sprintf(format, args...))
+			}
+			before := httpStatusCodeCount(tt.wantCode)
+			rec := httptest.NewRecorder()
+			StdHandler(tt.h, logf).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %d; want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q; want %q", got, tt.wantBody)
+			}
+			if len(logs) != tt.wantLogs {
+				t.Errorf("logs = %q; want %d lines", logs, tt.wantLogs)
+			}
+			if strings.Contains(rec.Body.String(), "internal detail") {
+				t.Errorf("internal error leaked to client: %q", rec.Body.String())
+			}
+			if got := httpStatusCodeCount(tt.wantCode) - before; got != 1 {
+				t.Errorf("status %d counted %d times; want 1", tt.wantCode, got)
+			}
+		})
+	}
+}
+
+func httpStatusCodeCount(code int) int64 {
+	return httpStatusCount.Get(strconv.Itoa(code)).Value()
+}
+
+func TestAllowDebugAccessTrustedProxies(t *testing.T) {
+	_, lb, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies(nil)
+
+	tests := []struct {
+		name    string
+		proxies []*net.IPNet
+		remote  string
+		xff     string
+		want    bool
+	}{
+		{"direct-tailscale", nil, "100.101.102.103:1234", "", true},
+		{"direct-public", nil, "8.8.8.8:1234", "", false},
+		{"xff-no-proxies", nil, "127.0.0.1:1234", "100.101.102.103", false},
+		{"xff-untrusted-proxy", []*net.IPNet{lb}, "8.8.8.8:1234", "100.101.102.103", false},
+		{"xff-trusted-proxy", []*net.IPNet{lb}, "10.1.2.3:1234", "100.101.102.103", true},
+		{"xff-trusted-proxy-public-client", []*net.IPNet{lb}, "10.1.2.3:1234", "8.8.8.8", false},
+		{"xff-spoofed-leftmost", []*net.IPNet{lb}, "10.1.2.3:1234", "100.101.102.103, 8.8.8.8", false},
+		{"xff-rightmost-trusted", []*net.IPNet{lb}, "10.1.2.3:1234", "8.8.8.8, 100.101.102.103", true},
+		{"xff-garbage", []*net.IPNet{lb}, "10.1.2.3:1234", "not-an-ip", false},
+	}
+	for _, tt := range tests {
+		SetTrustedProxies(tt.proxies)
+		r := httptest.NewRequest("GET", "/debug/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := AllowDebugAccess(r); got != tt.want {
+			t.Errorf("%s: AllowDebugAccess = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAllowDebugAccessIPv6(t *testing.T) {
+	_, lb, err := net.ParseCIDR("fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies(nil)
+	defer os.Setenv("ALLOW_DEBUG_IP", os.Getenv("ALLOW_DEBUG_IP"))
+
+	tests := []struct {
+		name    string
+		env     string // ALLOW_DEBUG_IP
+		proxies []*net.IPNet
+		remote  string
+		xff     string
+		want    bool
+	}{
+		{"loopback", "", nil, "[::1]:1234", "", true},
+		{"v4-mapped-loopback", "", nil, "[::ffff:127.0.0.1]:1234", "", true},
+		{"tailscale", "", nil, "[fd7a:115c:a1e0:ab12::1]:1234", "", true},
+		{"public", "", nil, "[2001:db8::1]:1234", "", false},
+		{"link-local-zoned", "", nil, "[fe80::1%eth0]:1234", "", false},
+		{"empty-zone", "", nil, "[fe80::1%]:1234", "", false},
+		{"env-v6", "2001:db8::1", nil, "[2001:db8::1]:1234", "", true},
+		{"env-v6-other-form", "2001:db8::1", nil, "[2001:db8:0:0::1]:1234", "", true},
+		{"env-v6-bracketed", "[2001:db8::1]", nil, "[2001:db8::1]:1234", "", true},
+		{"env-v6-other-ip", "2001:db8::1", nil, "[2001:db8::2]:1234", "", false},
+		{"env-zoned", "fe80::1%eth0", nil, "[fe80::1%eth0]:1234", "", true},
+		{"env-zoned-other-zone", "fe80::1%eth0", nil, "[fe80::1%eth1]:1234", "", false},
+		{"env-unzoned-any-zone", "fe80::1", nil, "[fe80::1%eth1]:1234", "", true},
+		{"xff-v6", "", []*net.IPNet{lb}, "[fd00::5]:443", "fd7a:115c:a1e0::1", true},
+		{"xff-v6-bracketed-port", "", []*net.IPNet{lb}, "[fd00::5]:443", "[fd7a:115c:a1e0::1]:5555", true},
+		{"xff-v6-public", "", []*net.IPNet{lb}, "[fd00::5]:443", "2001:db8::1", false},
+		{"xff-v6-untrusted-proxy", "", []*net.IPNet{lb}, "[2001:db8::5]:443", "fd7a:115c:a1e0::1", false},
+	}
+	for _, tt := range tests {
+		os.Setenv("ALLOW_DEBUG_IP", tt.env)
+		SetTrustedProxies(tt.proxies)
+		r := httptest.NewRequest("GET", "/debug/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := AllowDebugAccess(r); got != tt.want {
+			t.Errorf("%s: AllowDebugAccess = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	ok := HealthCheck{"ok", func() error { return nil }}
+	bad := HealthCheck{"db", func() error { return errors.New("connection refused") }}
+	tests := []struct {
+		name     string
+		checks   []HealthCheck
+		remote   string
+		wantCode int
+		wantBody string
+	}{
+		{"no-checks", nil, "8.8.8.8:1234", 200, "ok\n"},
+		{"healthy", []HealthCheck{ok}, "8.8.8.8:1234", 200, "ok\n"},
+		{"unhealthy-public", []HealthCheck{ok, bad}, "8.8.8.8:1234", 503, "unhealthy\n"},
+		{"unhealthy-debug", []HealthCheck{ok, bad}, "127.0.0.1:1234", 503, "unhealthy\ndb: connection refused\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			RegisterHealthHandler(mux, tt.checks...)
+			r := httptest.NewRequest("GET", "/healthz", nil)
+			r.RemoteAddr = tt.remote
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, r)
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %d; want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q; want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestStalenessCheck(t *testing.T) {
+	var last time.Time
+	c := StalenessCheck("stun", func() time.Time { return last }, time.Minute)
+	if err := c.Check(); err == nil {
+		t.Error("zero time: got nil error")
+	}
+	last = time.Now().Add(-2 * time.Minute)
+	if err := c.Check(); err == nil {
+		t.Error("stale time: got nil error")
+	}
+	last = time.Now()
+	if err := c.Check(); err != nil {
+		t.Errorf("fresh time: %v", err)
+	}
+}
+
+func TestAllowCORS(t *testing.T) {
+	const dash = "https://dash.example.com"
+	h := AllowCORS(Protected(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "vars")
+	})), []string{dash})
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		remote      string
+		wantCode    int
+		wantAllowed string // Access-Control-Allow-Origin
+	}{
+		{"no-origin", "GET", "", false, "127.0.0.1:1234", 200, ""},
+		{"allowed", "GET", dash, false, "127.0.0.1:1234", 200, dash},
+		{"other-origin", "GET", "https://evil.example.com", false, "127.0.0.1:1234", 200, ""},
+		{"allowed-unauthorized-ip", "GET", dash, false, "8.8.8.8:1234", 403, dash},
+		{"preflight-allowed", "OPTIONS", dash, true, "8.8.8.8:1234", 204, dash},
+		{"preflight-other-origin", "OPTIONS", "https://evil.example.com", true, "8.8.8.8:1234", 204, ""},
+		{"options-not-preflight", "OPTIONS", dash, false, "127.0.0.1:1234", 200, dash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/debug/varz", nil)
+			r.RemoteAddr = tt.remote
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", "GET")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %d; want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllowed {
+				t.Errorf("Access-Control-Allow-Origin = %q; want %q", got, tt.wantAllowed)
+			}
+			if tt.preflight && tt.wantAllowed != "" && rec.Header().Get("Access-Control-Allow-Methods") == "" {
+				t.Error("preflight response missing Access-Control-Allow-Methods")
+			}
+		})
+	}
+}
+
+func TestPort80Handler(t *testing.T) {
+	main := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "debug") })
+	tests := []struct {
+		name     string
+		h        Port80Handler
+		host     string
+		uri      string
+		wantLoc  string
+		wantHSTS string
+	}{
+		{"default", Port80Handler{Main: main}, "example.com", "/foo", "https://example.com/foo", ""},
+		{"default-with-port", Port80Handler{Main: main}, "example.com:80", "/foo", "https://example.com:443/foo", ""},
+		{"query", Port80Handler{Main: main}, "example.com", "/foo?a=b&c=d", "https://example.com/foo?a=b&c=d", ""},
+		{"custom-port", Port80Handler{Main: main, HTTPSPort: 8443}, "example.com", "/foo", "https://example.com:8443/foo", ""},
+		{"custom-port-replaces", Port80Handler{Main: main, HTTPSPort: 8443}, "example.com:8080", "/", "https://example.com:8443/", ""},
+		{"custom-port-ipv6", Port80Handler{Main: main, HTTPSPort: 8443}, "[2001:db8::1]", "/", "https://[2001:db8::1]:8443/", ""},
+		{"hsts", Port80Handler{Main: main, HSTS: "max-age=31536000"}, "example.com", "/", "https://example.com/", "max-age=31536000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.uri, nil)
+			r.Host = tt.host
+			r.RemoteAddr = "8.8.8.8:1234"
+			rec := httptest.NewRecorder()
+			tt.h.ServeHTTP(rec, r)
+			if rec.Code != http.StatusFound {
+				t.Fatalf("code = %d; want %d", rec.Code, http.StatusFound)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantLoc {
+				t.Errorf("Location = %q; want %q", got, tt.wantLoc)
+			}
+			if got := rec.Header().Get("Strict-Transport-Security"); got != tt.wantHSTS {
+				t.Errorf("Strict-Transport-Security = %q; want %q", got, tt.wantHSTS)
+			}
+		})
+	}
+}
+
+func TestProtectedWithAccess(t *testing.T) {
+	h := ProtectedWithAccess(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "debug")
+	}), func(r *http.Request) bool {
+		return r.Header.Get("X-Test-Auth") == "yes"
+	})
+	tests := []struct {
+		name     string
+		remote   string
+		auth     string
+		wantCode int
+	}{
+		{"allowed-pod-ip", "10.244.1.7:1234", "yes", 200},
+		{"denied-pod-ip", "10.244.1.7:1234", "", 403},
+		{"loopback-not-special", "127.0.0.1:1234", "", 403},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/debug/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.auth != "" {
+			r.Header.Set("X-Test-Auth", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: code = %d; want %d", tt.name, rec.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestDebugIdentityResolver(t *testing.T) {
+	defer SetDebugIdentityResolver(nil)
+	defer func(old bool) { DevMode = old }(DevMode)
+	DevMode = true
+
+	admin := net.ParseIP("100.64.0.1")
+	SetDebugIdentityResolver(func(ip net.IP) (bool, string) {
+		switch {
+		case ip.Equal(admin):
+			return true, "admin@ (tag:admin)"
+		case interfaces.IsTailscaleIP(ip):
+			return false, "alice@ (laptop)"
+		}
+		return false, ""
+	})
+	h := Protected(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "debug")
+	}))
+	tests := []struct {
+		name     string
+		remote   string
+		wantCode int
+		wantBody string
+	}{
+		{"admin", "100.64.0.1:1234", 200, "debug"},
+		{"other-tailnet-node", "100.64.0.2:1234", 403, "debug access denied for alice@ (laptop); "},
+		{"loopback", "127.0.0.1:1234", 200, "debug"},
+		{"unknown", "203.0.113.1:1234", 403, "debug access denied; "},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/debug/", nil)
+		r.RemoteAddr = tt.remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: code = %d; want %d", tt.name, rec.Code, tt.wantCode)
+		}
+		if !strings.HasPrefix(rec.Body.String(), tt.wantBody) {
+			t.Errorf("%s: body = %q; want prefix %q", tt.name, rec.Body.String(), tt.wantBody)
+		}
+	}
+
+	SetDebugIdentityResolver(nil)
+	r := httptest.NewRequest("GET", "/debug/", nil)
+	r.RemoteAddr = "100.64.0.2:1234"
+	if !AllowDebugAccess(r) {
+		t.Error("without resolver, Tailscale IP denied")
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	defer func(old bool) { JSONErrors = old }(JSONErrors)
+	JSONErrors = true
+
+	std := StdHandler(func(w http.ResponseWriter, r *http.Request) error {
+		return Error(http.StatusNotFound, "no such thing", errors.New("internal detail"))
+	}, t.Logf)
+	denied := ProtectedWithAccess(http.NotFoundHandler(), func(*http.Request) bool { return false })
+	tests := []struct {
+		name     string
+		h        http.Handler
+		accept   string
+		wantCode int
+		wantCT   string
+		wantBody string
+	}{
+		{"std-json", std, "application/json", 404, "application/json", `{"error":{"code":404,"message":"no such thing"}}` + "\n"},
+		{"std-text", std, "text/plain", 404, "text/plain; charset=utf-8", "no such thing\n"},
+		{"std-json-refused", std, "text/html, application/json;q=0", 404, "text/plain; charset=utf-8", "no such thing\n"},
+		{"protected-json", denied, "text/html;q=0.9, application/json", 403, "application/json", `{"error":{"code":403,"message":"debug access denied"}}` + "\n"},
+		{"protected-text", denied, "", 403, "text/plain; charset=utf-8", "debug access denied\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			tt.h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %d; want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantCT {
+				t.Errorf("Content-Type = %q; want %q", got, tt.wantCT)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q; want %q", got, tt.wantBody)
+			}
+		})
+	}
+
+	// Without the option, JSON clients get plain text as before.
+	JSONErrors = false
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	std.ServeHTTP(rec, req)
+	if got := rec.Body.String(); got != "no such thing\n" {
+		t.Errorf("with JSONErrors unset, body = %q", got)
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+	mux.HandleFunc("/implicit", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/ok", http.StatusFound) })
+	mux.HandleFunc("/boom", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "boom", 503) })
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("ResponseWriter isn't an http.Flusher")
+		}
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Error("ResponseWriter isn't an http.Hijacker")
+		}
+	})
+	h := Instrument(mux)
+
+	classes := []string{"2xx", "3xx", "4xx", "5xx"}
+	count := func() (total int64, byClass map[string]int64) {
+		byClass = map[string]int64{}
+		for _, c := range classes {
+			byClass[c] = httpRequestsByClass.Get(c).Value()
+		}
+		return httpRequests.Value(), byClass
+	}
+	total0, class0 := count()
+	for _, path := range []string{"/ok", "/implicit", "/redirect", "/boom", "/missing", "/missing", "/stream"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	total1, class1 := count()
+
+	if got := total1 - total0; got != 7 {
+		t.Errorf("total = %d; want 7", got)
+	}
+	want := map[string]int64{"2xx": 3, "3xx": 1, "4xx": 2, "5xx": 1}
+	for _, c := range classes {
+		if got := class1[c] - class0[c]; got != want[c] {
+			t.Errorf("%s = %d; want %d", c, got, want[c])
+		}
+	}
+}
+
+func TestGzip(t *testing.T) {
+	big := strings.Repeat("metric 1\n", gzipMinSize)
+	tests := []struct {
+		name     string
+		accept   string
+		h        http.HandlerFunc
+		wantGzip bool
+		wantBody string
+	}{
+		{
+			name:     "big",
+			accept:   "gzip, deflate",
+			h:        func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, big) },
+			wantGzip: true,
+			wantBody: big,
+		},
+		{
+			name:     "no_accept",
+			h:        func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, big) },
+			wantBody: big,
+		},
+		{
+			name:     "refused",
+			accept:   "gzip;q=0",
+			h:        func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, big) },
+			wantBody: big,
+		},
+		{
+			name:     "small",
+			accept:   "gzip",
+			h:        func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "small") },
+			wantBody: "small",
+		},
+		{
+			name:   "already_encoded",
+			accept: "gzip",
+			h: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "br")
+				io.WriteString(w, big)
+			},
+			wantBody: big,
+		},
+		{
+			name:   "streamed",
+			accept: "gzip",
+			h: func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "first ")
+				w.(http.Flusher).Flush()
+				io.WriteString(w, "second")
+			},
+			wantGzip: true,
+			wantBody: "first second",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			Gzip(tt.h).ServeHTTP(rec, req)
+
+			body := rec.Body.Bytes()
+			gotGzip := rec.Header().Get("Content-Encoding") == "gzip"
+			if gotGzip != tt.wantGzip {
+				t.Fatalf("gzipped = %v; want %v", gotGzip, tt.wantGzip)
+			}
+			if gotGzip {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = ioutil.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != tt.wantBody {
+				t.Errorf("body = %.40q...; want %.40q...", body, tt.wantBody)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q; want Accept-Encoding", got)
+			}
+		})
+	}
+}
+
+func TestRegisterVersion(t *testing.T) {
+	// RegisterVersion publishes a global expvar, so it can only be
+	// called once per process; test setVersion, which does the rest.
+	defer func(v, c string) { Version, Commit = v, c }(Version, Commit)
+	defer func(v, c string) { registeredVersion, registeredCommit = v, c }(registeredVersion, registeredCommit)
+	Version, Commit = "1.0", "abc123"
+	info := setVersion("", "")
+
+	if got, want := info.String(), `{"commit":"abc123","version":"1.0"}`; got != want {
+		t.Errorf("build_info = %s; want %s", got, want)
+	}
+	if registeredVersion != "1.0" || registeredCommit != "abc123" {
+		t.Errorf("registered %q, %q; want 1.0, abc123", registeredVersion, registeredCommit)
+	}
+}
+
+func TestDebugIndex(t *testing.T) {
+	defer func() { browserLinks = nil }()
+	defer func(v, c string) { registeredVersion, registeredCommit = v, c }(registeredVersion, registeredCommit)
+	registeredVersion, registeredCommit = "1.2.3", "abc123"
+	AddBrowserLink("Peers <all>", "/debug/peers?all=1&x=2")
+
+	mux := NewMuxWithAccess(nil, func(r *http.Request) bool {
+		return r.Header.Get("X-Test-Auth") == "yes"
+	})
+	get := func(path string, auth bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if auth {
+			r.Header.Set("X-Test-Auth", "yes")
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec
+	}
+
+	if rec := get("/debug/", false); rec.Code != http.StatusForbidden {
+		t.Errorf("unauthorized: code = %d; want 403", rec.Code)
+	}
+	if rec := get("/debug/nope", true); rec.Code != http.StatusNotFound {
+		t.Errorf("/debug/nope: code = %d; want 404", rec.Code)
+	}
+	rec := get("/debug/", true)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d; want 200", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`<a href="/debug/pprof/">`,
+		`<a href="/debug/vars">`,
+		`<a href="/debug/vars.json">`,
+		`<a href="/debug/varz">`,
+		`<a href="/healthz">`,
+		`<a href="/debug/peers?all=1&amp;x=2">Peers &lt;all&gt;</a>`,
+		"<b>Uptime:</b>",
+		"<b>Version:</b> 1.2.3 (abc123)",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("index page lacks %q; got:\n%s", want, body)
+		}
+	}
+}
+
+func TestPprofAccess(t *testing.T) {
+	isAdmin := func(r *http.Request) bool {
+		ip, _, _ := requestIP(r)
+		return ip.Equal(net.ParseIP("100.64.0.1"))
+	}
+	mux := NewMuxWithAccess(nil, AllowDebugAccess, PprofAccess(isAdmin))
+
+	tests := []struct {
+		name   string
+		remote string
+		path   string
+		want   int
+	}{
+		{"admin-pprof", "100.64.0.1:1234", "/debug/pprof/", 200},
+		{"admin-varz", "100.64.0.1:1234", "/debug/varz", 200},
+		{"tailnet-pprof", "100.64.0.2:1234", "/debug/pprof/", 403},
+		{"tailnet-varz", "100.64.0.2:1234", "/debug/varz", 200},
+		{"tailnet-vars", "100.64.0.2:1234", "/debug/vars", 200},
+		// The stricter check is on top of the shared one.
+		{"internet-pprof", "8.8.8.8:1234", "/debug/pprof/", 403},
+		{"internet-varz", "8.8.8.8:1234", "/debug/varz", 403},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.RemoteAddr = tt.remote
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		if rec.Code != tt.want {
+			t.Errorf("%s: code = %d; want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	// Without PprofAccess, pprof has the same access as the rest.
+	mux = NewMuxWithAccess(nil, AllowDebugAccess)
+	r := httptest.NewRequest("GET", "/debug/pprof/", nil)
+	r.RemoteAddr = "100.64.0.2:1234"
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	if rec.Code != 200 {
+		t.Errorf("default pprof access for tailnet node: code = %d; want 200", rec.Code)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &RateLimiter{Rate: 1, Burst: 2, ExemptLoopback: true, MaxClients: 2}
+	h := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/debug/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i, want := range []int{200, 200, 429} {
+		if got := get("192.0.2.1:1234").Code; got != want {
+			t.Errorf("request %d: code = %d; want %d", i, got, want)
+		}
+	}
+	if got := get("192.0.2.1:5678").Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q; want 1", got)
+	}
+	if got := get("192.0.2.2:1234").Code; got != 200 {
+		t.Errorf("other client: code = %d; want 200", got)
+	}
+	for i := 0; i < 5; i++ {
+		if got := get("127.0.0.1:1234").Code; got != 200 {
+			t.Fatalf("loopback request %d: code = %d; want 200", i, got)
+		}
+	}
+
+	// A client whose address can't be determined, here because of an
+	// untrusted X-Forwarded-For, is limited by its host across ports.
+	for i, want := range []int{200, 200, 429} {
+		req := httptest.NewRequest("GET", "/debug/", nil)
+		req.RemoteAddr = fmt.Sprintf("192.0.2.4:%d", 1000+i)
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := rec.Code; got != want {
+			t.Errorf("untrusted proxy request %d: code = %d; want %d", i, got, want)
+		}
+	}
+
+	// Tokens refill at Rate.
+	now := time.Now().Add(time.Hour)
+	if wait := l.take("192.0.2.3", now); wait != 0 {
+		t.Errorf("new client waits %v", wait)
+	}
+	l.take("192.0.2.3", now)
+	if wait := l.take("192.0.2.3", now); wait != time.Second {
+		t.Errorf("empty bucket waits %v; want 1s", wait)
+	}
+	if wait := l.take("192.0.2.3", now.Add(time.Second)); wait != 0 {
+		t.Errorf("refilled bucket waits %v", wait)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n := l.lru.Len(); n != 2 || len(l.byIP) != 2 {
+		t.Errorf("tracking %d clients (%d in map); want MaxClients = 2", n, len(l.byIP))
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	var logs []string
+	var logMu sync.Mutex
+	s := &Server{
+		HTTP:        &http.Server{Handler: mux},
+		GracePeriod: 50 * time.Millisecond,
+		Logf: func(format string, args ...interface{}) {
+			logMu.Lock()
+			defer logMu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	}
+	ready := s.ReadinessCheck()
+	RegisterHealthHandler(mux, ready)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	base := "http://" + ln.Addr().String()
+
+	slowErr := make(chan error, 1)
+	go func() {
+		res, err := http.Get(base + "/slow")
+		if err == nil {
+			_, err = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+		}
+		slowErr <- err
+	}()
+	<-started
+
+	if err := ready.Check(); err != nil {
+		t.Fatalf("before Shutdown, readiness = %v", err)
+	}
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- s.Shutdown(context.Background()) }()
+
+	// While draining, the health check fails but requests are
+	// still served.
+	deadline := time.Now().Add(5 * time.Second)
+	for ready.Check() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("readiness still passing after Shutdown")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	res, err := http.Get(base + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/healthz while draining = %d; want 503", res.StatusCode)
+	}
+
+	// Let the grace period end with the slow request in flight.
+	time.Sleep(4 * s.GracePeriod)
+	close(release)
+	if err := <-slowErr; err != nil {
+		t.Errorf("in-flight request failed: %v", err)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown = %v", err)
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	if !strings.Contains(strings.Join(logs, "\n"), "waiting for 1 in-flight") {
+		t.Errorf("logs = %q; want in-flight count of 1", logs)
+	}
+}
+
+func TestMaxBytesHandler(t *testing.T) {
+	const limit = 10
+	readAll := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "read error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "got %d", len(b))
+	})
+	ignoreBody := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	tests := []struct {
+		name     string
+		h        http.Handler
+		bodyLen  int
+		chunked  bool // unknown Content-Length
+		wantCode int
+		wantBody string
+	}{
+		{"under", MaxBytesHandler(readAll, limit), limit - 1, false, 200, "got 9"},
+		{"at", MaxBytesHandler(readAll, limit), limit, false, 200, "got 10"},
+		{"over", MaxBytesHandler(readAll, limit), limit + 1, false, 413, "request body too large\n"},
+		{"under-chunked", MaxBytesHandler(readAll, limit), limit - 1, true, 200, "got 9"},
+		{"at-chunked", MaxBytesHandler(readAll, limit), limit, true, 200, "got 10"},
+		{"over-chunked", MaxBytesHandler(readAll, limit), limit + 1, true, 413, "request body too large\n"},
+		{"over-unread", MaxBytesHandler(ignoreBody, limit), limit + 1, false, 200, "ok"},
+		{"route-raises-limit", MaxBytesHandler(MaxBytesHandler(readAll, 2*limit), limit), 2 * limit, true, 200, "got 20"},
+		{"route-lowers-limit", MaxBytesHandler(MaxBytesHandler(readAll, limit/2), limit), limit, true, 413, "request body too large\n"},
+		{"debug-default", newDebugOptions(nil).limit(readAll), DefaultMaxDebugBodyBytes + 1, false, 413, "request body too large\n"},
+		{"debug-option", newDebugOptions([]DebugOption{MaxDebugBodyBytes(limit)}).limit(readAll), limit + 1, false, 413, "request body too large\n"},
+		{"debug-unlimited", newDebugOptions([]DebugOption{MaxDebugBodyBytes(0)}).limit(readAll), DefaultMaxDebugBodyBytes + 1, false, 200, fmt.Sprintf("got %d", DefaultMaxDebugBodyBytes+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, tt.bodyLen)))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			tt.h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("code = %d; want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body = %q; want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
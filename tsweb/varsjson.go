@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+
+	"tailscale.com/metrics"
+)
+
+// varsJSONHandler serves all expvars as indented JSON, for humans.
+// Unlike /debug/vars, each *metrics.Set is a nested object of its
+// members, descended into as by varzHandler, and objects' keys are
+// sorted.
+func varsJSONHandler(w http.ResponseWriter, r *http.Request) {
+	j, err := json.MarshalIndent(expVarTree(expvar.Do), "", "  ")
+	if err != nil {
+		httpError(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(append(j, '\n'))
+}
+
+// expVarTree returns the variables listed by do, such as expvar.Do,
+// as a JSON-encodable tree: a map of each variable's key to its
+// JSON value, or, for a *metrics.Set, to a map of its members.
+func expVarTree(do func(func(expvar.KeyValue))) map[string]interface{} {
+	root := make(map[string]interface{})
+	do(func(kv expvar.KeyValue) {
+		walkExpVar(nil, kv, func(path []string, kv expvar.KeyValue) {
+			m := root
+			for _, k := range path {
+				m = m[k].(map[string]interface{})
+			}
+			if _, ok := kv.Value.(*metrics.Set); ok {
+				m[kv.Key] = make(map[string]interface{})
+				return
+			}
+			s := kv.Value.String()
+			if json.Valid([]byte(s)) {
+				m[kv.Key] = json.RawMessage(s)
+			} else {
+				m[kv.Key] = s
+			}
+		})
+	})
+	return root
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsweb
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// varzScrapeStats records when varzHandler last ran and how long its
+// export took, so that scrapes stopping or getting slow can be
+// alarmed on.
+type varzScrapeStats struct {
+	now func() time.Time // time.Now, except in tests
+
+	mu   sync.Mutex
+	last time.Time // when the last scrape finished; zero if never
+	dur  time.Duration
+}
+
+// record records a scrape that started at start and has just
+// finished.
+func (s *varzScrapeStats) record(start time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = s.now()
+	s.dur = s.last.Sub(start)
+}
+
+// lastUnix returns when the last scrape finished, in seconds since
+// the Unix epoch, or 0 if there hasn't been one.
+func (s *varzScrapeStats) lastUnix() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last.IsZero() {
+		return 0
+	}
+	return s.last.Unix()
+}
+
+// durationMillis returns how long the last scrape took.
+func (s *varzScrapeStats) durationMillis() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int64(s.dur / time.Millisecond)
+}
+
+var varzScrapes = &varzScrapeStats{now: time.Now}
+
+// The scrape stats are in varzHandler's own output, as of the
+// previous scrape.
+func init() {
+	expvar.Publish("gauge_varz_last_scrape_unixtime", expvar.Func(func() interface{} { return varzScrapes.lastUnix() }))
+	expvar.Publish("gauge_varz_scrape_duration_ms", expvar.Func(func() interface{} { return varzScrapes.durationMillis() }))
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// sendBatchWindow is how long a sendBatcher holds the first packet
+// of a batch waiting for more.
+const sendBatchWindow = 100 * time.Microsecond
+
+// maxSendBatch is the most packets a sendBatcher writes at once.
+const maxSendBatch = 64
+
+// A sendBatcher coalesces UDP writes made within sendBatchWindow of
+// each other into a single write of many datagrams. On Linux, that
+// write is one sendmmsg system call; elsewhere, ipv4.PacketConn
+// falls back to a write per datagram.
+//
+// Packets are copied into buffers owned by the sendBatcher, which
+// are reused, so callers may reuse theirs as soon as write returns.
+type sendBatcher struct {
+	conn *RebindingUDPConn
+	logf func(format string, args ...interface{})
+
+	mu     sync.Mutex
+	msgs   []ipv4.Message // msgs[:n] are pending; each has one buffer
+	n      int
+	clock  clock
+	timer  timer // fires flush; nil until first use
+	armed  bool  // timer is pending
+	closed bool
+}
+
+func newSendBatcher(conn *RebindingUDPConn, logf func(format string, args ...interface{}), clock clock) *sendBatcher {
+	b := &sendBatcher{
+		conn:  conn,
+		logf:  logf,
+		clock: clock,
+		msgs:  make([]ipv4.Message, maxSendBatch),
+	}
+	for i := range b.msgs {
+		b.msgs[i].Buffers = make([][]byte, 1)
+	}
+	return b
+}
+
+// write queues pkt to be sent to addr. Errors from the eventual
+// write are logged rather than returned, as with any lost datagram.
+func (b *sendBatcher) write(pkt []byte, addr *net.UDPAddr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	m := &b.msgs[b.n]
+	m.Buffers[0] = append(m.Buffers[0][:0], pkt...)
+	m.Addr = addr
+	b.n++
+	if b.n == len(b.msgs) {
+		b.flushLocked()
+		return
+	}
+	if !b.armed {
+		b.armed = true
+		if b.timer == nil {
+			b.timer = b.clock.AfterFunc(sendBatchWindow, b.flush)
+		} else {
+			b.timer.Reset(sendBatchWindow)
+		}
+	}
+}
+
+func (b *sendBatcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *sendBatcher) flushLocked() {
+	if b.armed {
+		b.timer.Stop()
+		b.armed = false
+	}
+	if b.n == 0 || b.closed {
+		return
+	}
+	msgs := b.msgs[:b.n]
+	for len(msgs) > 0 {
+		n, err := b.conn.writeBatch(msgs)
+		if err != nil {
+			b.logf("magicsock: batch send of %d packets: %v", len(msgs), err)
+			// Skip the packet that failed and try the rest.
+			n++
+		}
+		msgs = msgs[n:]
+	}
+	for i := range b.msgs[:b.n] {
+		b.msgs[i].Addr = nil
+	}
+	b.n = 0
+}
+
+// close discards any pending packets and stops b's timer.
+func (b *sendBatcher) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
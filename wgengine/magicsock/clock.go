@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import "time"
+
+// A clock is the source of time for a Conn: the current time, and
+// timers and tickers. All of a Conn's time-dependent logic uses its
+// clock, so tests can substitute a fake one (see Options.clock) and
+// advance time without sleeping.
+//
+// The exceptions are deadlines on network I/O, such as STUN and
+// DERP probe timeouts, which bound real operations, and Close's
+// wait for c's goroutines to exit.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+	NewTicker(d time.Duration) ticker
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+// A timer is like a *time.Timer.
+type timer interface {
+	// Chan returns the channel the time is sent on when the timer
+	// fires. It's nil for timers from AfterFunc.
+	Chan() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// A ticker is like a *time.Ticker.
+type ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                   { return time.Now() }
+func (realClock) NewTimer(d time.Duration) timer   { return realTimer{time.NewTimer(d)} }
+func (realClock) NewTicker(d time.Duration) ticker { return realTicker{time.NewTicker(d)} }
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct{ *time.Timer }
+
+func (t realTimer) Chan() <-chan time.Time { return t.C }
+
+type realTicker struct{ *time.Ticker }
+
+func (t realTicker) Chan() <-chan time.Time { return t.C }
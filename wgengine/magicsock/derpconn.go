@@ -0,0 +1,179 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"context"
+	crand "crypto/rand"
+	"net"
+	"sync"
+	"time"
+
+	"tailscale.com/derp/derphttp"
+)
+
+// DefaultDERPReconnectBackoff is the default value of
+// Options.DERPReconnectBackoff.
+const DefaultDERPReconnectBackoff = 250 * time.Millisecond
+
+// DefaultDERPReconnectMaxBackoff is the default value of
+// Options.DERPReconnectMaxBackoff.
+const DefaultDERPReconnectMaxBackoff = 10 * time.Second
+
+// DefaultDERPKeepaliveInterval is the default value of
+// Options.DERPKeepaliveInterval. It's well under the two minutes a
+// DERP connection may otherwise sit dead before a read times out.
+const DefaultDERPKeepaliveInterval = 30 * time.Second
+
+func (o *Options) derpReconnectBackoff() (base, max time.Duration) {
+	base, max = o.DERPReconnectBackoff, o.DERPReconnectMaxBackoff
+	if base <= 0 {
+		base = DefaultDERPReconnectBackoff
+	}
+	if max <= 0 {
+		max = DefaultDERPReconnectMaxBackoff
+	}
+	if max < base {
+		max = base
+	}
+	return base, max
+}
+
+func (o *Options) derpKeepaliveInterval() time.Duration {
+	if o.DERPKeepaliveInterval == 0 {
+		return DefaultDERPKeepaliveInterval
+	}
+	if o.DERPKeepaliveInterval < 0 {
+		return 0
+	}
+	return o.DERPKeepaliveInterval
+}
+
+// derpBackoff returns how long to wait before reconnecting to a DERP
+// server after n consecutive failures, n >= 1: base, doubling with
+// each further failure, up to max.
+func derpBackoff(base, max time.Duration, n int) time.Duration {
+	d := base
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// derpConnState is the state of the connection to a DERP server, as
+// seen by its derpReader and derpKeepalive goroutines.
+type derpConnState struct {
+	box *discoBox // for keepalive pings to ourselves
+
+	mu        sync.Mutex
+	connected bool      // the last connect succeeded and no read has failed since
+	pingTx    discoTxID // of the keepalive ping in flight
+	pingSent  bool      // a keepalive ping is in flight
+}
+
+// setConnected records whether the connection is up, reporting
+// whether that's a change.
+func (s *derpConnState) setConnected(v bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connected == v {
+		return false
+	}
+	s.connected = v
+	s.pingSent = false
+	return true
+}
+
+func (s *derpConnState) isConnected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected
+}
+
+// nextPing returns the transaction ID of the next keepalive ping to
+// send, if the connection is up. dead is true instead if the last
+// ping went unanswered, along with everything else since.
+func (s *derpConnState) nextPing() (tx discoTxID, send, dead bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.connected {
+		return tx, false, false
+	}
+	if s.pingSent {
+		s.pingSent = false
+		return tx, false, true
+	}
+	if _, err := crand.Read(tx[:]); err != nil {
+		panic(err)
+	}
+	s.pingTx, s.pingSent = tx, true
+	return tx, true, false
+}
+
+// noteRecv records that the packet b was received on the connection,
+// which is therefore alive. It reports whether b is our own
+// keepalive ping, come back, which isn't for WireGuard.
+func (s *derpConnState) noteRecv(b []byte) (isPing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if from, ok := discoSender(b); ok && from == s.box.self {
+		typ, tx, ok := s.box.open(b)
+		isPing = ok && typ == discoTypePing && tx == s.pingTx
+	}
+	s.pingSent = false
+	return isPing
+}
+
+// DERPConnected reports whether c is connected to the DERP server of
+// its preferred region (see SetPreferredDERP). Connections are made
+// on first use, and remade after failing, with exponential backoff
+// per Options.DERPReconnectBackoff. Each attempt to reconnect is
+// counted in the "derp_reconnects" metric.
+func (c *Conn) DERPConnected() bool {
+	c.derpMu.Lock()
+	st := c.derpState[c.myDerp]
+	c.derpMu.Unlock()
+	return st != nil && st.isConnected()
+}
+
+// runDerpKeepalive runs in a goroutine for the life of a DERP
+// connection, unless DERP keepalives are disabled. Every interval,
+// it sends a disco ping to ourselves via the server, through ch. If
+// nothing, including the ping, has been received by the next one,
+// the connection is presumed dead and dropped, for runDerpReader to
+// reconnect.
+func (c *Conn) runDerpKeepalive(ctx context.Context, derpFakeAddr *net.UDPAddr, dc *derphttp.Client, st *derpConnState, ch chan<- derpWriteRequest) {
+	t := c.clock.NewTicker(c.derpKeepaliveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.donec():
+			return
+		case <-t.Chan():
+		}
+		tx, send, dead := st.nextPing()
+		if dead {
+			c.logf("magicsock: derp-%d: no reply to keepalive in %v; reconnecting", derpFakeAddr.Port, c.derpKeepaliveInterval)
+			dc.Reset()
+			continue
+		}
+		if !send {
+			continue
+		}
+		var buf [discoMsgLen]byte
+		wr := derpWriteRequest{derpFakeAddr, st.box.self, st.box.appendMsg(buf[:0], discoTypePing, tx), make(chan error, 1)}
+		select {
+		case ch <- wr:
+		default:
+			// Writes are backed up. Unless something is received
+			// meanwhile, the next tick drops the connection.
+		}
+	}
+}
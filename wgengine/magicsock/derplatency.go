@@ -0,0 +1,154 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DefaultDERPProbeInterval is the default value of
+// Options.DERPProbeInterval.
+const DefaultDERPProbeInterval = 1 * time.Minute
+
+// derpSwitchRatio is how many times slower than the fastest region
+// the home DERP region must get before it's switched.
+const derpSwitchRatio = 1.5
+
+// derpProbeTimeout bounds how long a single DERP region probe takes.
+const derpProbeTimeout = 5 * time.Second
+
+// DERPLatencies returns the most recently measured round-trip time to
+// each DERP region in the DERP map, keyed by region number. Regions
+// that haven't been successfully probed are omitted.
+func (c *Conn) DERPLatencies() map[int]time.Duration {
+	c.derpLatMu.Lock()
+	defer c.derpLatMu.Unlock()
+	ret := make(map[int]time.Duration, len(c.derpLat))
+	for region, d := range c.derpLat {
+		ret[region] = d
+	}
+	return ret
+}
+
+// HomeDERP returns c's preferred DERP region, or 0 if it has none.
+func (c *Conn) HomeDERP() int {
+	c.derpMu.Lock()
+	defer c.derpMu.Unlock()
+	return c.myDerp
+}
+
+// probeDERPRegionsLoop runs in its own goroutine until ctx is done,
+// probing the DERP map's regions every c.derpProbeInterval.
+func (c *Conn) probeDERPRegionsLoop(ctx context.Context) {
+	ticker := c.clock.NewTicker(c.derpProbeInterval)
+	defer ticker.Stop()
+	for {
+		c.probeDERPRegions(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.Chan():
+		}
+	}
+}
+
+// probeDERPRegions measures the latency to each region in the DERP
+// map concurrently, then switches the home region if there's a
+// sufficiently faster one.
+func (c *Conn) probeDERPRegions(ctx context.Context) {
+	type result struct {
+		region int
+		d      time.Duration
+		err    error
+	}
+	results := make(chan result, len(c.derpMap))
+	for region := range c.derpMap {
+		go func(region int) {
+			ctx, cancel := context.WithTimeout(ctx, derpProbeTimeout)
+			defer cancel()
+			d, err := c.derpProbe(ctx, c.derpHost(region))
+			results <- result{region, d, err}
+		}(region)
+	}
+	lat := map[int]time.Duration{}
+	for range c.derpMap {
+		r := <-results
+		if r.err != nil {
+			c.logf("magicsock: DERP region %d probe: %v", r.region, r.err)
+			continue
+		}
+		lat[r.region] = r.d
+	}
+	c.derpLatMu.Lock()
+	c.derpLat = lat
+	c.derpLatMu.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+	if best := pickHomeDERP(c.HomeDERP(), lat); best != c.HomeDERP() {
+		c.logf("magicsock: home DERP region %d -> %d (latencies %v)", c.HomeDERP(), best, lat)
+		c.SetPreferredDERP(best)
+	}
+}
+
+// pickHomeDERP returns the region that should be home given the
+// current home region and the measured latencies. It sticks with the
+// current region unless another is more than derpSwitchRatio times
+// faster, to avoid flapping between similar regions.
+func pickHomeDERP(home int, lat map[int]time.Duration) int {
+	if len(lat) == 0 {
+		return home
+	}
+	regions := make([]int, 0, len(lat))
+	for region := range lat {
+		regions = append(regions, region)
+	}
+	sort.Ints(regions) // for determinism among equal latencies
+	best := regions[0]
+	for _, region := range regions[1:] {
+		if lat[region] < lat[best] {
+			best = region
+		}
+	}
+	cur, ok := lat[home]
+	if ok && float64(cur) <= derpSwitchRatio*float64(lat[best]) {
+		return home
+	}
+	return best
+}
+
+var derpProbeClient = &http.Client{
+	// Don't follow redirects; any response will do.
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// httpDERPProbe returns how long an HTTPS request to the DERP server
+// at host takes to get a response.
+func (c *Conn) httpDERPProbe(ctx context.Context, host string) (time.Duration, error) {
+	req, err := http.NewRequest("HEAD", "https://"+host+"/derp", nil)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	start := c.clock.Now()
+	client := derpProbeClient
+	if c.derpHTTPClient != nil {
+		cc := *c.derpHTTPClient
+		if cc.CheckRedirect == nil {
+			cc.CheckRedirect = derpProbeClient.CheckRedirect
+		}
+		client = &cc
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return c.clock.Now().Sub(start), nil
+}
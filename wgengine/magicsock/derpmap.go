@@ -47,3 +47,27 @@ func derpHost(i int) string {
 	}
 	return "derp.tailscale.com"
 }
+
+// DERPRegion is a region of DERP relay servers.
+type DERPRegion struct {
+	// Hosts are the region's relay servers, as "host" or
+	// "host:port" addresses for HTTPS. Only the first is
+	// currently used.
+	Hosts []string
+}
+
+// derpHost returns the host of DERP server index i (a fake port
+// number used with derpMagicIP), consulting c's DERP map before the
+// built-in one. It always returns a non-empty string.
+func (c *Conn) derpHost(i int) string {
+	if r, ok := c.derpMap[i]; ok && len(r.Hosts) > 0 {
+		return r.Hosts[0]
+	}
+	return derpHost(i)
+}
+
+// derpAddr returns the fake UDP address that represents DERP
+// region i.
+func derpAddr(i int) *net.UDPAddr {
+	return &net.UDPAddr{IP: derpMagicIP, Port: i}
+}
@@ -0,0 +1,566 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/crypto/nacl/box"
+	"tailscale.com/types/key"
+)
+
+// Disco ("discovery") messages are a tiny ping/pong protocol used to
+// confirm that a peer's endpoint is reachable in both directions
+// before preferring it for data. They share the UDP socket with
+// WireGuard and STUN, and are told apart by discoMagic, which
+// neither a WireGuard message type nor a STUN header can start with.
+//
+// A message is discoMagic, the sender's public key, a random nonce,
+// and a type byte and random transaction ID, which a pong echoes from
+// its ping, sealed with NaCl box from the sender's private key to the
+// recipient's public key. The keys are the WireGuard ones. Only
+// configured peers are answered, and a pong only counts if it's from
+// the peer that was pinged, so it proves that the endpoint reaches the
+// holder of the peer's private key, not just something that saw the
+// ping.
+const discoMagic = "TS\xf0\x9f\x92\xac" // "TS💬"
+
+const (
+	discoTypePing = 0x01
+	discoTypePong = 0x02
+)
+
+const (
+	discoHeaderLen = len(discoMagic) + len(key.Public{}) + discoNonceLen
+	discoNonceLen  = 24
+	discoMsgLen    = discoHeaderLen + 1 + len(discoTxID{}) + box.Overhead
+)
+
+type discoTxID [12]byte
+
+const (
+	// discoPingInterval is how often each endpoint of a peer that
+	// we're sending to is pinged.
+	discoPingInterval = 5 * time.Second
+
+	// discoPingTimeout is how long to wait for a pong before
+	// counting the ping as failed.
+	discoPingTimeout = 5 * time.Second
+
+	// discoTrustDuration is how long after a pong an endpoint is
+	// still considered confirmed.
+	discoTrustDuration = 3 * discoPingInterval
+)
+
+// discoPing is an outstanding ping.
+type discoPing struct {
+	as   *AddrSet
+	idx  int          // index in as.addrs, or -1 for a roaming candidate
+	addr *net.UDPAddr // where the ping was sent
+	sent time.Time
+
+	keepalive bool // sent by sendKeepalive, to an already confirmed endpoint
+
+	// replies, if non-nil, is sent the pong of a ping sent by
+	// Ping, unless it already has one waiting.
+	replies chan<- pingReply
+}
+
+// A discoBox seals and opens the disco messages between us and one
+// peer, or ourselves.
+type discoBox struct {
+	self   key.Public // our public key, the sender of what's sealed
+	shared [32]byte   // precomputed from our private key and the peer's public key
+}
+
+func newDiscoBox(priv key.Private, peer key.Public) *discoBox {
+	bx := &discoBox{self: priv.Public()}
+	box.Precompute(&bx.shared, (*[32]byte)(&peer), (*[32]byte)(&priv))
+	return bx
+}
+
+// appendMsg appends to b a disco message of type typ with
+// transaction ID tx, sealed for the peer.
+func (bx *discoBox) appendMsg(b []byte, typ byte, tx discoTxID) []byte {
+	var nonce [discoNonceLen]byte
+	if _, err := crand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	var plain [1 + len(discoTxID{})]byte
+	plain[0] = typ
+	copy(plain[1:], tx[:])
+	b = append(b, discoMagic...)
+	b = append(b, bx.self[:]...)
+	b = append(b, nonce[:]...)
+	return box.SealAfterPrecomputation(b, plain[:], &nonce, &bx.shared)
+}
+
+// open returns the type and transaction ID of the disco message b,
+// if it was sealed by the peer for us.
+func (bx *discoBox) open(b []byte) (typ byte, tx discoTxID, ok bool) {
+	if len(b) != discoMsgLen {
+		return 0, tx, false
+	}
+	var nonce [discoNonceLen]byte
+	copy(nonce[:], b[discoHeaderLen-discoNonceLen:])
+	var buf [1 + len(discoTxID{})]byte
+	plain, ok := box.OpenAfterPrecomputation(buf[:0], b[discoHeaderLen:], &nonce, &bx.shared)
+	if !ok || len(plain) != len(buf) {
+		return 0, tx, false
+	}
+	copy(tx[:], plain[1:])
+	return plain[0], tx, true
+}
+
+// discoSender reports whether b is a disco message and, if so,
+// returns the public key it claims to be from. Only opening it
+// checks that.
+func discoSender(b []byte) (from key.Public, ok bool) {
+	if len(b) != discoMsgLen || string(b[:len(discoMagic)]) != discoMagic {
+		return from, false
+	}
+	copy(from[:], b[len(discoMagic):])
+	return from, true
+}
+
+// discoBoxFor returns the discoBox for messages between us and peer,
+// or nil if we don't have a private key yet.
+func (c *Conn) discoBoxFor(peer key.Public) *discoBox {
+	c.discoBoxMu.Lock()
+	defer c.discoBoxMu.Unlock()
+	if !c.syncDiscoKeyLocked() {
+		return nil
+	}
+	if bx := c.discoBoxes[peer]; bx != nil {
+		return bx
+	}
+	if c.discoBoxes == nil {
+		c.discoBoxes = make(map[key.Public]*discoBox)
+	}
+	bx := newDiscoBox(c.discoPriv, peer)
+	c.discoBoxes[peer] = bx
+	return bx
+}
+
+// selfDiscoBox returns the discoBox for messages to ourselves, or nil
+// if we don't have a private key yet.
+func (c *Conn) selfDiscoBox() *discoBox {
+	c.discoBoxMu.Lock()
+	ok, self := c.syncDiscoKeyLocked(), c.discoPub
+	c.discoBoxMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return c.discoBoxFor(self)
+}
+
+// isSelf reports whether pub is our public key.
+func (c *Conn) isSelf(pub key.Public) bool {
+	c.discoBoxMu.Lock()
+	defer c.discoBoxMu.Unlock()
+	return c.syncDiscoKeyLocked() && pub == c.discoPub
+}
+
+// syncDiscoKeyLocked catches the disco keys up with SetPrivateKey,
+// reporting whether we have a private key.
+// c.discoBoxMu must be held.
+func (c *Conn) syncDiscoKeyLocked() bool {
+	c.derpMu.Lock()
+	priv := c.privateKey
+	c.derpMu.Unlock()
+	if priv != c.discoPriv {
+		c.discoPriv, c.discoPub = priv, key.Public{}
+		if !priv.IsZero() {
+			c.discoPub = priv.Public()
+		}
+		c.discoBoxes = nil
+	}
+	return !priv.IsZero()
+}
+
+// maybeDiscoPing pings each direct endpoint of as that isn't stale,
+// if it's been discoPingInterval since they were last pinged.
+func (c *Conn) maybeDiscoPing(as *AddrSet, now time.Time) {
+	as.mu.Lock()
+	if as.removed || now.Sub(as.lastPing) < discoPingInterval {
+		as.mu.Unlock()
+		return
+	}
+	as.lastPing = now
+	addrs := as.addrs
+	stale := make([]bool, len(addrs))
+	for i := range addrs {
+		stale[i] = as.staleLocked(i, now)
+	}
+	as.mu.Unlock()
+
+	bx := c.discoBoxFor(as.publicKey)
+	if bx == nil {
+		return
+	}
+
+	c.discoMu.Lock()
+	c.expireDiscoPingsLocked(now)
+	if c.discoPending == nil {
+		c.discoPending = make(map[discoTxID]discoPing)
+	}
+	lanFirst := false
+	for i := range addrs {
+		if as.needsHairpin != nil && as.needsHairpin(&addrs[i]) {
+			lanFirst = true // the peer is behind our NAT
+		}
+	}
+	var buf [discoMsgLen]byte
+	for _, i := range pingOrder(addrs, lanFirst) {
+		addr := &addrs[i]
+		if addr.IP.Equal(derpMagicIP) || stale[i] {
+			continue
+		}
+		var tx discoTxID
+		if _, err := crand.Read(tx[:]); err != nil {
+			panic(err)
+		}
+		c.discoPending[tx] = discoPing{as: as, idx: i, addr: addr, sent: now}
+		metricDiscoPingsSent.Add(1)
+		if _, err := c.pconn.WriteTo(bx.appendMsg(buf[:0], discoTypePing, tx), addr); err != nil && c.sendLogLimit.Allow() {
+			c.logf("magicsock: disco ping to %v: %v", addr, err)
+		}
+	}
+	c.discoMu.Unlock()
+}
+
+// expireDiscoPingsLocked forgets pings that have gone unanswered for
+// discoPingTimeout, counting them as failures.
+func (c *Conn) expireDiscoPingsLocked(now time.Time) {
+	for tx, p := range c.discoPending {
+		if now.Sub(p.sent) > discoPingTimeout {
+			delete(c.discoPending, tx)
+			metricDiscoPingTimeouts.Add(1)
+		}
+	}
+}
+
+// handleDiscoMsg handles the disco message b, claiming to be from
+// the public key from, received from addr. Messages from anyone but
+// a configured peer or ourselves, or that don't open, are dropped.
+func (c *Conn) handleDiscoMsg(from key.Public, b []byte, addr *net.UDPAddr) {
+	if c.addrSetOfKey(wgcfg.Key(from)) == nil && !c.isSelf(from) {
+		metricDiscoDropped.Add(1)
+		return
+	}
+	bx := c.discoBoxFor(from)
+	if bx == nil {
+		metricDiscoDropped.Add(1)
+		return
+	}
+	typ, tx, ok := bx.open(b)
+	if !ok {
+		metricDiscoDropped.Add(1)
+		return
+	}
+	switch typ {
+	case discoTypePing:
+		if from == bx.self {
+			c.isHairpinProbe(tx)
+			return
+		}
+		var buf [discoMsgLen]byte
+		c.pconn.WriteTo(bx.appendMsg(buf[:0], discoTypePong, tx), addr)
+	case discoTypePong:
+		now := c.clock.Now()
+		c.discoMu.Lock()
+		p, ok := c.discoPending[tx]
+		if ok && p.as.publicKey == from && equalUDPAddr(p.addr, addr) {
+			delete(c.discoPending, tx)
+		} else {
+			ok = false
+		}
+		c.discoMu.Unlock()
+		if !ok {
+			return // unsolicited, expired, or from the wrong peer or address
+		}
+		metricDiscoPongsRecv.Add(1)
+		p.as.noteDirectRecv(now)
+		if p.replies != nil {
+			select {
+			case p.replies <- pingReply{addr: addr, rtt: now.Sub(p.sent)}:
+			default:
+			}
+		}
+		if p.idx == -1 {
+			if p.as.confirmRoam(addr) {
+				metricRoamMigrations.Add(1)
+				c.emit(Event{Type: EventEndpointMigrated, Peer: wgcfg.Key(p.as.publicKey), Addr: addr})
+			}
+			return
+		}
+		if p.as.notePong(p.idx, p.addr, now, now.Sub(p.sent)) && !p.keepalive {
+			c.emit(Event{Type: EventEndpointConfirmed, Peer: wgcfg.Key(p.as.publicKey), Addr: addr})
+		}
+	}
+}
+
+// probeRoamCandidate sends a disco ping, sealed to the peer of as, to
+// addr, an address the peer has sent authenticated packets from but
+// that isn't one of its known endpoints. Packets are only sent there
+// once the peer answers from it.
+func (c *Conn) probeRoamCandidate(as *AddrSet, addr *net.UDPAddr) {
+	bx := c.discoBoxFor(as.publicKey)
+	if bx == nil {
+		return
+	}
+	var tx discoTxID
+	if _, err := crand.Read(tx[:]); err != nil {
+		panic(err)
+	}
+	now := c.clock.Now()
+	c.discoMu.Lock()
+	c.expireDiscoPingsLocked(now)
+	if c.discoPending == nil {
+		c.discoPending = make(map[discoTxID]discoPing)
+	}
+	c.discoPending[tx] = discoPing{as: as, idx: -1, addr: addr, sent: now}
+	c.discoMu.Unlock()
+
+	metricDiscoPingsSent.Add(1)
+	var buf [discoMsgLen]byte
+	if _, err := c.pconn.WriteTo(bx.appendMsg(buf[:0], discoTypePing, tx), addr); err != nil && c.sendLogLimit.Allow() {
+		c.logf("magicsock: disco ping to roaming candidate %v: %v", addr, err)
+	}
+}
+
+// confirmRoam migrates a to send to its roaming candidate, if that's
+// still addr, now that a pong from the peer has come from there. It
+// reports whether it did.
+func (a *AddrSet) confirmRoam(addr *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.roamCand == nil || !equalUDPAddr(a.roamCand, addr) {
+		return false
+	}
+	pk := wgcfg.Key(a.publicKey).ShortString()
+	if a.roamAddr == nil {
+		a.logf("magicsock: %s roamed to %s, confirmed; set as new priority", pk, addr)
+	} else {
+		a.logf("magicsock: %s roamed to %s, confirmed; replaces roaming address %s", pk, addr, a.roamAddr)
+	}
+	a.roamAddr = a.roamCand
+	a.roamCand = nil
+	return true
+}
+
+// pongRTTWeight is the weight of an endpoint's smoothed round-trip
+// time when a new pong's is averaged in, as in TCP's SRTT.
+const pongRTTWeight = 7
+
+// notePong records that the endpoint addr, at index i of a.addrs,
+// answered a ping at time now, rtt after it was sent, averaging rtt
+// into the endpoint's smoothed round-trip time. It reports
+// whether the endpoint is newly confirmed, not having answered within
+// discoTrustDuration before. A pong from an endpoint that UpdatePeer
+// has since moved or removed is ignored.
+func (a *AddrSet) notePong(i int, addr *net.UDPAddr, now time.Time, rtt time.Duration) (newlyConfirmed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if i >= len(a.addrs) || !equalUDPAddr(&a.addrs[i], addr) {
+		return false
+	}
+	if a.pongAt == nil {
+		a.pongAt = make([]time.Time, len(a.addrs))
+		a.pongRTT = make([]time.Duration, len(a.addrs))
+	}
+	last := a.pongAt[i]
+	a.pongAt[i] = now
+	if last.IsZero() {
+		a.pongRTT[i] = rtt
+	} else {
+		a.pongRTT[i] = (pongRTTWeight*a.pongRTT[i] + rtt) / (pongRTTWeight + 1)
+	}
+	return last.IsZero() || now.Sub(last) >= discoTrustDuration
+}
+
+// bestConfirmedLocked returns the index in a.addrs of the best
+// endpoint that has recently answered a ping, as ranked by
+// betterPathLocked, or -1 if none has. If the path preference ranks
+// DERP above that endpoint, it returns the peer's DERP endpoint
+// instead, if it has one; DERP endpoints aren't pinged.
+func (a *AddrSet) bestConfirmedLocked(now time.Time) int {
+	best := -1
+	for i := len(a.pongAt) - 1; i >= 0; i-- {
+		if t := a.pongAt[i]; !t.IsZero() && now.Sub(t) < discoTrustDuration {
+			if best == -1 || a.betterPathLocked(i, best) {
+				best = i
+			}
+		}
+	}
+	if best == -1 {
+		return -1
+	}
+	for i := range a.addrs {
+		if a.addrs[i].IP.Equal(derpMagicIP) && a.pathRankLocked(i) < a.pathRankLocked(best) {
+			return i
+		}
+	}
+	return best
+}
+
+// PeerEndpoint returns the address that packets to the peer with
+// public key pubKey are currently sent to, when not spraying
+// handshakes to all of its endpoints. The bool reports whether the
+// peer is known.
+func (c *Conn) PeerEndpoint(pubKey wgcfg.Key) (*net.UDPAddr, bool) {
+	as := c.addrSetOfKey(pubKey)
+	if as == nil {
+		return nil, false
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	return as.peerEndpointLocked(), true
+}
+
+// PeerSendError returns the error from the latest send to the
+// peer's current endpoint, as reported by PeerEndpoint, if that send
+// failed. It returns nil once a send there succeeds, or if the peer
+// is unknown.
+//
+// A persistent error suggests the direct path to the peer is broken,
+// as when the interface it used has gone away.
+func (c *Conn) PeerSendError(pubKey wgcfg.Key) error {
+	as := c.addrSetOfKey(pubKey)
+	if as == nil {
+		return nil
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	addr := as.peerEndpointLocked()
+	if addr == nil {
+		return nil
+	}
+	if se := as.sendErrs[udpAddrKey(addr)]; se != nil {
+		return fmt.Errorf("magicsock: last %d sends to %v failed: %w", se.n, addr, se.err)
+	}
+	return nil
+}
+
+// EndpointStatus is the state of one of a peer's endpoints, as
+// returned by Conn.PeerEndpoints.
+type EndpointStatus struct {
+	Addr *net.UDPAddr
+
+	// LastSeen is when the endpoint last sent a packet WireGuard
+	// accepted or answered a disco ping, or the zero time if never.
+	LastSeen time.Time
+
+	// Confirmed is whether the endpoint is known to work: it's the
+	// one WireGuard last accepted packets from, or it recently
+	// answered a disco ping.
+	Confirmed bool
+
+	// Stale is whether the endpoint has been silent for longer than
+	// Options.EndpointTTL while another endpoint hasn't, so it's no
+	// longer pinged or sent handshakes.
+	Stale bool
+}
+
+// PeerEndpoints returns the status of each endpoint of the peer with
+// public key pubKey, in the order the peer's configuration lists
+// them. It returns nil if the peer is unknown.
+//
+// Packets from an endpoint count only once WireGuard accepts them,
+// so they've been authenticated as coming from the peer.
+func (c *Conn) PeerEndpoints(pubKey wgcfg.Key) []EndpointStatus {
+	as := c.addrSetOfKey(pubKey)
+	if as == nil {
+		return nil
+	}
+	now := c.clock.Now()
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	ret := make([]EndpointStatus, len(as.addrs))
+	for i := range as.addrs {
+		addr := as.addrs[i]
+		st := EndpointStatus{
+			Addr:     &addr,
+			LastSeen: as.lastSeenLocked(i),
+			Stale:    as.staleLocked(i, now),
+		}
+		if as.roamAddr == nil && as.curAddr == i {
+			st.Confirmed = true
+		}
+		if as.pongAt != nil {
+			if t := as.pongAt[i]; !t.IsZero() && now.Sub(t) < discoTrustDuration {
+				st.Confirmed = true
+			}
+		}
+		ret[i] = st
+	}
+	return ret
+}
+
+func (c *Conn) addrSetOfKey(pubKey wgcfg.Key) *AddrSet {
+	c.addrsMu.Lock()
+	defer c.addrsMu.Unlock()
+	return c.addrsByKey[key.Public(pubKey)]
+}
+
+// peerEndpointLocked returns the address PeerEndpoint reports, or
+// nil if the peer has no addresses.
+// a.mu must be held.
+func (a *AddrSet) peerEndpointLocked() *net.UDPAddr {
+	if a.roamAddr != nil {
+		return a.roamAddr
+	}
+	now := a.now()
+	i := a.preferredLocked(a.curAddr, now)
+	if i == -1 {
+		i = a.bestConfirmedLocked(now)
+	}
+	if i == -1 {
+		i = len(a.addrs) - 1
+	}
+	if i == -1 {
+		return nil
+	}
+	return &a.addrs[i]
+}
+
+var (
+	// ErrUnknownPeer is returned by SendTo for a public key that
+	// isn't a configured peer.
+	ErrUnknownPeer = errors.New("magicsock: unknown peer")
+
+	// ErrNoEndpoint is returned by SendTo for a peer with no
+	// endpoint to send to yet.
+	ErrNoEndpoint = errors.New("magicsock: peer has no endpoint")
+)
+
+// SendTo sends the datagram b to the peer with public key pubKey, at
+// the address PeerEndpoint reports, without involving WireGuard.
+// The peer may be reached through DERP.
+//
+// It's meant for diagnostic tools, such as reachability testers,
+// that run without a WireGuard device.
+func (c *Conn) SendTo(pubKey wgcfg.Key, b []byte) error {
+	addr, ok := c.PeerEndpoint(pubKey)
+	if !ok {
+		return ErrUnknownPeer
+	}
+	if addr == nil {
+		return ErrNoEndpoint
+	}
+	err := c.sendAddr(addr, key.Public(pubKey), b)
+	if as := c.addrSetOfKey(pubKey); as != nil {
+		as.noteSendResult(addr, err)
+	}
+	if err != nil {
+		metricSendErrors.Add(1)
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// EventType is the kind of change an Event describes.
+type EventType int
+
+const (
+	// EventEndpoint is a new endpoint of this Conn, discovered by
+	// STUN. Addr is the endpoint.
+	EventEndpoint EventType = iota + 1
+
+	// EventEndpointConfirmed is a peer's endpoint answering a disco
+	// ping after not having recently done so. Peer and Addr are set.
+	EventEndpointConfirmed
+
+	// EventDERPFallback is packets to a peer also being sent via
+	// DERP because the direct path doesn't seem to be working.
+	// Peer is set, and Addr is the peer's DERP address.
+	EventDERPFallback
+
+	// EventRebind is the Conn's UDP socket being rebound. Addr is
+	// its new local address.
+	EventRebind
+
+	// EventNATType is the kind of NAT the Conn is behind changing,
+	// as reported by Conn.NATType. NATType is set.
+	EventNATType
+
+	// EventEndpointMigrated is packets to a peer being sent to a
+	// new address the peer roamed to, once it answered a disco
+	// ping. Peer is set, and Addr is the new address.
+	EventEndpointMigrated
+
+	// EventUDPBlocked is every STUN server going unanswered for a
+	// whole endpoint discovery pass, suggesting the network blocks
+	// UDP, and EventUDPUnblocked is a STUN response arriving after
+	// that. See Conn.UDPBlocked.
+	EventUDPBlocked
+	EventUDPUnblocked
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventEndpoint:
+		return "endpoint"
+	case EventEndpointConfirmed:
+		return "endpoint-confirmed"
+	case EventDERPFallback:
+		return "derp-fallback"
+	case EventRebind:
+		return "rebind"
+	case EventNATType:
+		return "nat-type"
+	case EventEndpointMigrated:
+		return "endpoint-migrated"
+	case EventUDPBlocked:
+		return "udp-blocked"
+	case EventUDPUnblocked:
+		return "udp-unblocked"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// An Event describes a change to a Conn's endpoints or its paths to
+// its peers, as delivered by Conn.Events. Which fields beyond Type
+// and Time are set depends on Type.
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Peer    wgcfg.Key    // the peer concerned, if any
+	Addr    *net.UDPAddr // the endpoint concerned, if any
+	NATType string       // for EventNATType
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%v %v", e.Time.Format(time.RFC3339Nano), e.Type)
+	if !e.Peer.IsZero() {
+		s += " peer=" + e.Peer.ShortString()
+	}
+	if e.Addr != nil {
+		s += " addr=" + e.Addr.String()
+	}
+	if e.NATType != "" {
+		s += " nat=" + e.NATType
+	}
+	return s
+}
+
+// eventBufSize is how many events a subscriber's channel holds.
+const eventBufSize = 64
+
+// eventSubs is the set of subscribers to a Conn's events.
+type eventSubs struct {
+	mu     sync.Mutex
+	subs   map[chan Event]bool
+	closed bool // no more events will be sent
+}
+
+// Events subscribes to a structured feed of changes to c's endpoints
+// and paths to its peers, such as for a live debugging UI. It's a
+// machine-readable counterpart to some of c's logging.
+//
+// The channel is buffered. If the consumer falls behind, the oldest
+// events are dropped, counted by the magicsock expvar
+// "events_dropped", so c's data path never blocks.
+//
+// The returned func unsubscribes, closing the channel. It's safe to
+// call more than once. The channel is also closed when c is.
+func (c *Conn) Events() (events <-chan Event, unsubscribe func()) {
+	ch := make(chan Event, eventBufSize)
+	es := &c.events
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if es.subs == nil {
+		es.subs = make(map[chan Event]bool)
+	}
+	es.subs[ch] = true
+	return ch, func() {
+		es.mu.Lock()
+		defer es.mu.Unlock()
+		if es.subs[ch] {
+			delete(es.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// emit sends ev to each subscriber, with its Time set to now,
+// dropping a subscriber's oldest event if its channel is full.
+func (c *Conn) emit(ev Event) {
+	es := &c.events
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if len(es.subs) == 0 {
+		return
+	}
+	ev.Time = c.clock.Now()
+	for ch := range es.subs {
+		select {
+		case ch <- ev:
+			continue
+		default:
+		}
+		select {
+		case <-ch:
+			metricEventsDropped.Add(1)
+		default:
+			// The consumer made room.
+		}
+		// Only emit sends, and es.mu is held, so this can't block.
+		ch <- ev
+	}
+}
+
+// closeEvents closes all subscribers' channels, for Conn.Close.
+func (c *Conn) closeEvents() {
+	es := &c.events
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.closed = true
+	for ch := range es.subs {
+		close(ch)
+	}
+	es.subs = nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Goroutines
+//
+// Every goroutine a Conn owns is started with goTracked, so that
+// Close can wait for it. Their number is bounded:
+//
+//   - "epUpdate": one per Conn. It runs at most one endpoint
+//     discovery pass at a time, in a goroutine it waits for.
+//   - "keepalive": one per Conn, unless keepalives are disabled.
+//   - "derpProbe": one per Conn with a DERP map. It runs one probe
+//     per region at a time and waits for them all.
+//   - "hairpin": at most one in flight per endpoint change, each
+//     ending after hairpinTimeout.
+//   - "derpReader" and "derpWriter": one each per DERP connection,
+//     and "derpClose" for each connection being closed. The reader
+//     also reconnects, so there's no separate reconnect loop.
+//   - "derpKeepalive": one per DERP connection, unless DERP
+//     keepalives are disabled.
+//   - "receive": one per ReceiveIPv4 call in progress, reading the
+//     socket; Close unblocks it by closing the socket.
+//
+// closeOnDone is the exception. It may be the caller of Close, so
+// Close can't wait for it, but it returns as soon as Close starts.
+
+// closeTimeout is how long Close waits for c's goroutines to exit
+// before logging those that haven't and returning anyway.
+const closeTimeout = 5 * time.Second
+
+// goTracked runs f in a new goroutine that Close waits for, and
+// reports whether it did. Once Close is waiting, it starts nothing
+// and returns false. name identifies the goroutine in Close's log
+// of goroutines that failed to exit.
+func (c *Conn) goTracked(name string, f func()) bool {
+	c.goMu.Lock()
+	defer c.goMu.Unlock()
+	if c.goClosed {
+		return false
+	}
+	if c.goRunning == nil {
+		c.goRunning = make(map[string]int)
+	}
+	c.goRunning[name]++
+	c.goWG.Add(1)
+	go func() {
+		defer func() {
+			c.goMu.Lock()
+			c.goRunning[name]--
+			if c.goRunning[name] == 0 {
+				delete(c.goRunning, name)
+			}
+			c.goMu.Unlock()
+			c.goWG.Done()
+		}()
+		f()
+	}()
+	return true
+}
+
+// waitGoroutines stops goTracked from starting any more goroutines
+// and waits up to timeout for those running to exit, logging the
+// ones that don't.
+func (c *Conn) waitGoroutines(timeout time.Duration) {
+	c.goMu.Lock()
+	c.goClosed = true
+	c.goMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.goWG.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		c.logf("magicsock: Close: goroutines still running after %v: %s", timeout, c.runningGoroutines())
+	}
+}
+
+// runningGoroutines describes c's tracked goroutines that are
+// running, such as "derpReader, receive×2".
+func (c *Conn) runningGoroutines() string {
+	c.goMu.Lock()
+	defer c.goMu.Unlock()
+	var names []string
+	for name, n := range c.goRunning {
+		if n > 1 {
+			name = fmt.Sprintf("%s×%d", name, n)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"context"
+	crand "crypto/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// Hairpinning is a NAT forwarding a packet sent from behind it to its
+// own public address back inside, to whichever local host that
+// address maps to. NATs that don't hairpin leave two peers behind
+// the same NAT unable to reach each other at their public endpoints,
+// so they must use their LAN addresses.
+//
+// To find out whether our NAT hairpins, we send a disco ping, sealed
+// to ourselves, to our own STUN-discovered address and see whether it
+// arrives.
+
+// hairpinTimeout is how long to wait for a hairpin probe to arrive.
+const hairpinTimeout = time.Second
+
+// HairpinSupported reports whether the NAT c is behind forwards
+// packets sent to c's own public address back to it. The second
+// result reports whether that's known yet; it's not until an
+// endpoint discovery pass has found c's public address and the
+// probe sent there has arrived or timed out.
+func (c *Conn) HairpinSupported() (supported, known bool) {
+	c.hairpinMu.Lock()
+	defer c.hairpinMu.Unlock()
+	return c.hairpinOK, c.hairpinDone
+}
+
+// notePublicEndpoints records the public endpoints found by STUN
+// in an endpoint discovery pass, and probes the first for
+// hairpinning if it hasn't been already.
+func (c *Conn) notePublicEndpoints(eps []string) {
+	if len(eps) == 0 {
+		return
+	}
+	sort.Strings(eps)
+	var ips []net.IP
+	for _, ep := range eps {
+		if ua, err := net.ResolveUDPAddr("udp", ep); err == nil {
+			ips = append(ips, ua.IP)
+		}
+	}
+
+	c.hairpinMu.Lock()
+	c.publicIPs = ips
+	c.hairpinWant = eps[0]
+	c.hairpinMu.Unlock()
+	c.maybeProbeHairpin()
+}
+
+// maybeProbeHairpin probes the public endpoint last found by STUN for
+// hairpinning, if it hasn't been already. The probe is a disco ping
+// to ourselves, so it waits for a private key; SetPrivateKey calls it
+// again.
+func (c *Conn) maybeProbeHairpin() {
+	if c.selfDiscoBox() == nil {
+		return
+	}
+	c.hairpinMu.Lock()
+	defer c.hairpinMu.Unlock()
+	if c.hairpinWant == "" || c.hairpinAddr == c.hairpinWant {
+		return
+	}
+	ua, err := net.ResolveUDPAddr("udp", c.hairpinWant)
+	if err != nil {
+		return
+	}
+	c.hairpinAddr = c.hairpinWant
+	c.hairpinDone, c.hairpinOK = false, false
+	if _, err := crand.Read(c.hairpinTx[:]); err != nil {
+		panic(err)
+	}
+	c.hairpinRecv = make(chan struct{})
+	ctx, tx, recv := c.connCtx, c.hairpinTx, c.hairpinRecv
+	c.goTracked("hairpin", func() { c.probeHairpin(ctx, ua, tx, recv) })
+}
+
+// probeHairpin sends the hairpin probe with transaction ID tx to our
+// public address addr and waits for recv to be closed by its arrival.
+func (c *Conn) probeHairpin(ctx context.Context, addr *net.UDPAddr, tx discoTxID, recv <-chan struct{}) {
+	bx := c.selfDiscoBox()
+	if bx == nil {
+		// The private key was cleared since; probe again once
+		// there's one.
+		c.hairpinMu.Lock()
+		if c.hairpinTx == tx {
+			c.hairpinAddr = ""
+		}
+		c.hairpinMu.Unlock()
+		return
+	}
+	var buf [discoMsgLen]byte
+	if _, err := c.pconn.WriteTo(bx.appendMsg(buf[:0], discoTypePing, tx), addr); err != nil {
+		c.logf("magicsock: hairpin probe to %v: %v", addr, err)
+	}
+	t := c.clock.NewTimer(hairpinTimeout)
+	defer t.Stop()
+	ok := false
+	select {
+	case <-recv:
+		ok = true
+	case <-t.Chan():
+	case <-ctx.Done():
+		return
+	}
+
+	c.hairpinMu.Lock()
+	defer c.hairpinMu.Unlock()
+	if c.hairpinTx != tx {
+		return // superseded by a probe of a newer address
+	}
+	c.hairpinDone, c.hairpinOK = true, ok
+	c.logf("magicsock: hairpinning to %v supported: %v", addr, ok)
+}
+
+// isHairpinProbe reports whether the disco ping with transaction ID
+// tx is our own hairpin probe, noting its arrival if so.
+func (c *Conn) isHairpinProbe(tx discoTxID) bool {
+	c.hairpinMu.Lock()
+	defer c.hairpinMu.Unlock()
+	if c.hairpinRecv == nil || tx != c.hairpinTx {
+		return false
+	}
+	close(c.hairpinRecv)
+	c.hairpinRecv = nil
+	return true
+}
+
+// needsHairpin reports whether sending to addr, a peer's endpoint,
+// would need our NAT to hairpin, as it's at one of our own public
+// IPs, and our NAT isn't known to. Peers behind the same NAT as us
+// should be reached at their LAN addresses instead.
+func (c *Conn) needsHairpin(addr *net.UDPAddr) bool {
+	c.hairpinMu.Lock()
+	defer c.hairpinMu.Unlock()
+	if c.hairpinDone && c.hairpinOK {
+		return false
+	}
+	for _, ip := range c.publicIPs {
+		if ip.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// lanEndpointLocked returns the index in a.addrs of the
+// highest-priority live LAN endpoint of a peer behind the same NAT
+// as us, if the peer's highest-priority endpoint would need our NAT
+// to hairpin. Otherwise, it returns -1.
+// a.mu must be held.
+func (a *AddrSet) lanEndpointLocked(now time.Time) int {
+	if a.needsHairpin == nil {
+		return -1
+	}
+	top := -1
+	for i := len(a.addrs) - 1; i >= 0; i-- {
+		if !a.addrs[i].IP.Equal(derpMagicIP) && !a.staleLocked(i, now) {
+			top = i
+			break
+		}
+	}
+	if top == -1 || !a.needsHairpin(&a.addrs[top]) {
+		return -1
+	}
+	for i := top - 1; i >= 0; i-- {
+		if isPrivateIP(a.addrs[i].IP) && !a.staleLocked(i, now) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pingOrder returns the indexes of addrs in the order they should be
+// disco pinged: LAN endpoints first if lanFirst, else as is.
+func pingOrder(addrs []net.UDPAddr, lanFirst bool) []int {
+	order := make([]int, 0, len(addrs))
+	for i := range addrs {
+		order = append(order, i)
+	}
+	if lanFirst {
+		sort.SliceStable(order, func(i, j int) bool {
+			return isPrivateIP(addrs[order[i]].IP) && !isPrivateIP(addrs[order[j]].IP)
+		})
+	}
+	return order
+}
+
+var privateNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "fc00::/7", "fe80::/10"} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// isPrivateIP reports whether ip is a private or link-local address,
+// reachable only on a LAN.
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
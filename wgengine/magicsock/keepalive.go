@@ -0,0 +1,131 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"context"
+	crand "crypto/rand"
+	"net"
+	"time"
+)
+
+// DefaultKeepaliveInterval is the default value of
+// Options.KeepaliveInterval. It's WireGuard's recommended persistent
+// keepalive interval, short enough for most NATs' UDP mapping
+// timeouts.
+const DefaultKeepaliveInterval = 25 * time.Second
+
+// keepaliveIntent is how long after a packet was last sent to a peer
+// its path is still kept alive. Peers we've stopped sending to get
+// no keepalives, so idle devices' radios can sleep.
+const keepaliveIntent = 5 * time.Minute
+
+func (o *Options) keepaliveInterval() time.Duration {
+	if o.KeepaliveInterval == 0 {
+		return DefaultKeepaliveInterval
+	}
+	if o.KeepaliveInterval < 0 {
+		return 0
+	}
+	return o.KeepaliveInterval
+}
+
+// KeepaliveInterval returns how long a direct path to a peer may be
+// idle before a keepalive is sent on it, or zero if keepalives are
+// disabled. See Options.KeepaliveInterval.
+func (c *Conn) KeepaliveInterval() time.Duration {
+	return c.keepaliveInterval
+}
+
+// keepaliveLoop sends keepalives until ctx is done.
+// It checks twice per interval, so no path is idle for longer.
+func (c *Conn) keepaliveLoop(ctx context.Context) {
+	ticker := c.clock.NewTicker(c.keepaliveInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.Chan():
+			c.sendKeepalives(now)
+		}
+	}
+}
+
+// sendKeepalives sends a disco ping to the confirmed endpoint of each
+// peer we've recently sent to but whose path has been idle for half
+// the keepalive interval.
+func (c *Conn) sendKeepalives(now time.Time) {
+	c.addrsMu.Lock()
+	peers := make([]*AddrSet, 0, len(c.addrsByKey))
+	for _, as := range c.addrsByKey {
+		peers = append(peers, as)
+	}
+	c.addrsMu.Unlock()
+
+	for _, as := range peers {
+		if i, addr := as.keepaliveDest(now, c.keepaliveInterval/2); addr != nil {
+			c.sendKeepalive(as, i, addr, now)
+		}
+	}
+}
+
+// keepaliveDest returns the endpoint of a to send a keepalive to, and
+// its index in a.addrs, if a has been sent to within keepaliveIntent
+// but not within idle, and has an endpoint that has answered a ping
+// within keepaliveIntent; the best such, by betterPathLocked.
+// Otherwise it returns a nil address.
+func (a *AddrSet) keepaliveDest(now time.Time, idle time.Duration) (int, *net.UDPAddr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastSend.IsZero() || now.Sub(a.lastSend) >= keepaliveIntent {
+		return -1, nil // no recent traffic intent
+	}
+	if now.Sub(a.lastSend) < idle || now.Sub(a.lastKeepalive) < idle {
+		return -1, nil // not idle
+	}
+	best := -1
+	for i := len(a.pongAt) - 1; i >= 0; i-- {
+		t := a.pongAt[i]
+		if !t.IsZero() && now.Sub(t) < keepaliveIntent && !a.addrs[i].IP.Equal(derpMagicIP) {
+			if best == -1 || a.betterPathLocked(i, best) {
+				best = i
+			}
+		}
+	}
+	if best == -1 {
+		return -1, nil
+	}
+	a.lastKeepalive = now
+	addr := a.addrs[best]
+	return best, &addr
+}
+
+// sendKeepalive sends a keepalive disco ping to addr, the endpoint
+// of as at index i. Its pong keeps the endpoint confirmed.
+func (c *Conn) sendKeepalive(as *AddrSet, i int, addr *net.UDPAddr, now time.Time) {
+	bx := c.discoBoxFor(as.publicKey)
+	if bx == nil {
+		return
+	}
+	var tx discoTxID
+	if _, err := crand.Read(tx[:]); err != nil {
+		panic(err)
+	}
+	c.discoMu.Lock()
+	c.expireDiscoPingsLocked(now)
+	if c.discoPending == nil {
+		c.discoPending = make(map[discoTxID]discoPing)
+	}
+	c.discoPending[tx] = discoPing{as: as, idx: i, addr: addr, sent: now, keepalive: true}
+	c.discoMu.Unlock()
+
+	metricKeepalivesSent.Add(1)
+	c.count(&c.stats.KeepalivesSent)
+	var buf [discoMsgLen]byte
+	if _, err := c.pconn.WriteTo(bx.appendMsg(buf[:0], discoTypePing, tx), addr); err != nil && c.sendLogLimit.Allow() {
+		c.logf("magicsock: keepalive to %v: %v", addr, err)
+	}
+}
@@ -12,8 +12,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,6 +28,7 @@ import (
 	"github.com/tailscale/wireguard-go/conn"
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/net/ipv4"
 	"golang.org/x/time/rate"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
@@ -31,6 +36,7 @@ import (
 	"tailscale.com/stun"
 	"tailscale.com/stunner"
 	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
 	"tailscale.com/version"
 )
 
@@ -39,15 +45,71 @@ import (
 type Conn struct {
 	pconn         *RebindingUDPConn
 	pconnPort     uint16
+	pconnHost     string // IP address to bind to, or empty for all addresses
 	stunServers   []string
+	stunFallback  []string      // queried when stunServers find no endpoint
+	stunTries     int           // binding requests per STUN server; 0 means stunner default
+	stunRetry     time.Duration // initial STUN retry interval; 0 means stunner default
+	stunTimeout   time.Duration // how long to wait for each STUN server; 0 means no limit
+	endpointTTL   time.Duration // how long a peer endpoint may be silent before it's pruned; 0 means never
 	startEpUpdate chan struct{} // send to trigger endpoint update
-	epFunc        func(endpoints []string)
-	logf          func(format string, args ...interface{})
+	reschedule    chan struct{} // send to restart the re-STUN timer
+	epDebounce    time.Duration // how long endpoints must be stable before notifying listeners
+	logf          logger.Logf
 	sendLogLimit  *rate.Limiter
+	readBufBytes  int          // requested socket receive buffer size, or 0
+	writeBufBytes int          // requested socket send buffer size, or 0
+	pacer         *pacer       // or nil if outbound packets aren't paced
+	batcher       *sendBatcher // or nil if outbound packets aren't batched
+
+	sniffer func(Direction, *net.UDPAddr, []byte) // Options.PacketSniffer, or nil
+
+	stunDial func(context.Context) (net.PacketConn, error) // Options.NetworkDialer, or nil to STUN over pconn
+
+	predictPorts bool // Options.PredictPorts
+
+	advertised    []string // Options.AdvertiseEndpoints, normalized
+	advertiseOnly bool     // Options.AdvertiseEndpointsOnly
+
+	pathPref []PathKind // Options.PathPreference, or the default
+
+	keepaliveInterval time.Duration // or zero if keepalives are disabled
+
+	clock clock // source of time; see clock.go
 
 	connCtx       context.Context // closed on Conn.Close
 	connCtxCancel func()          // closes connCtx
 
+	unregisterLinkChange func() // stops LinkChange calls on network changes; a no-op unless WatchNetworkChanges
+
+	closeMu sync.Mutex
+	closed  bool // Close has been called
+
+	// goWG counts the goroutines started by goTracked; see
+	// goroutines.go.
+	goWG      sync.WaitGroup
+	goMu      sync.Mutex
+	goRunning map[string]int // running goroutines by name
+	goClosed  bool           // Close is waiting on goWG
+
+	epMu          sync.Mutex
+	epPending     []string // endpoints waiting out the debounce window
+	epTimer       timer    // fires flushEndpoints; nil until first use
+	lastEndpoints []string // endpoints last passed to listeners
+	logEpChanges  bool     // Options.DebugEndpointChanges
+	epListeners   map[*endpointsListener]bool
+
+	curEpMu      sync.Mutex
+	curEndpoints []string // result of the latest endpoint discovery
+	curPredicted []string // the predicted ports among curEndpoints
+
+	reSTUNMu       sync.Mutex
+	reSTUNInterval time.Duration // mean time between periodic STUN passes
+	nextReSTUN     time.Time     // when the re-STUN timer fires; zero if not running
+
+	statsMu sync.Mutex
+	stats   Stats // counters only; see Conn.Stats
+
 	// addrsByUDP is a map of every remote ip:port to a priority
 	// list of endpoint addresses for a peer.
 	// The priority list is provided by wgengine configuration.
@@ -61,6 +123,7 @@ type Conn struct {
 	//	10.0.0.3:3 -> [10.0.0.3:3]
 	addrsMu    sync.Mutex
 	addrsByUDP map[udpAddr]*AddrSet
+	addrsByKey map[key.Public]*AddrSet // peer public key -> its AddrSet
 
 	// stunReceiveFunc holds the current STUN packet processing func.
 	// Its Loaded value is always non-nil.
@@ -69,11 +132,60 @@ type Conn struct {
 	udpRecvCh  chan udpReadResult
 	derpRecvCh chan derpReadResult
 
+	discoMu      sync.Mutex
+	discoPending map[discoTxID]discoPing // outstanding disco pings
+
+	// The keys for disco messages; see discoBoxFor.
+	discoBoxMu sync.Mutex
+	discoPriv  key.Private              // c.privateKey, as of the last sync
+	discoPub   key.Public               // of discoPriv
+	discoBoxes map[key.Public]*discoBox // peer public key -> its discoBox
+
+	stunStatsMu sync.Mutex
+	stunStats   map[string]*stunServerStats // STUN server -> stats
+
+	events eventSubs // subscribers to Events
+
+	// The hairpinning state; see hairpin.go.
+	hairpinMu   sync.Mutex
+	publicIPs   []net.IP      // our public IPs, as seen by STUN servers
+	hairpinWant string        // public endpoint to probe for hairpinning
+	hairpinAddr string        // public endpoint last probed for hairpinning
+	hairpinTx   discoTxID     // transaction ID of that probe
+	hairpinRecv chan struct{} // closed when the probe arrives; nil after
+	hairpinDone bool          // whether the probe arrived or timed out
+	hairpinOK   bool          // whether it arrived
+
+	natFunc func(natType string)
+	natMu   sync.Mutex
+	natType string // one of the NAT* constants, or empty if not yet known
+
+	udpBlockedMu sync.Mutex
+	udpBlocked   bool // see UDPBlocked
+
+	// derpMap optionally maps DERP region numbers (the ports of
+	// derpMagicIP addresses) to their servers. It's read-only
+	// after Listen.
+	derpMap map[int]DERPRegion
+
+	derpProbeInterval time.Duration
+	derpProbe         func(ctx context.Context, host string) (time.Duration, error)
+	derpHTTPClient    *http.Client // or nil for defaults
+
+	derpBackoffBase       time.Duration // first wait to reconnect to DERP
+	derpBackoffMax        time.Duration // cap on the wait to reconnect to DERP
+	derpKeepaliveInterval time.Duration // or 0 if DERP keepalives are disabled
+
+	derpLatMu sync.Mutex
+	derpLat   map[int]time.Duration // DERP region -> last measured latency
+
 	derpMu      sync.Mutex
 	privateKey  key.Private
+	myDerp      int                        // preferred DERP region for fallback, or 0 for none
 	derpConn    map[int]*derphttp.Client   // magic derp port (see derpmap.go) to its client
 	derpCancel  map[int]context.CancelFunc // to close derp goroutines
 	derpWriteCh map[int]chan<- derpWriteRequest
+	derpState   map[int]*derpConnState
 }
 
 // udpAddr is the key in the addrsByUDP map.
@@ -98,66 +210,611 @@ type Options struct {
 	// Zero means to pick one automatically.
 	Port uint16
 
+	// BindAddr optionally specifies the local address to bind to,
+	// instead of all local addresses. It may be an IP address, an
+	// "ip:port" pair, or a CIDR prefix, in which case the first
+	// local interface address within the prefix is used.
+	// If no port is given, Port is used.
+	// Only IPv4 addresses are currently supported.
+	BindAddr string
+
+	// STUN lists the STUN servers, as "host:port", queried to
+	// discover the Conn's public endpoints. If it's empty, or if
+	// DisableSTUN is set, no STUN queries are sent at all: only
+	// local endpoints are reported, and peers that can't reach
+	// those are reached via DERP.
 	STUN []string
 
+	// STUNFallback optionally lists more STUN servers, queried only
+	// in endpoint discovery passes where no server in STUN
+	// responded, so a large set can back up a few preferred ones
+	// without them all being hit each pass. What they find is
+	// reported like the results from STUN. It's ignored if STUN is
+	// empty. Their binding requests are counted in the
+	// "stun_fallback_requests" metric, not "stun_requests_sent".
+	STUNFallback []string
+
+	// DisableSTUN specifies that no STUN queries are sent, as if
+	// STUN were empty, for networks where outbound UDP to STUN
+	// servers is blocked.
+	DisableSTUN bool
+
+	// STUNRetries optionally specifies how many binding requests
+	// are sent to each STUN server before giving up on it.
+	// Zero means to use a default retry schedule.
+	STUNRetries int
+
+	// STUNRetryInterval optionally specifies how long to wait for
+	// the first STUN response from a server before retrying.
+	// The interval doubles on each subsequent retry, up to a cap.
+	// Zero means to use a default retry schedule.
+	STUNRetryInterval time.Duration
+
+	// STUNTimeout optionally bounds how long to wait for each STUN
+	// server to respond, across all retries, before giving up on it.
+	// Zero means DefaultSTUNTimeout. Negative means no bound beyond
+	// the retry schedule.
+	STUNTimeout time.Duration
+
+	// ReSTUNInterval optionally specifies how often endpoints are
+	// rediscovered, to keep NAT mappings alive and notice changes.
+	// Each wait is randomized by up to 20% either way, so a fleet of
+	// nodes doesn't query the STUN servers in lockstep.
+	// Zero means DefaultReSTUNInterval. Mobile platforms don't
+	// re-STUN periodically, relying on LinkChange instead.
+	ReSTUNInterval time.Duration
+
+	// WatchNetworkChanges specifies that the Conn calls its own
+	// LinkChange when interfaces.RegisterChangeCallback reports a
+	// network change. It's for programs using magicsock directly;
+	// wgengine leaves it off, as it calls LinkChange itself from
+	// wgengine/monitor, and both would rebind and re-STUN twice for
+	// each change.
+	WatchNetworkChanges bool
+
+	// NetworkDialer optionally provides the packet connection STUN
+	// queries are sent over, instead of the Conn's own UDP socket.
+	// It's called for each endpoint discovery pass, and the
+	// connection is closed when the pass finishes. It lets tests use
+	// an in-process transport and lets STUN be tunneled through a
+	// proxy. Note that STUN then reports the address its own
+	// connection appears from, which isn't necessarily the Conn's.
+	NetworkDialer func(ctx context.Context) (net.PacketConn, error)
+
+	// PredictPorts specifies whether, when behind a hard NAT that
+	// allocates public ports sequentially, to also advertise as
+	// endpoints the next few ports it's likely to map to peers, so
+	// a peer behind a hard NAT too can reach us. It's a heuristic;
+	// wrong guesses only cost the peer some disco pings. The
+	// predictions are reported by Conn.PredictedEndpoints.
+	PredictPorts bool
+
+	// AdvertiseEndpoints optionally lists endpoints, as "ip:port",
+	// to advertise in addition to those discovered, such as the
+	// public address of a port-forwarded server with a static
+	// mapping that STUN can't see. They're reported first, ahead
+	// of STUN endpoints. Listen fails if any is malformed.
+	// Only IPv4 endpoints are currently supported.
+	AdvertiseEndpoints []string
+
+	// AdvertiseEndpointsOnly specifies that AdvertiseEndpoints
+	// replace the discovered endpoints instead of adding to them:
+	// no local addresses are reported and no STUN queries are sent.
+	AdvertiseEndpointsOnly bool
+
+	// PathPreference optionally orders the kinds of path to a peer
+	// from most to least preferred, for choosing among its
+	// endpoints that recently answered disco pings, and between
+	// those and the endpoint it was last heard from. Confirmed
+	// endpoints of the same kind are chosen between by measured
+	// latency. A kind that isn't listed is never preferred to one
+	// that is. If empty, DefaultPathPreference is used.
+	// Conn.PeerPathKind reports the kind of path chosen.
+	PathPreference []PathKind
+
 	// EndpointsFunc optionally provides a func to be called when
 	// endpoints change. The called func does not own the slice.
+	// It's registered as if by Conn.AddEndpointsListener.
 	EndpointsFunc func(endpoint []string)
+
+	// EndpointsDebounce optionally specifies how long the set of
+	// endpoints must go unchanged before EndpointsFunc is called,
+	// so bursts of updates are coalesced into one call.
+	// Zero means DefaultEndpointsDebounce. Negative means to call
+	// EndpointsFunc as soon as the endpoints change.
+	EndpointsDebounce time.Duration
+
+	// NATTypeFunc optionally provides a func to be called when the
+	// kind of NAT the Conn is behind, as reported by Conn.NATType,
+	// changes.
+	NATTypeFunc func(natType string)
+
+	// DERPMap optionally specifies the DERP relay servers of each
+	// region, keyed by region number. Regions not in the map use
+	// the built-in list of Tailscale DERP servers.
+	DERPMap map[int]DERPRegion
+
+	// DERPProbeInterval optionally specifies how often the latency
+	// to each region in DERPMap is measured, to pick the closest as
+	// the preferred region. Zero means DefaultDERPProbeInterval.
+	DERPProbeInterval time.Duration
+
+	// DERPHTTPClient optionally specifies the HTTP client used to
+	// reach DERP servers, such as to trust other root CAs, set
+	// timeouts or go through a proxy. It's used as is for latency
+	// probes. For the connections that relay packets, its
+	// Transport, if an *http.Transport, provides the dialer, proxy
+	// and TLS configuration. If nil, a default client is used.
+	DERPHTTPClient *http.Client
+
+	// DERPReconnectBackoff and DERPReconnectMaxBackoff optionally
+	// specify how long to wait before reconnecting to a DERP server
+	// whose connection failed: DERPReconnectBackoff after the first
+	// failure, doubling with each consecutive failure up to
+	// DERPReconnectMaxBackoff. Zero means DefaultDERPReconnectBackoff
+	// and DefaultDERPReconnectMaxBackoff, respectively.
+	DERPReconnectBackoff    time.Duration
+	DERPReconnectMaxBackoff time.Duration
+
+	// DERPKeepaliveInterval optionally specifies how often a DERP
+	// connection is checked by relaying a ping to ourselves. A
+	// connection that has received nothing, not even the ping, by
+	// the next check is presumed dead and remade, so a dead server
+	// is noticed within two intervals.
+	// Zero means DefaultDERPKeepaliveInterval. Negative disables
+	// DERP keepalives.
+	DERPKeepaliveInterval time.Duration
+
+	// KeepaliveInterval optionally specifies how long the direct
+	// path to a peer may go without a packet being sent on it
+	// before a keepalive (a small disco ping) is sent, to keep NAT
+	// mappings open. Only peers that packets were sent to in the
+	// last few minutes get keepalives.
+	// Zero means DefaultKeepaliveInterval. Negative disables
+	// keepalives.
+	KeepaliveInterval time.Duration
+
+	// EndpointTTL optionally specifies how long a peer's endpoint
+	// may go without receiving any packet or disco pong before it's
+	// considered dead, as after the peer roamed away from it. Dead
+	// endpoints aren't pinged or sprayed with handshakes, as long as
+	// the peer has some other live endpoint.
+	// Zero means DefaultEndpointTTL. Negative means endpoints never
+	// die.
+	EndpointTTL time.Duration
+
+	// PacingBytesPerSec optionally specifies a rate to which bursts
+	// of outbound UDP packets are smoothed, to avoid overrunning
+	// slow uplinks. A packet is delayed by at most a few tens of
+	// milliseconds. Zero disables pacing.
+	PacingBytesPerSec int
+
+	// ReadBufferBytes and WriteBufferBytes optionally specify the
+	// sizes of the UDP socket's kernel receive and send buffers.
+	// The kernel may clamp them; the sizes obtained are logged.
+	// Zero means the system default.
+	ReadBufferBytes  int
+	WriteBufferBytes int
+
+	// Batch specifies whether to coalesce outbound UDP packets sent
+	// close together into a single system call where possible
+	// (sendmmsg on Linux). It's experimental. Write errors of
+	// batched packets are logged, not returned by Send.
+	Batch bool
+
+	// SocketMark optionally specifies a Linux SO_MARK for the UDP
+	// socket, so that policy routing rules can exempt the Conn's
+	// own packets from being routed back into the tunnel. Setting
+	// it requires CAP_NET_ADMIN. It's ignored, with a log message,
+	// on other platforms.
+	SocketMark uint32
+
+	// ReusePort specifies whether to set SO_REUSEADDR and, where
+	// supported, SO_REUSEPORT on the UDP socket, so that a restarted
+	// process can bind its port again at once even if the previous
+	// one's socket lingers. It's ignored, with a log message, on
+	// Windows.
+	//
+	// It also lets any other socket with the option set, by the same
+	// user, bind the same port while the Conn is using it. The kernel
+	// then spreads incoming packets among them, so two Conns sharing
+	// a port both misbehave. With Port zero, this includes another
+	// process using ReusePort that got DefaultPort first.
+	ReusePort bool
+
+	// PacketSniffer optionally provides a func to be called with
+	// each packet sent or received for WireGuard, directly or via
+	// DERP, such as to keep a capture for debugging. STUN and disco
+	// packets aren't included. For DERP packets, addr is the fake
+	// address representing the DERP region.
+	//
+	// It's called on the data path, so it must be fast and must not
+	// block. b is only valid for the duration of the call and must
+	// not be modified; implementations that keep the packet must
+	// copy it.
+	PacketSniffer func(dir Direction, addr *net.UDPAddr, b []byte)
+
+	// DebugEndpointChanges specifies whether to log each change in
+	// the endpoints passed to EndpointsFunc, as the endpoints added
+	// and removed since the previous call, for following the
+	// endpoints through network transitions.
+	DebugEndpointChanges bool
+
+	// Logf optionally provides a log function to use.
+	// If nil, log.Printf is used.
+	Logf logger.Logf
+
+	// clock, if non-nil, replaces the real clock, for tests.
+	clock clock
 }
 
-func (o *Options) endpointsFunc() func([]string) {
-	if o == nil || o.EndpointsFunc == nil {
-		return func([]string) {}
+// Direction is which way a packet passed to Options.PacketSniffer
+// is going.
+type Direction int
+
+const (
+	DirSend Direction = iota // sent by this Conn
+	DirRecv                  // received by this Conn
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirSend:
+		return "send"
+	case DirRecv:
+		return "recv"
 	}
-	return o.EndpointsFunc
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+func (o *Options) logf() logger.Logf {
+	if o.Logf == nil {
+		return log.Printf
+	}
+	return o.Logf
+}
+
+// DefaultSTUNTimeout is the default value of Options.STUNTimeout.
+const DefaultSTUNTimeout = 3 * time.Second
+
+func (o *Options) stunTimeout() time.Duration {
+	switch {
+	case o.STUNTimeout == 0:
+		return DefaultSTUNTimeout
+	case o.STUNTimeout < 0:
+		return 0
+	}
+	return o.STUNTimeout
+}
+
+// DefaultReSTUNInterval is the default value of Options.ReSTUNInterval.
+// It's just under 30s, a likely UDP NAT mapping timeout.
+const DefaultReSTUNInterval = 28 * time.Second
+
+// DefaultEndpointTTL is the default value of Options.EndpointTTL.
+const DefaultEndpointTTL = 2 * time.Minute
+
+func (o *Options) endpointTTL() time.Duration {
+	switch {
+	case o.EndpointTTL == 0:
+		return DefaultEndpointTTL
+	case o.EndpointTTL < 0:
+		return 0
+	}
+	return o.EndpointTTL
+}
+
+// DefaultEndpointsDebounce is the default value of
+// Options.EndpointsDebounce.
+const DefaultEndpointsDebounce = 250 * time.Millisecond
+
+func (o *Options) endpointsDebounce() time.Duration {
+	if o.EndpointsDebounce == 0 {
+		return DefaultEndpointsDebounce
+	}
+	return o.EndpointsDebounce
+}
+
+func (o *Options) clockOrDefault() clock {
+	if o.clock == nil {
+		return realClock{}
+	}
+	return o.clock
+}
+
+func (o *Options) natTypeFunc() func(string) {
+	if o.NATTypeFunc == nil {
+		return func(string) {}
+	}
+	return o.NATTypeFunc
 }
 
 // Listen creates a magic Conn listening on opts.Port.
 // As the set of possible endpoints for a Conn changes, the
 // callback opts.EndpointsFunc is called.
 func Listen(opts Options) (*Conn, error) {
-	var packetConn net.PacketConn
-	var err error
-	if opts.Port == 0 {
+	return ListenContext(context.Background(), opts)
+}
+
+// ListenContext is like Listen, but the Conn is closed when ctx is
+// done. If ctx is done before the Conn is set up, ListenContext
+// returns ctx.Err().
+func ListenContext(ctx context.Context, opts Options) (*Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	host, port, err := opts.bindHostPort()
+	if err != nil {
+		return nil, fmt.Errorf("magicsock.Listen: %v", err)
+	}
+	advertised, err := opts.advertiseEndpoints()
+	if err != nil {
+		return nil, fmt.Errorf("magicsock.Listen: %v", err)
+	}
+	logf := opts.logf()
+	mark := opts.SocketMark
+	if mark != 0 && !socketMarkSupported {
+		logf("magicsock: SocketMark not supported on %s; ignoring", runtime.GOOS)
+		mark = 0
+	}
+	reusePort := opts.ReusePort
+	if reusePort && !reusePortSupported {
+		logf("magicsock: ReusePort not supported on %s; ignoring", runtime.GOOS)
+		reusePort = false
+	}
+	var packetConn *net.UDPConn
+	if port == 0 {
 		// Our choice of port. Start with DefaultPort.
 		// If unavailable, pick any port.
-		want := fmt.Sprintf(":%d", DefaultPort)
-		log.Printf("magicsock: bind: trying %v\n", want)
-		packetConn, err = net.ListenPacket("udp4", want)
+		logf("magicsock: bind: trying %v\n", net.JoinHostPort(host, fmt.Sprint(DefaultPort)))
+		packetConn, err = listenPacket(host, DefaultPort, mark, reusePort)
 		if err != nil {
-			want = ":0"
-			log.Printf("magicsock: bind: falling back to %v (%v)\n", want, err)
-			packetConn, err = net.ListenPacket("udp4", want)
+			logf("magicsock: bind: falling back to %v (%v)\n", net.JoinHostPort(host, "0"), err)
+			packetConn, err = listenPacket(host, 0, mark, reusePort)
 		}
 	} else {
-		packetConn, err = net.ListenPacket("udp4", fmt.Sprintf(":%d", opts.Port))
+		packetConn, err = listenPacket(host, port, mark, reusePort)
 	}
 	if err != nil {
 		return nil, fmt.Errorf("magicsock.Listen: %v", err)
 	}
+	if err := ctx.Err(); err != nil {
+		packetConn.Close()
+		return nil, err
+	}
 
 	connCtx, connCtxCancel := context.WithCancel(context.Background())
 	c := &Conn{
 		pconn:         new(RebindingUDPConn),
-		pconnPort:     opts.Port,
+		pconnPort:     port,
+		pconnHost:     host,
 		sendLogLimit:  rate.NewLimiter(rate.Every(1*time.Minute), 1),
 		stunServers:   append([]string{}, opts.STUN...),
+		stunFallback:  append([]string{}, opts.STUNFallback...),
+		stunTries:     opts.STUNRetries,
+		stunRetry:     opts.STUNRetryInterval,
+		stunTimeout:   opts.stunTimeout(),
+		stunDial:      opts.NetworkDialer,
+		endpointTTL:   opts.endpointTTL(),
 		startEpUpdate: make(chan struct{}, 1),
+		reschedule:    make(chan struct{}, 1),
 		connCtx:       connCtx,
 		connCtxCancel: connCtxCancel,
-		epFunc:        opts.endpointsFunc(),
-		logf:          log.Printf,
+		epDebounce:    opts.endpointsDebounce(),
+		natFunc:       opts.natTypeFunc(),
+		sniffer:       opts.PacketSniffer,
+		derpMap:       copyDERPMap(opts.DERPMap),
+		logf:          logf,
 		addrsByUDP:    make(map[udpAddr]*AddrSet),
+		addrsByKey:    make(map[key.Public]*AddrSet),
 		derpRecvCh:    make(chan derpReadResult),
 		udpRecvCh:     make(chan udpReadResult),
 	}
+	c.derpHTTPClient = opts.DERPHTTPClient
+	c.derpBackoffBase, c.derpBackoffMax = opts.derpReconnectBackoff()
+	c.derpKeepaliveInterval = opts.derpKeepaliveInterval()
+	c.predictPorts = opts.PredictPorts
+	c.logEpChanges = opts.DebugEndpointChanges
+	c.advertised = advertised
+	c.advertiseOnly = opts.AdvertiseEndpointsOnly
+	c.pathPref = opts.pathPreference()
+	c.clock = opts.clockOrDefault()
+	c.keepaliveInterval = opts.keepaliveInterval()
+	c.derpProbe = c.httpDERPProbe
+	if opts.DisableSTUN {
+		c.stunServers = nil
+		c.stunFallback = nil
+	}
+	c.reSTUNInterval = opts.ReSTUNInterval
+	if c.reSTUNInterval <= 0 {
+		c.reSTUNInterval = DefaultReSTUNInterval
+	}
+	if opts.PacingBytesPerSec > 0 {
+		c.pacer = newPacer(opts.PacingBytesPerSec, c.clock, connCtx.Done())
+	}
+	if opts.Batch {
+		c.batcher = newSendBatcher(c.pconn, c.logf, c.clock)
+	}
+	if opts.EndpointsFunc != nil {
+		c.AddEndpointsListener(opts.EndpointsFunc)
+	}
+	c.readBufBytes, c.writeBufBytes = opts.ReadBufferBytes, opts.WriteBufferBytes
+	c.pconn.setup = c.setSocketBuffers
+	c.pconn.mark = mark
+	c.pconn.reusePort = reusePort
 	c.ignoreSTUNPackets()
-	c.pconn.Reset(packetConn.(*net.UDPConn))
+	c.pconn.Reset(packetConn)
 	c.reSTUN()
-	go c.epUpdate(connCtx)
+	c.goTracked("epUpdate", func() { c.epUpdate(connCtx) })
+	c.unregisterLinkChange = func() {}
+	if opts.WatchNetworkChanges {
+		c.unregisterLinkChange = interfaces.RegisterChangeCallback(c.LinkChange)
+	}
+	go c.closeOnDone(ctx)
+	if c.keepaliveInterval > 0 {
+		c.goTracked("keepalive", func() { c.keepaliveLoop(connCtx) })
+	}
+	if len(c.derpMap) > 0 {
+		c.derpProbeInterval = opts.DERPProbeInterval
+		if c.derpProbeInterval <= 0 {
+			c.derpProbeInterval = DefaultDERPProbeInterval
+		}
+		c.goTracked("derpProbe", func() { c.probeDERPRegionsLoop(connCtx) })
+	}
 	return c, nil
 }
 
+// setSocketBuffers sets pc's kernel buffer sizes, if configured.
+func (c *Conn) setSocketBuffers(pc *net.UDPConn) {
+	if c.readBufBytes == 0 && c.writeBufBytes == 0 {
+		return
+	}
+	if c.readBufBytes != 0 {
+		if err := pc.SetReadBuffer(c.readBufBytes); err != nil {
+			c.logf("magicsock: setting read buffer to %d: %v", c.readBufBytes, err)
+		}
+	}
+	if c.writeBufBytes != 0 {
+		if err := pc.SetWriteBuffer(c.writeBufBytes); err != nil {
+			c.logf("magicsock: setting write buffer to %d: %v", c.writeBufBytes, err)
+		}
+	}
+	r, w, err := socketBufferSizes(pc)
+	if err != nil {
+		c.logf("magicsock: getting socket buffer sizes: %v", err)
+		return
+	}
+	c.logf("magicsock: socket buffers: read %d (requested %d), write %d (requested %d)", r, c.readBufBytes, w, c.writeBufBytes)
+}
+
+func copyDERPMap(m map[int]DERPRegion) map[int]DERPRegion {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[int]DERPRegion, len(m))
+	for i, r := range m {
+		ret[i] = DERPRegion{Hosts: append([]string(nil), r.Hosts...)}
+	}
+	return ret
+}
+
+// closeOnDone runs in its own goroutine until either ctx or c is
+// done, closing c if ctx finished first.
+func (c *Conn) closeOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		c.Close()
+	case <-c.donec():
+	}
+}
+
+// bindHostPort returns the IP address and port that the Conn's
+// socket should be bound to, as specified by o.BindAddr and o.Port.
+// An empty host means all local addresses.
+func (o *Options) bindHostPort() (host string, port uint16, err error) {
+	port = o.Port
+	addr := o.BindAddr
+	if addr == "" {
+		return "", port, nil
+	}
+	if strings.Contains(addr, "/") {
+		_, ipNet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid BindAddr %q: %v", addr, err)
+		}
+		ip, err := interfaces.AddressInPrefix(ipNet)
+		if err != nil {
+			return "", 0, err
+		}
+		if ip == nil {
+			return "", 0, fmt.Errorf("no local address in BindAddr %q", addr)
+		}
+		return ip.String(), port, nil
+	}
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid BindAddr %q port: %v", addr, err)
+		}
+		addr, port = h, uint16(n)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", 0, fmt.Errorf("invalid BindAddr %q: not an IP address", o.BindAddr)
+	}
+	if ip.To4() == nil {
+		return "", 0, fmt.Errorf("invalid BindAddr %q: IPv6 not yet supported", o.BindAddr)
+	}
+	return ip.String(), port, nil
+}
+
+// advertiseEndpoints returns o.AdvertiseEndpoints, validated and
+// normalized.
+func (o *Options) advertiseEndpoints() ([]string, error) {
+	if o.AdvertiseEndpointsOnly && len(o.AdvertiseEndpoints) == 0 {
+		return nil, errors.New("AdvertiseEndpointsOnly set without AdvertiseEndpoints")
+	}
+	var eps []string
+	for _, ep := range o.AdvertiseEndpoints {
+		h, p, err := net.SplitHostPort(ep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AdvertiseEndpoints entry %q: %v", ep, err)
+		}
+		ip := net.ParseIP(h)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid AdvertiseEndpoints entry %q: not an IP address", ep)
+		}
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("invalid AdvertiseEndpoints entry %q: IPv6 not yet supported", ep)
+		}
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid AdvertiseEndpoints entry %q: bad port", ep)
+		}
+		eps = append(eps, net.JoinHostPort(ip.String(), p))
+	}
+	return eps, nil
+}
+
+// listenPacket opens a UDP socket bound to host (empty meaning
+// all local addresses) and port (zero meaning any free port), with
+// its SO_MARK set to mark if it's non-zero, and SO_REUSEADDR and
+// SO_REUSEPORT set if reusePort.
+func listenPacket(host string, port uint16, mark uint32, reusePort bool) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: chainControl(markControl(mark), reusePortControl(reusePort))}
+	packetConn, err := lc.ListenPacket(context.Background(), "udp4", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		return nil, err
+	}
+	return packetConn.(*net.UDPConn), nil
+}
+
+// chainControl returns a net.ListenConfig Control func that calls
+// each non-nil one of fs in turn, stopping at the first error, or
+// nil if they're all nil.
+func chainControl(fs ...func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	var nonNil []func(network, address string, c syscall.RawConn) error
+	for _, f := range fs {
+		if f != nil {
+			nonNil = append(nonNil, f)
+		}
+	}
+	switch len(nonNil) {
+	case 0:
+		return nil
+	case 1:
+		return nonNil[0]
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, f := range nonNil {
+			if err := f(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
 func (c *Conn) donec() <-chan struct{} { return c.connCtx.Done() }
 
 // ignoreSTUNPackets sets a STUN packet processing func that does nothing.
@@ -166,20 +823,27 @@ func (c *Conn) ignoreSTUNPackets() {
 }
 
 // epUpdate runs in its own goroutine until ctx is shut down.
-// Whenever c.startEpUpdate receives a value, it starts an
-// STUN endpoint lookup.
+// Whenever c.startEpUpdate receives a value, or the re-STUN timer
+// fires, it starts an STUN endpoint lookup.
 func (c *Conn) epUpdate(ctx context.Context) {
-	var lastEndpoints []string
 	var lastCancel func()
 	var lastDone chan struct{}
 
+	// We assume that LinkChange notifications are plumbed through well
+	// on our mobile clients, so don't do the timer thing to save radio/battery/CPU/etc.
+	periodic := !version.IsMobile()
+	var timer timer
 	var regularUpdate <-chan time.Time
-	if !version.IsMobile() {
-		// We assume that LinkChange notifications are plumbed through well
-		// on our mobile clients, so don't do the timer thing to save radio/battery/CPU/etc.
-		ticker := time.NewTicker(28 * time.Second) // just under 30s, a likely UDP NAT timeout
-		defer ticker.Stop()
-		regularUpdate = ticker.C
+	schedule := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = c.clock.NewTimer(c.scheduleReSTUN())
+		regularUpdate = timer.Chan()
+	}
+	if periodic {
+		schedule()
+		defer func() { timer.Stop() }()
 	}
 
 	for {
@@ -187,11 +851,22 @@ func (c *Conn) epUpdate(ctx context.Context) {
 		case <-ctx.Done():
 			if lastCancel != nil {
 				lastCancel()
+				<-lastDone
 			}
 			return
+		case <-c.reschedule:
+			if periodic {
+				schedule()
+			}
+			continue
 		case <-c.startEpUpdate:
 		case <-regularUpdate:
 		}
+		if periodic {
+			// Count the next interval from this pass, however
+			// it was started.
+			schedule()
+		}
 
 		if lastCancel != nil {
 			lastCancel()
@@ -204,90 +879,667 @@ func (c *Conn) epUpdate(ctx context.Context) {
 		go func() {
 			defer close(lastDone)
 			endpoints, err := c.determineEndpoints(epCtx)
+			if err == context.Canceled {
+				return
+			}
 			if err != nil {
 				c.logf("magicsock.Conn: endpoint update failed: %v", err)
 				// TODO(crawshaw): are there any conditions under which
 				// we should trigger a retry based on the error here?
 				return
 			}
-			if stringsEqual(endpoints, lastEndpoints) {
-				return
-			}
-			lastEndpoints = endpoints
-			c.epFunc(endpoints)
+			c.setEndpoints(endpoints)
+			c.queueEndpoints(endpoints)
 		}()
 	}
 }
 
+// reSTUNJitter is the fraction by which each wait between periodic
+// STUN passes is randomly lengthened or shortened.
+const reSTUNJitter = 0.2
+
+// jitter returns d randomly scaled by a factor in
+// [1-reSTUNJitter, 1+reSTUNJitter).
+func jitter(d time.Duration) time.Duration {
+	f := 1 - reSTUNJitter + 2*reSTUNJitter*rand.Float64()
+	return time.Duration(float64(d) * f)
+}
+
+// scheduleReSTUN picks how long to wait before the next periodic
+// STUN pass and records when that will be for NextReSTUN.
+func (c *Conn) scheduleReSTUN() time.Duration {
+	c.reSTUNMu.Lock()
+	defer c.reSTUNMu.Unlock()
+	d := jitter(c.reSTUNInterval)
+	c.nextReSTUN = c.clock.Now().Add(d)
+	return d
+}
+
+// SetReSTUNInterval changes the mean interval between periodic STUN
+// passes, as set by Options.ReSTUNInterval, and restarts the timer
+// for the next one. A non-positive d means DefaultReSTUNInterval.
+func (c *Conn) SetReSTUNInterval(d time.Duration) {
+	if d <= 0 {
+		d = DefaultReSTUNInterval
+	}
+	c.reSTUNMu.Lock()
+	c.reSTUNInterval = d
+	c.reSTUNMu.Unlock()
+	select {
+	case c.reschedule <- struct{}{}:
+	default:
+		// A reschedule is already pending.
+	}
+}
+
+// NextReSTUN returns when the next periodic STUN pass is due, or the
+// zero time if passes aren't periodic on this platform.
+func (c *Conn) NextReSTUN() time.Time {
+	c.reSTUNMu.Lock()
+	defer c.reSTUNMu.Unlock()
+	return c.nextReSTUN
+}
+
+func (c *Conn) setEndpoints(endpoints []string) {
+	c.curEpMu.Lock()
+	defer c.curEpMu.Unlock()
+	c.curEndpoints = endpoints
+}
+
+// Endpoints returns the endpoints found by the most recent endpoint
+// discovery, in the order they're passed to EndpointsFunc. It returns
+// nil if discovery hasn't completed yet.
+func (c *Conn) Endpoints() []string {
+	c.curEpMu.Lock()
+	defer c.curEpMu.Unlock()
+	return append([]string(nil), c.curEndpoints...)
+}
+
+// LastSTUNTime returns when c last got a response from any STUN
+// server, or the zero time if it never has.
+func (c *Conn) LastSTUNTime() time.Time {
+	c.stunStatsMu.Lock()
+	defer c.stunStatsMu.Unlock()
+	var last time.Time
+	for _, st := range c.stunStats {
+		if st.lastSuccess.After(last) {
+			last = st.lastSuccess
+		}
+	}
+	return last
+}
+
+// queueEndpoints arranges for the endpoints listeners to be called
+// with endpoints once no newer endpoints have been queued for
+// c.epDebounce.
+func (c *Conn) queueEndpoints(endpoints []string) {
+	if c.epDebounce < 0 {
+		c.epMu.Lock()
+		c.epPending = endpoints
+		c.epMu.Unlock()
+		c.flushEndpoints()
+		return
+	}
+
+	c.epMu.Lock()
+	defer c.epMu.Unlock()
+	c.epPending = endpoints
+	if c.epTimer == nil {
+		c.epTimer = c.clock.AfterFunc(c.epDebounce, c.flushEndpoints)
+	} else {
+		c.epTimer.Reset(c.epDebounce)
+	}
+}
+
+// flushEndpoints notifies the endpoints listeners of the pending
+// endpoints, unless they're the same set they were last notified of.
+func (c *Conn) flushEndpoints() {
+	c.epMu.Lock()
+	defer c.epMu.Unlock()
+	endpoints := c.epPending
+	c.epPending = nil
+	if endpoints == nil || c.isClosed() {
+		return
+	}
+	if stringSetsEqual(endpoints, c.lastEndpoints) {
+		return
+	}
+	if c.logEpChanges {
+		added, removed := diffEndpoints(c.lastEndpoints, endpoints)
+		c.logf("magicsock: endpoints changed: added %v, removed %v", added, removed)
+	}
+	c.lastEndpoints = endpoints
+	metricEndpoints.Set(int64(len(endpoints)))
+	for l := range c.epListeners {
+		l.notify(endpoints)
+	}
+}
+
+// An endpointsListener is a func registered with AddEndpointsListener.
+// Each runs in its own goroutine, so a slow one doesn't delay the
+// others. If it falls behind, it skips to the latest endpoints.
+type endpointsListener struct {
+	f    func([]string)
+	ch   chan []string // holds the newest endpoints not yet passed to f
+	done chan struct{} // closed on removal
+}
+
+// notify queues endpoints for l, replacing any it hasn't taken yet.
+// Calls must be serialized.
+func (l *endpointsListener) notify(endpoints []string) {
+	select {
+	case <-l.ch:
+	default:
+	}
+	l.ch <- endpoints
+}
+
+func (l *endpointsListener) run(donec <-chan struct{}) {
+	for {
+		select {
+		case eps := <-l.ch:
+			l.f(eps)
+		case <-l.done:
+			return
+		case <-donec:
+			return
+		}
+	}
+}
+
+// AddEndpointsListener registers f to be called with c's endpoints
+// whenever they change, starting with the current endpoints, if
+// they're known yet. All listeners get the same slice, which they
+// must not modify.
+//
+// The returned func unregisters f. After it returns, f isn't called
+// again, unless a call was already in progress. It's safe to call
+// more than once, and concurrently.
+func (c *Conn) AddEndpointsListener(f func(endpoints []string)) (remove func()) {
+	l := &endpointsListener{
+		f:    f,
+		ch:   make(chan []string, 1),
+		done: make(chan struct{}),
+	}
+	c.epMu.Lock()
+	if c.epListeners == nil {
+		c.epListeners = make(map[*endpointsListener]bool)
+	}
+	c.epListeners[l] = true
+	if c.lastEndpoints != nil {
+		l.notify(c.lastEndpoints)
+	}
+	c.epMu.Unlock()
+	go l.run(c.donec())
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.epMu.Lock()
+			delete(c.epListeners, l)
+			c.epMu.Unlock()
+			close(l.done)
+		})
+	}
+}
+
+// maxConcurrentSTUN is how many STUN servers an endpoint discovery
+// pass queries at once.
+const maxConcurrentSTUN = 8
+
 // determineEndpoints returns the machine's endpoint addresses. It
-// does a STUN lookup to determine its public address.
+// does a STUN lookup to determine its public address. Endpoints
+// from Options.AdvertiseEndpoints are included, or are all that's
+// returned if Options.AdvertiseEndpointsOnly is set.
+//
+// Each newly discovered STUN endpoint is reported to the endpoints
+// listeners as it arrives, along with the local addresses, rather
+// than waiting for the slowest STUN server. If no primary STUN
+// server responds, the fallback servers are queried the same way.
 func (c *Conn) determineEndpoints(ctx context.Context) ([]string, error) {
 	var (
 		alreadyMu sync.Mutex
-		already   = make(map[string]bool) // endpoint -> true
+		cands     []endpointCandidate
+		already   = make(map[string]bool) // STUN endpoints already seen
 	)
-	var eps []string // unique endpoints
+
+	stunEps := make(map[string]string) // STUN server -> endpoint it saw
+	stunFailures := 0                  // STUN servers that never responded
+	stunQueried := 0                   // STUN servers queried
 
 	addAddr := func(s, reason string) {
-		log.Printf("magicsock: found local %s (%s)\n", s, reason)
+		c.logf("magicsock: found local %s (%s)\n", s, reason)
 
 		alreadyMu.Lock()
 		defer alreadyMu.Unlock()
-		if !already[s] {
-			already[s] = true
-			eps = append(eps, s)
+		kind := endpointLocal
+		if reason == "stun" {
+			kind = endpointSTUN
 		}
+		cands = append(cands, endpointCandidate{s, kind})
 	}
 
-	s := &stunner.Stunner{
-		Send:     c.pconn.WriteTo,
-		Endpoint: func(server, endpoint string, d time.Duration) { addAddr(endpoint, "stun") },
-		Servers:  c.stunServers,
-		Logf:     c.logf,
+	for _, ep := range c.advertised {
+		c.logf("magicsock: advertising configured endpoint %s\n", ep)
+		cands = append(cands, endpointCandidate{ep, endpointAdvertised})
+	}
+	if c.advertiseOnly {
+		return orderEndpoints(cands), nil
+	}
+
+	var localIPs []string // addresses classifyNAT compares STUN results to
+	localAddr := c.pconn.LocalAddr()
+	if localAddr.IP.IsUnspecified() {
+		ips, loopback, err := interfaces.LocalAddresses()
+		if err != nil {
+			return nil, err
+		}
+		localIPs = append(ips, loopback...)
+		var eps []string
+		for _, ep := range interfaces.CandidateLocalEndpoints(uint16(localAddr.Port)) {
+			if !strings.HasPrefix(ep, "[") { // our socket is IPv4-only
+				eps = append(eps, ep)
+			}
+		}
+		reason := "localAddresses"
+		if len(eps) == 0 {
+			// Only include loopback addresses if we have no
+			// interfaces at all to use as endpoints. This allows
+			// for localhost testing when you're on a plane and
+			// offline, for example.
+			for _, ipStr := range loopback {
+				eps = append(eps, net.JoinHostPort(ipStr, fmt.Sprint(localAddr.Port)))
+			}
+			reason = "loopback"
+		}
+		for _, ep := range eps {
+			addAddr(ep, reason)
+		}
+	} else {
+		// Our local endpoint is bound to a particular address.
+		// Do not offer addresses on other local interfaces.
+		localIPs = []string{localAddr.IP.String()}
+		addAddr(localAddr.String(), "socket")
+	}
+
+	if len(c.stunServers) == 0 {
+		// DERP-only mode: there are no public endpoints to
+		// discover, or NAT to classify.
+		alreadyMu.Lock()
+		defer alreadyMu.Unlock()
+		return orderEndpoints(cands), nil
+	}
+
+	writeSTUN := c.pconn.WriteTo
+	var stunConn net.PacketConn // from c.stunDial, if non-nil
+	if c.stunDial != nil {
+		var err error
+		stunConn, err = c.stunDial(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("dialing STUN transport: %v", err)
+		}
+		defer stunConn.Close()
+		writeSTUN = stunConn.WriteTo
+	}
+
+	// STUN responses read from stunConn go to the current pass's
+	// Stunner, as those read from pconn do via c.stunReceiveFunc.
+	var stunConnReceive atomic.Value // of func(p []byte, fromAddr *net.UDPAddr)
+	if stunConn != nil {
+		stunConnReceive.Store(func([]byte, *net.UDPAddr) {})
+		go readSTUN(stunConn, func(b []byte, addr *net.UDPAddr) {
+			stunConnReceive.Load().(func([]byte, *net.UDPAddr))(b, addr)
+		})
+	}
+
+	// runSTUN queries servers, which are the fallback ones if
+	// fallback is set, until each has responded or been given up on.
+	runSTUN := func(servers []string, fallback bool) error {
+		s := &stunner.Stunner{
+			Send: func(b []byte, addr net.Addr) (int, error) {
+				if fallback {
+					metricSTUNFallbackRequests.Add(1)
+				} else {
+					metricSTUNRequestsSent.Add(1)
+				}
+				c.count(&c.stats.STUNSent)
+				n, err := writeSTUN(b, addr)
+				if err != nil {
+					metricSendErrors.Add(1)
+				}
+				return n, err
+			},
+			Endpoint: func(server, endpoint string, d time.Duration) {
+				metricSTUNResponsesReceived.Add(1)
+				c.count(&c.stats.STUNRecv)
+				c.noteSTUNResult(server, true)
+				c.setUDPBlocked(false)
+				alreadyMu.Lock()
+				if _, ok := stunEps[server]; !ok {
+					stunEps[server] = endpoint
+				}
+				isNew := !already[endpoint]
+				already[endpoint] = true
+				alreadyMu.Unlock()
+				if !isNew || ctx.Err() != nil {
+					return
+				}
+				addAddr(endpoint, "stun")
+				if ua, err := net.ResolveUDPAddr("udp", endpoint); err == nil {
+					c.emit(Event{Type: EventEndpoint, Addr: ua})
+				}
+				alreadyMu.Lock()
+				eps := orderEndpoints(cands)
+				alreadyMu.Unlock()
+				c.setEndpoints(eps)
+				c.queueEndpoints(eps)
+			},
+			Failure: func(server string) {
+				c.noteSTUNResult(server, false)
+				alreadyMu.Lock()
+				stunFailures++
+				alreadyMu.Unlock()
+			},
+			Rejected:       func(*net.UDPAddr) { metricSTUNResponsesRejected.Add(1) },
+			Dropped:        func(string) { metricSTUNRequestsDropped.Add(1) },
+			Servers:        servers,
+			Logf:           c.logf,
+			MaxTries:       c.stunTries,
+			RetryInterval:  c.stunRetry,
+			Timeout:        c.stunTimeout,
+			MaxConcurrency: maxConcurrentSTUN,
+		}
+
+		alreadyMu.Lock()
+		stunQueried += len(servers)
+		alreadyMu.Unlock()
+		if stunConn != nil {
+			stunConnReceive.Store(s.Receive)
+		} else {
+			c.stunReceiveFunc.Store(s.Receive)
+		}
+		return s.Run(ctx)
+	}
+
+	if err := runSTUN(c.stunServers, false); err != nil {
+		return nil, err
+	}
+	alreadyMu.Lock()
+	useFallback := len(stunEps) == 0 && len(c.stunFallback) > 0
+	alreadyMu.Unlock()
+	if useFallback && ctx.Err() == nil {
+		c.logf("magicsock: no primary STUN server responded; trying %d fallback servers", len(c.stunFallback))
+		if err := runSTUN(c.stunFallback, true); err != nil {
+			return nil, err
+		}
+	}
+
+	c.ignoreSTUNPackets()
+
+	if err := ctx.Err(); err != nil {
+		// Abandoned, as by Close or a newer pass. Don't let
+		// its partial results overwrite anything.
+		return nil, err
+	}
+
+	alreadyMu.Lock()
+	udpBlocked := len(stunEps) == 0 && stunFailures == stunQueried
+	nat := classifyNAT(stunEps, localAddr.Port, localIPs)
+	var predicted []string
+	if c.predictPorts && nat == NATHard {
+		predicted = predictEndpoints(stunEps)
+		for _, ep := range predicted {
+			cands = append(cands, endpointCandidate{ep, endpointPredicted})
+		}
+	}
+	eps := orderEndpoints(cands)
+	var publicEps []string
+	for _, ep := range stunEps {
+		publicEps = append(publicEps, ep)
+	}
+	alreadyMu.Unlock()
+	if udpBlocked {
+		c.setUDPBlocked(true)
+	}
+	c.setNATType(nat)
+	c.notePublicEndpoints(publicEps)
+	if len(predicted) > 0 {
+		c.logf("magicsock: predicted endpoints %v", predicted)
+	}
+	c.curEpMu.Lock()
+	c.curPredicted = predicted
+	c.curEpMu.Unlock()
+	return eps, nil
+}
+
+// readSTUN passes the STUN packets read from pc to receive until pc
+// is closed.
+func readSTUN(pc net.PacketConn, receive func([]byte, *net.UDPAddr)) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if ua, ok := addr.(*net.UDPAddr); ok && stun.Is(buf[:n]) {
+			receive(buf[:n], ua)
+		}
+	}
+}
+
+// endpointKind is where an endpoint candidate came from. Lower
+// values sort first in the list passed to EndpointsFunc.
+type endpointKind int
+
+const (
+	endpointAdvertised endpointKind = iota // from Options.AdvertiseEndpoints
+	endpointSTUN                           // as seen by a STUN server
+	endpointLocal                          // a local interface address
+	endpointPredicted                      // a predicted port of a hard NAT; see portpredict.go
+)
+
+type endpointCandidate struct {
+	addr string // ip:port
+	kind endpointKind
+}
+
+// orderEndpoints returns the unique addresses of cands, in an order
+// that depends only on the set of candidates, so the same endpoints
+// are always reported the same way.
+//
+// Endpoints are grouped by kind, in priority order from "farthest but
+// most reliable" to "closest but least reliable." Addresses returned
+// from STUN should be globally addressable, but might go farther on the
+// network than necessary. Local interface addresses might have lower
+// latency, but not be globally addressable.
+//
+// The STUN address(es) are always first, after any configured with
+// Options.AdvertiseEndpoints, so that legacy wireguard can use eps[0]
+// as its only known endpoint address (although that's obviously
+// non-ideal).
+//
+// Within a group, addresses are sorted. An address found both ways
+// is kept in the higher priority group.
+func orderEndpoints(cands []endpointCandidate) []string {
+	cands = append([]endpointCandidate(nil), cands...)
+	sort.Slice(cands, func(i, j int) bool {
+		if cands[i].kind != cands[j].kind {
+			return cands[i].kind < cands[j].kind
+		}
+		return cands[i].addr < cands[j].addr
+	})
+	already := make(map[string]bool) // endpoint -> true
+	var eps []string
+	for _, cand := range cands {
+		if !already[cand.addr] {
+			already[cand.addr] = true
+			eps = append(eps, cand.addr)
+		}
+	}
+	return eps
+}
+
+// NAT types returned by Conn.NATType.
+const (
+	NATUnknown = "unknown" // not enough STUN servers responded to tell
+	NATNone    = "none"    // STUN servers saw one of our local addresses
+	NATEasy    = "easy"    // endpoint-independent mapping
+	NATHard    = "hard"    // address- or port-dependent (symmetric) mapping
+)
+
+// NATType returns the kind of NAT c appears to be behind, as of the
+// last endpoint discovery: one of NATUnknown, NATNone, NATEasy or
+// NATHard.
+//
+// Only a hard NAT's mapping depends on the destination, making
+// direct connections between two such peers unlikely to work.
+func (c *Conn) NATType() string {
+	c.natMu.Lock()
+	defer c.natMu.Unlock()
+	if c.natType == "" {
+		return NATUnknown
+	}
+	return c.natType
+}
+
+func (c *Conn) setNATType(t string) {
+	old := c.NATType()
+	c.natMu.Lock()
+	c.natType = t
+	c.natMu.Unlock()
+	if t != old {
+		c.logf("magicsock: NAT type %s", t)
+		c.natFunc(t)
+		c.emit(Event{Type: EventNATType, NATType: t})
+	}
+}
+
+// UDPBlocked reports whether the network c is on appears to block
+// UDP: every STUN server went unanswered during the last endpoint
+// discovery pass, and none has responded since. If so, peers can
+// likely only be reached via DERP, and running in DERP-only mode,
+// with no STUN servers, avoids the futile discovery.
+//
+// Only IPv4 is probed, as c has no IPv6 socket.
+func (c *Conn) UDPBlocked() bool {
+	c.udpBlockedMu.Lock()
+	defer c.udpBlockedMu.Unlock()
+	return c.udpBlocked
+}
+
+func (c *Conn) setUDPBlocked(blocked bool) {
+	c.udpBlockedMu.Lock()
+	changed := blocked != c.udpBlocked
+	c.udpBlocked = blocked
+	c.udpBlockedMu.Unlock()
+	if !changed {
+		return
+	}
+	if blocked {
+		c.logf("magicsock: no STUN server responded; UDP appears to be blocked on this network, so peers may only be reachable via DERP (consider DERP-only mode)")
+		c.emit(Event{Type: EventUDPBlocked})
+	} else {
+		c.logf("magicsock: STUN response received; UDP is no longer blocked")
+		c.emit(Event{Type: EventUDPUnblocked})
+	}
+}
+
+// classifyNAT classifies the NAT we're behind, following RFC 5780
+// mapping behavior discovery. stunEps maps each STUN server that
+// responded to the endpoint it saw us at. localPort and localIPs are
+// those of our socket.
+//
+// If the servers all saw the same endpoint, the mapping doesn't
+// depend on the destination and the NAT is easy. If not, it's hard.
+func classifyNAT(stunEps map[string]string, localPort int, localIPs []string) string {
+	distinct := make(map[string]bool)
+	for _, ep := range stunEps {
+		host, port, err := net.SplitHostPort(ep)
+		if err != nil {
+			continue
+		}
+		if port == strconv.Itoa(localPort) {
+			for _, ip := range localIPs {
+				if host == ip {
+					return NATNone
+				}
+			}
+		}
+		distinct[ep] = true
+	}
+	switch {
+	case len(stunEps) < 2:
+		return NATUnknown
+	case len(distinct) == 1:
+		return NATEasy
+	default:
+		return NATHard
+	}
+}
+
+// stunServerStats tracks how a STUN server has been responding.
+type stunServerStats struct {
+	successes   int
+	failures    int // times the server didn't respond after all retries
+	lastSuccess time.Time
+}
+
+// noteSTUNResult records whether a STUN server responded to a
+// binding request.
+func (c *Conn) noteSTUNResult(server string, ok bool) {
+	c.stunStatsMu.Lock()
+	defer c.stunStatsMu.Unlock()
+	if c.stunStats == nil {
+		c.stunStats = make(map[string]*stunServerStats)
+	}
+	st := c.stunStats[server]
+	if st == nil {
+		st = new(stunServerStats)
+		c.stunStats[server] = st
+	}
+	if ok {
+		st.successes++
+		st.lastSuccess = c.clock.Now()
+	} else {
+		st.failures++
+	}
+}
+
+// stringSetsEqual reports whether x and y contain the same
+// strings, ignoring order.
+func stringSetsEqual(x, y []string) bool {
+	if len(x) != len(y) {
+		return false
 	}
+	xs := append([]string(nil), x...)
+	ys := append([]string(nil), y...)
+	sort.Strings(xs)
+	sort.Strings(ys)
+	return stringsEqual(xs, ys)
+}
 
-	c.stunReceiveFunc.Store(s.Receive)
-
-	if err := s.Run(ctx); err != nil {
-		return nil, err
+// diffEndpoints returns the endpoints in new but not old, and those
+// in old but not new, each sorted and without duplicates.
+func diffEndpoints(old, new []string) (added, removed []string) {
+	inOld := make(map[string]bool, len(old))
+	for _, ep := range old {
+		inOld[ep] = true
 	}
-
-	c.ignoreSTUNPackets()
-
-	if localAddr := c.pconn.LocalAddr(); localAddr.IP.IsUnspecified() {
-		ips, loopback, err := interfaces.LocalAddresses()
-		if err != nil {
-			return nil, err
-		}
-		reason := "localAddresses"
-		if len(ips) == 0 {
-			// Only include loopback addresses if we have no
-			// interfaces at all to use as endpoints. This allows
-			// for localhost testing when you're on a plane and
-			// offline, for example.
-			ips = loopback
-			reason = "loopback"
+	inNew := make(map[string]bool, len(new))
+	for _, ep := range new {
+		if !inOld[ep] && !inNew[ep] {
+			added = append(added, ep)
 		}
-		for _, ipStr := range ips {
-			addAddr(net.JoinHostPort(ipStr, fmt.Sprint(localAddr.Port)), reason)
+		inNew[ep] = true
+	}
+	for ep := range inOld {
+		if !inNew[ep] {
+			removed = append(removed, ep)
 		}
-	} else {
-		// Our local endpoint is bound to a particular address.
-		// Do not offer addresses on other local interfaces.
-		addAddr(localAddr.String(), "socket")
 	}
-
-	// Note: the endpoints are intentionally returned in priority order,
-	// from "farthest but most reliable" to "closest but least
-	// reliable." Addresses returned from STUN should be globally
-	// addressable, but might go farther on the network than necessary.
-	// Local interface addresses might have lower latency, but not be
-	// globally addressable.
-	//
-	// The STUN address(es) are always first so that legacy wireguard
-	// can use eps[0] as its only known endpoint address (although that's
-	// obviously non-ideal).
-	return eps, nil
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
 }
 
 func stringsEqual(x, y []string) bool {
@@ -302,11 +1554,23 @@ func stringsEqual(x, y []string) bool {
 	return true
 }
 
+// LocalPort returns the port of c's UDP/IPv4 socket.
 func (c *Conn) LocalPort() uint16 {
 	laddr := c.pconn.LocalAddr()
 	return uint16(laddr.Port)
 }
 
+// LocalAddrs returns the addresses c's UDP sockets are bound to, as
+// *net.UDPAddrs with the port chosen if Options.Port was zero. The
+// socket may be rebound to a new port, as by LinkChange, so the
+// result is only current as of the call.
+//
+// There's currently only the one UDP/IPv4 socket, but callers
+// should expect an IPv6 one too in the future.
+func (c *Conn) LocalAddrs() []net.Addr {
+	return []net.Addr{c.pconn.LocalAddr()}
+}
+
 func shouldSprayPacket(b []byte) bool {
 	if len(b) < 4 {
 		return false
@@ -327,13 +1591,18 @@ var logPacketDests, _ = strconv.ParseBool(os.Getenv("DEBUG_LOG_PACKET_DESTS"))
 // written to in order to reach as. Some of the returned UDPAddrs may
 // be fake addrs representing DERP servers.
 //
+// If no packet has been received from as over a direct path
+// recently, b is also sent via DERP: to as's DERP address if it has
+// one, else to fallbackDERP, if non-nil.
+//
 // It also returns as's current roamAddr, if any.
-func appendDests(dsts []*net.UDPAddr, as *AddrSet, b []byte) (_ []*net.UDPAddr, roamAddr *net.UDPAddr) {
+func appendDests(dsts []*net.UDPAddr, as *AddrSet, b []byte, fallbackDERP *net.UDPAddr) (_ []*net.UDPAddr, roamAddr *net.UDPAddr) {
 	spray := shouldSprayPacket(b) // true for handshakes
-	now := time.Now()
+	now := as.now()
 
 	as.mu.Lock()
 	defer as.mu.Unlock()
+	as.lastSend = now
 
 	// Spray logic.
 	//
@@ -372,21 +1641,97 @@ func appendDests(dsts []*net.UDPAddr, as *AddrSet, b []byte) (_ []*net.UDPAddr,
 			return dsts, roamAddr
 		}
 	}
+	cur := as.preferredLocked(as.curAddr, now)
+	if cur == -1 && !spray {
+		// We haven't heard from the peer directly yet, but prefer
+		// an endpoint we know is reachable over one that might
+		// blackhole packets.
+		cur = as.bestConfirmedLocked(now)
+	}
+	if cur == -1 && !spray {
+		// Nor do we know a working endpoint. If the peer is
+		// behind our NAT, which might not hairpin, start with
+		// its LAN address.
+		cur = as.lanEndpointLocked(now)
+	}
 	for i := len(as.addrs) - 1; i >= 0; i-- {
 		addr := &as.addrs[i]
-		if spray || as.curAddr == -1 || as.curAddr == i {
+		if i != cur && as.staleLocked(i, now) {
+			continue
+		}
+		if spray || cur == -1 || cur == i {
 			dsts = append(dsts, addr)
 		}
 		if !spray && len(dsts) != 0 {
 			break
 		}
 	}
+	if !spray && now.Sub(as.lastDirectRecv) > derpFallbackAfter {
+		if d := as.derpAddrLocked(fallbackDERP); d != nil && !containsUDPAddr(dsts, d) {
+			if !as.derpFallback {
+				as.derpFallback = true
+				as.derpFallbackAddr = d
+				metricDERPFallbackActivated.Add(1)
+				if as.emit != nil {
+					as.emit(Event{Type: EventDERPFallback, Peer: wgcfg.Key(as.publicKey), Addr: d})
+				}
+			}
+			dsts = append(dsts, d)
+		}
+	}
+	as.connStatusLocked(now) // to count flaps
 	if logPacketDests {
-		log.Printf("spray=%v; roam=%v; dests=%v", spray, roamAddr, dsts)
+		as.logf("spray=%v; roam=%v; dests=%v", spray, roamAddr, dsts)
 	}
 	return dsts, roamAddr
 }
 
+// derpFallbackAfter is how long packets are sent to a peer without
+// any reply over a direct path before they're also sent via DERP.
+const derpFallbackAfter = 5 * time.Second
+
+func containsUDPAddr(addrs []*net.UDPAddr, addr *net.UDPAddr) bool {
+	for _, a := range addrs {
+		if equalUDPAddr(a, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackDERPAddr returns the fake UDP address of c's preferred DERP
+// region, or nil if it doesn't have one.
+func (c *Conn) fallbackDERPAddr() *net.UDPAddr {
+	c.derpMu.Lock()
+	defer c.derpMu.Unlock()
+	if c.myDerp == 0 {
+		return nil
+	}
+	return derpAddr(c.myDerp)
+}
+
+// SetPreferredDERP sets the DERP region used to relay packets to
+// peers that aren't reachable directly and don't have a DERP region
+// of their own. It connects to the region if possible.
+//
+// Region 0 means to have no preferred region.
+func (c *Conn) SetPreferredDERP(region int) error {
+	if region < 0 || region > 64<<10 {
+		return fmt.Errorf("magicsock: invalid DERP region %d", region)
+	}
+	c.derpMu.Lock()
+	old := c.myDerp
+	c.myDerp = region
+	c.derpMu.Unlock()
+	if region == old || region == 0 {
+		return nil
+	}
+	c.logf("magicsock: preferred DERP region %d (%s)", region, c.derpHost(region))
+	// Connect now, so peers can reach us via the region.
+	c.derpWriteChanOfAddr(derpAddr(region))
+	return nil
+}
+
 var errNoDestinations = errors.New("magicsock: no destinations")
 
 func (c *Conn) Send(b []byte, ep conn.Endpoint) error {
@@ -400,14 +1745,20 @@ func (c *Conn) Send(b []byte, ep conn.Endpoint) error {
 			c.logf("DERP BUG: attempting to send packet to DERP address %v", addr)
 			return nil
 		}
-		_, err := c.pconn.WriteTo(b, addr)
+		err := c.writeUDP(b, addr)
+		if err != nil {
+			metricSendErrors.Add(1)
+		}
 		return err
 	case *AddrSet:
 		as = v
 	}
 
+	now := c.clock.Now()
+	c.maybeDiscoPing(as, now)
+
 	var addrBuf [8]*net.UDPAddr
-	dsts, roamAddr := appendDests(addrBuf[:0], as, b)
+	dsts, roamAddr := appendDests(addrBuf[:0], as, b, c.fallbackDERPAddr())
 
 	if len(dsts) == 0 {
 		return errNoDestinations
@@ -417,13 +1768,17 @@ func (c *Conn) Send(b []byte, ep conn.Endpoint) error {
 	var ret error
 	for _, addr := range dsts {
 		err := c.sendAddr(addr, as.publicKey, b)
+		as.noteSendResult(addr, err)
+		if err != nil {
+			metricSendErrors.Add(1)
+		}
 		if err == nil {
 			success = true
 		} else if ret == nil {
 			ret = err
 		}
 		if err != nil && addr != roamAddr && c.sendLogLimit.Allow() {
-			log.Printf("magicsock: Conn.Send(%v): %v", addr, err)
+			c.logf("magicsock: Conn.Send(%v): %v", addr, err)
 		}
 	}
 	if success {
@@ -432,6 +1787,14 @@ func (c *Conn) Send(b []byte, ep conn.Endpoint) error {
 	return ret
 }
 
+// pace blocks as needed to keep UDP writes to the rate set by
+// Options.PacingBytesPerSec, if any.
+func (c *Conn) pace(n int) {
+	if c.pacer != nil {
+		c.pacer.wait(n)
+	}
+}
+
 var errConnClosed = errors.New("Conn closed")
 
 var errDropDerpPacket = errors.New("too many DERP packets queued; dropping")
@@ -441,6 +1804,9 @@ var errDropDerpPacket = errors.New("too many DERP packets queued; dropping")
 // The provided public key identifies the recipient.
 func (c *Conn) sendAddr(addr *net.UDPAddr, pubKey key.Public, b []byte) error {
 	if ch := c.derpWriteChanOfAddr(addr); ch != nil {
+		if c.sniffer != nil {
+			c.sniffer(DirSend, addr, b)
+		}
 		errc := make(chan error, 1)
 		select {
 		case <-c.donec():
@@ -457,6 +1823,21 @@ func (c *Conn) sendAddr(addr *net.UDPAddr, pubKey key.Public, b []byte) error {
 			return errDropDerpPacket
 		}
 	}
+	return c.writeUDP(b, addr)
+}
+
+// writeUDP writes packet b to addr on c's UDP socket, paced and
+// batched as configured in Options.
+func (c *Conn) writeUDP(b []byte, addr *net.UDPAddr) error {
+	if c.sniffer != nil {
+		c.sniffer(DirSend, addr, b)
+	}
+	c.pace(len(b))
+	c.count(&c.stats.PacketsSent)
+	if c.batcher != nil {
+		c.batcher.write(b, addr)
+		return nil
+	}
 	_, err := c.pconn.WriteTo(b, addr)
 	return err
 }
@@ -477,6 +1858,11 @@ func (c *Conn) derpWriteChanOfAddr(addr *net.UDPAddr) chan<- derpWriteRequest {
 	}
 	c.derpMu.Lock()
 	defer c.derpMu.Unlock()
+	if c.isClosed() {
+		// Close has closed, or is about to close, all DERP
+		// connections. Don't start another.
+		return nil
+	}
 	if c.privateKey.IsZero() {
 		c.logf("DERP lookup of %v with no private key; ignoring", addr.IP)
 		return nil
@@ -487,13 +1873,15 @@ func (c *Conn) derpWriteChanOfAddr(addr *net.UDPAddr) chan<- derpWriteRequest {
 			c.derpWriteCh = make(map[int]chan<- derpWriteRequest)
 			c.derpConn = make(map[int]*derphttp.Client)
 			c.derpCancel = make(map[int]context.CancelFunc)
+			c.derpState = make(map[int]*derpConnState)
 		}
-		host := derpHost(addr.Port)
-		dc, err := derphttp.NewClient(c.privateKey, "https://"+host+"/derp", log.Printf)
+		host := c.derpHost(addr.Port)
+		dc, err := derphttp.NewClient(c.privateKey, "https://"+host+"/derp", c.logf)
 		if err != nil {
 			c.logf("derphttp.NewClient: port %d, host %q invalid? err: %v", addr.Port, host, err)
 			return nil
 		}
+		c.configureDERPClient(dc)
 
 		ctx, cancel := context.WithCancel(context.Background())
 
@@ -502,12 +1890,32 @@ func (c *Conn) derpWriteChanOfAddr(addr *net.UDPAddr) chan<- derpWriteRequest {
 		c.derpConn[addr.Port] = dc
 		c.derpWriteCh[addr.Port] = ch
 		c.derpCancel[addr.Port] = cancel
-		go c.runDerpReader(ctx, addr, dc)
-		go c.runDerpWriter(ctx, addr, dc, bidiCh)
+		st := &derpConnState{box: newDiscoBox(c.privateKey, c.privateKey.Public())}
+		c.derpState[addr.Port] = st
+		c.goTracked("derpReader", func() { c.runDerpReader(ctx, addr, dc, st) })
+		c.goTracked("derpWriter", func() { c.runDerpWriter(ctx, addr, dc, bidiCh) })
+		if c.derpKeepaliveInterval > 0 {
+			c.goTracked("derpKeepalive", func() { c.runDerpKeepalive(ctx, addr, dc, st, bidiCh) })
+		}
 	}
 	return ch
 }
 
+// configureDERPClient sets dc to connect using the transport of
+// Options.DERPHTTPClient, if any.
+func (c *Conn) configureDERPClient(dc *derphttp.Client) {
+	if c.derpHTTPClient == nil {
+		return
+	}
+	tr, ok := c.derpHTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	dc.TLSConfig = tr.TLSClientConfig
+	dc.DialContext = tr.DialContext
+	dc.Proxy = tr.Proxy
+}
+
 // derpReadResult is the type sent by runDerpClient to ReceiveIPv4
 // when a DERP packet is available.
 type derpReadResult struct {
@@ -523,8 +1931,11 @@ type derpReadResult struct {
 var logDerpVerbose, _ = strconv.ParseBool(os.Getenv("DEBUG_DERP_VERBOSE"))
 
 // runDerpReader runs in a goroutine for the life of a DERP
-// connection, handling received packets.
-func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr *net.UDPAddr, dc *derphttp.Client) {
+// connection, handling received packets. It connects, and after a
+// failure reconnects, to the server, waiting as derpBackoff says
+// between consecutive failed attempts.
+func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr *net.UDPAddr, dc *derphttp.Client, st *derpConnState) {
+	defer st.setConnected(false)
 	didCopy := make(chan struct{}, 1)
 	var buf [derp.MaxPacketSize]byte
 	var bufValid int // bytes in buf that are valid
@@ -534,12 +1945,21 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr *net.UDPAddr, dc
 		return n
 	}
 
+	failures := 0 // consecutive failed connects or reads
 	for {
-		msg, err := dc.Recv(buf[:])
+		var msg derp.ReceivedMessage
+		err := dc.Connect(ctx)
+		if err == nil {
+			if st.setConnected(true) && failures > 0 {
+				c.logf("magicsock: derp-%d: reconnected", derpFakeAddr.Port)
+			}
+			msg, err = dc.Recv(buf[:])
+		}
 		if err == derphttp.ErrClientClosed {
 			return
 		}
 		if err != nil {
+			st.setConnected(false)
 			select {
 			case <-c.donec():
 				return
@@ -547,20 +1967,38 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr *net.UDPAddr, dc
 				return
 			default:
 			}
-			log.Printf("derp.Recv: %v", err)
-			time.Sleep(250 * time.Millisecond)
+			failures++
+			d := derpBackoff(c.derpBackoffBase, c.derpBackoffMax, failures)
+			c.logf("magicsock: derp-%d: %v; reconnecting in %v", derpFakeAddr.Port, err, d)
+			t := c.clock.NewTimer(d)
+			select {
+			case <-t.Chan():
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-c.donec():
+				t.Stop()
+				return
+			}
+			metricDERPReconnects.Add(1)
 			continue
 		}
+		failures = 0
 		switch m := msg.(type) {
 		case derp.ReceivedPacket:
+			if st.noteRecv(m) {
+				continue // our keepalive
+			}
 			bufValid = len(m)
+			metricDERPPacketsRecv.Add(1)
+			c.count(&c.stats.DERPRecv)
 		default:
 			// Ignore.
 			// TODO: handle endpoint notification messages.
 			continue
 		}
 		if logDerpVerbose {
-			log.Printf("got derp %v packet: %q", derpFakeAddr, buf[:bufValid])
+			c.logf("got derp %v packet: %q", derpFakeAddr, buf[:bufValid])
 		}
 		select {
 		case <-c.donec():
@@ -590,7 +2028,7 @@ func (c *Conn) runDerpWriter(ctx context.Context, derpFakeAddr *net.UDPAddr, dc
 		case wr := <-ch:
 			err := dc.Send(wr.pubKey, wr.b)
 			if err != nil {
-				log.Printf("magicsock: derp.Send(%v): %v", wr.addr, err)
+				c.logf("magicsock: derp.Send(%v): %v", wr.addr, err)
 			}
 			select {
 			case wr.errc <- err:
@@ -623,11 +2061,13 @@ type udpReadResult struct {
 var aLongTimeAgo = time.Unix(233431200, 0)
 
 func (c *Conn) ReceiveIPv4(b []byte) (n int, ep conn.Endpoint, addr *net.UDPAddr, err error) {
-	go func() {
+	if c.isClosed() {
+		return 0, nil, nil, errConnClosed
+	}
+	if !c.goTracked("receive", func() {
 		// Read a packet, and process any STUN packets before returning.
 		for {
-			var pAddr net.Addr
-			n, pAddr, err = c.pconn.ReadFrom(b)
+			n, pAddr, err := c.pconn.ReadFrom(b)
 			if err != nil {
 				select {
 				case c.udpRecvCh <- udpReadResult{err: err}:
@@ -635,20 +2075,28 @@ func (c *Conn) ReceiveIPv4(b []byte) (n int, ep conn.Endpoint, addr *net.UDPAddr
 				}
 				return
 			}
+			addr := pAddr.(*net.UDPAddr)
 			if stun.Is(b[:n]) {
-				c.stunReceiveFunc.Load().(func([]byte, *net.UDPAddr))(b, addr)
+				c.stunReceiveFunc.Load().(func([]byte, *net.UDPAddr))(b[:n], addr)
+				continue
+			}
+			if from, ok := discoSender(b[:n]); ok {
+				c.handleDiscoMsg(from, b[:n], addr)
 				continue
 			}
 
-			addr := pAddr.(*net.UDPAddr)
 			addr.IP = addr.IP.To4()
+			metricPacketsRecvIPv4.Add(1)
+			c.count(&c.stats.PacketsRecvV4)
 			select {
 			case c.udpRecvCh <- udpReadResult{n: n, addr: addr}:
 			case <-c.donec():
 			}
 			return
 		}
-	}()
+	}) {
+		return 0, nil, nil, errConnClosed
+	}
 
 	select {
 	case dm := <-c.derpRecvCh:
@@ -666,23 +2114,34 @@ func (c *Conn) ReceiveIPv4(b []byte) (n int, ep conn.Endpoint, addr *net.UDPAddr
 			// is done with our b []byte buf.
 			c.pconn.SetReadDeadline(time.Time{})
 		case <-c.donec():
-			return 0, nil, nil, errors.New("Conn closed")
+			return 0, nil, nil, errConnClosed
 		}
 		n, addr = dm.n, dm.derpAddr
 		ncopy := dm.copyBuf(b)
 		if ncopy != n {
 			err = fmt.Errorf("received DERP packet of length %d that's too big for WireGuard ReceiveIPv4 buf size %d", n, ncopy)
-			log.Printf("magicsock: %v", err)
+			c.logf("magicsock: %v", err)
 			return 0, nil, nil, err
 		}
 
 	case um := <-c.udpRecvCh:
 		if um.err != nil {
-			return 0, nil, nil, err
+			if c.isClosed() {
+				return 0, nil, nil, errConnClosed
+			}
+			return 0, nil, nil, um.err
 		}
 		n, addr = um.n, um.addr
+
+	case <-c.donec():
+		// The read goroutine, if still blocked, is unblocked
+		// by Close closing the underlying socket.
+		return 0, nil, nil, errConnClosed
 	}
 
+	if c.sniffer != nil {
+		c.sniffer(DirRecv, addr, b[:n])
+	}
 	addrSet := c.findAddrSet(addr)
 	if addrSet == nil {
 		// The peer that sent this packet has roamed beyond the
@@ -691,6 +2150,9 @@ func (c *Conn) ReceiveIPv4(b []byte) (n int, ep conn.Endpoint, addr *net.UDPAddr
 		// on the original endpoint using this addr.
 		return n, (*singleEndpoint)(addr), addr, nil
 	}
+	// Direct receives are noted once WireGuard authenticates the
+	// packet and calls UpdateDst: the source address alone can be
+	// spoofed.
 	return n, addrSet, addr, nil
 }
 
@@ -701,12 +2163,20 @@ func (c *Conn) ReceiveIPv6(buff []byte) (int, conn.Endpoint, *net.UDPAddr, error
 
 // SetPrivateKey sets the connection's private key.
 //
-// This is only used to be able prove our identity when connecting to
-// DERP servers.
+// It's used to prove our identity when connecting to DERP servers,
+// and to seal disco messages, which peers only answer once they're
+// configured with the matching public key. WireGuard itself is
+// rekeyed by its own reconfiguration, so rotating keys this way
+// leaves the UDP socket, discovered endpoints and peers' confirmed
+// paths as they were.
 //
 // If the private key changes, any DERP connections are torn down &
-// recreated when needed.
+// recreated when needed, with the new key.
 func (c *Conn) SetPrivateKey(privateKey wgcfg.PrivateKey) error {
+	// Run after derpMu is released: the hairpin probe, a disco
+	// ping to ourselves, waits for a private key.
+	defer c.maybeProbeHairpin()
+
 	c.derpMu.Lock()
 	defer c.derpMu.Unlock()
 
@@ -721,6 +2191,7 @@ func (c *Conn) SetPrivateKey(privateKey wgcfg.PrivateKey) error {
 	}
 
 	// Key changed. Close any DERP connections.
+	c.logf("magicsock: private key changed; reconnecting to DERP")
 	c.closeAllDerpLocked()
 
 	return nil
@@ -728,8 +2199,9 @@ func (c *Conn) SetPrivateKey(privateKey wgcfg.PrivateKey) error {
 
 // c.derpMu must be held.
 func (c *Conn) closeAllDerpLocked() {
-	for _, c := range c.derpConn {
-		go c.Close()
+	for _, dc := range c.derpConn {
+		dc := dc
+		c.goTracked("derpClose", func() { dc.Close() })
 	}
 	for _, cancel := range c.derpCancel {
 		cancel()
@@ -737,66 +2209,133 @@ func (c *Conn) closeAllDerpLocked() {
 	c.derpConn = nil
 	c.derpCancel = nil
 	c.derpWriteCh = nil
+	c.derpState = nil
 }
 
 func (c *Conn) SetMark(value uint32) error { return nil }
 func (c *Conn) LastMark() uint32           { return 0 }
 
+// Close closes the connection.
+//
+// Any goroutines blocked in ReceiveIPv4 are unblocked and return
+// errConnClosed, which WireGuard treats as the Bind shutting down.
+// Close waits, up to closeTimeout, for c's goroutines to exit.
+// Only the first call to Close has any effect.
 func (c *Conn) Close() error {
-	// TODO: make this safe for concurrent Close? it's safe now only if Close calls are serialized.
-	select {
-	case <-c.donec():
+	c.closeMu.Lock()
+	if c.closed {
+		c.closeMu.Unlock()
 		return nil
-	default:
 	}
+	c.closed = true
+	c.closeMu.Unlock()
+
 	c.connCtxCancel()
+	c.unregisterLinkChange()
+	c.closeEvents()
+
+	c.epMu.Lock()
+	if c.epTimer != nil {
+		c.epTimer.Stop()
+	}
+	c.epMu.Unlock()
 
 	c.derpMu.Lock()
 	c.closeAllDerpLocked()
 	c.derpMu.Unlock()
 
-	return c.pconn.Close()
+	if c.batcher != nil {
+		c.batcher.close()
+	}
+	err := c.pconn.Close()
+	c.waitGoroutines(closeTimeout)
+	return err
+}
+
+// isClosed reports whether Close has been called.
+func (c *Conn) isClosed() bool {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+	return c.closed
+}
+
+// ReSTUN triggers an immediate endpoint discovery pass, such as
+// after a network change. The reason is logged.
+//
+// If a pass is already queued, the call is collapsed into it.
+// A pass already in progress is abandoned in favor of the new one,
+// as its results may be stale.
+func (c *Conn) ReSTUN(reason string) {
+	metricReSTUNCalls.Add(1)
+	c.logf("magicsock: re-STUN: %s", reason)
+	c.reSTUN()
 }
 
 func (c *Conn) reSTUN() {
 	select {
 	case c.startEpUpdate <- struct{}{}:
 	case <-c.donec():
+	default:
+		// An update is already queued.
 	}
 }
 
+// LinkChange informs c that the system's network configuration
+// changed. It rebinds c's socket and rediscovers its endpoints.
 func (c *Conn) LinkChange() {
-	defer c.reSTUN()
-
-	if c.pconnPort != 0 {
-		c.pconn.mu.Lock()
-		if err := c.pconn.pconn.Close(); err != nil {
-			log.Printf("magicsock: link change close failed: %v", err)
-		}
-		packetConn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", c.pconnPort))
-		if err == nil {
-			log.Printf("magicsock: link change rebound port: %d", c.pconnPort)
-			c.pconn.pconn = packetConn.(*net.UDPConn)
-			c.pconn.mu.Unlock()
-			return
-		}
-		log.Printf("magicsock: link change unable to bind fixed port %d: %v, falling back to random port", c.pconnPort, err)
-		c.pconn.mu.Unlock()
+	defer c.ReSTUN("link change")
+	if err := c.Rebind(); err != nil {
+		c.logf("magicsock: link change: %v", err)
 	}
+}
 
-	log.Printf("magicsock: link change, binding new port")
-	packetConn, err := net.ListenPacket("udp4", ":0")
-	if err != nil {
-		log.Printf("magicsock: link change failed to bind new port: %v", err)
-		return
+// Rebind closes and reopens c's UDP socket, such as after the
+// interface it was bound to went away. It keeps the same port if
+// possible, falling back to a random one.
+//
+// The Conn itself, and any endpoints handed out to WireGuard, remain
+// valid. Reads and writes in progress on the old socket are retried
+// on the new one.
+func (c *Conn) Rebind() error {
+	if c.isClosed() {
+		return errConnClosed
+	}
+	port := c.pconnPort
+	if port == 0 {
+		port = c.LocalPort()
+	}
+	if err := c.pconn.rebind(c.pconnHost, port, 0); err == errConnClosed {
+		return err // closed meanwhile
+	} else if err != nil {
+		return fmt.Errorf("magicsock: rebind: %v", err)
+	}
+	if newPort := c.LocalPort(); newPort != port {
+		c.logf("magicsock: unable to rebind port %d, bound new port %d", port, newPort)
+	} else {
+		c.logf("magicsock: rebound port %d", port)
 	}
-	c.pconn.Reset(packetConn.(*net.UDPConn))
+	c.emit(Event{Type: EventRebind, Addr: c.pconn.LocalAddr()})
+	return nil
 }
 
 // AddrSet is a set of UDP addresses that implements wireguard/conn.Endpoint.
 type AddrSet struct {
 	publicKey key.Public    // peer public key used for DERP communication
 	addrs     []net.UDPAddr // ordered priority list (low to high) provided by wgengine
+	logf      logger.Logf   // the owning Conn's logf
+	emit      func(Event)   // the owning Conn's emit, or nil
+
+	// needsHairpin is the owning Conn's needsHairpin, or nil.
+	needsHairpin func(addr *net.UDPAddr) bool
+
+	// probeRoam is the owning Conn's probeRoamCandidate, or nil.
+	probeRoam func(as *AddrSet, addr *net.UDPAddr)
+
+	clock clock // the owning Conn's clock, or nil for the real clock
+
+	// pathPref is the owning Conn's path preference, or nil for
+	// DefaultPathPreference.
+	pathPref []PathKind
 
 	mu sync.Mutex // guards following fields
 
@@ -808,6 +2347,18 @@ type AddrSet struct {
 	// are correctly learning/sharing the network map details.
 	roamAddr *net.UDPAddr
 
+	// roamCand is an unexpected address a correctly signed
+	// WireGuard packet was received from, which will become
+	// roamAddr once it answers a disco ping with a pong sealed by
+	// the peer's private key. Until then, it could be an attacker
+	// replaying a captured packet to redirect our traffic, so
+	// nothing is sent there but the ping. Only the peer can answer
+	// it, so the pong proves the address reaches the peer; someone
+	// there relaying to the peer is no worse than a router on the
+	// path. roamCandProbe is when that ping was last sent.
+	roamCand      *net.UDPAddr
+	roamCandProbe time.Time
+
 	// curAddr is an index into addrs of the highest-priority
 	// address a valid packet has been received from so far.
 	// If no valid packet from addrs has been received, curAddr is -1.
@@ -818,6 +2369,211 @@ type AddrSet struct {
 
 	// lastSpray is the lsat time we sprayed a packet.
 	lastSpray time.Time
+
+	// lastDirectRecv is when WireGuard last accepted a packet from
+	// the peer over a direct (non-DERP) path, or the peer last
+	// answered a disco ping.
+	lastDirectRecv time.Time
+
+	// lastPing is when the peer's endpoints were last sent disco
+	// pings (see disco.go).
+	lastPing time.Time
+
+	// lastSend is when a packet was last sent to the peer, and
+	// lastKeepalive when a keepalive was (see keepalive.go).
+	lastSend      time.Time
+	lastKeepalive time.Time
+
+	// pongAt is, for each of addrs, when it last answered a disco
+	// ping, and pongRTT its smoothed round-trip time (see
+	// notePong). They're nil until the first pong.
+	pongAt  []time.Time
+	pongRTT []time.Duration
+
+	// derpFallback is whether packets are also being sent via
+	// DERP because the direct path doesn't seem to be working,
+	// and derpFallbackAddr the DERP address they're sent to.
+	derpFallback     bool
+	derpFallbackAddr *net.UDPAddr
+
+	// statusDirect is whether the peer was direct, rather than
+	// relayed, when last checked by connStatusLocked, if
+	// statusKnown. It's used to count flips between the two.
+	statusKnown  bool
+	statusDirect bool
+
+	// sendErrs is, for each destination whose latest send failed,
+	// that failure. Destinations are removed on a successful send.
+	sendErrs map[udpAddr]*sendErr
+
+	// recvAt is, for each of addrs, when WireGuard last accepted a
+	// packet from it (see UpdateDst). It's nil until the first.
+	recvAt []time.Time
+
+	// created is when the AddrSet was created, which is as long
+	// as an endpoint that's never been heard from has been silent.
+	created time.Time
+
+	// ttl is how long an endpoint may be silent before it's
+	// considered dead (see staleLocked). Zero means never.
+	ttl time.Duration
+
+	// removed is whether RemovePeer has removed the peer, after
+	// which it's no longer pinged.
+	removed bool
+}
+
+// now returns the current time according to a's clock.
+func (a *AddrSet) now() time.Time {
+	if a.clock == nil {
+		return time.Now()
+	}
+	return a.clock.Now()
+}
+
+// sendErr is a run of consecutive failed sends to one destination.
+type sendErr struct {
+	err error // the latest
+	n   int   // how many in a row
+}
+
+// noteSendResult records the result, err, of sending to addr.
+func (a *AddrSet) noteSendResult(addr *net.UDPAddr, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err == nil && len(a.sendErrs) == 0 {
+		return // fast path: nothing failing
+	}
+	k := udpAddrKey(addr)
+	if err == nil {
+		delete(a.sendErrs, k)
+		return
+	}
+	if a.sendErrs == nil {
+		a.sendErrs = make(map[udpAddr]*sendErr)
+	}
+	se := a.sendErrs[k]
+	if se == nil {
+		se = new(sendErr)
+		a.sendErrs[k] = se
+	}
+	se.err = err
+	se.n++
+}
+
+// udpAddrKey returns addr as a key for maps like addrsByUDP.
+func udpAddrKey(addr *net.UDPAddr) udpAddr {
+	var k udpAddr
+	copy(k.ip.Addr[:], addr.IP.To16())
+	k.port = uint16(addr.Port)
+	return k
+}
+
+// noteRecvLocked records that WireGuard accepted a packet from the
+// endpoint at index i of a.addrs at time now.
+// a.mu must be held.
+func (a *AddrSet) noteRecvLocked(i int, now time.Time) {
+	if a.recvAt == nil {
+		a.recvAt = make([]time.Time, len(a.addrs))
+	}
+	a.recvAt[i] = now
+}
+
+// lastSeenLocked returns when the endpoint at index i of a.addrs was
+// last heard from, by a WireGuard packet or a disco pong, or the
+// zero time if it never has been.
+// a.mu must be held.
+func (a *AddrSet) lastSeenLocked(i int) time.Time {
+	var t time.Time
+	if a.recvAt != nil {
+		t = a.recvAt[i]
+	}
+	if a.pongAt != nil && a.pongAt[i].After(t) {
+		t = a.pongAt[i]
+	}
+	return t
+}
+
+// staleLocked reports whether the direct endpoint at index i of
+// a.addrs has been silent for longer than a.ttl, counting from a's
+// creation if it was never heard from, while some other direct
+// endpoint of the peer hasn't. If none is live, none is stale: the
+// peer may just be idle, or reachable only via DERP, and the
+// endpoints may yet work. The DERP endpoint is never stale.
+// a.mu must be held.
+func (a *AddrSet) staleLocked(i int, now time.Time) bool {
+	if a.ttl <= 0 || now.Sub(a.created) <= a.ttl {
+		return false
+	}
+	if a.addrs[i].IP.Equal(derpMagicIP) || a.liveLocked(i, now) {
+		return false
+	}
+	for j := range a.addrs {
+		if j != i && !a.addrs[j].IP.Equal(derpMagicIP) && a.liveLocked(j, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// liveLocked reports whether the endpoint at index i of a.addrs has
+// been heard from within a.ttl.
+// a.mu must be held.
+func (a *AddrSet) liveLocked(i int, now time.Time) bool {
+	t := a.lastSeenLocked(i)
+	return !t.IsZero() && now.Sub(t) <= a.ttl
+}
+
+// noteDirectRecv records that an authenticated packet was received
+// from the peer over a direct path at time now.
+func (a *AddrSet) noteDirectRecv(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.noteDirectRecvLocked(now)
+}
+
+// a.mu must be held.
+func (a *AddrSet) noteDirectRecvLocked(now time.Time) {
+	a.lastDirectRecv = now
+	a.derpFallback = false
+	a.derpFallbackAddr = nil
+	a.connStatusLocked(now) // to count flaps
+}
+
+// derpAddrLocked returns the peer's DERP address, or fallback if it
+// doesn't have one.
+// a.mu must be held.
+func (a *AddrSet) derpAddrLocked(fallback *net.UDPAddr) *net.UDPAddr {
+	for i := range a.addrs {
+		if a.addrs[i].IP.Equal(derpMagicIP) {
+			return &a.addrs[i]
+		}
+	}
+	return fallback
+}
+
+// PeerLatency returns the round-trip time to the peer with public
+// key pubKey at its current endpoint, as reported by PeerEndpoint,
+// smoothed over the disco pings there. The bool reports whether
+// that endpoint has answered a ping; DERP endpoints and roaming
+// addresses are never pinged for latency.
+func (c *Conn) PeerLatency(pubKey wgcfg.Key) (time.Duration, bool) {
+	as := c.addrSetOfKey(pubKey)
+	if as == nil {
+		return 0, false
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.roamAddr != nil || as.pongAt == nil {
+		return 0, false
+	}
+	addr := as.peerEndpointLocked()
+	for i := range as.addrs {
+		if &as.addrs[i] == addr && !as.pongAt[i].IsZero() {
+			return as.pongRTT[i], true
+		}
+	}
+	return 0, false
 }
 
 var noAddr = &net.UDPAddr{
@@ -877,11 +2633,17 @@ func (a *AddrSet) UpdateDst(new *net.UDPAddr) error {
 		if equalUDPAddr(a.roamAddr, new) {
 			// Packet from the current roaming address, no logging.
 			// This is a hot path for established connections.
+			a.noteDirectRecvLocked(a.now())
 			return nil
 		}
 	} else if a.curAddr >= 0 && equalUDPAddr(new, &a.addrs[a.curAddr]) {
 		// Packet from current-priority address, no logging.
 		// This is a hot path for established connections.
+		now := a.now()
+		a.noteRecvLocked(a.curAddr, now)
+		if !new.IP.Equal(derpMagicIP) {
+			a.noteDirectRecvLocked(now)
+		}
 		return nil
 	}
 
@@ -892,6 +2654,9 @@ func (a *AddrSet) UpdateDst(new *net.UDPAddr) error {
 			break
 		}
 	}
+	if index != -1 {
+		a.noteRecvLocked(index, a.now())
+	}
 
 	publicKey := wgcfg.Key(a.publicKey)
 	pk := publicKey.ShortString()
@@ -902,30 +2667,42 @@ func (a *AddrSet) UpdateDst(new *net.UDPAddr) error {
 
 	switch {
 	case index == -1:
-		if a.roamAddr == nil {
-			log.Printf("magicsock: rx %s from roaming address %s, set as new priority", pk, new)
+		now := a.now()
+		if a.roamCand != nil && equalUDPAddr(a.roamCand, new) {
+			if now.Sub(a.roamCandProbe) < discoPingInterval {
+				return nil // still waiting for it to answer
+			}
 		} else {
-			log.Printf("magicsock: rx %s from roaming address %s, replaces roaming address %s", pk, new, a.roamAddr)
+			a.logf("magicsock: rx %s from roaming address %s, probing", pk, new)
+			a.roamCand = new
+		}
+		a.roamCandProbe = now
+		if a.probeRoam != nil && !a.removed {
+			// Not under a.mu, which the pong handler needs.
+			go a.probeRoam(a, new)
 		}
-		a.roamAddr = new
 
 	case a.roamAddr != nil:
-		log.Printf("magicsock: rx %s from known %s (%d), replaces roaming address %s", pk, new, index, a.roamAddr)
+		a.logf("magicsock: rx %s from known %s (%d), replaces roaming address %s", pk, new, index, a.roamAddr)
 		a.roamAddr = nil
+		a.roamCand = nil
 		a.curAddr = index
 
 	case a.curAddr == -1:
-		log.Printf("magicsock: rx %s from %s (%d/%d), set as new priority", pk, new, index, len(a.addrs))
+		a.logf("magicsock: rx %s from %s (%d/%d), set as new priority", pk, new, index, len(a.addrs))
 		a.curAddr = index
 
 	case index < a.curAddr:
-		log.Printf("magicsock: rx %s from low-pri %s (%d), keeping current %s (%d)", pk, new, index, old, a.curAddr)
+		a.logf("magicsock: rx %s from low-pri %s (%d), keeping current %s (%d)", pk, new, index, old, a.curAddr)
 
 	default: // index > a.curAddr
-		log.Printf("magicsock: rx %s from %s (%d/%d), replaces old priority %s", pk, new, index, len(a.addrs), old)
+		a.logf("magicsock: rx %s from %s (%d/%d), replaces old priority %s", pk, new, index, len(a.addrs), old)
 		a.curAddr = index
 	}
 
+	if index != -1 && !new.IP.Equal(derpMagicIP) {
+		a.noteDirectRecvLocked(a.now())
+	}
 	return nil
 }
 
@@ -957,6 +2734,8 @@ func (a *AddrSet) String() string {
 }
 
 func (a *AddrSet) Addrs() []wgcfg.Endpoint {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	var eps []wgcfg.Endpoint
 	for _, addr := range a.addrs {
 		eps = append(eps, wgcfg.Endpoint{
@@ -965,8 +2744,6 @@ func (a *AddrSet) Addrs() []wgcfg.Endpoint {
 		})
 	}
 
-	a.mu.Lock()
-	defer a.mu.Unlock()
 	if a.roamAddr != nil {
 		eps = append(eps, wgcfg.Endpoint{
 			Host: a.roamAddr.IP.String(),
@@ -979,41 +2756,26 @@ func (a *AddrSet) Addrs() []wgcfg.Endpoint {
 // CreateEndpoint is called by WireGuard to connect to an endpoint.
 // The key is the public key of the peer and addrs is a
 // comma-separated list of UDP ip:ports.
+//
+// If c already knows the peer, as from UpdatePeer or an earlier
+// CreateEndpoint, its AddrSet is updated, as by UpdatePeer, and
+// returned, so there's only ever one per peer.
 func (c *Conn) CreateEndpoint(key [32]byte, addrs string) (conn.Endpoint, error) {
 	pk := wgcfg.Key(key)
-	log.Printf("magicsock: CreateEndpoint: key=%s: %s", pk.ShortString(), addrs)
-	a := &AddrSet{
-		publicKey: key,
-		curAddr:   -1,
-	}
+	c.logf("magicsock: CreateEndpoint: key=%s: %s", pk.ShortString(), addrs)
 
+	var uaddrs []net.UDPAddr
 	if addrs != "" {
 		for _, ep := range strings.Split(addrs, ",") {
-			addr, err := net.ResolveUDPAddr("udp", ep)
+			addr, err := resolveEndpoint(ep)
 			if err != nil {
 				return nil, err
 			}
-			if ip4 := addr.IP.To4(); ip4 != nil {
-				addr.IP = ip4
-			}
-			a.addrs = append(a.addrs, *addr)
+			uaddrs = append(uaddrs, *addr)
 		}
 	}
-
-	c.addrsMu.Lock()
-	for _, addr := range a.addrs {
-		if addr.IP.Equal(derpMagicIP) {
-			continue
-		}
-
-		var epAddr udpAddr
-		copy(epAddr.ip.Addr[:], addr.IP.To16())
-		epAddr.port = uint16(addr.Port)
-		c.addrsByUDP[epAddr] = a
-	}
-	c.addrsMu.Unlock()
-
-	return a, nil
+	as, _, _ := c.setPeerAddrs(key, uaddrs)
+	return as, nil
 }
 
 type singleEndpoint net.UDPAddr
@@ -1037,14 +2799,31 @@ func (e *singleEndpoint) Addrs() []wgcfg.Endpoint {
 // RebindingUDPConn is a UDP socket that can be re-bound.
 // Unix has no notion of re-binding a socket, so we swap it out for a new one.
 type RebindingUDPConn struct {
-	mu    sync.Mutex
-	pconn *net.UDPConn
+	// setup, if non-nil, is called with each new socket before
+	// it's put to use. It must be set before the first Reset.
+	setup func(*net.UDPConn)
+
+	// mark is the SO_MARK new sockets get, or 0 for none.
+	mark uint32
+
+	// reusePort is whether new sockets get SO_REUSEADDR and
+	// SO_REUSEPORT (see Options.ReusePort).
+	reusePort bool
+
+	mu     sync.Mutex
+	pconn  *net.UDPConn
+	pconn4 *ipv4.PacketConn // wraps pconn for batch writes; created on demand
+	closed bool             // Close has been called
 }
 
 func (c *RebindingUDPConn) Reset(pconn *net.UDPConn) {
+	if c.setup != nil {
+		c.setup(pconn)
+	}
 	c.mu.Lock()
 	old := c.pconn
 	c.pconn = pconn
+	c.pconn4 = nil
 	c.mu.Unlock()
 
 	if old != nil {
@@ -1052,6 +2831,78 @@ func (c *RebindingUDPConn) Reset(pconn *net.UDPConn) {
 	}
 }
 
+// rebind replaces c's current socket with a new one bound to host
+// and the first of ports that's available, or else to any free port.
+//
+// A socket on a free port is bound before the old socket is touched,
+// so if host can't be bound at all, as when its address has gone
+// away, c keeps its old socket and rebind returns the error. The old
+// socket is then closed, freeing its port to be bound again, and
+// replaced in the same critical section, so concurrent reads and
+// writes that fail on it find the new one in place when they check
+// whether to retry.
+//
+// If c is closed, even while the new socket is being bound, that's
+// closed too and rebind returns errConnClosed.
+func (c *RebindingUDPConn) rebind(host string, ports ...uint16) error {
+	pconn, err := listenPacket(host, 0, c.mark, c.reusePort)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		pconn.Close()
+		return errConnClosed
+	}
+	c.pconn.Close()
+	for _, port := range ports {
+		if port == 0 {
+			break // pconn is on a free port already
+		}
+		if p, err := listenPacket(host, port, c.mark, c.reusePort); err == nil {
+			pconn.Close()
+			pconn = p
+			break
+		}
+	}
+	if c.setup != nil {
+		c.setup(pconn)
+	}
+	c.pconn = pconn
+	c.pconn4 = nil
+	return nil
+}
+
+// writeBatch writes msgs, each with a single buffer, to the current
+// socket. It returns the number of messages written.
+func (c *RebindingUDPConn) writeBatch(msgs []ipv4.Message) (int, error) {
+	written := 0
+	for {
+		c.mu.Lock()
+		if c.pconn4 == nil {
+			c.pconn4 = ipv4.NewPacketConn(c.pconn)
+		}
+		pconn := c.pconn
+		pconn4 := c.pconn4
+		c.mu.Unlock()
+
+		n, err := pconn4.WriteBatch(msgs, 0)
+		if err != nil {
+			c.mu.Lock()
+			pconn2 := c.pconn
+			c.mu.Unlock()
+
+			if pconn != pconn2 {
+				written += n
+				msgs = msgs[n:]
+				continue
+			}
+		}
+		return written + n, err
+	}
+}
+
 func (c *RebindingUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	for {
 		c.mu.Lock()
@@ -1081,6 +2932,7 @@ func (c *RebindingUDPConn) LocalAddr() *net.UDPAddr {
 func (c *RebindingUDPConn) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.closed = true
 	return c.pconn.Close()
 }
 
@@ -5,11 +5,25 @@
 package magicsock
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/stun"
+	"tailscale.com/types/key"
 )
 
 func TestListen(t *testing.T) {
@@ -77,3 +91,3241 @@ func TestDerpIPConstant(t *testing.T) {
 		t.Errorf("str %q != IP %v", derpMagicIPStr, derpMagicIP)
 	}
 }
+
+func TestCloseUnblocksReceive(t *testing.T) {
+	conn, err := Listen(Options{Port: pickPort(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		var pkt [64 << 10]byte
+		_, _, _, err := conn.ReceiveIPv4(pkt[:])
+		errc <- err
+	}()
+
+	// Give the receive a chance to block in ReadFrom.
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != errConnClosed {
+			t.Errorf("ReceiveIPv4 error = %v; want %v", err, errConnClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiveIPv4 still blocked after Close")
+	}
+
+	// A second Close must not panic or hang.
+	if err := conn.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestBindHostPort(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		wantHost string
+		wantPort uint16
+		wantErr  bool
+	}{
+		{opts: Options{Port: 123}, wantHost: "", wantPort: 123},
+		{opts: Options{Port: 123, BindAddr: "127.0.0.1"}, wantHost: "127.0.0.1", wantPort: 123},
+		{opts: Options{Port: 123, BindAddr: "127.0.0.1:456"}, wantHost: "127.0.0.1", wantPort: 456},
+		{opts: Options{BindAddr: "127.0.0.0/8"}, wantHost: "127.0.0.1"},
+		{opts: Options{BindAddr: "localhost"}, wantErr: true},
+		{opts: Options{BindAddr: "127.0.0.1:http"}, wantErr: true},
+		{opts: Options{BindAddr: "::1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		host, port, err := tt.opts.bindHostPort()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%+v: err = %v; want error %v", tt.opts, err, tt.wantErr)
+			continue
+		}
+		if host != tt.wantHost || port != tt.wantPort {
+			t.Errorf("%+v: got %q, %d; want %q, %d", tt.opts, host, port, tt.wantHost, tt.wantPort)
+		}
+	}
+}
+
+func TestListenContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := ListenContext(ctx, Options{Port: pickPort(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cancel()
+	select {
+	case <-conn.donec():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Conn not closed after context canceled")
+	}
+
+	if _, err := ListenContext(ctx, Options{}); err != context.Canceled {
+		t.Errorf("ListenContext with canceled context: err = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestEndpointsDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	called := make(chan []string, 10)
+	c := &Conn{
+		connCtx:    ctx,
+		epDebounce: 20 * time.Millisecond,
+		clock:      realClock{},
+	}
+	c.AddEndpointsListener(func(eps []string) { called <- eps })
+	c.queueEndpoints([]string{"1.2.3.4:1"})
+	c.queueEndpoints([]string{"1.2.3.4:1", "5.6.7.8:2"})
+	select {
+	case eps := <-called:
+		if want := []string{"1.2.3.4:1", "5.6.7.8:2"}; !stringsEqual(eps, want) {
+			t.Errorf("got %q; want %q", eps, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("EndpointsFunc not called")
+	}
+
+	// The same set, reordered, isn't reported again.
+	c.queueEndpoints([]string{"5.6.7.8:2", "1.2.3.4:1"})
+	select {
+	case eps := <-called:
+		t.Errorf("unexpected EndpointsFunc call with %q", eps)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReSTUNCollapses(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Conn{
+		logf:          t.Logf,
+		connCtx:       ctx,
+		startEpUpdate: make(chan struct{}, 1),
+	}
+	before := metricReSTUNCalls.Value()
+	for i := 0; i < 3; i++ {
+		c.ReSTUN("test")
+	}
+	if got := len(c.startEpUpdate); got != 1 {
+		t.Errorf("queued updates = %d; want 1", got)
+	}
+	if got := metricReSTUNCalls.Value() - before; got != 3 {
+		t.Errorf("re-STUN calls counted = %d; want 3", got)
+	}
+}
+
+func TestPeerLatency(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var peer wgcfg.Key
+	peer[0] = 1
+	if _, ok := conn.PeerLatency(peer); ok {
+		t.Error("latency of unknown peer")
+	}
+	ep, err := conn.CreateEndpoint(peer, "127.3.3.40:1,192.0.2.1:1,192.0.2.2:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := ep.(*AddrSet)
+	if _, ok := conn.PeerLatency(peer); ok {
+		t.Error("latency before any pong")
+	}
+
+	// It's the RTT of the endpoint packets are sent to, not of any
+	// other that answered.
+	now := time.Now()
+	as.notePong(1, &as.addrs[1], now, 30*time.Millisecond)
+	as.notePong(2, &as.addrs[2], now, 10*time.Millisecond)
+	if got, ok := conn.PeerLatency(peer); !ok || got != 10*time.Millisecond {
+		t.Errorf("PeerLatency = %v, %v; want 10ms, true", got, ok)
+	}
+	// Later pongs are averaged in, with 1/8 the weight.
+	as.notePong(2, &as.addrs[2], now, 90*time.Millisecond)
+	if got, ok := conn.PeerLatency(peer); !ok || got != 20*time.Millisecond {
+		t.Errorf("after a slow pong, PeerLatency = %v, %v; want 20ms, true", got, ok)
+	}
+	as.notePong(2, &as.addrs[2], now, 4*time.Millisecond)
+	if got, ok := conn.PeerLatency(peer); !ok || got != 18*time.Millisecond {
+		t.Errorf("after a fast pong, PeerLatency = %v, %v; want 18ms, true", got, ok)
+	}
+
+	// One outlier doesn't make the slower endpoint look faster.
+	as.notePong(1, &as.addrs[1], now, time.Millisecond)
+	if got, _ := conn.PeerEndpoint(peer); got.String() != "192.0.2.2:2" {
+		t.Errorf("after an outlier pong, PeerEndpoint = %v; want 192.0.2.2:2", got)
+	}
+
+	// DERP isn't pinged.
+	as.mu.Lock()
+	as.curAddr = 0
+	as.pongAt[1], as.pongAt[2] = time.Time{}, time.Time{}
+	as.mu.Unlock()
+	if got, ok := conn.PeerLatency(peer); ok {
+		t.Errorf("PeerLatency over DERP = %v; want none", got)
+	}
+}
+
+func TestAppendDestsDERPFallback(t *testing.T) {
+	direct := net.UDPAddr{IP: net.ParseIP("1.2.3.4").To4(), Port: 1234}
+	derp := net.UDPAddr{IP: derpMagicIP, Port: 1}
+	data := []byte{4, 0, 0, 0} // a WireGuard transport data message
+
+	as := &AddrSet{addrs: []net.UDPAddr{derp, direct}, curAddr: -1}
+	before := metricDERPFallbackActivated.Value()
+	dsts, _ := appendDests(nil, as, data, nil)
+	if len(dsts) != 2 || !equalUDPAddr(dsts[0], &direct) || !equalUDPAddr(dsts[1], &derp) {
+		t.Errorf("no direct reply: dests = %v; want [%v %v]", dsts, &direct, &derp)
+	}
+	appendDests(nil, as, data, nil)
+	if got := metricDERPFallbackActivated.Value() - before; got != 1 {
+		t.Errorf("fallback activated %d times; want 1", got)
+	}
+
+	as.noteDirectRecv(time.Now())
+	dsts, _ = appendDests(nil, as, data, nil)
+	if len(dsts) != 1 || !equalUDPAddr(dsts[0], &direct) {
+		t.Errorf("after direct reply: dests = %v; want [%v]", dsts, &direct)
+	}
+
+	// A peer without a DERP address falls back to our preferred region.
+	mine := derpAddr(2)
+	as = &AddrSet{addrs: []net.UDPAddr{direct}, curAddr: -1}
+	dsts, _ = appendDests(nil, as, data, mine)
+	if len(dsts) != 2 || !equalUDPAddr(dsts[1], mine) {
+		t.Errorf("preferred region fallback: dests = %v; want [%v %v]", dsts, &direct, mine)
+	}
+}
+
+func TestDirectRecvNeedsAuth(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	senderAddr := sender.LocalAddr().(*net.UDPAddr)
+	var peer wgcfg.Key
+	peer[0] = 1
+	ep, err := conn.CreateEndpoint(peer, derpAddr(1).String()+","+senderAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := ep.(*AddrSet)
+	lastDirectRecv := func() time.Time {
+		as.mu.Lock()
+		defer as.mu.Unlock()
+		return as.lastDirectRecv
+	}
+
+	// A packet from the peer's endpoint address, which anyone could
+	// spoof, isn't a direct receive until WireGuard accepts it.
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(conn.LocalPort())}
+	if _, err := sender.WriteTo([]byte{4, 0, 0, 0}, dst); err != nil {
+		t.Fatal(err)
+	}
+	var pkt [64 << 10]byte
+	_, gotEP, _, err := conn.ReceiveIPv4(pkt[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotEP != ep {
+		t.Fatalf("ReceiveIPv4 endpoint = %v; want the peer's", gotEP)
+	}
+	if got := lastDirectRecv(); !got.IsZero() {
+		t.Errorf("unauthenticated packet noted as direct receive at %v", got)
+	}
+
+	if err := as.UpdateDst(derpAddr(1)); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastDirectRecv(); !got.IsZero() {
+		t.Errorf("DERP packet noted as direct receive at %v", got)
+	}
+	if err := as.UpdateDst(senderAddr); err != nil {
+		t.Fatal(err)
+	}
+	if lastDirectRecv().IsZero() {
+		t.Error("packet WireGuard accepted not noted as direct receive")
+	}
+}
+
+func TestPickHomeDERP(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		home int
+		lat  map[int]time.Duration
+		want int
+	}{
+		{"no-data", 3, nil, 3},
+		{"initial", 0, map[int]time.Duration{1: 50 * ms, 2: 20 * ms}, 2},
+		{"keep-similar", 1, map[int]time.Duration{1: 25 * ms, 2: 20 * ms}, 1},
+		{"switch-degraded", 1, map[int]time.Duration{1: 80 * ms, 2: 20 * ms}, 2},
+		{"home-unreachable", 1, map[int]time.Duration{2: 20 * ms}, 2},
+		{"tie", 0, map[int]time.Duration{2: 20 * ms, 1: 20 * ms}, 1},
+	}
+	for _, tt := range tests {
+		if got := pickHomeDERP(tt.home, tt.lat); got != tt.want {
+			t.Errorf("%s: pickHomeDERP = %d; want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProbeDERPRegions(t *testing.T) {
+	c := &Conn{
+		logf: t.Logf,
+		derpMap: map[int]DERPRegion{
+			1: {Hosts: []string{"far.example.com"}},
+			2: {Hosts: []string{"near.example.com"}},
+			3: {Hosts: []string{"down.example.com"}},
+		},
+		derpProbe: func(ctx context.Context, host string) (time.Duration, error) {
+			switch host {
+			case "far.example.com":
+				return 100 * time.Millisecond, nil
+			case "near.example.com":
+				return 10 * time.Millisecond, nil
+			}
+			return 0, errors.New("unreachable")
+		},
+	}
+	c.probeDERPRegions(context.Background())
+	lat := c.DERPLatencies()
+	if len(lat) != 2 || lat[1] != 100*time.Millisecond || lat[2] != 10*time.Millisecond {
+		t.Errorf("DERPLatencies = %v", lat)
+	}
+	if got := c.HomeDERP(); got != 2 {
+		t.Errorf("HomeDERP = %d; want 2", got)
+	}
+}
+
+func TestDERPHTTPClient(t *testing.T) {
+	reqs := make(chan string, 16)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case reqs <- r.Method + " " + r.Header.Get("Upgrade"):
+		default:
+		}
+		http.Error(w, "not a DERP server", http.StatusTeapot)
+	}))
+	defer srv.Close()
+
+	// The test server's certificate is only trusted by its client,
+	// so any request reaching it was made with that client.
+	conn, err := Listen(Options{
+		BindAddr:       "127.0.0.1",
+		DisableSTUN:    true,
+		DERPMap:        map[int]DERPRegion{1: {Hosts: []string{srv.Listener.Addr().String()}}},
+		DERPHTTPClient: srv.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetPrivateKey(wgcfg.PrivateKey{1}); err != nil {
+		t.Fatal(err)
+	}
+	if conn.derpWriteChanOfAddr(derpAddr(1)) == nil {
+		t.Fatal("no DERP connection started")
+	}
+
+	want := map[string]bool{
+		"HEAD ":    true, // latency probe
+		"GET DERP": true, // relay connection
+	}
+	timeout := time.After(5 * time.Second)
+	for len(want) > 0 {
+		select {
+		case r := <-reqs:
+			delete(want, r)
+		case <-timeout:
+			t.Fatalf("timeout; never got requests %v", want)
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1", EndpointsDebounce: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalPort()
+
+	type recv struct {
+		b   []byte
+		err error
+	}
+	recvc := make(chan recv, 1)
+	go func() {
+		var pkt [64 << 10]byte
+		n, _, _, err := conn.ReceiveIPv4(pkt[:])
+		recvc <- recv{pkt[:n], err}
+	}()
+
+	// Give the receive a chance to block in ReadFrom on the old socket.
+	time.Sleep(50 * time.Millisecond)
+	if err := conn.Rebind(); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.LocalPort(); got != port {
+		t.Errorf("port after Rebind = %d; want %d", got, port)
+	}
+
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	dst := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(port)}
+	if _, err := sender.WriteTo([]byte("hello"), dst); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-recvc:
+		if r.err != nil {
+			t.Fatalf("ReceiveIPv4: %v", r.err)
+		}
+		if string(r.b) != "hello" {
+			t.Errorf("ReceiveIPv4 = %q; want %q", r.b, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiveIPv4 didn't get packet sent after Rebind")
+	}
+
+	conn.Close()
+	if err := conn.Rebind(); err != errConnClosed {
+		t.Errorf("Rebind after Close = %v; want %v", err, errConnClosed)
+	}
+}
+
+func TestRebindCloseRace(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		conn, err := Listen(Options{BindAddr: "127.0.0.1", EndpointsDebounce: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		recvDone := make(chan struct{})
+		go func() {
+			defer close(recvDone)
+			var pkt [64 << 10]byte
+			for {
+				if _, _, _, err := conn.ReceiveIPv4(pkt[:]); err != nil {
+					return
+				}
+			}
+		}()
+		rebindDone := make(chan error, 1)
+		go func() { rebindDone <- conn.Rebind() }()
+		conn.Close()
+		if err := <-rebindDone; err != nil && err != errConnClosed {
+			t.Fatalf("Rebind racing Close = %v; want nil or %v", err, errConnClosed)
+		}
+
+		// Whichever won, no socket is left open, so reads end.
+		conn.pconn.mu.Lock()
+		pc := conn.pconn.pconn
+		conn.pconn.mu.Unlock()
+		if _, err := pc.WriteToUDP([]byte{0}, pc.LocalAddr().(*net.UDPAddr)); err == nil {
+			t.Fatal("socket left open after Rebind racing Close")
+		}
+		select {
+		case <-recvDone:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ReceiveIPv4 didn't return after Close")
+		}
+	}
+
+	// The narrowest case: Rebind checked that the Conn was open,
+	// then Close ran before the socket was swapped.
+	conn, err := Listen(Options{BindAddr: "127.0.0.1", EndpointsDebounce: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if err := conn.pconn.rebind("127.0.0.1", 0); err != errConnClosed {
+		t.Errorf("rebind after Close = %v; want %v", err, errConnClosed)
+	}
+	pc := conn.pconn.pconn
+	if _, err := pc.WriteToUDP([]byte{0}, pc.LocalAddr().(*net.UDPAddr)); err == nil {
+		t.Error("rebind after Close left a socket open")
+	}
+}
+
+func TestRebindFailure(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1", EndpointsDebounce: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	port := conn.LocalPort()
+
+	// As after sleep and wake, when the bound address has gone
+	// away: 192.0.2.1 (TEST-NET-1) isn't a local address, so
+	// nothing can be bound to it.
+	conn.pconnHost = "192.0.2.1"
+	if err := conn.Rebind(); err == nil {
+		t.Fatal("Rebind to a non-local address succeeded")
+	}
+	if got := conn.LocalPort(); got != port {
+		t.Errorf("port after failed Rebind = %d; want %d", got, port)
+	}
+
+	// The old socket is still in use.
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	dst := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(port)}
+	if _, err := sender.WriteTo([]byte("hello"), dst); err != nil {
+		t.Fatal(err)
+	}
+	recvc := make(chan string, 1)
+	go func() {
+		var pkt [64 << 10]byte
+		n, _, _, err := conn.ReceiveIPv4(pkt[:])
+		if err != nil {
+			recvc <- err.Error()
+			return
+		}
+		recvc <- string(pkt[:n])
+	}()
+	select {
+	case got := <-recvc:
+		if got != "hello" {
+			t.Errorf("ReceiveIPv4 after failed Rebind = %q; want %q", got, "hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceiveIPv4 didn't get packet sent after failed Rebind")
+	}
+}
+
+func TestClassifyNAT(t *testing.T) {
+	local := []string{"10.0.0.2", "127.0.0.1"}
+	tests := []struct {
+		name    string
+		stunEps map[string]string
+		want    string
+	}{
+		{"no-responses", nil, NATUnknown},
+		{"one-server", map[string]string{"s1": "203.0.113.1:41641"}, NATUnknown},
+		{"no-nat", map[string]string{"s1": "10.0.0.2:41641"}, NATNone},
+		{"local-ip-other-port", map[string]string{"s1": "10.0.0.2:1234", "s2": "10.0.0.2:1234"}, NATEasy},
+		{"easy", map[string]string{"s1": "203.0.113.1:41641", "s2": "203.0.113.1:41641"}, NATEasy},
+		{"hard-port", map[string]string{"s1": "203.0.113.1:1000", "s2": "203.0.113.1:1001"}, NATHard},
+		{"hard-ip", map[string]string{"s1": "203.0.113.1:1000", "s2": "203.0.113.2:1000"}, NATHard},
+	}
+	for _, tt := range tests {
+		if got := classifyNAT(tt.stunEps, 41641, local); got != tt.want {
+			t.Errorf("%s: classifyNAT = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPredictEndpoints(t *testing.T) {
+	tests := []struct {
+		name    string
+		stunEps map[string]string
+		want    []string
+	}{
+		{"no-responses", nil, nil},
+		{"one-server", map[string]string{"s1": "203.0.113.1:1000"}, nil},
+		{"easy", map[string]string{"s1": "203.0.113.1:1000", "s2": "203.0.113.1:1000"}, nil},
+		{
+			"sequential",
+			map[string]string{"s1": "203.0.113.1:1001", "s2": "203.0.113.1:1000", "s3": "203.0.113.1:1002"},
+			[]string{"203.0.113.1:1003", "203.0.113.1:1004", "203.0.113.1:1005", "203.0.113.1:1006"},
+		},
+		{
+			"step-2",
+			map[string]string{"s1": "203.0.113.1:1000", "s2": "203.0.113.1:1002"},
+			[]string{"203.0.113.1:1004", "203.0.113.1:1006", "203.0.113.1:1008", "203.0.113.1:1010"},
+		},
+		{
+			"ipv6",
+			map[string]string{"s1": "[2001:db8::1]:1000", "s2": "[2001:db8::1]:1001"},
+			[]string{"[2001:db8::1]:1002", "[2001:db8::1]:1003", "[2001:db8::1]:1004", "[2001:db8::1]:1005"},
+		},
+		{
+			"top-of-range",
+			map[string]string{"s1": "203.0.113.1:65533", "s2": "203.0.113.1:65534"},
+			[]string{"203.0.113.1:65535"},
+		},
+		{"uneven", map[string]string{"s1": "203.0.113.1:1000", "s2": "203.0.113.1:1001", "s3": "203.0.113.1:1005"}, nil},
+		{"random", map[string]string{"s1": "203.0.113.1:1000", "s2": "203.0.113.1:31337"}, nil},
+		{"different-ips", map[string]string{"s1": "203.0.113.1:1000", "s2": "203.0.113.2:1001"}, nil},
+	}
+	for _, tt := range tests {
+		got := predictEndpoints(tt.stunEps)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: predictEndpoints = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Predictions sort after the endpoints actually seen.
+	eps := orderEndpoints([]endpointCandidate{
+		{"203.0.113.1:1002", endpointPredicted},
+		{"10.0.0.2:41641", endpointLocal},
+		{"203.0.113.1:1000", endpointSTUN},
+	})
+	if want := "[203.0.113.1:1000 10.0.0.2:41641 203.0.113.1:1002]"; fmt.Sprint(eps) != want {
+		t.Errorf("orderEndpoints = %v; want %v", eps, want)
+	}
+}
+
+func TestSendPacing(t *testing.T) {
+	const rate = 1 << 20 // bytes/sec
+	conn, err := Listen(Options{BindAddr: "127.0.0.1", PacingBytesPerSec: rate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	recv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	ep := (*singleEndpoint)(recv.LocalAddr().(*net.UDPAddr))
+
+	const pkts, pktSize = 100, 1400
+	pkt := make([]byte, pktSize)
+	start := time.Now()
+	for i := 0; i < pkts; i++ {
+		if err := conn.Send(pkt, ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	// All but the initial burst must be paced out at rate.
+	burst := rate * pacingBurst.Seconds()
+	min := time.Duration((pkts*pktSize - burst) / rate * float64(time.Second))
+	if elapsed < min {
+		t.Errorf("sent %d bytes in %v; want at least %v at %d bytes/sec", pkts*pktSize, elapsed, min, rate)
+	}
+}
+
+func TestPacerMaxDelay(t *testing.T) {
+	p := newPacer(1000, realClock{}, nil)
+	start := time.Now()
+	p.wait(1 << 20) // would take ~17 minutes at the pacing rate
+	if d := time.Since(start); d > 10*maxPacingDelay {
+		t.Errorf("wait blocked for %v; want at most about %v", d, maxPacingDelay)
+	}
+
+	p = newPacer(1<<30, realClock{}, nil)
+	allocs := testing.AllocsPerRun(1000, func() { p.wait(1400) })
+	if allocs != 0 {
+		t.Errorf("wait allocs = %v; want 0", allocs)
+	}
+
+	// Nor when packets are held back: ~100µs each at this rate.
+	p = newPacer(1<<24, realClock{}, nil)
+	p.wait(1 << 20) // use up the burst
+	allocs = testing.AllocsPerRun(100, func() { p.wait(1400) })
+	if allocs != 0 {
+		t.Errorf("delayed wait allocs = %v; want 0", allocs)
+	}
+}
+
+func TestPacerDone(t *testing.T) {
+	// The fake clock never advances, so only done ends the wait.
+	done := make(chan struct{})
+	p := newPacer(1000, newFakeClock(), done)
+	p.wait(10) // use up the burst
+	waited := make(chan struct{})
+	go func() {
+		p.wait(1000)
+		close(waited)
+	}()
+	close(done)
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait didn't return when done was closed")
+	}
+	p.wait(1000) // returns at once
+}
+
+func TestOrderEndpoints(t *testing.T) {
+	raw := []endpointCandidate{
+		{"10.0.0.2:41641", endpointLocal},
+		{"203.0.113.9:41641", endpointSTUN},
+		{"192.168.1.5:41641", endpointLocal},
+		{"203.0.113.1:41641", endpointSTUN},
+		{"10.0.0.2:41641", endpointLocal},
+		{"203.0.113.9:41641", endpointSTUN},
+		{"192.168.1.5:41641", endpointSTUN}, // no NAT: also seen by STUN
+	}
+	want := []string{
+		"192.168.1.5:41641",
+		"203.0.113.1:41641",
+		"203.0.113.9:41641",
+		"10.0.0.2:41641",
+	}
+	got := orderEndpoints(raw)
+	if !stringsEqual(got, want) {
+		t.Errorf("orderEndpoints = %q; want %q", got, want)
+	}
+
+	// The same candidates in a different order must be reported the same.
+	rev := make([]endpointCandidate, len(raw))
+	for i, c := range raw {
+		rev[len(raw)-1-i] = c
+	}
+	if got2 := orderEndpoints(rev); !stringsEqual(got2, got) {
+		t.Errorf("orderEndpoints of reversed input = %q; want %q", got2, got)
+	}
+}
+
+func TestSTUNTimeout(t *testing.T) {
+	// A STUN server that never replies.
+	blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+
+	epCh := make(chan []string, 1)
+	start := time.Now()
+	conn, err := Listen(Options{
+		BindAddr:          "127.0.0.1",
+		STUN:              []string{blackhole.LocalAddr().String()},
+		STUNTimeout:       300 * time.Millisecond,
+		EndpointsDebounce: -1,
+		EndpointsFunc: func(eps []string) {
+			select {
+			case epCh <- append([]string(nil), eps...):
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case eps := <-epCh:
+		// Without the timeout, the default retry schedule would
+		// wait several seconds for the server.
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("endpoints took %v", d)
+		}
+		want := fmt.Sprintf("127.0.0.1:%d", conn.LocalPort())
+		if len(eps) != 1 || eps[0] != want {
+			t.Errorf("endpoints = %q; want [%q]", eps, want)
+		}
+		if got := conn.Endpoints(); !stringsEqual(got, eps) {
+			t.Errorf("Endpoints() = %q; want %q", got, eps)
+		}
+		if got := conn.LastSTUNTime(); !got.IsZero() {
+			t.Errorf("LastSTUNTime = %v; want zero, as the server never replied", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for endpoints")
+	}
+}
+
+func TestUDPBlocked(t *testing.T) {
+	// Two STUN servers that don't reply, as on a network that
+	// blocks UDP, until the first is told to.
+	var servers []string
+	var first net.PacketConn
+	for i := 0; i < 2; i++ {
+		blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blackhole.Close()
+		if first == nil {
+			first = blackhole
+		}
+		servers = append(servers, blackhole.LocalAddr().String())
+	}
+
+	conn, err := Listen(Options{
+		BindAddr:    "127.0.0.1",
+		STUN:        servers,
+		STUNTimeout: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	events, unsubscribe := conn.Events()
+	defer unsubscribe()
+	go func() {
+		// STUN responses are read by the receive path.
+		var pkt [1500]byte
+		for {
+			if _, _, _, err := conn.ReceiveIPv4(pkt[:]); err != nil {
+				return
+			}
+		}
+	}()
+	waitEvent := func(typ EventType) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.Type == typ {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for %v event", typ)
+			}
+		}
+	}
+
+	waitEvent(EventUDPBlocked)
+	if !conn.UDPBlocked() {
+		t.Error("UDPBlocked = false after every STUN server timed out; want true")
+	}
+
+	// A STUN response clears it.
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := first.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			tx, err := stun.ParseBindingRequest(buf[:n])
+			if err != nil {
+				continue
+			}
+			first.WriteTo(stun.Response(tx, net.IPv4(1, 2, 3, 4), 5678), addr)
+		}
+	}()
+	conn.ReSTUN("test")
+	waitEvent(EventUDPUnblocked)
+	if conn.UDPBlocked() {
+		t.Error("UDPBlocked = true after a STUN response; want false")
+	}
+}
+
+func TestSTUNFallback(t *testing.T) {
+	// A primary STUN server that doesn't reply until told to, and a
+	// fallback one that does, as seen from 1.2.3.4:5678.
+	var servers [2]net.PacketConn
+	for i := range servers {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		servers[i] = pc
+	}
+	primary, fallback := servers[0], servers[1]
+	var fallbackReqs int32
+	serveSTUN := func(pc net.PacketConn, ip net.IP, port uint16, reqs *int32) {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			tx, err := stun.ParseBindingRequest(buf[:n])
+			if err != nil {
+				continue
+			}
+			if reqs != nil {
+				atomic.AddInt32(reqs, 1)
+			}
+			pc.WriteTo(stun.Response(tx, ip, port), addr)
+		}
+	}
+	go serveSTUN(fallback, net.IPv4(1, 2, 3, 4), 5678, &fallbackReqs)
+
+	epCh := make(chan []string, 10)
+	before := metricSTUNFallbackRequests.Value()
+	conn, err := Listen(Options{
+		BindAddr:          "127.0.0.1",
+		STUN:              []string{primary.LocalAddr().String()},
+		STUNFallback:      []string{fallback.LocalAddr().String()},
+		STUNTimeout:       200 * time.Millisecond,
+		EndpointsDebounce: -1,
+		EndpointsFunc: func(eps []string) {
+			select {
+			case epCh <- append([]string(nil), eps...):
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		// STUN responses are read by the receive path.
+		var pkt [1500]byte
+		for {
+			if _, _, _, err := conn.ReceiveIPv4(pkt[:]); err != nil {
+				return
+			}
+		}
+	}()
+	waitEndpoint := func(want string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case eps := <-epCh:
+				for _, ep := range eps {
+					if ep == want {
+						return
+					}
+				}
+			case <-timeout:
+				t.Fatalf("timeout waiting for endpoint %s", want)
+			}
+		}
+	}
+
+	waitEndpoint("1.2.3.4:5678")
+	if got := metricSTUNFallbackRequests.Value() - before; got == 0 {
+		t.Error("stun_fallback_requests unchanged after querying the fallback server")
+	}
+
+	// Once the primary server replies, the fallback isn't queried.
+	go serveSTUN(primary, net.IPv4(5, 6, 7, 8), 1234, nil)
+	reqs := atomic.LoadInt32(&fallbackReqs)
+	conn.ReSTUN("test")
+	waitEndpoint("5.6.7.8:1234")
+	time.Sleep(200 * time.Millisecond) // for the pass to finish
+	if got := atomic.LoadInt32(&fallbackReqs) - reqs; got != 0 {
+		t.Errorf("fallback server got %d requests while the primary replied", got)
+	}
+}
+
+func TestSTUNReportsFastServerFirst(t *testing.T) {
+	// A STUN server that replies, as seen from 1.2.3.4:5678.
+	fast, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := fast.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			tx, err := stun.ParseBindingRequest(buf[:n])
+			if err != nil {
+				continue
+			}
+			fast.WriteTo(stun.Response(tx, net.IPv4(1, 2, 3, 4), 5678), addr)
+		}
+	}()
+	// A STUN server that never replies, and which the default
+	// retry schedule waits several seconds for.
+	slow, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	epCh := make(chan []string, 10)
+	start := time.Now()
+	conn, err := Listen(Options{
+		BindAddr:          "127.0.0.1",
+		STUN:              []string{slow.LocalAddr().String(), fast.LocalAddr().String()},
+		EndpointsDebounce: -1,
+		EndpointsFunc: func(eps []string) {
+			select {
+			case epCh <- append([]string(nil), eps...):
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// STUN responses are read by the receive path.
+		var pkt [1500]byte
+		for {
+			if _, _, _, err := conn.ReceiveIPv4(pkt[:]); err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case eps := <-epCh:
+		if d := time.Since(start); d > 2*time.Second {
+			t.Errorf("endpoints took %v", d)
+		}
+		if len(eps) == 0 || eps[0] != "1.2.3.4:5678" {
+			t.Errorf("endpoints = %q; want STUN endpoint first", eps)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for endpoints")
+	}
+
+	// Closing abandons the query to the slow server, so its
+	// final endpoints are never reported.
+	conn.Close()
+	select {
+	case eps := <-epCh:
+		t.Errorf("endpoints reported after Close: %q", eps)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestJitter(t *testing.T) {
+	const d = 10 * time.Second
+	for i := 0; i < 1000; i++ {
+		if got := jitter(d); got < 8*time.Second || got >= 12*time.Second {
+			t.Fatalf("jitter(%v) = %v; want within 20%%", d, got)
+		}
+	}
+}
+
+func TestReSTUNInterval(t *testing.T) {
+	// A STUN server that counts, but doesn't answer, requests.
+	// With one try per server, each pass sends one request.
+	srv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	var reqs int32
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := srv.ReadFrom(buf); err != nil {
+				return
+			}
+			atomic.AddInt32(&reqs, 1)
+		}
+	}()
+
+	const interval = 100 * time.Millisecond
+	conn, err := Listen(Options{
+		BindAddr:       "127.0.0.1",
+		STUN:           []string{srv.LocalAddr().String()},
+		STUNRetries:    1,
+		ReSTUNInterval: interval,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	time.Sleep(10 * interval)
+	// One pass at startup plus about ten periodic ones.
+	if got := atomic.LoadInt32(&reqs); got < 6 || got > 16 {
+		t.Errorf("got %d STUN passes in %v; want about 11", got, 10*interval)
+	}
+
+	conn.SetReSTUNInterval(time.Hour)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Until(conn.NextReSTUN()) < 30*time.Minute {
+		if time.Now().After(deadline) {
+			t.Fatalf("NextReSTUN = %v after SetReSTUNInterval(1h)", conn.NextReSTUN())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	before := atomic.LoadInt32(&reqs)
+	time.Sleep(5 * interval)
+	if got := atomic.LoadInt32(&reqs) - before; got > 1 {
+		t.Errorf("got %d STUN passes after lengthening the interval; want at most 1", got)
+	}
+}
+
+func TestNetworkDialer(t *testing.T) {
+	// A STUN server that reports each request's source address.
+	srv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := srv.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			tx, err := stun.ParseBindingRequest(buf[:n])
+			if err != nil {
+				continue
+			}
+			ua := addr.(*net.UDPAddr)
+			srv.WriteTo(stun.Response(tx, ua.IP, uint16(ua.Port)), addr)
+		}
+	}()
+
+	var mu sync.Mutex
+	var dialed []string // local addresses of dialed conns
+	dial := func(ctx context.Context) (net.PacketConn, error) {
+		pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, pc.LocalAddr().String())
+		return pc, nil
+	}
+
+	epCh := make(chan []string, 10)
+	conn, err := Listen(Options{
+		BindAddr:          "127.0.0.1",
+		STUN:              []string{srv.LocalAddr().String()},
+		NetworkDialer:     dial,
+		EndpointsDebounce: -1,
+		EndpointsFunc: func(eps []string) {
+			select {
+			case epCh <- append([]string(nil), eps...):
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Nothing calls ReceiveIPv4, so the responses can only arrive
+	// through the dialed conn.
+	select {
+	case eps := <-epCh:
+		mu.Lock()
+		defer mu.Unlock()
+		if len(dialed) == 0 {
+			t.Fatal("NetworkDialer not called")
+		}
+		if len(eps) == 0 || eps[0] != dialed[0] {
+			t.Errorf("endpoints = %q; want STUN endpoint %q first", eps, dialed[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for endpoints")
+	}
+}
+
+func TestDisableSTUN(t *testing.T) {
+	srv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	tests := []struct {
+		name    string
+		stun    []string
+		disable bool
+	}{
+		{"no-servers", nil, false},
+		{"disabled", []string{srv.LocalAddr().String()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dials int32
+			epCh := make(chan []string, 10)
+			conn, err := Listen(Options{
+				BindAddr:          "127.0.0.1",
+				STUN:              tt.stun,
+				DisableSTUN:       tt.disable,
+				EndpointsDebounce: -1,
+				NetworkDialer: func(context.Context) (net.PacketConn, error) {
+					atomic.AddInt32(&dials, 1)
+					return nil, errors.New("unexpected dial")
+				},
+				EndpointsFunc: func(eps []string) {
+					select {
+					case epCh <- append([]string(nil), eps...):
+					default:
+					}
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			want := fmt.Sprintf("127.0.0.1:%d", conn.LocalPort())
+			select {
+			case eps := <-epCh:
+				if len(eps) != 1 || eps[0] != want {
+					t.Errorf("endpoints = %q; want [%q]", eps, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for endpoints")
+			}
+
+			srv.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if _, addr, err := srv.ReadFrom(make([]byte, 1500)); err == nil {
+				t.Errorf("STUN server got a packet from %v", addr)
+			}
+			if n := atomic.LoadInt32(&dials); n != 0 {
+				t.Errorf("STUN transport dialed %d times", n)
+			}
+			if st := conn.Stats(); st.STUNSent != 0 {
+				t.Errorf("STUNSent = %d; want 0", st.STUNSent)
+			}
+			if nat := conn.NATType(); nat != NATUnknown {
+				t.Errorf("NATType = %q; want %q", nat, NATUnknown)
+			}
+		})
+	}
+}
+
+func TestAdvertiseEndpointsValidation(t *testing.T) {
+	tests := []struct {
+		opts    Options
+		want    []string
+		wantErr bool
+	}{
+		{opts: Options{}, want: nil},
+		{opts: Options{AdvertiseEndpoints: []string{"1.2.3.4:5"}}, want: []string{"1.2.3.4:5"}},
+		{opts: Options{AdvertiseEndpoints: []string{"::ffff:1.2.3.4:5"}}, wantErr: true},
+		{opts: Options{AdvertiseEndpoints: []string{"[::ffff:1.2.3.4]:5"}}, want: []string{"1.2.3.4:5"}},
+		{opts: Options{AdvertiseEndpoints: []string{"1.2.3.4"}}, wantErr: true},
+		{opts: Options{AdvertiseEndpoints: []string{"example.com:5"}}, wantErr: true},
+		{opts: Options{AdvertiseEndpoints: []string{"1.2.3.4:0"}}, wantErr: true},
+		{opts: Options{AdvertiseEndpoints: []string{"1.2.3.4:70000"}}, wantErr: true},
+		{opts: Options{AdvertiseEndpoints: []string{"[2001:db8::1]:5"}}, wantErr: true},
+		{opts: Options{AdvertiseEndpointsOnly: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.opts.advertiseEndpoints()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v; want error %v", tt.opts.AdvertiseEndpoints, err, tt.wantErr)
+			continue
+		}
+		if !stringsEqual(got, tt.want) {
+			t.Errorf("%q: got %q; want %q", tt.opts.AdvertiseEndpoints, got, tt.want)
+		}
+	}
+
+	if _, err := Listen(Options{AdvertiseEndpoints: []string{"bogus"}}); err == nil {
+		t.Error("Listen with bogus AdvertiseEndpoints succeeded")
+	}
+}
+
+func TestAdvertiseEndpoints(t *testing.T) {
+	tests := []struct {
+		name  string
+		only  bool
+		local bool // whether the local endpoint is reported too
+	}{
+		{"merged", false, true},
+		{"only", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			epCh := make(chan []string, 10)
+			conn, err := Listen(Options{
+				BindAddr:               "127.0.0.1",
+				AdvertiseEndpoints:     []string{"203.0.113.7:41641", "198.51.100.1:1234"},
+				AdvertiseEndpointsOnly: tt.only,
+				EndpointsDebounce:      -1,
+				EndpointsFunc: func(eps []string) {
+					select {
+					case epCh <- append([]string(nil), eps...):
+					default:
+					}
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			want := []string{"198.51.100.1:1234", "203.0.113.7:41641"}
+			if tt.local {
+				want = append(want, fmt.Sprintf("127.0.0.1:%d", conn.LocalPort()))
+			}
+			select {
+			case eps := <-epCh:
+				if !stringsEqual(eps, want) {
+					t.Errorf("endpoints = %q; want %q", eps, want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for endpoints")
+			}
+		})
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1", Batch: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	recv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	ep := (*singleEndpoint)(recv.LocalAddr().(*net.UDPAddr))
+
+	const pkts = 3 * maxSendBatch / 2 // one full batch and a partial one
+	pkt := make([]byte, 100)
+	for i := 0; i < pkts; i++ {
+		pkt[0] = byte(i)
+		if err := conn.Send(pkt, ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	for i := 0; i < pkts; i++ {
+		n, _, err := recv.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if n != len(pkt) || buf[0] != byte(i) {
+			t.Fatalf("packet %d: got %d bytes starting with %d", i, n, buf[0])
+		}
+	}
+}
+
+func BenchmarkSend(b *testing.B) {
+	for _, batch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batch=%v", batch), func(b *testing.B) {
+			conn, err := Listen(Options{BindAddr: "127.0.0.1", Batch: batch, Logf: func(string, ...interface{}) {}})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			recv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer recv.Close()
+			go func() {
+				buf := make([]byte, 1500)
+				for {
+					if _, _, err := recv.ReadFrom(buf); err != nil {
+						return
+					}
+				}
+			}()
+			ep := (*singleEndpoint)(recv.LocalAddr().(*net.UDPAddr))
+
+			pkt := make([]byte, 1280)
+			b.SetBytes(int64(len(pkt)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				conn.Send(pkt, ep)
+			}
+		})
+	}
+}
+
+func TestLastSTUNTime(t *testing.T) {
+	c := &Conn{clock: realClock{}}
+	if got := c.LastSTUNTime(); !got.IsZero() {
+		t.Errorf("initial LastSTUNTime = %v; want zero", got)
+	}
+	c.noteSTUNResult("a", true)
+	first := c.LastSTUNTime()
+	if first.IsZero() {
+		t.Fatal("LastSTUNTime is zero after a response")
+	}
+	c.noteSTUNResult("b", false)
+	if got := c.LastSTUNTime(); !got.Equal(first) {
+		t.Errorf("LastSTUNTime after failure = %v; want %v", got, first)
+	}
+}
+
+// testPrivateKey returns a private key distinct for each b. The
+// curve ignores the low three bits, so key.Private{1} and
+// key.Private{2} are the same key.
+func testPrivateKey(b byte) key.Private {
+	return key.Private{0, b}
+}
+
+// setTestKey gives c the private key testPrivateKey(b), returning its
+// public key.
+func setTestKey(t *testing.T, c *Conn, b byte) wgcfg.Key {
+	t.Helper()
+	priv := testPrivateKey(b)
+	if err := c.SetPrivateKey(wgcfg.PrivateKey(priv)); err != nil {
+		t.Fatal(err)
+	}
+	return wgcfg.Key(priv.Public())
+}
+
+// addTestPeer configures on c the peer with public key pub, at the
+// local address of peer, so that c answers its disco pings.
+func addTestPeer(t *testing.T, c *Conn, pub wgcfg.Key, peer *Conn) {
+	t.Helper()
+	if _, err := c.CreateEndpoint(pub, fmt.Sprintf("127.0.0.1:%d", peer.LocalPort())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscoMsg(t *testing.T) {
+	priv1, priv2, priv3 := testPrivateKey(1), testPrivateKey(2), testPrivateKey(3)
+	pub1, pub2, pub3 := priv1.Public(), priv2.Public(), priv3.Public()
+	tx := discoTxID{1, 2, 3}
+	msg := newDiscoBox(priv1, pub2).appendMsg(nil, discoTypePong, tx)
+	if from, ok := discoSender(msg); !ok || from != pub1 {
+		t.Errorf("discoSender = %v, %v; want %v, true", from, ok, pub1)
+	}
+	typ, got, ok := newDiscoBox(priv2, pub1).open(msg)
+	if !ok || typ != discoTypePong || got != tx {
+		t.Errorf("open = %v, %v, %v; want %v, %v, true", typ, got, ok, discoTypePong, tx)
+	}
+
+	// Only the recipient can open it, and only as from the sender.
+	if _, _, ok := newDiscoBox(priv3, pub1).open(msg); ok {
+		t.Error("opened by a third party")
+	}
+	forged := append([]byte(nil), msg...)
+	copy(forged[len(discoMagic):], pub3[:])
+	if _, _, ok := newDiscoBox(priv2, pub3).open(forged); ok {
+		t.Error("opened with the sender key replaced")
+	}
+	tampered := append([]byte(nil), msg...)
+	tampered[len(tampered)-1] ^= 1
+	if _, _, ok := newDiscoBox(priv2, pub1).open(tampered); ok {
+		t.Error("opened after tampering")
+	}
+
+	for _, b := range [][]byte{
+		{4, 0, 0, 0}, // WireGuard data
+		stun.Request(stun.NewTxID()),
+		[]byte(discoMagic), // truncated
+	} {
+		if _, ok := discoSender(b); ok {
+			t.Errorf("discoSender(%q) ok; want not a disco message", b)
+		}
+	}
+}
+
+func TestDiscoPing(t *testing.T) {
+	newConn := func() *Conn {
+		c, err := Listen(Options{BindAddr: "127.0.0.1", Logf: t.Logf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			var pkt [64 << 10]byte
+			for {
+				if _, _, _, err := c.ReceiveIPv4(pkt[:]); err != nil {
+					return
+				}
+			}
+		}()
+		return c
+	}
+	c1, c2 := newConn(), newConn()
+	defer c1.Close()
+	defer c2.Close()
+	peerKey := setTestKey(t, c2, 2)
+	addTestPeer(t, c2, setTestKey(t, c1, 1), c1)
+
+	// A port nothing answers on.
+	blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+
+	// The blackhole has the higher priority, so it's used until the
+	// peer's real endpoint is confirmed.
+	real := fmt.Sprintf("127.0.0.1:%d", c2.LocalPort())
+	ep, err := c1.CreateEndpoint(peerKey, real+","+blackhole.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c1.PeerEndpoint(peerKey); got.String() != blackhole.LocalAddr().String() {
+		t.Errorf("before ping, PeerEndpoint = %v; want %v", got, blackhole.LocalAddr())
+	}
+
+	pongsBefore := metricDiscoPongsRecv.Value()
+	if err := c1.Send([]byte{4, 0, 0, 0}, ep); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for metricDiscoPongsRecv.Value() == pongsBefore {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for pong")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, _ := c1.PeerEndpoint(peerKey); got.String() != real {
+		t.Errorf("after pong, PeerEndpoint = %v; want %v", got, real)
+	}
+	dsts, _ := appendDests(nil, ep.(*AddrSet), []byte{4, 0, 0, 0}, nil)
+	if len(dsts) != 1 || dsts[0].String() != real {
+		t.Errorf("after pong, dests = %v; want [%v]", dsts, real)
+	}
+}
+
+func TestDiscoUnknownSender(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		var pkt [64 << 10]byte
+		for {
+			if _, _, _, err := conn.ReceiveIPv4(pkt[:]); err != nil {
+				return
+			}
+		}
+	}()
+	self := key.Public(setTestKey(t, conn, 1))
+
+	sender, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(conn.LocalPort())}
+	priv := testPrivateKey(2)
+	bx := newDiscoBox(priv, self)
+	ping := func() (pong []byte) {
+		t.Helper()
+		if _, err := sender.WriteTo(bx.appendMsg(nil, discoTypePing, discoTxID{1}), dst); err != nil {
+			t.Fatal(err)
+		}
+		sender.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		buf := make([]byte, 1500)
+		n, _, err := sender.ReadFrom(buf)
+		if err != nil {
+			return nil
+		}
+		return buf[:n]
+	}
+
+	droppedBefore := metricDiscoDropped.Value()
+	if pong := ping(); pong != nil {
+		t.Errorf("unknown sender's ping answered with %q", pong)
+	}
+	if got := metricDiscoDropped.Value() - droppedBefore; got != 1 {
+		t.Errorf("disco_dropped rose by %d; want 1", got)
+	}
+
+	if _, err := conn.CreateEndpoint(wgcfg.Key(priv.Public()), sender.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	pong := ping()
+	if typ, tx, ok := bx.open(pong); !ok || typ != discoTypePong || tx != (discoTxID{1}) {
+		t.Errorf("peer's ping answered with %q; want pong", pong)
+	}
+}
+
+func TestPing(t *testing.T) {
+	newConn := func() *Conn {
+		c, err := Listen(Options{BindAddr: "127.0.0.1", Logf: t.Logf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			var pkt [64 << 10]byte
+			for {
+				if _, _, _, err := c.ReceiveIPv4(pkt[:]); err != nil {
+					return
+				}
+			}
+		}()
+		return c
+	}
+	c1, c2 := newConn(), newConn()
+	defer c1.Close()
+	defer c2.Close()
+
+	blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+
+	if _, err := c1.Ping(context.Background(), wgcfg.Key{9}); err == nil {
+		t.Error("Ping of unknown peer succeeded")
+	}
+	if _, err := c2.CreateEndpoint(wgcfg.Key{9}, "127.0.0.1:9"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.Ping(context.Background(), wgcfg.Key{9}); err != errNoPrivateKey {
+		t.Errorf("Ping without a private key: err = %v; want %v", err, errNoPrivateKey)
+	}
+
+	peer := setTestKey(t, c2, 2)
+	addTestPeer(t, c2, setTestKey(t, c1, 1), c1)
+	var silent, relayed wgcfg.Key
+	silent[0], relayed[0] = 3, 4
+	real := fmt.Sprintf("127.0.0.1:%d", c2.LocalPort())
+	if _, err := c1.CreateEndpoint(peer, blackhole.LocalAddr().String()+","+real); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c1.CreateEndpoint(silent, blackhole.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c1.CreateEndpoint(relayed, derpAddr(1).String()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := c1.Ping(ctx, peer)
+	if err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if res.Endpoint.String() != real {
+		t.Errorf("Ping endpoint = %v; want %v", res.Endpoint, real)
+	}
+	if !res.Direct() || res.Path != PathIPv4 {
+		t.Errorf("Ping path = %v; want direct IPv4", res.Path)
+	}
+	if res.RTT <= 0 || res.RTT > time.Second {
+		t.Errorf("Ping RTT = %v; want a sensible loopback RTT", res.RTT)
+	}
+	if res.Attempts < 1 {
+		t.Errorf("Ping attempts = %d; want at least 1", res.Attempts)
+	}
+
+	// The pings to the blackhole are cancelled once Ping returns.
+	c1.discoMu.Lock()
+	for _, p := range c1.discoPending {
+		if p.replies != nil {
+			t.Errorf("Ping left a ping to %v pending", p.addr)
+		}
+	}
+	c1.discoMu.Unlock()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c1.Ping(ctx, silent); err != context.DeadlineExceeded {
+		t.Errorf("Ping of silent peer: err = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := c1.Ping(context.Background(), relayed); err != errNoDirectEndpoints {
+		t.Errorf("Ping of DERP-only peer: err = %v; want %v", err, errNoDirectEndpoints)
+	}
+}
+
+func TestSetPrivateKeyRotation(t *testing.T) {
+	newConn := func() *Conn {
+		c, err := Listen(Options{BindAddr: "127.0.0.1", Logf: t.Logf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			var pkt [64 << 10]byte
+			for {
+				if _, _, _, err := c.ReceiveIPv4(pkt[:]); err != nil {
+					return
+				}
+			}
+		}()
+		return c
+	}
+	c1, c2 := newConn(), newConn()
+	defer c1.Close()
+	defer c2.Close()
+	oldKey := setTestKey(t, c1, 1)
+	addTestPeer(t, c2, oldKey, c1)
+	peerKey := setTestKey(t, c2, 2)
+	real := fmt.Sprintf("127.0.0.1:%d", c2.LocalPort())
+	ep, err := c1.CreateEndpoint(peerKey, real)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := ep.(*AddrSet)
+	waitPong := func(what string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			as.mu.Lock()
+			confirmed := len(as.pongAt) > 0 && !as.pongAt[0].IsZero()
+			as.mu.Unlock()
+			if confirmed {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: timeout waiting for pong", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if err := c1.Send([]byte{4, 0, 0, 0}, ep); err != nil {
+		t.Fatal(err)
+	}
+	waitPong("before rotation")
+
+	derpCanceled := false
+	c1.derpMu.Lock()
+	c1.derpCancel = map[int]context.CancelFunc{1: func() { derpCanceled = true }}
+	c1.derpMu.Unlock()
+
+	port := c1.LocalPort()
+	newKey := setTestKey(t, c1, 3)
+	if !derpCanceled {
+		t.Error("DERP connection not closed on key change")
+	}
+	if got := c1.LocalPort(); got != port {
+		t.Errorf("LocalPort = %d after key change; want %d", got, port)
+	}
+	if got, _ := c1.PeerEndpoint(peerKey); got.String() != real {
+		t.Errorf("PeerEndpoint = %v after key change; want %v", got, real)
+	}
+
+	// Pings still get through, once the peer learns the new key.
+	c2.RemovePeer(oldKey)
+	addTestPeer(t, c2, newKey, c1)
+	as.mu.Lock()
+	as.pongAt[0] = time.Time{}
+	as.mu.Unlock()
+	c1.maybeDiscoPing(as, time.Now().Add(discoPingInterval))
+	waitPong("after rotation")
+}
+
+func TestKeepalive(t *testing.T) {
+	newConn := func(interval time.Duration) *Conn {
+		c, err := Listen(Options{BindAddr: "127.0.0.1", Logf: t.Logf, KeepaliveInterval: interval})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			var pkt [64 << 10]byte
+			for {
+				if _, _, _, err := c.ReceiveIPv4(pkt[:]); err != nil {
+					return
+				}
+			}
+		}()
+		return c
+	}
+	c1, c2, c3 := newConn(40*time.Millisecond), newConn(0), newConn(-1)
+	defer c1.Close()
+	defer c2.Close()
+	defer c3.Close()
+	if got := c2.KeepaliveInterval(); got != DefaultKeepaliveInterval {
+		t.Errorf("default KeepaliveInterval = %v; want %v", got, DefaultKeepaliveInterval)
+	}
+	if got := c3.KeepaliveInterval(); got != 0 {
+		t.Errorf("disabled KeepaliveInterval = %v; want 0", got)
+	}
+
+	k1 := setTestKey(t, c1, 1)
+	addTestPeer(t, c2, k1, c1)
+	addTestPeer(t, c3, k1, c1)
+
+	// A peer that's never been sent to gets no keepalives.
+	quiet, err := c1.CreateEndpoint(setTestKey(t, c3, 3), fmt.Sprintf("127.0.0.1:%d", c3.LocalPort()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := c1.CreateEndpoint(setTestKey(t, c2, 2), fmt.Sprintf("127.0.0.1:%d", c2.LocalPort()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := ep.(*AddrSet)
+	if err := c1.Send([]byte{4, 0, 0, 0}, ep); err != nil {
+		t.Fatal(err)
+	}
+	pongAt := func() time.Time {
+		as.mu.Lock()
+		defer as.mu.Unlock()
+		if len(as.pongAt) == 0 {
+			return time.Time{}
+		}
+		return as.pongAt[0]
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for pongAt().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for endpoint to be confirmed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	confirmed := pongAt()
+
+	// With no more sends, keepalives keep the endpoint confirmed.
+	for c1.Stats().KeepalivesSent < 3 || !pongAt().After(confirmed) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for keepalives; sent %d", c1.Stats().KeepalivesSent)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	qa := quiet.(*AddrSet)
+	qa.mu.Lock()
+	defer qa.mu.Unlock()
+	if !qa.lastKeepalive.IsZero() {
+		t.Error("keepalive sent to peer with no traffic")
+	}
+}
+
+func TestSendTo(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	recv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+
+	var peer, noAddrs, unknown wgcfg.Key
+	peer[0], noAddrs[0], unknown[0] = 1, 2, 3
+	if _, err := conn.CreateEndpoint(peer, recv.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.CreateEndpoint(noAddrs, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.SendTo(unknown, []byte("hello")); err != ErrUnknownPeer {
+		t.Errorf("SendTo(unknown) = %v; want %v", err, ErrUnknownPeer)
+	}
+	if err := conn.SendTo(noAddrs, []byte("hello")); err != ErrNoEndpoint {
+		t.Errorf("SendTo(noAddrs) = %v; want %v", err, ErrNoEndpoint)
+	}
+	if err := conn.SendTo(peer, []byte("hello")); err != nil {
+		t.Fatalf("SendTo(peer) = %v", err)
+	}
+	recv.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := recv.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "hello" {
+		t.Errorf("got %q; want %q", got, "hello")
+	}
+}
+
+func TestPacketSniffer(t *testing.T) {
+	var mu sync.Mutex
+	counts := map[Direction]int{}
+	sniff := func(dir Direction, addr *net.UDPAddr, b []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		counts[dir]++
+	}
+	newConn := func(sniffer func(Direction, *net.UDPAddr, []byte)) *Conn {
+		c, err := Listen(Options{BindAddr: "127.0.0.1", PacketSniffer: sniffer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c1, c2 := newConn(sniff), newConn(nil)
+	defer c1.Close()
+	defer c2.Close()
+
+	ep1 := (*singleEndpoint)(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(c1.LocalPort())})
+	ep2 := (*singleEndpoint)(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(c2.LocalPort())})
+	const pkts = 3
+	for i := 0; i < pkts; i++ {
+		if err := c1.Send([]byte("ping"), ep2); err != nil {
+			t.Fatal(err)
+		}
+		if err := c2.Send([]byte("pong"), ep1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var pkt [1500]byte
+	for i := 0; i < pkts; i++ {
+		if _, _, _, err := c1.ReceiveIPv4(pkt[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if counts[DirSend] != pkts || counts[DirRecv] != pkts {
+		t.Errorf("sniffed %d sent, %d received; want %d each", counts[DirSend], counts[DirRecv], pkts)
+	}
+}
+
+func TestPeerSendError(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// An IPv4 socket can't send to an IPv6 address.
+	var peer wgcfg.Key
+	peer[0] = 1
+	ep, err := conn.CreateEndpoint(peer, "[::1]:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.PeerSendError(peer); err != nil {
+		t.Fatalf("before sending, PeerSendError = %v", err)
+	}
+
+	errsBefore := metricSendErrors.Value()
+	for i := 0; i < 2; i++ {
+		if err := conn.Send([]byte("hello"), ep); err == nil {
+			t.Fatal("Send to IPv6 address succeeded")
+		}
+	}
+	err = conn.PeerSendError(peer)
+	if err == nil || !strings.Contains(err.Error(), "last 2 sends") {
+		t.Errorf("after failures, PeerSendError = %v; want 2 failures", err)
+	}
+	if got := metricSendErrors.Value() - errsBefore; got != 2 {
+		t.Errorf("send_errors rose by %d; want 2", got)
+	}
+
+	addr, _ := conn.PeerEndpoint(peer)
+	ep.(*AddrSet).noteSendResult(addr, nil)
+	if err := conn.PeerSendError(peer); err != nil {
+		t.Errorf("after success, PeerSendError = %v", err)
+	}
+}
+
+func TestPeerEndpointsStale(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1", EndpointTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var peer wgcfg.Key
+	peer[0] = 1
+	ep, err := conn.CreateEndpoint(peer, "1.2.3.4:1,5.6.7.8:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := ep.(*AddrSet)
+	old, live := as.addrs[0], as.addrs[1]
+
+	// Until the TTL has passed since the peer was added, nothing is stale.
+	as.UpdateDst(&live)
+	for i, st := range conn.PeerEndpoints(peer) {
+		if st.Stale {
+			t.Errorf("new endpoint %d (%v) is stale", i, st.Addr)
+		}
+	}
+
+	as.mu.Lock()
+	as.created = time.Now().Add(-time.Hour)
+	as.mu.Unlock()
+	got := conn.PeerEndpoints(peer)
+	if len(got) != 2 {
+		t.Fatalf("PeerEndpoints = %v; want 2 endpoints", got)
+	}
+	if st := got[0]; !equalUDPAddr(st.Addr, &old) || !st.Stale || st.Confirmed || !st.LastSeen.IsZero() {
+		t.Errorf("silent endpoint = %+v; want stale, unconfirmed, never seen", st)
+	}
+	if st := got[1]; !equalUDPAddr(st.Addr, &live) || st.Stale || !st.Confirmed || st.LastSeen.IsZero() {
+		t.Errorf("active endpoint = %+v; want live, confirmed, seen", st)
+	}
+
+	handshake := []byte{1, 0, 0, 0} // a WireGuard handshake initiation
+	dsts, _ := appendDests(nil, as, handshake, nil)
+	if len(dsts) != 1 || !equalUDPAddr(dsts[0], &live) {
+		t.Errorf("spray dests = %v; want [%v]", dsts, &live)
+	}
+
+	// Once no endpoint is live, they're all tried again.
+	as.mu.Lock()
+	as.recvAt[1] = time.Now().Add(-time.Hour)
+	as.mu.Unlock()
+	dsts, _ = appendDests(nil, as, handshake, nil)
+	if len(dsts) != 2 {
+		t.Errorf("spray dests with no live endpoint = %v; want both", dsts)
+	}
+
+	if got := conn.PeerEndpoints(wgcfg.Key{2}); got != nil {
+		t.Errorf("PeerEndpoints of unknown peer = %v; want nil", got)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c := &Conn{clock: realClock{}}
+	events, unsubscribe := c.Events()
+	dropsBefore := metricEventsDropped.Value()
+	const extra = 5
+	for i := 0; i < eventBufSize+extra; i++ {
+		c.emit(Event{Type: EventEndpoint, Addr: &net.UDPAddr{Port: i}})
+	}
+	if got := metricEventsDropped.Value() - dropsBefore; got != extra {
+		t.Errorf("dropped %d events; want %d", got, extra)
+	}
+	if ev := <-events; ev.Addr.Port != extra || ev.Time.IsZero() {
+		t.Errorf("first event = %v; want the oldest not dropped, port %d", ev, extra)
+	}
+	unsubscribe()
+	unsubscribe()
+	n := 0
+	for range events {
+		n++
+	}
+	if n != eventBufSize-1 {
+		t.Errorf("got %d more events before close; want %d", n, eventBufSize-1)
+	}
+
+	conn, err := Listen(Options{BindAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	events, _ = conn.Events()
+	if err := conn.Rebind(); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for found := false; !found; {
+		select {
+		case ev := <-events:
+			if ev.Type == EventRebind {
+				found = true
+				if ev.Addr == nil || ev.Addr.Port != int(conn.LocalPort()) {
+					t.Errorf("rebind event addr = %v; want port %d", ev.Addr, conn.LocalPort())
+				}
+			}
+		case <-timeout:
+			t.Fatal("no rebind event")
+		}
+	}
+	conn.Close()
+	for range events {
+		// Drain until Close closes the channel.
+	}
+}
+
+func TestHairpinProbe(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	setTestKey(t, conn, 1)
+	if _, known := conn.HairpinSupported(); known {
+		t.Fatal("hairpinning known before any STUN")
+	}
+
+	// A socket that reads nothing stands in for a NAT that doesn't
+	// hairpin, and our own loopback address for one that does.
+	blackhole, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+	self := fmt.Sprintf("127.0.0.1:%d", conn.LocalPort())
+
+	tests := []struct {
+		name string
+		ep   string
+		want bool
+	}{
+		{"no-hairpin", blackhole.LocalAddr().String(), false},
+		{"hairpin", self, true},
+	}
+	// Receive, as WireGuard would, for the probe to arrive.
+	go func() {
+		var pkt [64 << 10]byte
+		for {
+			_, _, _, err := conn.ReceiveIPv4(pkt[:])
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn.notePublicEndpoints([]string{tt.ep})
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				got, known := conn.HairpinSupported()
+				if known {
+					if got != tt.want {
+						t.Errorf("HairpinSupported = %v; want %v", got, tt.want)
+					}
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("hairpin probe never finished")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestHairpinProbeWaitsForKey(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		var pkt [64 << 10]byte
+		for {
+			if _, _, _, err := conn.ReceiveIPv4(pkt[:]); err != nil {
+				return
+			}
+		}
+	}()
+
+	// As in wgengine, a discovery pass finds our public endpoint
+	// before there's a private key to seal the probe with.
+	conn.notePublicEndpoints([]string{fmt.Sprintf("127.0.0.1:%d", conn.LocalPort())})
+	time.Sleep(hairpinTimeout + 100*time.Millisecond)
+	if got, known := conn.HairpinSupported(); known {
+		t.Fatalf("without a key, HairpinSupported = %v, known; want unknown", got)
+	}
+
+	setTestKey(t, conn, 1)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, known := conn.HairpinSupported()
+		if known {
+			if !got {
+				t.Error("after SetPrivateKey, HairpinSupported = false; want true")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("hairpin probe never finished after SetPrivateKey")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAppendDestsPrefersLANBehindSameNAT(t *testing.T) {
+	derp := net.UDPAddr{IP: derpMagicIP, Port: 1}
+	lan := net.UDPAddr{IP: net.ParseIP("192.168.1.5").To4(), Port: 41641}
+	public := net.UDPAddr{IP: net.ParseIP("203.0.113.1").To4(), Port: 41641}
+	data := []byte{4, 0, 0, 0} // a WireGuard transport data message
+
+	tests := []struct {
+		name         string
+		needsHairpin func(*net.UDPAddr) bool
+		want         *net.UDPAddr
+	}{
+		{"no-hook", nil, &public},
+		{"hairpins", func(*net.UDPAddr) bool { return false }, &public},
+		{"same-nat", func(a *net.UDPAddr) bool { return a.IP.Equal(public.IP) }, &lan},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			as := &AddrSet{
+				addrs:          []net.UDPAddr{derp, lan, public},
+				curAddr:        -1,
+				lastDirectRecv: time.Now(),
+				needsHairpin:   tt.needsHairpin,
+			}
+			dsts, _ := appendDests(nil, as, data, nil)
+			if len(dsts) != 1 || !equalUDPAddr(dsts[0], tt.want) {
+				t.Errorf("dests = %v; want [%v]", dsts, tt.want)
+			}
+		})
+	}
+
+	order := pingOrder([]net.UDPAddr{public, lan, derp}, true)
+	if want := []int{1, 0, 2}; fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Errorf("pingOrder = %v; want %v", order, want)
+	}
+}
+
+func TestRoamRequiresProbe(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		var pkt [64 << 10]byte
+		for {
+			_, _, _, err := conn.ReceiveIPv4(pkt[:])
+			if err != nil {
+				return
+			}
+		}
+	}()
+	events, _ := conn.Events()
+	self := key.Public(setTestKey(t, conn, 1))
+
+	// Another peer of conn's stands in for an impostor that somehow
+	// learns the ping's transaction ID.
+	peerPriv, impostorPriv := testPrivateKey(2), testPrivateKey(3)
+	peer, impostor := wgcfg.Key(peerPriv.Public()), wgcfg.Key(impostorPriv.Public())
+	ep, err := conn.CreateEndpoint(peer, "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.CreateEndpoint(impostor, "127.0.0.1:10"); err != nil {
+		t.Fatal(err)
+	}
+	as := ep.(*AddrSet)
+	known, _ := conn.PeerEndpoint(peer)
+
+	// roamer stands in for the peer at its new address. silent
+	// stands in for a spoofed source, which won't answer the probe.
+	roamer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer roamer.Close()
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	migrationsBefore := metricRoamMigrations.Value()
+	as.UpdateDst(silent.LocalAddr().(*net.UDPAddr))
+	if got, _ := conn.PeerEndpoint(peer); !equalUDPAddr(got, known) {
+		t.Fatalf("after packet from unprobed address, endpoint = %v; want %v", got, known)
+	}
+
+	as.UpdateDst(roamer.LocalAddr().(*net.UDPAddr))
+	roamer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := roamer.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bx := newDiscoBox(peerPriv, self)
+	typ, tx, ok := bx.open(buf[:n])
+	if !ok || typ != discoTypePing {
+		t.Fatalf("roaming address got %q; want disco ping to the peer", buf[:n])
+	}
+	if got, _ := conn.PeerEndpoint(peer); !equalUDPAddr(got, known) {
+		t.Fatalf("before probe answered, endpoint = %v; want %v", got, known)
+	}
+	conn.handleDiscoMsg(key.Public(impostor), newDiscoBox(impostorPriv, self).appendMsg(nil, discoTypePong, tx), roamer.LocalAddr().(*net.UDPAddr))
+	if got, _ := conn.PeerEndpoint(peer); !equalUDPAddr(got, known) {
+		t.Fatalf("after impostor's pong, endpoint = %v; want %v", got, known)
+	}
+	roamer.WriteTo(bx.appendMsg(nil, discoTypePong, tx), from)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type != EventEndpointMigrated {
+				continue
+			}
+			if !equalUDPAddr(ev.Addr, roamer.LocalAddr().(*net.UDPAddr)) {
+				t.Errorf("migration event addr = %v; want %v", ev.Addr, roamer.LocalAddr())
+			}
+		case <-timeout:
+			t.Fatal("no migration event")
+		}
+		break
+	}
+	if got, _ := conn.PeerEndpoint(peer); !equalUDPAddr(got, roamer.LocalAddr().(*net.UDPAddr)) {
+		t.Errorf("after probe answered, endpoint = %v; want %v", got, roamer.LocalAddr())
+	}
+	if got := metricRoamMigrations.Value() - migrationsBefore; got != 1 {
+		t.Errorf("roam_migrations rose by %d; want 1", got)
+	}
+}
+
+func TestEndpointsListeners(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &Conn{
+		connCtx:    ctx,
+		epDebounce: -1,
+	}
+
+	// A listener that's stuck mustn't hold up the others.
+	unblock := make(chan bool)
+	defer close(unblock)
+	c.AddEndpointsListener(func([]string) { <-unblock })
+
+	got1 := make(chan []string, 10)
+	got2 := make(chan []string, 10)
+	remove1 := c.AddEndpointsListener(func(eps []string) { got1 <- eps })
+	c.AddEndpointsListener(func(eps []string) { got2 <- eps })
+
+	recv := func(ch chan []string) []string {
+		t.Helper()
+		select {
+		case eps := <-ch:
+			return eps
+		case <-time.After(5 * time.Second):
+			t.Fatal("listener not called")
+			return nil
+		}
+	}
+
+	want := []string{"1.2.3.4:1", "10.0.0.1:1"}
+	c.queueEndpoints(want)
+	if eps := recv(got1); !stringsEqual(eps, want) {
+		t.Errorf("listener 1 got %q; want %q", eps, want)
+	}
+	if eps := recv(got2); !stringsEqual(eps, want) {
+		t.Errorf("listener 2 got %q; want %q", eps, want)
+	}
+
+	// A listener added later starts with the current endpoints.
+	got3 := make(chan []string, 10)
+	c.AddEndpointsListener(func(eps []string) { got3 <- eps })
+	if eps := recv(got3); !stringsEqual(eps, want) {
+		t.Errorf("late listener got %q; want %q", eps, want)
+	}
+
+	remove1()
+	remove1() // no-op
+	want = []string{"1.2.3.4:1"}
+	c.queueEndpoints(want)
+	if eps := recv(got2); !stringsEqual(eps, want) {
+		t.Errorf("listener 2 got %q; want %q", eps, want)
+	}
+	select {
+	case eps := <-got1:
+		t.Errorf("removed listener called with %q", eps)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	const want = 4 << 20
+	var logs []string
+	var mu sync.Mutex
+	conn, err := Listen(Options{
+		BindAddr:         "127.0.0.1",
+		ReadBufferBytes:  want,
+		WriteBufferBytes: want,
+		Logf: func(format string, args ...interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The kernel may clamp the sizes, so just check that setting
+	// them worked and something sensible resulted.
+	r, w, err := socketBufferSizes(conn.pconn.pconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r <= 0 || w <= 0 {
+		t.Errorf("buffer sizes = %d, %d; want positive", r, w)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, l := range logs {
+		if strings.Contains(l, "setting") || strings.Contains(l, "getting") {
+			t.Errorf("unexpected error log: %s", l)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	recv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recv.Close()
+	ep := (*singleEndpoint)(recv.LocalAddr().(*net.UDPAddr))
+
+	const pkts = 3
+	for i := 0; i < pkts; i++ {
+		if err := conn.Send([]byte("hello"), ep); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.setNATType(NATEasy)
+
+	st := conn.Stats()
+	if st.PacketsSent != pkts {
+		t.Errorf("PacketsSent = %d; want %d", st.PacketsSent, pkts)
+	}
+	if st.NATType != NATEasy {
+		t.Errorf("NATType = %q; want %q", st.NATType, NATEasy)
+	}
+	if st.STUNRecv > st.STUNSent {
+		t.Errorf("STUNRecv = %d > STUNSent = %d", st.STUNRecv, st.STUNSent)
+	}
+}
+
+func TestCloseWaitsForGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	const numConns = 10
+	for i := 0; i < numConns; i++ {
+		c, err := Listen(Options{
+			BindAddr: "127.0.0.1",
+			Logf:     t.Logf,
+			DERPMap:  map[int]DERPRegion{1: {Hosts: []string{"127.0.0.1:1"}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Start a DERP connection's reader and writer too.
+		if err := c.SetPrivateKey(wgcfg.PrivateKey{1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SetPreferredDERP(1); err != nil {
+			t.Fatal(err)
+		}
+		recvDone := make(chan struct{})
+		go func() {
+			defer close(recvDone)
+			var pkt [64 << 10]byte
+			for {
+				if _, _, _, err := c.ReceiveIPv4(pkt[:]); err != nil {
+					return
+				}
+			}
+		}()
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+		<-recvDone
+		if got := c.runningGoroutines(); got != "" {
+			t.Errorf("conn %d: goroutines running after Close: %s", i, got)
+		}
+		if c.goTracked("late", func() {}) {
+			t.Errorf("conn %d: goTracked started a goroutine after Close", i)
+		}
+	}
+
+	// Goroutines outside the Conns, such as the test's receive
+	// loops, may take a moment to be reaped.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= before {
+			break
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines after closing %d Conns; had %d before:\n%s", n, numConns, before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCloseLogsStuckGoroutines(t *testing.T) {
+	var logs []string
+	var mu sync.Mutex
+	c, err := Listen(Options{BindAddr: "127.0.0.1", Logf: func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		c.goTracked("stuck", func() { <-release })
+	}
+	c.waitGoroutines(10 * time.Millisecond)
+	close(release)
+	c.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, l := range logs {
+		if strings.Contains(l, "still running") && strings.Contains(l, "stuck×2") {
+			return
+		}
+	}
+	t.Errorf("no log of stuck goroutines; got %q", logs)
+}
+
+// fakeClock is a clock whose time moves only when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	ch     chan time.Time // nil for AfterFunc timers
+	f      func()         // for AfterFunc timers
+	period time.Duration  // for tickers
+	when   time.Time
+	active bool
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer   { return c.add(d, 0, nil) }
+func (c *fakeClock) NewTicker(d time.Duration) ticker { return fakeTicker{c.add(d, d, nil)} }
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	return c.add(d, 0, f)
+}
+
+func (c *fakeClock) add(d, period time.Duration, f func()) *fakeTimer {
+	t := &fakeTimer{clock: c, f: f, period: period}
+	if f == nil {
+		t.ch = make(chan time.Time, 1)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.when = c.now.Add(d)
+	t.active = true
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers that come
+// due on the way in order.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTimer
+		active := c.timers[:0]
+		for _, t := range c.timers {
+			if !t.active {
+				continue
+			}
+			active = append(active, t)
+			if !t.when.After(end) && (next == nil || t.when.Before(next.when)) {
+				next = t
+			}
+		}
+		c.timers = active
+		if next == nil {
+			break
+		}
+		c.now = next.when
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			next.active = false
+		}
+		if next.f != nil {
+			go next.f()
+		} else {
+			select {
+			case next.ch <- c.now:
+			default: // like a time.Ticker, drop ticks nobody's waiting for
+			}
+		}
+	}
+	c.now = end
+}
+
+func (t *fakeTimer) Chan() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.when = t.clock.now.Add(d)
+	if !was {
+		t.active = true
+		t.clock.timers = append(t.clock.timers, t)
+	}
+	return was
+}
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
+
+func TestFakeClockReSTUN(t *testing.T) {
+	// A STUN server that reports, but doesn't answer, requests.
+	// With one try per server, each pass sends one request.
+	srv, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	reqs := make(chan bool, 10)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := srv.ReadFrom(buf); err != nil {
+				return
+			}
+			reqs <- true
+		}
+	}()
+	waitPass := func(what string) {
+		t.Helper()
+		select {
+		case <-reqs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no STUN pass %s", what)
+		}
+	}
+
+	const interval = time.Minute
+	clock := newFakeClock()
+	start := clock.Now()
+	conn, err := Listen(Options{
+		BindAddr:       "127.0.0.1",
+		STUN:           []string{srv.LocalAddr().String()},
+		STUNRetries:    1,
+		ReSTUNInterval: interval,
+		clock:          clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitPass("at startup")
+	next := conn.NextReSTUN()
+	if d := next.Sub(start); d < interval-interval/5 || d > interval+interval/5 {
+		t.Fatalf("NextReSTUN is %v after start; want about %v", d, interval)
+	}
+
+	// Time stands still until advanced, however long the test takes.
+	clock.Advance(next.Sub(start) - time.Second)
+	select {
+	case <-reqs:
+		t.Fatal("STUN pass before NextReSTUN")
+	default:
+	}
+	clock.Advance(time.Second)
+	waitPass("at NextReSTUN")
+}
+
+func TestPathPreference(t *testing.T) {
+	derp := *derpAddr(1)
+	v4 := net.UDPAddr{IP: net.ParseIP("1.2.3.4").To4(), Port: 1}
+	v4b := net.UDPAddr{IP: net.ParseIP("5.6.7.8").To4(), Port: 2}
+	v6 := net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3}
+	now := time.Now()
+	const (
+		fast = 1 * time.Millisecond
+		slow = 50 * time.Millisecond
+	)
+	tests := []struct {
+		name      string
+		pref      []PathKind
+		addrs     []net.UDPAddr
+		confirmed []time.Duration // per addr, the pong RTT; zero if unconfirmed
+		want      int
+	}{
+		{"none-confirmed", nil, []net.UDPAddr{derp, v4, v6}, []time.Duration{0, 0, 0}, -1},
+		{"v6-preferred", nil, []net.UDPAddr{derp, v6, v4}, []time.Duration{0, slow, fast}, 1},
+		{"v4-preferred", []PathKind{PathIPv4, PathIPv6}, []net.UDPAddr{derp, v4, v6}, []time.Duration{0, slow, fast}, 1},
+		{"only-v4-confirmed", nil, []net.UDPAddr{derp, v4, v6}, []time.Duration{0, fast, 0}, 1},
+		{"derp-preferred", []PathKind{PathDERP, PathIPv4}, []net.UDPAddr{derp, v4}, []time.Duration{0, fast}, 0},
+		{"latency-breaks-tie", nil, []net.UDPAddr{derp, v4, v4b}, []time.Duration{0, fast, slow}, 1},
+		{"priority-breaks-near-tie", nil, []net.UDPAddr{derp, v4, v4b}, []time.Duration{0, fast + time.Millisecond, fast}, 2},
+		{"unlisted-kind-last", []PathKind{PathIPv4}, []net.UDPAddr{v6, v4}, []time.Duration{fast, slow}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			as := &AddrSet{addrs: tt.addrs, curAddr: -1, pathPref: tt.pref}
+			as.pongAt = make([]time.Time, len(tt.addrs))
+			as.pongRTT = make([]time.Duration, len(tt.addrs))
+			for i, rtt := range tt.confirmed {
+				if rtt != 0 {
+					as.pongAt[i] = now
+					as.pongRTT[i] = rtt
+				}
+			}
+			as.mu.Lock()
+			defer as.mu.Unlock()
+			if got := as.bestConfirmedLocked(now); got != tt.want {
+				t.Errorf("bestConfirmedLocked = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerPathKind(t *testing.T) {
+	for _, tt := range []struct {
+		pref []PathKind
+		want PathKind
+	}{
+		{nil, PathIPv6},
+		{[]PathKind{PathIPv4, PathIPv6, PathDERP}, PathIPv4},
+	} {
+		c, err := Listen(Options{BindAddr: "127.0.0.1", Logf: t.Logf, PathPreference: tt.pref})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		peer := wgcfg.Key{1}
+		ep, err := c.CreateEndpoint(peer, "127.3.3.40:1,1.2.3.4:1,[2001:db8::1]:2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		as := ep.(*AddrSet)
+		if got := c.PeerPathKind(peer); got != PathIPv6 {
+			t.Errorf("%v: unconfirmed PeerPathKind = %v; want %v, the highest-priority endpoint", tt.pref, got, PathIPv6)
+		}
+
+		// Packets are arriving via DERP, but both direct paths work.
+		as.UpdateDst(derpAddr(1))
+		if got := c.PeerPathKind(peer); got != PathDERP {
+			t.Errorf("%v: PeerPathKind = %v; want %v", tt.pref, got, PathDERP)
+		}
+		now := time.Now()
+		as.notePong(1, &as.addrs[1], now, time.Millisecond)
+		as.notePong(2, &as.addrs[2], now, 20*time.Millisecond)
+		if got := c.PeerPathKind(peer); got != tt.want {
+			t.Errorf("%v: PeerPathKind = %v; want %v", tt.pref, got, tt.want)
+		}
+		// Until a packet arrives directly, DERP is used as well.
+		dsts, _ := appendDests(nil, as, []byte{4, 0, 0, 0}, nil)
+		if len(dsts) == 0 || pathKindOf(dsts[0]) != tt.want {
+			t.Errorf("%v: appendDests = %v; want a %v endpoint first", tt.pref, dsts, tt.want)
+		}
+	}
+}
+
+func TestPeerConnectionStatus(t *testing.T) {
+	clock := newFakeClock()
+	c, err := Listen(Options{BindAddr: "127.0.0.1", Logf: t.Logf, KeepaliveInterval: -1, clock: clock})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if direct, via := c.PeerConnectionStatus(wgcfg.Key{9}); direct || via != "" {
+		t.Errorf("unknown peer: status = %v, %q; want false, \"\"", direct, via)
+	}
+
+	peer := wgcfg.Key{1}
+	ep, err := c.CreateEndpoint(peer, "127.3.3.40:3,1.2.3.4:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := ep.(*AddrSet)
+	data := []byte{4, 0, 0, 0} // a WireGuard transport data message
+	check := func(what string, wantDirect bool, wantVia string) {
+		t.Helper()
+		if direct, via := c.PeerConnectionStatus(peer); direct != wantDirect || via != wantVia {
+			t.Errorf("%s: status = %v, %q; want %v, %q", what, direct, via, wantDirect, wantVia)
+		}
+	}
+	flaps := metricPathFlaps.Value()
+
+	check("never heard from", false, "derp-3")
+	as.noteDirectRecv(clock.Now())
+	check("heard from directly", true, "1.2.3.4:1")
+
+	// The direct path goes quiet, so packets fall back to DERP.
+	clock.Advance(derpFallbackAfter + time.Second)
+	dsts, _ := appendDests(nil, as, data, nil)
+	if !containsUDPAddr(dsts, derpAddr(3)) {
+		t.Fatalf("dests = %v; want DERP fallback", dsts)
+	}
+	check("after DERP fallback", false, "derp-3")
+
+	as.noteDirectRecv(clock.Now())
+	check("direct again", true, "1.2.3.4:1")
+	if got := metricPathFlaps.Value() - flaps; got != 3 {
+		t.Errorf("path flaps = %d; want 3", got)
+	}
+}
+
+func TestLocalAddrs(t *testing.T) {
+	c, err := Listen(Options{BindAddr: "127.0.0.1", Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	addrs := c.LocalAddrs()
+	if len(addrs) != 1 {
+		t.Fatalf("LocalAddrs = %v; want one UDP/IPv4 address", addrs)
+	}
+	ua, ok := addrs[0].(*net.UDPAddr)
+	if !ok {
+		t.Fatalf("LocalAddrs()[0] is %T; want *net.UDPAddr", addrs[0])
+	}
+	if !ua.IP.Equal(net.ParseIP("127.0.0.1")) || ua.Port == 0 || ua.Port != int(c.LocalPort()) {
+		t.Errorf("LocalAddrs = %v; want 127.0.0.1:%d", ua, c.LocalPort())
+	}
+}
+
+func TestDebugEndpointChanges(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var mu sync.Mutex
+		var logs []string
+		c := &Conn{
+			connCtx:      ctx,
+			epDebounce:   -1,
+			logEpChanges: enabled,
+			logf: func(format string, args ...interface{}) {
+				mu.Lock()
+				defer mu.Unlock()
+				logs = append(logs, fmt.Sprintf(format, args...))
+			},
+		}
+		c.queueEndpoints([]string{"1.2.3.4:1", "10.0.0.1:1"})
+		c.queueEndpoints([]string{"10.0.0.1:1", "1.2.3.4:1"}) // same set; not logged
+		c.queueEndpoints([]string{"5.6.7.8:1", "10.0.0.1:1", "5.6.7.8:1", "10.0.0.2:1"})
+
+		var want []string
+		if enabled {
+			want = []string{
+				"magicsock: endpoints changed: added [1.2.3.4:1 10.0.0.1:1], removed []",
+				"magicsock: endpoints changed: added [10.0.0.2:1 5.6.7.8:1], removed [1.2.3.4:1]",
+			}
+		}
+		mu.Lock()
+		if !stringsEqual(logs, want) {
+			t.Errorf("enabled=%v: logs = %q; want %q", enabled, logs, want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestUpdateRemovePeer(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1", Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	setTestKey(t, conn, 1)
+
+	// pending returns the indexes in as.addrs of its outstanding pings.
+	pending := func(as *AddrSet) []int {
+		conn.discoMu.Lock()
+		defer conn.discoMu.Unlock()
+		var idxs []int
+		for _, p := range conn.discoPending {
+			if p.as == as {
+				idxs = append(idxs, p.idx)
+			}
+		}
+		sort.Ints(idxs)
+		return idxs
+	}
+	byUDP := func(addr string) *AddrSet {
+		ua, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn.findAddrSet(ua)
+	}
+
+	var peer, other wgcfg.Key
+	peer[0], other[0] = 1, 2
+	otherEP, err := conn.CreateEndpoint(other, "192.0.2.9:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	conn.maybeDiscoPing(otherEP.(*AddrSet), now)
+
+	// Add.
+	a := wgcfg.Endpoint{Host: "192.0.2.1", Port: 1}
+	b := wgcfg.Endpoint{Host: "192.0.2.2", Port: 2}
+	c := wgcfg.Endpoint{Host: "192.0.2.3", Port: 3}
+	if err := conn.UpdatePeer(peer, []wgcfg.Endpoint{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	as := conn.addrSetOfKey(peer)
+	if as == nil {
+		t.Fatal("UpdatePeer didn't add the peer")
+	}
+	conn.maybeDiscoPing(as, now)
+	if got := pending(as); fmt.Sprint(got) != "[0 1]" {
+		t.Errorf("after add, pending pings = %v; want [0 1]", got)
+	}
+	as.notePong(1, &as.addrs[1], now, time.Millisecond)
+
+	// Update: a is dropped, b moves to index 0, c is new.
+	if err := conn.UpdatePeer(peer, []wgcfg.Endpoint{b, c}); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.addrSetOfKey(peer); got != as {
+		t.Errorf("UpdatePeer replaced the peer's AddrSet")
+	}
+	if got := pending(as); fmt.Sprint(got) != "[0]" {
+		t.Errorf("after update, pending pings = %v; want [0]", got)
+	}
+	if st := conn.PeerEndpoints(peer); len(st) != 2 || !st[0].Confirmed || st[1].Confirmed {
+		t.Errorf("after update, PeerEndpoints = %+v; want b confirmed, c not", st)
+	}
+	if got := byUDP("192.0.2.1:1"); got != nil {
+		t.Errorf("dropped endpoint still maps to %v", got)
+	}
+	if got := byUDP("192.0.2.3:3"); got != as {
+		t.Errorf("new endpoint maps to %v; want the peer", got)
+	}
+	conn.maybeDiscoPing(as, now)
+	if got := pending(as); fmt.Sprint(got) != "[0 0 1]" {
+		t.Errorf("after update and ping, pending pings = %v; want [0 0 1]", got)
+	}
+
+	// An update with the same endpoints changes nothing.
+	if err := conn.UpdatePeer(peer, []wgcfg.Endpoint{b, c}); err != nil {
+		t.Fatal(err)
+	}
+	if got := pending(as); len(got) != 3 {
+		t.Errorf("after no-op update, pending pings = %v; want 3", got)
+	}
+
+	// Remove.
+	conn.RemovePeer(peer)
+	if got := conn.addrSetOfKey(peer); got != nil {
+		t.Errorf("after remove, peer still known")
+	}
+	if got := pending(as); len(got) != 0 {
+		t.Errorf("after remove, pending pings = %v; want none", got)
+	}
+	for _, addr := range []string{"192.0.2.2:2", "192.0.2.3:3"} {
+		if got := byUDP(addr); got != nil {
+			t.Errorf("after remove, %s maps to %v", addr, got)
+		}
+	}
+	conn.maybeDiscoPing(as, now.Add(discoPingInterval))
+	if got := pending(as); len(got) != 0 {
+		t.Errorf("removed peer was pinged: %v", got)
+	}
+
+	// The other peer was untouched throughout.
+	if got := pending(otherEP.(*AddrSet)); fmt.Sprint(got) != "[0]" {
+		t.Errorf("other peer's pending pings = %v; want [0]", got)
+	}
+	if got := byUDP("192.0.2.9:9"); got != otherEP {
+		t.Errorf("other peer's endpoint maps to %v", got)
+	}
+}
+
+func TestUpdatePeerThenCreateEndpoint(t *testing.T) {
+	conn, err := Listen(Options{BindAddr: "127.0.0.1", Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	byUDP := func(addr string) *AddrSet {
+		ua, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn.findAddrSet(ua)
+	}
+
+	var peer wgcfg.Key
+	peer[0] = 1
+	a := wgcfg.Endpoint{Host: "192.0.2.1", Port: 1}
+	b := wgcfg.Endpoint{Host: "192.0.2.2", Port: 2}
+	if err := conn.UpdatePeer(peer, []wgcfg.Endpoint{a, b}); err != nil {
+		t.Fatal(err)
+	}
+	as := conn.addrSetOfKey(peer)
+	now := time.Now()
+	as.notePong(1, &as.addrs[1], now, time.Millisecond)
+
+	// WireGuard gets the AddrSet UpdatePeer made, with its new
+	// endpoints, and a's mapping is gone.
+	ep, err := conn.CreateEndpoint(peer, "192.0.2.2:2,192.0.2.3:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ep != as || conn.addrSetOfKey(peer) != as {
+		t.Fatal("CreateEndpoint made a second AddrSet for the peer")
+	}
+	if got := byUDP("192.0.2.1:1"); got != nil {
+		t.Errorf("dropped endpoint still maps to %v", got)
+	}
+	for _, addr := range []string{"192.0.2.2:2", "192.0.2.3:3"} {
+		if got := byUDP(addr); got != as {
+			t.Errorf("%s maps to %v; want the peer", addr, got)
+		}
+	}
+	if st := conn.PeerEndpoints(peer); len(st) != 2 || !st[0].Confirmed || st[1].Confirmed {
+		t.Errorf("PeerEndpoints = %+v; want b confirmed, c not", st)
+	}
+
+	// Later updates reach the endpoint WireGuard holds.
+	if err := conn.UpdatePeer(peer, []wgcfg.Endpoint{a}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ep.(*AddrSet).Addrs(); len(got) != 1 || got[0] != a {
+		t.Errorf("after UpdatePeer, endpoint's Addrs = %v; want [%v]", got, a)
+	}
+	if got := byUDP("192.0.2.2:2"); got != nil {
+		t.Errorf("after UpdatePeer, dropped endpoint still maps to %v", got)
+	}
+}
+
+func TestDERPBackoff(t *testing.T) {
+	const base, max = 100 * time.Millisecond, time.Second
+	var got []time.Duration
+	for n := 1; n <= 6; n++ {
+		got = append(got, derpBackoff(base, max, n))
+	}
+	if want := "[100ms 200ms 400ms 800ms 1s 1s]"; fmt.Sprint(got) != want {
+		t.Errorf("backoff = %v; want %v", got, want)
+	}
+}
+
+// testDERPServer is a DERP server, over TLS, that can drop or
+// silence its connections and refuse new ones.
+type testDERPServer struct {
+	*httptest.Server
+	derp *derp.Server
+
+	mu       sync.Mutex
+	conns    []*testDERPConn
+	refuse   bool
+	refused  int // DERP connections refused
+	accepted int // DERP connections accepted
+}
+
+// A testDERPConn is a connection to a testDERPServer. Once silent,
+// nothing written to it is sent.
+type testDERPConn struct {
+	net.Conn
+	silent int32 // atomic
+}
+
+func (c *testDERPConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.silent) != 0 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+type testDERPListener struct {
+	net.Listener
+	s *testDERPServer
+}
+
+func (ln testDERPListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tc := &testDERPConn{Conn: c}
+	ln.s.mu.Lock()
+	ln.s.conns = append(ln.s.conns, tc)
+	ln.s.mu.Unlock()
+	return tc, nil
+}
+
+func newTestDERPServer(t *testing.T) *testDERPServer {
+	s := &testDERPServer{derp: derp.NewServer(key.Private{9}, t.Logf)}
+	h := derphttp.Handler(s.derp)
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "DERP" {
+			s.mu.Lock()
+			refuse := s.refuse
+			if refuse {
+				s.refused++
+			} else {
+				s.accepted++
+			}
+			s.mu.Unlock()
+			if refuse {
+				http.Error(w, "refused", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	}))
+	s.Listener = testDERPListener{s.Listener, s}
+	s.StartTLS()
+	return s
+}
+
+func (s *testDERPServer) Close() {
+	s.derp.Close()
+	s.Server.Close()
+}
+
+func (s *testDERPServer) setRefuse(v bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refuse = v
+}
+
+func (s *testDERPServer) counts() (refused, accepted int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refused, s.accepted
+}
+
+// drop closes all connections to s.
+func (s *testDERPServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+// silence stops s sending anything on its current connections.
+func (s *testDERPServer) silence() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		atomic.StoreInt32(&c.silent, 1)
+	}
+}
+
+// listenDERP returns a Conn using s as the DERP server of its
+// preferred region.
+func listenDERP(t *testing.T, s *testDERPServer, opts Options) *Conn {
+	opts.BindAddr = "127.0.0.1"
+	opts.DisableSTUN = true
+	opts.DERPMap = map[int]DERPRegion{1: {Hosts: []string{s.Listener.Addr().String()}}}
+	opts.DERPHTTPClient = s.Client()
+	opts.Logf = t.Logf
+	conn, err := Listen(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetPrivateKey(wgcfg.PrivateKey{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetPreferredDERP(1); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func waitDERPConnected(t *testing.T, conn *Conn, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for conn.DERPConnected() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for DERPConnected = %v", want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDERPReconnect(t *testing.T) {
+	ds := newTestDERPServer(t)
+	defer ds.Close()
+	const base, max = 50 * time.Millisecond, 200 * time.Millisecond
+	conn := listenDERP(t, ds, Options{
+		DERPReconnectBackoff:    base,
+		DERPReconnectMaxBackoff: max,
+		DERPKeepaliveInterval:   -1,
+	})
+	defer conn.Close()
+	waitDERPConnected(t, conn, true)
+
+	before := metricDERPReconnects.Value()
+	ds.setRefuse(true)
+	dropped := time.Now()
+	ds.drop()
+	waitDERPConnected(t, conn, false)
+
+	// Losing the connection is the first failure, so the three
+	// refused attempts follow waits of 50, 100 and 200ms.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if refused, _ := ds.counts(); refused >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for reconnect attempts")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if d, want := time.Since(dropped), base+2*base+max; d < want {
+		t.Errorf("3 reconnect attempts in %v; want backoff of at least %v", d, want)
+	}
+	if conn.DERPConnected() {
+		t.Errorf("DERPConnected while the server refuses connections")
+	}
+
+	// Once allowed, the reconnect comes within the capped backoff,
+	// plus slack for connecting.
+	ds.setRefuse(false)
+	allowed := time.Now()
+	waitDERPConnected(t, conn, true)
+	if d := time.Since(allowed); d > max+time.Second {
+		t.Errorf("reconnected %v after the server allowed it; want within %v", d, max)
+	}
+	if got := metricDERPReconnects.Value() - before; got < 4 {
+		t.Errorf("derp_reconnects grew by %d; want at least 4", got)
+	}
+}
+
+func TestDERPKeepalive(t *testing.T) {
+	ds := newTestDERPServer(t)
+	defer ds.Close()
+	const interval = 100 * time.Millisecond
+	conn := listenDERP(t, ds, Options{
+		DERPReconnectBackoff:  10 * time.Millisecond,
+		DERPKeepaliveInterval: interval,
+	})
+	defer conn.Close()
+	waitDERPConnected(t, conn, true)
+
+	// Keepalives answered by a live server keep the connection.
+	before := metricDERPReconnects.Value()
+	time.Sleep(5 * interval)
+	if got := metricDERPReconnects.Value() - before; got != 0 {
+		t.Errorf("%d reconnects to a live server", got)
+	}
+	if _, accepted := ds.counts(); accepted != 1 {
+		t.Errorf("%d DERP connections to a live server; want 1", accepted)
+	}
+
+	// A server that goes quiet is reconnected to.
+	ds.silence()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, accepted := ds.counts(); accepted >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for silent connection to be replaced")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitDERPConnected(t, conn, true)
+	if got := metricDERPReconnects.Value() - before; got < 1 {
+		t.Errorf("derp_reconnects grew by %d; want at least 1", got)
+	}
+}
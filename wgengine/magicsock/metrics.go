@@ -0,0 +1,97 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"expvar"
+
+	"tailscale.com/metrics"
+)
+
+// Counters of magicsock activity, summed over all Conns in the process.
+// They're published as the expvar "magicsock" for tsweb's varz handler.
+var (
+	metricSTUNRequestsSent      = new(expvar.Int)
+	metricSTUNResponsesReceived = new(expvar.Int)
+	metricSTUNResponsesRejected = new(expvar.Int)
+	metricSTUNRequestsDropped   = new(expvar.Int)
+	metricSTUNFallbackRequests  = new(expvar.Int)
+	metricPacketsRecvIPv4       = new(expvar.Int)
+	metricPacketsRecvIPv6       = new(expvar.Int)
+	metricDERPPacketsRecv       = new(expvar.Int)
+	metricReSTUNCalls           = new(expvar.Int)
+	metricDERPFallbackActivated = new(expvar.Int)
+	metricDiscoPingsSent        = new(expvar.Int)
+	metricDiscoPongsRecv        = new(expvar.Int)
+	metricDiscoPingTimeouts     = new(expvar.Int)
+	metricDiscoDropped          = new(expvar.Int)
+	metricSendErrors            = new(expvar.Int)
+	metricEventsDropped         = new(expvar.Int)
+	metricRoamMigrations        = new(expvar.Int)
+	metricKeepalivesSent        = new(expvar.Int)
+	metricPathFlaps             = new(expvar.Int) // peers flipping between direct and relayed
+	metricDERPReconnects        = new(expvar.Int)
+
+	// metricEndpoints is the number of endpoints last reported to EndpointsFunc.
+	metricEndpoints = new(metrics.Gauge)
+)
+
+func init() {
+	m := new(metrics.Set)
+	m.Set("stun_requests_sent", metricSTUNRequestsSent)
+	m.Set("stun_responses_received", metricSTUNResponsesReceived)
+	m.Set("stun_responses_rejected", metricSTUNResponsesRejected)
+	m.Set("stun_requests_dropped", metricSTUNRequestsDropped)
+	m.Set("stun_fallback_requests", metricSTUNFallbackRequests)
+	m.Set("packets_recv_ipv4", metricPacketsRecvIPv4)
+	m.Set("packets_recv_ipv6", metricPacketsRecvIPv6)
+	m.Set("derp_packets_recv", metricDERPPacketsRecv)
+	m.Set("restun_calls", metricReSTUNCalls)
+	m.Set("derp_fallback_activated", metricDERPFallbackActivated)
+	m.Set("disco_pings_sent", metricDiscoPingsSent)
+	m.Set("disco_pongs_received", metricDiscoPongsRecv)
+	m.Set("disco_ping_timeouts", metricDiscoPingTimeouts)
+	m.Set("disco_dropped", metricDiscoDropped)
+	m.Set("send_errors", metricSendErrors)
+	m.Set("events_dropped", metricEventsDropped)
+	m.Set("roam_migrations", metricRoamMigrations)
+	m.Set("keepalives_sent", metricKeepalivesSent)
+	m.Set("path_flaps", metricPathFlaps)
+	m.Set("derp_reconnects", metricDERPReconnects)
+	m.Set("gauge_endpoints", metricEndpoints)
+	expvar.Publish("magicsock", m)
+}
+
+// Stats is a snapshot of a single Conn's activity, as returned by
+// Conn.Stats. Unlike the process-wide expvars above, its counters
+// are read together and so are consistent with each other.
+type Stats struct {
+	STUNSent       uint64   `json:"stunSent"`       // STUN binding requests sent
+	STUNRecv       uint64   `json:"stunRecv"`       // STUN binding responses accepted
+	PacketsRecvV4  uint64   `json:"packetsRecvV4"`  // packets received over UDP/IPv4
+	PacketsRecvV6  uint64   `json:"packetsRecvV6"`  // packets received over UDP/IPv6
+	PacketsSent    uint64   `json:"packetsSent"`    // packets written to the UDP socket
+	DERPRecv       uint64   `json:"derpRecv"`       // packets received from DERP servers
+	KeepalivesSent uint64   `json:"keepalivesSent"` // keepalives sent on idle paths
+	Endpoints      []string `json:"endpoints"`      // as returned by Conn.Endpoints
+	NATType        string   `json:"natType"`        // as returned by Conn.NATType
+}
+
+// Stats returns a snapshot of c's counters and current state.
+func (c *Conn) Stats() Stats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	s := c.stats
+	s.Endpoints = c.Endpoints()
+	s.NATType = c.NATType()
+	return s
+}
+
+// count increments the counter v, which must point into c.stats.
+func (c *Conn) count(v *uint64) {
+	c.statsMu.Lock()
+	*v++
+	c.statsMu.Unlock()
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"sync"
+	"time"
+)
+
+// maxPacingDelay is the longest a packet is held back by a pacer.
+// Packets that would wait longer are sent after this delay anyway,
+// so latency-sensitive traffic isn't starved by a bulk transfer.
+const maxPacingDelay = 20 * time.Millisecond
+
+// pacingBurst is how much traffic, as time at the pacing rate, a
+// pacer lets through back-to-back after being idle.
+const pacingBurst = 10 * time.Millisecond
+
+// A pacer smooths bursts of outbound packets to a steady rate,
+// using a token bucket refilled on demand.
+type pacer struct {
+	rate  float64 // bytes per second
+	burst float64 // bucket size in bytes
+	clock clock
+	done  <-chan struct{} // closed to stop waiting, as on Conn.Close
+
+	mu     sync.Mutex
+	tokens float64   // bytes that can be sent immediately; negative when in debt
+	last   time.Time // when tokens was last refilled
+
+	// Waiters take turns with timer, which is reused so that
+	// pacing doesn't allocate per packet. Each waits until an
+	// absolute send time, and later packets get later ones, so
+	// taking turns delays none of them.
+	waitMu sync.Mutex
+	timer  timer // created on first use
+}
+
+func newPacer(bytesPerSec int, clock clock, done <-chan struct{}) *pacer {
+	rate := float64(bytesPerSec)
+	return &pacer{
+		rate:   rate,
+		burst:  rate * pacingBurst.Seconds(),
+		clock:  clock,
+		done:   done,
+		tokens: rate * pacingBurst.Seconds(),
+		last:   clock.Now(),
+	}
+}
+
+// wait blocks until a packet of n bytes may be sent, or for
+// maxPacingDelay, whichever is sooner. It returns early once p.done
+// is closed.
+func (p *pacer) wait(n int) {
+	p.mu.Lock()
+	now := p.clock.Now()
+	p.tokens += now.Sub(p.last).Seconds() * p.rate
+	if p.tokens > p.burst {
+		p.tokens = p.burst
+	}
+	p.last = now
+	p.tokens -= float64(n)
+	var delay time.Duration
+	if p.tokens < 0 {
+		delay = time.Duration(-p.tokens / p.rate * float64(time.Second))
+		if delay > maxPacingDelay {
+			// Forgive the debt beyond what we're willing to wait
+			// out, rather than penalizing later packets for it.
+			delay = maxPacingDelay
+			p.tokens = -p.rate * maxPacingDelay.Seconds()
+		}
+	}
+	p.mu.Unlock()
+	if delay > 0 {
+		p.waitUntil(now.Add(delay))
+	}
+}
+
+// waitUntil blocks until time t, or until p.done is closed.
+func (p *pacer) waitUntil(t time.Time) {
+	p.waitMu.Lock()
+	defer p.waitMu.Unlock()
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+	d := t.Sub(p.clock.Now())
+	if d <= 0 {
+		return
+	}
+	if p.timer == nil {
+		p.timer = p.clock.NewTimer(d)
+	} else {
+		p.timer.Reset(d)
+	}
+	select {
+	case <-p.timer.Chan():
+	case <-p.done:
+		if !p.timer.Stop() {
+			// It fired meanwhile; drain it for the next Reset.
+			select {
+			case <-p.timer.Chan():
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// A PathKind is a kind of path packets to a peer can take.
+type PathKind int
+
+const (
+	PathNone PathKind = iota // no path: the peer is unknown or has no endpoints
+	PathDERP                 // relayed via a DERP server
+	PathIPv4                 // direct, over IPv4
+	PathIPv6                 // direct, over IPv6
+)
+
+func (k PathKind) String() string {
+	switch k {
+	case PathNone:
+		return "none"
+	case PathDERP:
+		return "derp"
+	case PathIPv4:
+		return "ipv4"
+	case PathIPv6:
+		return "ipv6"
+	}
+	return fmt.Sprintf("PathKind(%d)", int(k))
+}
+
+// DefaultPathPreference is the default Options.PathPreference.
+// A direct IPv6 path often avoids NAT entirely, so it's preferred to
+// a direct IPv4 one.
+var DefaultPathPreference = []PathKind{PathIPv6, PathIPv4, PathDERP}
+
+// pathLatencyMargin is how much lower one confirmed endpoint's
+// measured latency must be than another's of the same kind for it
+// to be preferred, so measurement noise doesn't flap between them.
+const pathLatencyMargin = 5 * time.Millisecond
+
+func (o *Options) pathPreference() []PathKind {
+	if len(o.PathPreference) == 0 {
+		return DefaultPathPreference
+	}
+	return append([]PathKind(nil), o.PathPreference...)
+}
+
+// pathKindOf returns the kind of path to addr, an endpoint address.
+func pathKindOf(addr *net.UDPAddr) PathKind {
+	switch {
+	case addr == nil:
+		return PathNone
+	case addr.IP.Equal(derpMagicIP):
+		return PathDERP
+	case addr.IP.To4() != nil:
+		return PathIPv4
+	}
+	return PathIPv6
+}
+
+// pathRankLocked returns the position of the kind of a.addrs[i] in
+// a's path preference, lower being better. Kinds not listed rank
+// after all those that are.
+// a.mu must be held.
+func (a *AddrSet) pathRankLocked(i int) int {
+	pref := a.pathPref
+	if pref == nil {
+		pref = DefaultPathPreference
+	}
+	k := pathKindOf(&a.addrs[i])
+	for rank, pk := range pref {
+		if pk == k {
+			return rank
+		}
+	}
+	return len(pref)
+}
+
+// betterPathLocked reports whether the endpoint at index i of a.addrs
+// is a better path than the one at index j, both confirmed: by its
+// kind, then by its measured latency, then by its priority.
+// a.mu must be held.
+func (a *AddrSet) betterPathLocked(i, j int) bool {
+	if ri, rj := a.pathRankLocked(i), a.pathRankLocked(j); ri != rj {
+		return ri < rj
+	}
+	if a.pongRTT != nil {
+		ti, tj := a.pongRTT[i], a.pongRTT[j]
+		if ti+pathLatencyMargin < tj {
+			return true
+		}
+		if tj+pathLatencyMargin < ti {
+			return false
+		}
+	}
+	return i > j
+}
+
+// preferredLocked returns cur, the index in a.addrs of the endpoint
+// packets are being sent to, or else a confirmed endpoint of a kind
+// the path preference ranks above it.
+// a.mu must be held.
+func (a *AddrSet) preferredLocked(cur int, now time.Time) int {
+	if cur == -1 {
+		return -1
+	}
+	if best := a.bestConfirmedLocked(now); best != -1 && a.pathRankLocked(best) < a.pathRankLocked(cur) {
+		return best
+	}
+	return cur
+}
+
+// PeerPathKind returns the kind of path packets to the peer with
+// public key pubKey currently take, as reported by PeerEndpoint.
+func (c *Conn) PeerPathKind(pubKey wgcfg.Key) PathKind {
+	addr, _ := c.PeerEndpoint(pubKey)
+	return pathKindOf(addr)
+}
+
+// PeerConnectionStatus reports whether packets to the peer with
+// public key pubKey currently go directly to it, and via what: the
+// endpoint, as "ip:port", if direct, or the DERP region, as
+// "derp-N", if relayed. via is empty for an unknown peer, or a
+// relayed one with no DERP region to use.
+//
+// A peer is relayed if its current endpoint is a DERP one, or if
+// nothing has been heard from it directly lately, as when its
+// direct path stops working and packets fall back to DERP. Each
+// flip of a peer between direct and relayed, including its first
+// upgrade to direct, is counted in the "path_flaps" metric.
+func (c *Conn) PeerConnectionStatus(pubKey wgcfg.Key) (direct bool, via string) {
+	as := c.addrSetOfKey(pubKey)
+	if as == nil {
+		return false, ""
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	direct, addr := as.connStatusLocked(as.now())
+	switch {
+	case addr == nil:
+		return direct, ""
+	case direct:
+		return true, addr.String()
+	}
+	return false, fmt.Sprintf("derp-%d", addr.Port)
+}
+
+// connStatusLocked returns whether packets to the peer go directly
+// to it and the address they go to: its current endpoint if
+// direct, or else the DERP address in use, if any. It counts a
+// flip between direct and relayed since the last call.
+// a.mu must be held.
+func (a *AddrSet) connStatusLocked(now time.Time) (direct bool, addr *net.UDPAddr) {
+	ep := a.peerEndpointLocked()
+	if ep != nil && pathKindOf(ep) != PathDERP && !a.derpFallback {
+		if now.Sub(a.lastDirectRecv) <= derpFallbackAfter {
+			direct = true
+		} else if i := a.bestConfirmedLocked(now); i != -1 && pathKindOf(&a.addrs[i]) != PathDERP {
+			direct = true
+		}
+	}
+	switch {
+	case direct:
+		addr = ep
+	case pathKindOf(ep) == PathDERP:
+		addr = ep
+	case a.derpFallbackAddr != nil:
+		addr = a.derpFallbackAddr
+	default:
+		addr = a.derpAddrLocked(nil)
+	}
+	if a.statusKnown && direct != a.statusDirect {
+		metricPathFlaps.Add(1)
+	}
+	a.statusKnown, a.statusDirect = true, direct
+	return direct, addr
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/types/key"
+)
+
+// newAddrSet returns a new AddrSet, with no endpoints, for the peer
+// with public key pub.
+func (c *Conn) newAddrSet(pub key.Public) *AddrSet {
+	return &AddrSet{
+		publicKey: pub,
+		logf:      c.logf,
+		emit:      c.emit,
+		curAddr:   -1,
+		created:   c.clock.Now(),
+		ttl:       c.endpointTTL,
+		clock:     c.clock,
+		pathPref:  c.pathPref,
+
+		needsHairpin: c.needsHairpin,
+		probeRoam:    c.probeRoamCandidate,
+	}
+}
+
+// resolveEndpoint resolves ep, an "ip:port" or "host:port" endpoint
+// of a peer, to an address whose IP is 4 bytes long if it's IPv4.
+func resolveEndpoint(ep string) (*net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp", ep)
+	if err != nil {
+		return nil, err
+	}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		addr.IP = ip4
+	}
+	return addr, nil
+}
+
+// addUDPAddrsLocked maps each direct endpoint in addrs to as in
+// c.addrsByUDP.
+// c.addrsMu must be held.
+func (c *Conn) addUDPAddrsLocked(as *AddrSet, addrs []net.UDPAddr) {
+	for i := range addrs {
+		if addrs[i].IP.Equal(derpMagicIP) {
+			continue
+		}
+		c.addrsByUDP[udpAddrKey(&addrs[i])] = as
+	}
+}
+
+// removeUDPAddrsLocked removes the entries of c.addrsByUDP for the
+// endpoints in addrs that map to as. Those that another peer has
+// since claimed are left alone.
+// c.addrsMu must be held.
+func (c *Conn) removeUDPAddrsLocked(as *AddrSet, addrs []net.UDPAddr) {
+	for i := range addrs {
+		k := udpAddrKey(&addrs[i])
+		if c.addrsByUDP[k] == as {
+			delete(c.addrsByUDP, k)
+		}
+	}
+}
+
+// UpdatePeer sets the endpoints of the peer with public key pubKey,
+// adding the peer if c doesn't know it, without touching any other
+// peer. It's an incremental alternative to recreating every peer's
+// endpoint on each change to the set of peers. A peer it adds gets
+// the same AddrSet from a later CreateEndpoint.
+//
+// What's known about each endpoint the peer keeps, such as when it
+// was last heard from or answered a disco ping, carries over.
+// Outstanding pings to endpoints it no longer has are cancelled.
+//
+// The error is that of resolving an endpoint, if one fails, in
+// which case the peer is left as it was.
+func (c *Conn) UpdatePeer(pubKey wgcfg.Key, endpoints []wgcfg.Endpoint) error {
+	addrs := make([]net.UDPAddr, 0, len(endpoints))
+	for _, ep := range endpoints {
+		addr, err := resolveEndpoint(net.JoinHostPort(ep.Host, strconv.Itoa(int(ep.Port))))
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, *addr)
+	}
+
+	_, added, changed := c.setPeerAddrs(key.Public(pubKey), addrs)
+	switch {
+	case added:
+		c.logf("magicsock: UpdatePeer: added %s: %v", pubKey.ShortString(), addrs)
+	case changed:
+		c.logf("magicsock: UpdatePeer: %s: %v", pubKey.ShortString(), addrs)
+	}
+	return nil
+}
+
+// setPeerAddrs sets the endpoints of the peer with public key pub to
+// addrs, adding the peer if it's new, and returns its AddrSet.
+// changed reports whether an existing peer's endpoints changed, in
+// which case the addrsByUDP entries of those it no longer has are
+// removed, and its outstanding pings to them cancelled.
+func (c *Conn) setPeerAddrs(pub key.Public, addrs []net.UDPAddr) (as *AddrSet, added, changed bool) {
+	c.addrsMu.Lock()
+	as = c.addrsByKey[pub]
+	if as == nil {
+		as = c.newAddrSet(pub)
+		as.addrs = addrs
+		c.addrsByKey[pub] = as
+		c.addUDPAddrsLocked(as, addrs)
+		c.addrsMu.Unlock()
+		return as, true, false
+	}
+	as.mu.Lock()
+	old := as.addrs
+	remap, changed := as.setAddrsLocked(addrs)
+	as.mu.Unlock()
+	if changed {
+		c.removeUDPAddrsLocked(as, old)
+		c.addUDPAddrsLocked(as, addrs)
+	}
+	c.addrsMu.Unlock()
+	if !changed {
+		return as, false, false
+	}
+
+	c.discoMu.Lock()
+	for tx, p := range c.discoPending {
+		if p.as != as || p.idx == -1 {
+			continue
+		}
+		if p.idx = remap[p.idx]; p.idx == -1 {
+			delete(c.discoPending, tx)
+		} else {
+			c.discoPending[tx] = p
+		}
+	}
+	c.discoMu.Unlock()
+	return as, false, true
+}
+
+// RemovePeer forgets the peer with public key pubKey: its endpoints
+// are no longer matched against received packets, and its
+// outstanding disco pings are cancelled. Its endpoint, if WireGuard
+// still holds it, is never pinged again. Other peers are untouched.
+func (c *Conn) RemovePeer(pubKey wgcfg.Key) {
+	pub := key.Public(pubKey)
+	c.addrsMu.Lock()
+	as := c.addrsByKey[pub]
+	if as == nil {
+		c.addrsMu.Unlock()
+		return
+	}
+	delete(c.addrsByKey, pub)
+	as.mu.Lock()
+	as.removed = true
+	c.removeUDPAddrsLocked(as, as.addrs)
+	as.mu.Unlock()
+	c.addrsMu.Unlock()
+	c.logf("magicsock: RemovePeer: %s", pubKey.ShortString())
+
+	c.discoMu.Lock()
+	for tx, p := range c.discoPending {
+		if p.as == as {
+			delete(c.discoPending, tx)
+		}
+	}
+	c.discoMu.Unlock()
+
+	c.discoBoxMu.Lock()
+	delete(c.discoBoxes, pub)
+	c.discoBoxMu.Unlock()
+}
+
+// setAddrsLocked replaces a.addrs with addrs, carrying over the
+// state of the endpoints in both. It returns, for each index in the
+// old a.addrs, that endpoint's index in addrs, or -1 if it's gone.
+// changed is false, and nothing is done, if addrs is the same as
+// a.addrs.
+// a.mu must be held.
+func (a *AddrSet) setAddrsLocked(addrs []net.UDPAddr) (remap []int, changed bool) {
+	remap = make([]int, len(a.addrs))
+	changed = len(addrs) != len(a.addrs)
+	for i := range a.addrs {
+		remap[i] = -1
+		for j := range addrs {
+			if equalUDPAddr(&a.addrs[i], &addrs[j]) {
+				remap[i] = j
+				break
+			}
+		}
+		if remap[i] != i {
+			changed = true
+		}
+	}
+	if !changed {
+		return remap, false
+	}
+
+	if a.curAddr >= 0 {
+		a.curAddr = remap[a.curAddr]
+	}
+	if a.pongAt != nil {
+		pongAt := make([]time.Time, len(addrs))
+		pongRTT := make([]time.Duration, len(addrs))
+		for i, j := range remap {
+			if j != -1 {
+				pongAt[j], pongRTT[j] = a.pongAt[i], a.pongRTT[i]
+			}
+		}
+		a.pongAt, a.pongRTT = pongAt, pongRTT
+	}
+	if a.recvAt != nil {
+		recvAt := make([]time.Time, len(addrs))
+		for i, j := range remap {
+			if j != -1 {
+				recvAt[j] = a.recvAt[i]
+			}
+		}
+		a.recvAt = recvAt
+	}
+	for i, j := range remap {
+		if j == -1 {
+			delete(a.sendErrs, udpAddrKey(&a.addrs[i]))
+		}
+	}
+	// a.addrs is replaced, not modified, as maybeDiscoPing and
+	// appendDests hand out pointers into it.
+	a.addrs = addrs
+	a.lastPing = time.Time{} // ping any new endpoints promptly
+	return remap, true
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// pingRetryInterval is how often Ping pings a peer's endpoints
+// again while none has answered.
+const pingRetryInterval = time.Second
+
+// errNoDirectEndpoints is returned by Ping for a peer with no
+// endpoints but DERP ones.
+var errNoDirectEndpoints = errors.New("magicsock: peer has no direct endpoints to ping")
+
+// errNoPrivateKey is returned by Ping before SetPrivateKey, as disco
+// pings can't be sealed without it.
+var errNoPrivateKey = errors.New("magicsock: no private key to ping with")
+
+// A PingResult is the result of a successful Ping.
+type PingResult struct {
+	RTT      time.Duration // between sending the ping and receiving its pong
+	Endpoint *net.UDPAddr  // the endpoint that answered
+	Path     PathKind      // the kind of path the pong came over
+	Attempts int           // rounds of pings sent, the last of which was answered
+}
+
+// Direct reports whether the ping went directly to the peer, rather
+// than being relayed via DERP.
+func (r PingResult) Direct() bool {
+	return r.Path == PathIPv4 || r.Path == PathIPv6
+}
+
+// pingReply is a pong to a ping sent by Ping.
+type pingReply struct {
+	addr *net.UDPAddr
+	rtt  time.Duration
+}
+
+// Ping sends disco pings to each direct endpoint of the peer with
+// public key pubKey and waits for the first pong, returning how long
+// it took and which endpoint sent it. Unlike PeerLatency, which
+// reports a smoothed round-trip time to the current endpoint, it
+// probes the peer now. Until an endpoint answers, the endpoints are
+// pinged again every pingRetryInterval; Ping gives up when ctx is
+// done.
+//
+// DERP packets don't say who sent them, so a peer can't answer a
+// ping relayed over DERP, and only direct paths can be pinged. The
+// pong also confirms the endpoint, as a disco ping sent with data
+// would.
+func (c *Conn) Ping(ctx context.Context, pubKey wgcfg.Key) (PingResult, error) {
+	as := c.addrSetOfKey(pubKey)
+	if as == nil {
+		return PingResult{}, fmt.Errorf("magicsock: Ping: unknown peer %s", pubKey.ShortString())
+	}
+	bx := c.discoBoxFor(as.publicKey)
+	if bx == nil {
+		return PingResult{}, errNoPrivateKey
+	}
+	replies := make(chan pingReply, 1)
+	var txs []discoTxID
+	defer func() {
+		c.discoMu.Lock()
+		for _, tx := range txs {
+			delete(c.discoPending, tx)
+		}
+		c.discoMu.Unlock()
+	}()
+
+	t := c.clock.NewTicker(pingRetryInterval)
+	defer t.Stop()
+	var res PingResult
+	for {
+		res.Attempts++
+		sent := c.sendPings(as, bx, replies, &txs)
+		if sent == 0 {
+			return res, errNoDirectEndpoints
+		}
+		select {
+		case r := <-replies:
+			res.RTT = r.rtt
+			res.Endpoint = r.addr
+			res.Path = pathKindOf(r.addr)
+			return res, nil
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-c.donec():
+			return res, errConnClosed
+		case <-t.Chan():
+		}
+	}
+}
+
+// sendPings sends a disco ping, sealed with bx, whose pong is sent to
+// replies, to each direct endpoint of as, appending their transaction IDs to
+// txs. It returns how many it sent.
+func (c *Conn) sendPings(as *AddrSet, bx *discoBox, replies chan<- pingReply, txs *[]discoTxID) int {
+	as.mu.Lock()
+	addrs := as.addrs
+	as.mu.Unlock()
+
+	now := c.clock.Now()
+	var buf [discoMsgLen]byte
+	sent := 0
+	for i := range addrs {
+		addr := &addrs[i]
+		if addr.IP.Equal(derpMagicIP) {
+			continue
+		}
+		var tx discoTxID
+		if _, err := crand.Read(tx[:]); err != nil {
+			panic(err)
+		}
+		c.discoMu.Lock()
+		c.expireDiscoPingsLocked(now)
+		if c.discoPending == nil {
+			c.discoPending = make(map[discoTxID]discoPing)
+		}
+		c.discoPending[tx] = discoPing{as: as, idx: i, addr: addr, sent: now, replies: replies}
+		c.discoMu.Unlock()
+		*txs = append(*txs, tx)
+		sent++
+
+		metricDiscoPingsSent.Add(1)
+		if _, err := c.pconn.WriteTo(bx.appendMsg(buf[:0], discoTypePing, tx), addr); err != nil && c.sendLogLimit.Allow() {
+			c.logf("magicsock: Ping to %v: %v", addr, err)
+		}
+	}
+	return sent
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net"
+	"sort"
+	"strconv"
+)
+
+// Port prediction helps two peers both behind hard (symmetric) NATs,
+// which map each destination to a new public port, so neither can
+// learn from STUN the port the other's packets will arrive from.
+// Many such NATs allocate ports sequentially, though, so the ports
+// STUN servers saw us at in a discovery pass suggest the next few
+// ports: those are advertised as endpoints too, for the peer to
+// probe. See Options.PredictPorts.
+
+const (
+	// numPredictedPorts is how many ports are predicted.
+	numPredictedPorts = 4
+
+	// maxPredictDelta is the largest step between consecutively
+	// allocated ports considered predictable.
+	maxPredictDelta = 16
+)
+
+// predictEndpoints returns the endpoints predicted from stunEps,
+// which maps each STUN server that responded in a discovery pass to
+// the endpoint it saw us at, or nil if the ports don't look
+// predictable.
+//
+// The ports are predictable if all servers saw the same IP, at
+// distinct ports that are, in increasing order, evenly spaced by a
+// step of at most maxPredictDelta. The predictions are the next
+// numPredictedPorts ports at that spacing.
+func predictEndpoints(stunEps map[string]string) []string {
+	var ip string
+	var ports []int
+	for _, ep := range stunEps {
+		host, portStr, err := net.SplitHostPort(ep)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		if ip != "" && host != ip {
+			return nil
+		}
+		ip = host
+		ports = append(ports, port)
+	}
+	if len(ports) < 2 {
+		return nil
+	}
+	sort.Ints(ports)
+	delta := ports[1] - ports[0]
+	if delta < 1 || delta > maxPredictDelta {
+		return nil
+	}
+	for i := 2; i < len(ports); i++ {
+		if ports[i]-ports[i-1] != delta {
+			return nil
+		}
+	}
+
+	var eps []string
+	last := ports[len(ports)-1]
+	for i := 1; i <= numPredictedPorts; i++ {
+		p := last + i*delta
+		if p > 65535 {
+			break
+		}
+		eps = append(eps, net.JoinHostPort(ip, strconv.Itoa(p)))
+	}
+	return eps
+}
+
+// PredictedEndpoints returns which of the endpoints returned by
+// Endpoints are predicted ports, rather than ones actually seen by
+// STUN servers or local. It's always empty unless
+// Options.PredictPorts was set.
+func (c *Conn) PredictedEndpoints() []string {
+	c.curEpMu.Lock()
+	defer c.curEpMu.Unlock()
+	return append([]string(nil), c.curPredicted...)
+}
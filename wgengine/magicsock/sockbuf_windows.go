@@ -0,0 +1,29 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"net"
+	"syscall"
+)
+
+// socketBufferSizes returns the kernel's receive and send buffer
+// sizes for pc, which may differ from those requested.
+func socketBufferSizes(pc *net.UDPConn) (read, write int, err error) {
+	rc, err := pc.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		read, err = syscall.GetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if err == nil {
+			write, err = syscall.GetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		}
+	})
+	if cerr != nil {
+		return 0, 0, cerr
+	}
+	return read, write, err
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// socketMarkSupported is whether Options.SocketMark works here.
+const socketMarkSupported = true
+
+// markControl returns a net.ListenConfig Control func that sets the
+// SO_MARK of new sockets to mark, or nil if mark is zero.
+func markControl(mark uint32) func(network, address string, c syscall.RawConn) error {
+	if mark == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+		}); err != nil {
+			return err
+		}
+		if serr != nil {
+			return fmt.Errorf("setting SO_MARK to %#x: %v", mark, serr)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestSocketMark(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("setting SO_MARK requires CAP_NET_ADMIN")
+	}
+	const mark = 0x80000
+	conn, err := Listen(Options{BindAddr: "127.0.0.1", SocketMark: mark})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	checkMark := func(when string) {
+		t.Helper()
+		conn.pconn.mu.Lock()
+		rc, err := conn.pconn.pconn.SyscallConn()
+		conn.pconn.mu.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got int
+		var gerr error
+		rc.Control(func(fd uintptr) {
+			got, gerr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+		})
+		if gerr != nil {
+			t.Fatalf("%s: %v", when, gerr)
+		}
+		if got != mark {
+			t.Errorf("%s: SO_MARK = %#x; want %#x", when, got, mark)
+		}
+	}
+	checkMark("after Listen")
+	if err := conn.Rebind(); err != nil {
+		t.Fatal(err)
+	}
+	checkMark("after Rebind")
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package magicsock
+
+import "syscall"
+
+// socketMarkSupported is whether Options.SocketMark works here.
+const socketMarkSupported = false
+
+func markControl(mark uint32) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
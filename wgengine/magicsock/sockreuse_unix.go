@@ -0,0 +1,42 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package magicsock
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported is whether Options.ReusePort works here.
+const reusePortSupported = true
+
+// reusePortControl returns a net.ListenConfig Control func that sets
+// SO_REUSEADDR and SO_REUSEPORT on new sockets, or nil if !reuse.
+func reusePortControl(reuse bool) func(network, address string, c syscall.RawConn) error {
+	if !reuse {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var serr error
+		if err := c.Control(func(fd uintptr) {
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			if serr != nil {
+				serr = fmt.Errorf("setting SO_REUSEADDR: %v", serr)
+				return
+			}
+			serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			if serr != nil {
+				serr = fmt.Errorf("setting SO_REUSEPORT: %v", serr)
+			}
+		}); err != nil {
+			return err
+		}
+		return serr
+	}
+}
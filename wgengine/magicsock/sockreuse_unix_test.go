@@ -0,0 +1,40 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package magicsock
+
+import (
+	"testing"
+)
+
+func TestReusePort(t *testing.T) {
+	old, err := Listen(Options{BindAddr: "127.0.0.1", ReusePort: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	port := old.LocalPort()
+
+	// Without ReusePort, the port is taken.
+	if c, err := Listen(Options{BindAddr: "127.0.0.1", Port: port}); err == nil {
+		c.Close()
+		t.Fatalf("second Listen on port %d without ReusePort succeeded; want address in use", port)
+	}
+
+	// A restart whose predecessor's socket is still open can bind
+	// it again.
+	c, err := Listen(Options{BindAddr: "127.0.0.1", Port: port, ReusePort: true})
+	if err != nil {
+		t.Fatalf("Listen with ReusePort: %v", err)
+	}
+	defer c.Close()
+	if got := c.LocalPort(); got != port {
+		t.Errorf("LocalPort = %d; want %d", got, port)
+	}
+	if err := c.Rebind(); err != nil {
+		t.Errorf("Rebind with ReusePort: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import "syscall"
+
+// reusePortSupported is whether Options.ReusePort works here. On
+// Windows, SO_REUSEADDR lets any socket steal a port in use rather
+// than only rebind a lingering one, so it's not used.
+const reusePortSupported = false
+
+func reusePortControl(reuse bool) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -122,6 +122,7 @@ func newUserspaceEngineAdvanced(logf logger.Logf, tundev tun.Device, routerGen R
 		Port:          listenPort,
 		STUN:          magicsock.DefaultSTUN,
 		EndpointsFunc: endpointsFn,
+		Logf:          logf,
 	}
 	e.magicConn, err = magicsock.Listen(magicsockOpts)
 	if err != nil {